@@ -63,12 +63,25 @@ int load_ebpf_program(EncodedProgram program, size_t size,
     attr.func_info = (uint64_t)(func);
     attr.func_info_cnt =
         ((program.function().length()) / sizeof(struct bpf_func_info));
+    if (!program.line_info().empty()) {
+      attr.line_info_rec_size = sizeof(struct bpf_line_info);
+      attr.line_info = (uint64_t)program.line_info().c_str();
+      attr.line_info_cnt =
+          program.line_info().length() / sizeof(struct bpf_line_info);
+    }
   }
   insn = (struct bpf_insn *)((uint8_t *)(program.program().c_str()));
-  attr.prog_type = BPF_PROG_TYPE_SOCKET_FILTER;
+  attr.prog_type = program.prog_type() == BPF_PROG_TYPE_UNSPEC
+                      ? BPF_PROG_TYPE_SOCKET_FILTER
+                      : program.prog_type();
+  attr.expected_attach_type = program.expected_attach_type();
+  attr.attach_btf_id = program.attach_btf_id();
+  attr.prog_flags = program.prog_flags();
   attr.insns = (uint64_t)insn;
   attr.insn_cnt = ((program.program().length()) / (sizeof(struct bpf_insn)));
-  attr.license = (uint64_t) "GPL";
+  attr.license = program.license().empty()
+                     ? (uint64_t) "GPL"
+                     : (uint64_t)program.license().c_str();
   attr.log_size = ebpf_ffi::kLogBuffSize;
   attr.log_buf = (uint64_t)log_buf;
   attr.log_level = 2;
@@ -148,6 +161,89 @@ bool get_map_elements(int map_fd, size_t map_size, std::vector<uint64_t> *res,
   return true;
 }
 
+bool get_map_elements_batch(int map_fd, size_t map_size,
+                            std::vector<uint64_t> *res, std::string &error) {
+  if (map_size == 0) return true;
+
+  std::vector<uint32_t> keys(map_size);
+  std::vector<uint64_t> values(map_size);
+  uint32_t out_batch = 0;
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  // A null in_batch starts the lookup at the beginning of the map.
+  attr.batch.in_batch = 0;
+  attr.batch.out_batch = (uint64_t)&out_batch;
+  attr.batch.keys = (uint64_t)keys.data();
+  attr.batch.values = (uint64_t)values.data();
+  attr.batch.count = map_size;
+  attr.batch.map_fd = map_fd;
+
+  int err = syscall(SYS_bpf, BPF_MAP_LOOKUP_BATCH, &attr, sizeof(attr));
+  // ENOENT means the whole map was consumed by this batch, any other error
+  // (e.g. EINVAL on kernels without batch support) or a partial read falls
+  // back to per element lookups.
+  if ((err < 0 && errno != ENOENT) || attr.batch.count != map_size) {
+    return get_map_elements(map_fd, map_size, res, error);
+  }
+
+  res->assign(map_size, 0);
+  for (size_t i = 0; i < map_size; i++) {
+    if (keys[i] >= map_size) {
+      error = "batch lookup returned an out of range key";
+      return false;
+    }
+    (*res)[keys[i]] = values[i];
+  }
+  return true;
+}
+
+int num_possible_cpus(std::string &error) {
+  FILE *possible = fopen("/sys/devices/system/cpu/possible", "r");
+  if (possible == nullptr) {
+    error = strerror(errno);
+    return -1;
+  }
+  // The file holds a list of ranges like "0-3,6-7", per-cpu values are laid
+  // out up to the highest cpu number.
+  int highest = -1;
+  int first, last;
+  char separator;
+  while (fscanf(possible, "%d", &first) == 1) {
+    last = first;
+    if (fscanf(possible, "%c", &separator) == 1 && separator == '-') {
+      if (fscanf(possible, "%d", &last) != 1) break;
+      fscanf(possible, "%c", &separator);
+    }
+    if (last > highest) highest = last;
+  }
+  fclose(possible);
+  if (highest < 0) {
+    error = "could not parse /sys/devices/system/cpu/possible";
+    return -1;
+  }
+  return highest + 1;
+}
+
+bool get_percpu_map_element(int map_fd, uint32_t key,
+                            std::vector<uint64_t> *res, std::string &error) {
+  int cpus = num_possible_cpus(error);
+  if (cpus < 0) return false;
+
+  // Each cpu gets its own copy of the 8 byte value.
+  std::vector<uint64_t> values(cpus);
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.map_fd = map_fd;
+  attr.key = (uint64_t)&key;
+  attr.value = (uint64_t)values.data();
+  if (syscall(SYS_bpf, BPF_MAP_LOOKUP_ELEM, &attr, sizeof(attr)) < 0) {
+    error = strerror(errno);
+    return false;
+  }
+  res->assign(values.begin(), values.end());
+  return true;
+}
+
 int ffi_update_map_element(int map_fd, int key, uint64_t value) {
   union bpf_attr attr = {
       .map_fd = (unsigned int)map_fd,
@@ -173,6 +269,80 @@ int ffi_create_bpf_map(size_t size) {
                         size);
 }
 
+int ffi_create_percpu_array_map(size_t size) {
+  return bpf_create_map(BPF_MAP_TYPE_PERCPU_ARRAY, sizeof(uint32_t),
+                        sizeof(uint64_t), size);
+}
+
+int ffi_create_queue_map(size_t size) {
+  // Queues and stacks have no keys, elements are pushed and popped.
+  return bpf_create_map(BPF_MAP_TYPE_QUEUE, 0, sizeof(uint64_t), size);
+}
+
+int ffi_create_stack_map(size_t size) {
+  return bpf_create_map(BPF_MAP_TYPE_STACK, 0, sizeof(uint64_t), size);
+}
+
+int ffi_create_lru_hash_map(size_t size) {
+  return bpf_create_map(BPF_MAP_TYPE_LRU_HASH, sizeof(uint32_t),
+                        sizeof(uint64_t), size);
+}
+
+int ffi_create_ringbuf_map(size_t size) {
+  // Ring buffers have neither keys nor values, max_entries is the size in
+  // bytes of the buffer.
+  return bpf_create_map(BPF_MAP_TYPE_RINGBUF, 0, 0, size);
+}
+
+int ffi_create_spin_lock_map(size_t size, void *btf_buff, size_t btf_size,
+                             uint32_t key_type_id, uint32_t value_type_id,
+                             uint32_t value_size) {
+  std::string error;
+  int btf_fd = btf_load(btf_buff, btf_size, error);
+  if (btf_fd < 0) {
+    return btf_fd;
+  }
+  union bpf_attr attr = {.map_type = BPF_MAP_TYPE_ARRAY,
+                         .key_size = sizeof(uint32_t),
+                         .value_size = value_size,
+                         .max_entries = static_cast<uint32_t>(size)};
+  attr.btf_fd = btf_fd;
+  attr.btf_key_type_id = key_type_id;
+  attr.btf_value_type_id = value_type_id;
+
+  int map_fd = syscall(SYS_bpf, BPF_MAP_CREATE, &attr, sizeof(attr));
+  // The map holds its own reference to the BTF. Keep errno from the map
+  // creation for the caller.
+  int saved_errno = errno;
+  close(btf_fd);
+  errno = saved_errno;
+  return map_fd;
+}
+
+int ffi_create_prog_array_map(size_t size) {
+  return bpf_create_map(BPF_MAP_TYPE_PROG_ARRAY, sizeof(uint32_t),
+                        sizeof(uint32_t), size);
+}
+
+int ffi_pin_object(int fd, const char *path) {
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.pathname = (uint64_t)path;
+  attr.bpf_fd = fd;
+  return syscall(SYS_bpf, BPF_OBJ_PIN, &attr, sizeof(attr));
+}
+
+int ffi_update_prog_array_element(int map_fd, int key, int prog_fd) {
+  uint32_t value = prog_fd;
+  union bpf_attr attr = {
+      .map_fd = (unsigned int)map_fd,
+      .key = (unsigned long)&key,
+      .value = (unsigned long)&value,
+      .flags = 0,
+  };
+  return syscall(SYS_bpf, BPF_MAP_UPDATE_ELEM, &attr, sizeof(attr));
+}
+
 // Retrieves all the elements in a bpf map, returns a serialized MapElements
 // proto message.
 struct bpf_result ffi_get_map_elements(int map_fd, uint64_t map_size) {
@@ -188,6 +358,32 @@ struct bpf_result ffi_get_map_elements(int map_fd, uint64_t map_size) {
   return serialize_proto(res);
 }
 
+struct bpf_result ffi_get_map_elements_batch(int map_fd, uint64_t map_size) {
+  MapElements res;
+  std::vector<uint64_t> elements;
+  std::string error_message;
+  if (!get_map_elements_batch(map_fd, map_size, &elements, error_message)) {
+    res.set_error_message(error_message);
+    return serialize_proto(res);
+  }
+  auto proto_elements = res.mutable_elements();
+  proto_elements->Add(elements.begin(), elements.end());
+  return serialize_proto(res);
+}
+
+struct bpf_result ffi_get_percpu_map_element(int map_fd, uint32_t key) {
+  MapElements res;
+  std::vector<uint64_t> elements;
+  std::string error_message;
+  if (!get_percpu_map_element(map_fd, key, &elements, error_message)) {
+    res.set_error_message(error_message);
+    return serialize_proto(res);
+  }
+  auto proto_elements = res.mutable_elements();
+  proto_elements->Add(elements.begin(), elements.end());
+  return serialize_proto(res);
+}
+
 bool execute_ebpf_program(int prog_fd, uint8_t *input, int input_length,
                           std::string &error_message) {
   int socks[2] = {};
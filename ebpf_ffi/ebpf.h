@@ -42,6 +42,20 @@ struct bpf_result ffi_load_ebpf_program(void *serialized_proto, size_t size,
 bool get_map_elements(int map_fd, size_t map_size, std::vector<uint64_t> *res,
                       std::string &error);
 
+// Same as get_map_elements but reads the whole map with a single
+// BPF_MAP_LOOKUP_BATCH command, falling back to per element lookups when the
+// kernel does not support batch operations.
+bool get_map_elements_batch(int map_fd, size_t map_size,
+                            std::vector<uint64_t> *res, std::string &error);
+
+// Returns the number of per-cpu copies the kernel keeps of per-cpu map
+// values, or -1 and sets |error|.
+int num_possible_cpus(std::string &error);
+
+// Reads the value every cpu has for |key| in the per-cpu array |map_fd|.
+bool get_percpu_map_element(int map_fd, uint32_t key,
+                            std::vector<uint64_t> *res, std::string &error);
+
 // Sets the value at key |key| in the map described by |map_fd| to |value|.
 int ffi_update_map_element(int map_fd, int key, uint64_t value);
 
@@ -51,10 +65,54 @@ int bpf_create_map(enum bpf_map_type map_type, unsigned int key_size,
 // Creates an ebpf map, returns the file descriptor to it.
 int ffi_create_bpf_map(size_t size);
 
+// Creates a BPF_MAP_TYPE_PERCPU_ARRAY map with u32 keys and u64 values,
+// returns the file descriptor to it.
+int ffi_create_percpu_array_map(size_t size);
+
+// Create BPF_MAP_TYPE_QUEUE and BPF_MAP_TYPE_STACK maps of u64 values, return
+// the file descriptor of the new map.
+int ffi_create_queue_map(size_t size);
+int ffi_create_stack_map(size_t size);
+
+// Creates a BPF_MAP_TYPE_LRU_HASH map of at most |size| u32 keys with u64
+// values, returns the file descriptor to it. Updates of a full map evict the
+// least recently used keys.
+int ffi_create_lru_hash_map(size_t size);
+
+// Create a BPF_MAP_TYPE_RINGBUF map of |size| bytes, which must be a power of
+// 2 multiple of the page size. Returns the file descriptor of the new map.
+int ffi_create_ringbuf_map(size_t size);
+
+// Creates a BPF_MAP_TYPE_ARRAY map of |size| elements whose values, of
+// |value_size| bytes, hold a bpf_spin_lock. |btf_buff| is the BTF describing
+// the key and value as the types |key_type_id| and |value_type_id|, see
+// ebpf.SpinLockValueBtf. Returns the file descriptor of the new map.
+int ffi_create_spin_lock_map(size_t size, void *btf_buff, size_t btf_size,
+                             uint32_t key_type_id, uint32_t value_type_id,
+                             uint32_t value_size);
+
+// Creates a BPF_MAP_TYPE_PROG_ARRAY map to be used with the tail_call helper,
+// returns the file descriptor to it.
+int ffi_create_prog_array_map(size_t size);
+
+// Pins the map or program |fd| to |path|, which must be inside a bpffs mount.
+// Returns -1 and sets errno on failure.
+int ffi_pin_object(int fd, const char *path);
+
+// Stores the program |prog_fd| at index |key| of the prog array |map_fd|.
+int ffi_update_prog_array_element(int map_fd, int key, int prog_fd);
+
 // Retrieves the elements of the specified map_fd, return value is of type
 // MapElements.
 struct bpf_result ffi_get_map_elements(int map_fd, uint64_t map_size);
 
+// Batched version of ffi_get_map_elements, return value is of type
+// MapElements.
+struct bpf_result ffi_get_map_elements_batch(int map_fd, uint64_t map_size);
+
+// Returns a serialized MapElements with the value of |key| for every cpu.
+struct bpf_result ffi_get_percpu_map_element(int map_fd, uint32_t key);
+
 bool execute_ebpf_program(int prog_fd, uint8_t *input, int input_length,
                           std::string &error_message);
 
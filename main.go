@@ -19,8 +19,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"time"
 
+	"buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
 	"buzzer/pkg/strategies/strategies"
 	"buzzer/pkg/units/units"
 )
@@ -34,6 +38,12 @@ var (
 	sourceFilesPath    = flag.String("src_path", "/root/sourceFiles", "The fuzzer will look for source files to visualize the coverage at this path")
 	metricsServerAddr  = flag.String("metrics_server_addr", "0.0.0.0", "Address that the metrics server will listen to at")
 	metricsServerPort  = flag.Uint("metrics_server_port", 8080, "Port that the metrics server will listen to at")
+	rngName            = flag.String("rng", "default", "Random number generator algorithm: default (math/rand) or xorshift, which is faster")
+	seed               = flag.Int64("seed", 0, "Seed for the random number generator, 0 picks one based on the current time. With a fixed seed the same strategy generates the same sequence of programs")
+	avoidDegenerate    = flag.Bool("avoid_degenerate_immediates", false, "Keep random alu instructions from using immediates that make their result constant (and with 0, mul by 0, or with all ones), which lets the verifier prune code")
+	flipClass          = flag.Bool("flip_class_mutations", false, "Let the coverage_based strategy also mutate programs by switching alu instructions between their 32 and 64 bit forms")
+	temperature        = flag.Float64("temperature", -1, "If between 0 and 1, scales the size and branchiness of the generated programs from simple to gnarly, see GeneratorConfig.SetTemperature. Negative values leave the defaults")
+	reportPath         = flag.String("report", "", "If set, a JSON line describing every loaded ebpf program (hash, size, verdict...) is written to this file")
 )
 
 var (
@@ -44,6 +54,20 @@ var (
 		strategies.NewCoverageBasedStrategy(),
 		strategies.NewCbpfPlaygroundStrategy(),
 		strategies.NewCbpfRandomInstructionStrategy(),
+		strategies.NewSpillFillStrategy(),
+		strategies.NewPacketBoundsStrategy(),
+		strategies.NewSubregisterStrategy(),
+		strategies.NewStatePruningStrategy(),
+		strategies.NewSleepableStrategy(),
+		strategies.NewMalformedStrategy(),
+		strategies.NewComplexityStrategy(),
+		strategies.NewRingbufStrategy(),
+		strategies.NewTypeConfusionStrategy(),
+		strategies.NewVariableStackStrategy(),
+		strategies.NewLockBalanceStrategy(),
+		strategies.NewIrreducibleLoopStrategy(),
+		strategies.NewPointerReturnStrategy(),
+		strategies.NewTemplateStrategy(ebpf.XdpTemplate),
 	}
 )
 
@@ -64,6 +88,25 @@ func main() {
 		return
 	}
 	fmt.Printf("using strategy %s\n", strategy.Name())
+	if cv, ok := strategy.(*strategies.CoverageBased); ok && *flipClass {
+		cv.Operations = append(cv.Operations, strategies.OPERATION_FLIP_CLASS)
+	}
+	if *temperature >= 0 {
+		ebpf.SharedConfig.SetTemperature(*temperature)
+	}
+	ebpf.SharedConfig.AvoidDegenerateImmediates = *avoidDegenerate
+	// Pick the seed here rather than leaving it to rand so the report has
+	// the one the campaign actually used.
+	rngSeed := *seed
+	if rngSeed == 0 {
+		rngSeed = time.Now().Unix()
+	}
+	source, err := rand.NewSourceByName(*rngName, rngSeed)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rand.SharedRNG = rand.NewRand(source)
 	coverageManager := units.NewCoverageManager(func(inputString string) (string, error) {
 		cmd := exec.Command("/usr/bin/addr2line", "-e", *vmLinuxPath)
 		w, err := cmd.StdinPipe()
@@ -85,6 +128,15 @@ func main() {
 		log.Fatalf("failed to init control unit: %v", err)
 	}
 
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			log.Fatalf("failed to create the report: %v", err)
+		}
+		defer f.Close()
+		controlUnit.SetReportWriter(units.NewReportWriter(f, rngSeed))
+	}
+
 	if err := controlUnit.RunFuzzer(); err != nil {
 		log.Fatalf("failed to init control unit: %v", err)
 	}
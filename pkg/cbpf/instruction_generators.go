@@ -53,7 +53,12 @@ func RandomJmpInstruction(maxOffset uint64) *pb.Instruction {
 		}
 	}
 
-	offset := int8(rand.SharedRNG.RandRange(1, maxOffset))
+	// With no room to jump forward fall back to an offset of 0, which simply
+	// continues on the next instruction.
+	offset := int8(0)
+	if maxOffset > 0 {
+		offset = int8(rand.SharedRNG.RandRange(1, maxOffset))
+	}
 	if rand.SharedRNG.OneOf(2) {
 		src := int32(rand.SharedRNG.RandRange(0, 0xffffffff))
 		return newJmpInstruction(op, 0, int32(offset), src)
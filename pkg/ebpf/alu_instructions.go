@@ -15,9 +15,82 @@
 package ebpf
 
 import (
+	"fmt"
+
 	pb "buzzer/proto/ebpf_go_proto"
+	proto "github.com/golang/protobuf/proto"
 )
 
+// aluSourceRule describes the source operands an alu operation accepts.
+type aluSourceRule struct {
+	allowImm bool
+	allowReg bool
+
+	// validImm, if set, restricts the immediate of the instruction. For
+	// AluEnd the immediate encodes the swap width in both byte orders.
+	validImm func(imm int32) bool
+}
+
+// aluValidity holds the operations that do not accept every source operand,
+// operations not in the table accept both an immediate and a register.
+var aluValidity = map[pb.AluOperationCode]aluSourceRule{
+	// Negation only has the immediate form and the immediate must be 0.
+	pb.AluOperationCode_AluNeg: {
+		allowImm: true,
+		allowReg: false,
+		validImm: func(imm int32) bool { return imm == 0 },
+	},
+	// For byte swaps the source bit selects the target endianness rather
+	// than a register, see NewEndInstruction. The immediate is the width to
+	// swap.
+	pb.AluOperationCode_AluEnd: {
+		allowImm: true,
+		allowReg: false,
+		validImm: func(imm int32) bool { return imm == 16 || imm == 32 || imm == 64 },
+	},
+}
+
+// IsValidAluSource returns whether `op` accepts `source` as its source operand.
+func IsValidAluSource(op pb.AluOperationCode, source pb.SrcOperand) bool {
+	rule, ok := aluValidity[op]
+	if !ok {
+		return true
+	}
+	if source == pb.SrcOperand_RegSrc {
+		return rule.allowReg
+	}
+	return rule.allowImm
+}
+
+func checkAluImmediate(op pb.AluOperationCode, imm int32) error {
+	if rule, ok := aluValidity[op]; ok && rule.validImm != nil && !rule.validImm(imm) {
+		return fmt.Errorf("invalid immediate %d for alu operation %v", imm, op)
+	}
+	return nil
+}
+
+// NewAluImmInstruction creates an alu instruction with `imm` as source,
+// returning an error if `op` does not support an immediate source or `imm`
+// is not valid for it.
+func NewAluImmInstruction(op pb.AluOperationCode, insClass pb.InsClass, dst pb.Reg, imm int32) (*pb.Instruction, error) {
+	if !IsValidAluSource(op, pb.SrcOperand_Immediate) {
+		return nil, fmt.Errorf("alu operation %v does not support an immediate source", op)
+	}
+	if err := checkAluImmediate(op, imm); err != nil {
+		return nil, err
+	}
+	return newAluInstruction(op, insClass, dst, imm), nil
+}
+
+// NewAluRegInstruction creates an alu instruction with `src` as source,
+// returning an error if `op` does not support a register source.
+func NewAluRegInstruction(op pb.AluOperationCode, insClass pb.InsClass, dst pb.Reg, src pb.Reg) (*pb.Instruction, error) {
+	if !IsValidAluSource(op, pb.SrcOperand_RegSrc) {
+		return nil, fmt.Errorf("alu operation %v does not support a register source", op)
+	}
+	return newAluInstruction(op, insClass, dst, src), nil
+}
+
 func newAluInstruction[T Src](oc pb.AluOperationCode, insclass pb.InsClass, dst pb.Reg, src T) *pb.Instruction {
 	var srcType pb.SrcOperand
 	var srcReg pb.Reg
@@ -26,7 +99,7 @@ func newAluInstruction[T Src](oc pb.AluOperationCode, insclass pb.InsClass, dst
 	case pb.Reg:
 		srcType = pb.SrcOperand_RegSrc
 		srcReg = any(src).(pb.Reg)
-		imm = 0
+		imm = UnusedField
 	case int:
 		srcType = pb.SrcOperand_Immediate
 		srcReg = pb.Reg_R0
@@ -41,37 +114,7 @@ func newAluInstruction[T Src](oc pb.AluOperationCode, insclass pb.InsClass, dst
 	case int64:
 		if oc == pb.AluOperationCode_AluMov {
 			upper := int32(src >> 32)
-			return &pb.Instruction{
-				Opcode: &pb.Instruction_MemOpcode{
-					MemOpcode: &pb.MemOpcode{
-						Mode:             pb.StLdMode_StLdModeIMM,
-						Size:             pb.StLdSize_StLdSizeDW,
-						InstructionClass: pb.InsClass_InsClassLd,
-					},
-				},
-				DstReg:    dst,
-				SrcReg:    pb.Reg_R0,
-				Offset:    0,
-				Immediate: int32(src),
-				PseudoInstruction: &pb.Instruction_PseudoValue{
-					PseudoValue: &pb.Instruction{
-						Opcode: &pb.Instruction_MemOpcode{
-							MemOpcode: &pb.MemOpcode{
-								Mode:             0,
-								Size:             0,
-								InstructionClass: 0,
-							},
-						},
-						DstReg:    0,
-						SrcReg:    0,
-						Offset:    0,
-						Immediate: upper,
-						PseudoInstruction: &pb.Instruction_Empty{
-							Empty: &pb.Empty{},
-						},
-					},
-				},
-			}
+			return newLoadImmOperation(pb.StLdSize_StLdSizeDW, dst, pb.Reg_R0, UnusedField, int32(src), newPseudoValue(upper))
 		} else {
 			srcType = pb.SrcOperand_Immediate
 			srcReg = pb.Reg_R0
@@ -251,6 +294,42 @@ func Mov[T Src](dstReg pb.Reg, src T) *pb.Instruction {
 	return newAluInstruction(pb.AluOperationCode_AluMov, pb.InsClass_InsClassAlu, dstReg, src)
 }
 
+// ZeroRegisters returns a `mov rX, 0` for each of `regs`, in order. The
+// registers are reported as initialized to SharedConfig.Tracer, if any.
+func ZeroRegisters(regs ...pb.Reg) []*pb.Instruction {
+	instructions := make([]*pb.Instruction, 0, len(regs))
+	for _, reg := range regs {
+		instructions = append(instructions, Mov64(reg, 0))
+		if SharedConfig.Tracer != nil {
+			SharedConfig.Tracer.OnRegisterInit(reg)
+		}
+	}
+	return instructions
+}
+
+// FlipAluClass returns a copy of the alu instruction `i` switched between
+// its 32 bit (ALU) and 64 bit (ALU64) forms, every other field is kept. This
+// is a cheap mutation that keeps the program structure but changes how the
+// verifier tracks the bounds of the destination. Note that immediate shift
+// amounts are kept too, so a 64 bit shift by 32 or more becomes an invalid
+// 32 bit shift.
+func FlipAluClass(i *pb.Instruction) (*pb.Instruction, error) {
+	if i.GetAluOpcode() == nil {
+		return nil, fmt.Errorf("only alu instructions can be flipped, got %s", InstructionString(i))
+	}
+	flipped := proto.Clone(i).(*pb.Instruction)
+	op := flipped.GetAluOpcode()
+	switch op.InstructionClass {
+	case pb.InsClass_InsClassAlu:
+		op.InstructionClass = pb.InsClass_InsClassAlu64
+	case pb.InsClass_InsClassAlu64:
+		op.InstructionClass = pb.InsClass_InsClassAlu
+	default:
+		return nil, fmt.Errorf("alu instruction with class %v cannot be flipped", op.InstructionClass)
+	}
+	return flipped, nil
+}
+
 // Arsh64 Creates a new 64 bit Arsh instruction that is either imm or reg depending
 // on the data type of src
 func Arsh64[T Src](dstReg pb.Reg, src T) *pb.Instruction {
@@ -263,14 +342,33 @@ func Arsh[T Src](dstReg pb.Reg, src T) *pb.Instruction {
 	return newAluInstruction(pb.AluOperationCode_AluArsh, pb.InsClass_InsClassAlu, dstReg, src)
 }
 
-// End64 Creates a new 64 bit End instruction that is either imm or reg depending
-// on the data type of src
-func End64[T Src](dstReg pb.Reg, src T) *pb.Instruction {
-	return newAluInstruction(pb.AluOperationCode_AluEnd, pb.InsClass_InsClassAlu64, dstReg, src)
+// End64 Creates a new 64 bit End instruction, an unconditional swap of the
+// lower `width` bits of dstReg.
+func End64(dstReg pb.Reg, width int32) *pb.Instruction {
+	return newEndInstruction(pb.InsClass_InsClassAlu64, dstReg, ToLE, width)
 }
 
-// End Creates a new 32 bit End instruction that is either imm or reg depending
-// on the data type of src
-func End[T Src](dstReg pb.Reg, src T) *pb.Instruction {
-	return newAluInstruction(pb.AluOperationCode_AluEnd, pb.InsClass_InsClassAlu, dstReg, src)
+// End Creates a new 32 bit End instruction that converts the lower `width`
+// bits of dstReg from host byte order to `order`.
+func End(dstReg pb.Reg, order pb.SrcOperand, width int32) *pb.Instruction {
+	return newEndInstruction(pb.InsClass_InsClassAlu, dstReg, order, width)
+}
+
+// NewEndInstruction creates a byte swap of the lower `width` bits of `dst`
+// to `order`, returning an error if `width` is not 16, 32 or 64 or if
+// `order` is ToBE for a 64 bit swap, which only has the unconditional form.
+func NewEndInstruction(insClass pb.InsClass, dst pb.Reg, order pb.SrcOperand, width int32) (*pb.Instruction, error) {
+	if err := checkAluImmediate(pb.AluOperationCode_AluEnd, width); err != nil {
+		return nil, err
+	}
+	if insClass == pb.InsClass_InsClassAlu64 && order != ToLE {
+		return nil, fmt.Errorf("64 bit byte swaps cannot convert to big endian")
+	}
+	return newEndInstruction(insClass, dst, order, width), nil
+}
+
+func newEndInstruction(insClass pb.InsClass, dst pb.Reg, order pb.SrcOperand, width int32) *pb.Instruction {
+	i := newAluInstruction(pb.AluOperationCode_AluEnd, insClass, dst, width)
+	i.GetAluOpcode().Source = order
+	return i
 }
@@ -353,28 +353,28 @@ func TestAluInstructionGenerationAndEncoding(t *testing.T) {
 			wantEncoding:         []uint64{0xffff0001000009c4},
 		},
 		{
-			testName:             "Encoding End64 with immediate value as source",
-			instruction:          End64(testDstReg, testImm),
+			testName:             "Encoding End64",
+			instruction:          End64(testDstReg, 32),
 			wantDstReg:           testDstReg,
-			wantImm:              testImm,
+			wantImm:              32,
 			wantInstructionClass: pb.InsClass_InsClassAlu64,
 			wantSrcReg:           pb.Reg_R0,
-			wantSrc:              pb.SrcOperand_Immediate,
+			wantSrc:              ToLE,
 			wantOffset:           0,
 			wantOperationCode:    pb.AluOperationCode_AluEnd,
-			wantEncoding:         []uint64{0xffff0001000009d7},
+			wantEncoding:         []uint64{0x00000020000009d7},
 		},
 		{
-			testName:             "Encoding End32 with immediate value as source",
-			instruction:          End(testDstReg, testImm),
+			testName:             "Encoding End32 to little endian",
+			instruction:          End(testDstReg, ToLE, 32),
 			wantDstReg:           testDstReg,
-			wantImm:              testImm,
+			wantImm:              32,
 			wantInstructionClass: pb.InsClass_InsClassAlu,
 			wantSrcReg:           pb.Reg_R0,
-			wantSrc:              pb.SrcOperand_Immediate,
+			wantSrc:              ToLE,
 			wantOffset:           0,
 			wantOperationCode:    pb.AluOperationCode_AluEnd,
-			wantEncoding:         []uint64{0xffff0001000009d4},
+			wantEncoding:         []uint64{0x00000020000009d4},
 		},
 		{
 			testName:             "Encoding Add64 with register value as source",
@@ -663,26 +663,16 @@ func TestAluInstructionGenerationAndEncoding(t *testing.T) {
 			wantEncoding:         []uint64{0x79cc},
 		},
 		{
-			testName:             "Encoding End64 with register value as source",
-			instruction:          End64(testDstReg, testSrcReg),
+			testName:             "Encoding End32 to big endian",
+			instruction:          End(testDstReg, ToBE, 16),
 			wantDstReg:           testDstReg,
-			wantSrcReg:           testSrcReg,
-			wantSrc:              pb.SrcOperand_RegSrc,
-			wantOffset:           0,
-			wantOperationCode:    pb.AluOperationCode_AluEnd,
-			wantInstructionClass: pb.InsClass_InsClassAlu64,
-			wantEncoding:         []uint64{0x79df},
-		},
-		{
-			testName:             "Encoding End32 with register value as source",
-			instruction:          End(testDstReg, testSrcReg),
-			wantDstReg:           testDstReg,
-			wantSrcReg:           testSrcReg,
-			wantSrc:              pb.SrcOperand_RegSrc,
+			wantImm:              16,
+			wantSrcReg:           pb.Reg_R0,
+			wantSrc:              ToBE,
 			wantOffset:           0,
 			wantOperationCode:    pb.AluOperationCode_AluEnd,
 			wantInstructionClass: pb.InsClass_InsClassAlu,
-			wantEncoding:         []uint64{0x79dc},
+			wantEncoding:         []uint64{0x00000010000009dc},
 		},
 	}
 
@@ -855,3 +845,163 @@ func TestMov64(t *testing.T) {
 		}
 	})
 }
+
+func TestAluConstructorsRejectInvalidSources(t *testing.T) {
+	tests := []struct {
+		testName string
+		build    func() (*pb.Instruction, error)
+		wantErr  bool
+	}{
+		{
+			testName: "Neg with register source",
+			build: func() (*pb.Instruction, error) {
+				return NewAluRegInstruction(pb.AluOperationCode_AluNeg, pb.InsClass_InsClassAlu64, R1, R2)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "Neg with zero immediate",
+			build: func() (*pb.Instruction, error) {
+				return NewAluImmInstruction(pb.AluOperationCode_AluNeg, pb.InsClass_InsClassAlu64, R1, 0)
+			},
+			wantErr: false,
+		},
+		{
+			testName: "Neg with non zero immediate",
+			build: func() (*pb.Instruction, error) {
+				return NewAluImmInstruction(pb.AluOperationCode_AluNeg, pb.InsClass_InsClassAlu64, R1, 5)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "End with valid width",
+			build: func() (*pb.Instruction, error) {
+				return NewAluImmInstruction(pb.AluOperationCode_AluEnd, pb.InsClass_InsClassAlu, R1, 32)
+			},
+			wantErr: false,
+		},
+		{
+			testName: "End with invalid width",
+			build: func() (*pb.Instruction, error) {
+				return NewAluImmInstruction(pb.AluOperationCode_AluEnd, pb.InsClass_InsClassAlu, R1, 42)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "End with register source",
+			build: func() (*pb.Instruction, error) {
+				return NewAluRegInstruction(pb.AluOperationCode_AluEnd, pb.InsClass_InsClassAlu, R1, R2)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "End to big endian",
+			build: func() (*pb.Instruction, error) {
+				return NewEndInstruction(pb.InsClass_InsClassAlu, R1, ToBE, 64)
+			},
+			wantErr: false,
+		},
+		{
+			testName: "End to big endian with invalid width",
+			build: func() (*pb.Instruction, error) {
+				return NewEndInstruction(pb.InsClass_InsClassAlu, R1, ToBE, 8)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "64 bit End to big endian",
+			build: func() (*pb.Instruction, error) {
+				return NewEndInstruction(pb.InsClass_InsClassAlu64, R1, ToBE, 32)
+			},
+			wantErr: true,
+		},
+		{
+			testName: "Add with register source",
+			build: func() (*pb.Instruction, error) {
+				return NewAluRegInstruction(pb.AluOperationCode_AluAdd, pb.InsClass_InsClassAlu64, R1, R2)
+			},
+			wantErr: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			instruction, err := tc.build()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && instruction == nil {
+				t.Fatalf("instruction = nil, want a valid instruction")
+			}
+		})
+	}
+}
+
+func TestZeroRegisters(t *testing.T) {
+	regs := []pb.Reg{R0, R3, R7}
+	instructions := ZeroRegisters(regs...)
+	if len(instructions) != len(regs) {
+		t.Fatalf("len(ZeroRegisters()) = %d, want %d", len(instructions), len(regs))
+	}
+
+	for i, ins := range instructions {
+		opcode := ins.GetAluOpcode()
+		if opcode.GetOperationCode() != pb.AluOperationCode_AluMov || opcode.GetInstructionClass() != pb.InsClass_InsClassAlu64 || opcode.GetSource() != pb.SrcOperand_Immediate {
+			t.Errorf("ZeroRegisters()[%d] = %v, want a 64 bit mov of an immediate", i, ins)
+		}
+		if ins.DstReg != regs[i] {
+			t.Errorf("ZeroRegisters()[%d].DstReg = %v, want %v", i, ins.DstReg, regs[i])
+		}
+		if ins.Immediate != 0 {
+			t.Errorf("ZeroRegisters()[%d].Immediate = %d, want 0", i, ins.Immediate)
+		}
+	}
+}
+
+func TestFlipAluClass(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction *pb.Instruction
+		want        *pb.Instruction
+		wantErr     bool
+	}{
+		{
+			name:        "alu64 to alu",
+			instruction: Add64(R3, R4),
+			want:        Add(R3, R4),
+		},
+		{
+			name:        "alu to alu64",
+			instruction: Xor(R1, 0x1234),
+			want:        Xor64(R1, 0x1234),
+		},
+		{
+			name:        "jmp",
+			instruction: JmpEQ(R1, 0, 1),
+			wantErr:     true,
+		},
+		{
+			name:        "memory",
+			instruction: LdW(R1, R2, 0),
+			wantErr:     true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			original := protobuf.Clone(tc.instruction)
+			got, err := FlipAluClass(tc.instruction)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("FlipAluClass() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !protobuf.Equal(tc.instruction, original) {
+				t.Errorf("FlipAluClass() modified its argument to %v", tc.instruction)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !protobuf.Equal(got, tc.want) {
+				t.Errorf("FlipAluClass() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	btfpb "buzzer/proto/btf_go_proto"
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+const (
+	// BTF type ids of the functions described by BpfLoopBtf.
+	bpfLoopMainTypeId     = 2
+	bpfLoopCallbackTypeId = 7
+)
+
+// bpfLoopTypes returns the BTF types describing a main function that takes
+// no arguments (type 2) and a bpf_loop callback taking the loop index and the
+// context pointer (type 7). Both are static, bpf_loop rejects any other
+// linkage for callbacks.
+func bpfLoopTypes() []*btfpb.BtfType {
+	types := []*btfpb.BtfType{}
+
+	// 1: Func_Proto
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x0,
+		Info: &btfpb.TypeInfo{
+			Vlen:     0,
+			Kind:     btfpb.BtfKind_FUNCPROTO,
+			KindFlag: false,
+		},
+		SizeOrType: 0x0,
+		Extra: &btfpb.BtfType_Empty{
+			Empty: &btfpb.Empty{},
+		},
+	})
+
+	// 2: Func
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x1,
+		Info: &btfpb.TypeInfo{
+			Vlen:     0,
+			Kind:     btfpb.BtfKind_FUNC,
+			KindFlag: false,
+		},
+		SizeOrType: 0x01,
+		Extra: &btfpb.BtfType_Empty{
+			Empty: &btfpb.Empty{},
+		},
+	})
+
+	// 3: Int
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x1,
+		Info: &btfpb.TypeInfo{
+			Vlen:     0,
+			Kind:     btfpb.BtfKind_INT,
+			KindFlag: false,
+		},
+		SizeOrType: 0x4,
+		Extra: &btfpb.BtfType_IntTypeData{
+			IntTypeData: &btfpb.IntTypeData{IntInfo: 0x01000020},
+		},
+	})
+
+	// 4: Struct
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x1,
+		Info: &btfpb.TypeInfo{
+			Vlen:     1,
+			Kind:     btfpb.BtfKind_STRUCT,
+			KindFlag: false,
+		},
+		SizeOrType: 0x4,
+		Extra: &btfpb.BtfType_StructTypeData{
+			StructTypeData: &btfpb.StructTypeData{
+				NameOff:    0x1,
+				StructType: 0x3,
+				Offset:     0x0,
+			},
+		},
+	})
+
+	// 5: Ptr
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x0,
+		Info: &btfpb.TypeInfo{
+			Vlen:     0,
+			Kind:     btfpb.BtfKind_PTR,
+			KindFlag: false,
+		},
+		SizeOrType: 0x4,
+		Extra: &btfpb.BtfType_Empty{
+			Empty: &btfpb.Empty{},
+		},
+	})
+
+	// 6: Func_Proto
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x0,
+		Info: &btfpb.TypeInfo{
+			Vlen:     2,
+			Kind:     btfpb.BtfKind_FUNCPROTO,
+			KindFlag: false,
+		},
+		SizeOrType: 0x3,
+		Extra: &btfpb.BtfType_FuncProtoTypeData{
+			FuncProtoTypeData: &btfpb.FuncProtoTypeData{
+				Param: []*btfpb.BtfParam{
+					{NameOff: 0x1, ParamType: 0x3},
+					{NameOff: 0x1, ParamType: 0x5},
+				},
+			},
+		},
+	})
+
+	// 7: Func
+	types = append(types, &btfpb.BtfType{
+		NameOff: 0x1,
+		Info: &btfpb.TypeInfo{
+			Vlen:     0,
+			Kind:     btfpb.BtfKind_FUNC,
+			KindFlag: false,
+		},
+		SizeOrType: 0x6,
+		Extra: &btfpb.BtfType_Empty{
+			Empty: &btfpb.Empty{},
+		},
+	})
+	return types
+}
+
+// BpfLoopBtf returns the encoded BTF describing the functions of a program
+// built by BpfLoopProgram.
+func BpfLoopBtf() ([]byte, error) {
+	btf := &btfpb.Btf{}
+	SetHeaderSection(btf, 0xeb9f, 0x01, 0x0)
+	btf.TypeSection = &btfpb.TypeSection{BtfType: bpfLoopTypes()}
+	btf.StringSection = &btfpb.StringSection{Str: "buzzer"}
+	return GetBuffer(btf)
+}
+
+// BpfLoopCall returns the instructions that call bpf_loop(nrLoops, callback,
+// ctx, flags), where `ctx` is the register holding the context pointer handed
+// to the callback. The callback starts `callbackOffset` slots after the end
+// of the returned sequence.
+func BpfLoopCall(nrLoops int32, ctx pb.Reg, flags int32, callbackOffset int32) []*pb.Instruction {
+	return []*pb.Instruction{
+		// ctx goes first in case it lives in one of the other argument
+		// registers.
+		Mov64(R3, ctx),
+		Mov64(R1, nrLoops),
+		Mov64(R4, flags),
+		// The function address is relative to the slot after the load,
+		// the call is still in between.
+		LdFunctionPtr(callbackOffset + 2),
+		Call(Loop),
+	}
+}
+
+// BpfLoopProgram returns a program whose main function runs `before`, calls
+// bpf_loop to run `callback` `nrLoops` times, and then runs `after`. The
+// callback is the second function of the program and both come with the BTF
+// and func_info the verifier needs for bpf_loop.
+func BpfLoopProgram(before, after, callback []*pb.Instruction, nrLoops int32, ctx pb.Reg) (*pb.Program, error) {
+	btf, err := BpfLoopBtf()
+	if err != nil {
+		return nil, err
+	}
+
+	main := append([]*pb.Instruction{}, before...)
+	main = append(main, BpfLoopCall(nrLoops, ctx, 0, int32(ProgramSize(after)))...)
+	main = append(main, after...)
+
+	return &pb.Program{
+		Functions: []*pb.Functions{
+			{
+				Instructions: main,
+				FuncInfo:     &btfpb.FuncInfo{InsnOff: 0, TypeId: bpfLoopMainTypeId},
+			},
+			{
+				Instructions: callback,
+				FuncInfo:     &btfpb.FuncInfo{InsnOff: int32(ProgramSize(main)), TypeId: bpfLoopCallbackTypeId},
+			},
+		},
+		Btf: btf,
+	}, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestBpfLoopProgram(t *testing.T) {
+	before := []*pb.Instruction{Mov64(R6, R10), Add64(R6, -8)}
+	// The wide load makes slots and instruction indices differ.
+	after := []*pb.Instruction{LdImm64(R7, 1<<40), Mov64(R0, 0), Exit()}
+	callback := []*pb.Instruction{Mov64(R0, 0), Exit()}
+
+	prog, err := BpfLoopProgram(before, after, callback, 8, R6)
+	if err != nil {
+		t.Fatalf("BpfLoopProgram() error = %v", err)
+	}
+	if len(prog.Functions) != 2 {
+		t.Fatalf("len(BpfLoopProgram().Functions) = %d, want 2", len(prog.Functions))
+	}
+	if len(prog.Btf) == 0 {
+		t.Errorf("BpfLoopProgram().Btf is empty")
+	}
+
+	main := prog.Functions[0].Instructions
+	callbackSlot := ProgramSize(main)
+	if got := prog.Functions[1].FuncInfo.InsnOff; got != int32(callbackSlot) {
+		t.Errorf("callback FuncInfo.InsnOff = %d, want %d", got, callbackSlot)
+	}
+
+	funcPtrTarget, loopCalls := -1, 0
+	Walk(main, func(slot int, i *pb.Instruction) error {
+		if i.GetMemOpcode() != nil && i.SrcReg == PseudoFunc {
+			funcPtrTarget = slot + 1 + int(i.Immediate)
+		}
+		if isCall(i) && i.Immediate == Loop {
+			loopCalls++
+		}
+		return nil
+	})
+	if loopCalls != 1 {
+		t.Errorf("BpfLoopProgram() has %d calls to bpf_loop, want 1\n%s", loopCalls, ProgramString(main))
+	}
+	if funcPtrTarget != callbackSlot {
+		t.Errorf("bpf_loop callback points to slot %d, want %d\n%s", funcPtrTarget, callbackSlot, ProgramString(main))
+	}
+}
@@ -70,6 +70,26 @@ func GetBuffer(btf *pb.Btf) ([]byte, error) {
 }
 
 func generateBTF(btf_proto *pb.Btf) ([]byte, error) {
+	string_data := []byte(btf_proto.StringSection.Str)
+	var string_buff bytes.Buffer
+	// The first string in the string section must be a null string
+	string_buff.Write([]byte{0})
+	for _, strings := range string_data {
+		err := binary.Write(&string_buff, binary.LittleEndian, strings)
+		if err != nil {
+			fmt.Println("binary.Write failed:", err)
+			return nil, err
+		}
+		string_buff.Write([]byte{0})
+	}
+	return encodeBTF(btf_proto, string_buff.Bytes())
+}
+
+// encodeBTF serializes the header and type section of `btf_proto` followed
+// by `string_section`, which is copied as is instead of being built from the
+// string section of the proto. It is for BTF that needs names longer than
+// one character.
+func encodeBTF(btf_proto *pb.Btf, string_section []byte) ([]byte, error) {
 	var btf_buff bytes.Buffer
 	var err error
 
@@ -101,22 +121,9 @@ func generateBTF(btf_proto *pb.Btf) ([]byte, error) {
 		}
 	}
 
-	string_data := []byte(btf_proto.StringSection.Str)
-	var string_buff bytes.Buffer
-	// The first string in the string section must be a null string
-	string_buff.Write([]byte{0})
-	for _, strings := range string_data {
-		err = binary.Write(&string_buff, binary.LittleEndian, strings)
-		if err != nil {
-			fmt.Println("binary.Write failed:", err)
-			return nil, err
-		}
-		string_buff.Write([]byte{0})
-	}
-
 	btf_proto.Header.TypeLen = int32(len(types_buff.Bytes()))
 	btf_proto.Header.StrOff = int32(len(types_buff.Bytes()))
-	btf_proto.Header.StrLen = int32(len(string_buff.Bytes()))
+	btf_proto.Header.StrLen = int32(len(string_section))
 
 	var header_data = []any{
 		uint16(btf_proto.Header.Magic),
@@ -137,6 +144,6 @@ func generateBTF(btf_proto *pb.Btf) ([]byte, error) {
 	}
 
 	btf_buff.Write(types_buff.Bytes())
-	btf_buff.Write(string_buff.Bytes())
+	btf_buff.Write(string_section)
 	return btf_buff.Bytes(), nil
 }
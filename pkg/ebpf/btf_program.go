@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	btfpb "buzzer/proto/btf_go_proto"
+	pb "buzzer/proto/ebpf_go_proto"
+	"strings"
+)
+
+// singleFunctionTypeId is the BTF type id of the function described by
+// SingleFunctionBtf.
+const singleFunctionTypeId = 2
+
+// SingleFunctionBtf returns the encoded BTF describing a program made of a
+// single static function that takes no arguments.
+func SingleFunctionBtf() ([]byte, error) {
+	types := []*btfpb.BtfType{
+		// 1: Func_Proto
+		{
+			NameOff:    0x0,
+			Info:       &btfpb.TypeInfo{Vlen: 0, Kind: btfpb.BtfKind_FUNCPROTO},
+			SizeOrType: 0x0,
+			Extra:      &btfpb.BtfType_Empty{Empty: &btfpb.Empty{}},
+		},
+		// 2: Func
+		{
+			NameOff:    0x1,
+			Info:       &btfpb.TypeInfo{Vlen: 0, Kind: btfpb.BtfKind_FUNC},
+			SizeOrType: 0x1,
+			Extra:      &btfpb.BtfType_Empty{Empty: &btfpb.Empty{}},
+		},
+	}
+	btf := &btfpb.Btf{}
+	SetHeaderSection(btf, 0xeb9f, 0x01, 0x0)
+	btf.TypeSection = &btfpb.TypeSection{BtfType: types}
+	btf.StringSection = &btfpb.StringSection{Str: "buzzer"}
+	return GetBuffer(btf)
+}
+
+const (
+	// SpinLockKeyTypeId and SpinLockValueTypeId are the BTF type ids of the
+	// key and value of a map described by SpinLockValueBtf.
+	SpinLockKeyTypeId   = 1
+	SpinLockValueTypeId = 3
+	// SpinLockValueSize is the size in bytes of the value, the bpf_spin_lock
+	// is at offset 0 and the 8 bytes at offset 8 are free for the program to
+	// access while holding it.
+	SpinLockValueSize = 16
+)
+
+// spinLockStrings is the string section of SpinLockValueBtf. The kernel
+// finds the lock by the name of its type, which has to be "bpf_spin_lock".
+const spinLockStrings = "\x00u32\x00bpf_spin_lock\x00val\x00value\x00lock\x00"
+
+// spinLockNameOff returns the offset of `name` in spinLockStrings.
+func spinLockNameOff(name string) int32 {
+	return int32(strings.Index(spinLockStrings, "\x00"+name+"\x00") + 1)
+}
+
+// SpinLockValueBtf returns the encoded BTF of a map with u32 keys whose
+// values have a bpf_spin_lock at offset 0, that is:
+//
+//	struct value {
+//		struct bpf_spin_lock lock;
+//		u64 data;
+//	};
+//
+// The verifier only allows CallSpinLock on values described by BTF.
+func SpinLockValueBtf() ([]byte, error) {
+	types := []*btfpb.BtfType{
+		// 1: u32
+		{
+			NameOff:    spinLockNameOff("u32"),
+			Info:       &btfpb.TypeInfo{Vlen: 0, Kind: btfpb.BtfKind_INT},
+			SizeOrType: 4,
+			Extra:      &btfpb.BtfType_IntTypeData{IntTypeData: &btfpb.IntTypeData{IntInfo: 32}},
+		},
+		// 2: struct bpf_spin_lock { u32 val; }
+		{
+			NameOff:    spinLockNameOff("bpf_spin_lock"),
+			Info:       &btfpb.TypeInfo{Vlen: 1, Kind: btfpb.BtfKind_STRUCT},
+			SizeOrType: 4,
+			Extra: &btfpb.BtfType_StructTypeData{StructTypeData: &btfpb.StructTypeData{
+				NameOff:    spinLockNameOff("val"),
+				StructType: 1,
+				Offset:     0,
+			}},
+		},
+		// 3: struct value, data is left out of the members and only
+		// accounted for in the size.
+		{
+			NameOff:    spinLockNameOff("value"),
+			Info:       &btfpb.TypeInfo{Vlen: 1, Kind: btfpb.BtfKind_STRUCT},
+			SizeOrType: SpinLockValueSize,
+			Extra: &btfpb.BtfType_StructTypeData{StructTypeData: &btfpb.StructTypeData{
+				NameOff:    spinLockNameOff("lock"),
+				StructType: 2,
+				Offset:     0,
+			}},
+		},
+	}
+	btf := &btfpb.Btf{}
+	btf.TypeSection = &btfpb.TypeSection{BtfType: types}
+	btf.StringSection = &btfpb.StringSection{}
+	SetHeaderSection(btf, 0xeb9f, 0x01, 0x0)
+	return encodeBTF(btf, []byte(spinLockStrings))
+}
+
+// InstructionLineInfo returns a line info record for every instruction of
+// `instructions`, instruction n is reported as line n + 1 so verifier logs
+// can be matched against ProgramString. `firstSlot` is the slot the
+// instructions start at within the program.
+//
+// File and line both point to the first string of the BTF string section,
+// which SingleFunctionBtf and BpfLoopBtf have.
+func InstructionLineInfo(instructions []*pb.Instruction, firstSlot int) []*btfpb.LineInfo {
+	lineInfo := []*btfpb.LineInfo{}
+	line := 0
+	Walk(instructions, func(slot int, _ *pb.Instruction) error {
+		line++
+		lineInfo = append(lineInfo, &btfpb.LineInfo{
+			InsnOff:     int32(firstSlot + slot),
+			FileNameOff: 0x1,
+			LineOff:     0x1,
+			LineCol:     int32(line << 10),
+		})
+		return nil
+	})
+	return lineInfo
+}
+
+// SingleFunctionProgram wraps `instructions` in a program that carries BTF,
+// func_info and line_info, so the verifier takes its BTF aware paths and
+// annotates its log with the instruction lines.
+func SingleFunctionProgram(instructions []*pb.Instruction) (*pb.Program, error) {
+	btf, err := SingleFunctionBtf()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Program{
+		Functions: []*pb.Functions{
+			{
+				Instructions: instructions,
+				FuncInfo:     &btfpb.FuncInfo{InsnOff: 0, TypeId: singleFunctionTypeId},
+				LineInfo:     InstructionLineInfo(instructions, 0),
+			},
+		},
+		Btf: btf,
+	}, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestSingleFunctionProgram(t *testing.T) {
+	instructions := []*pb.Instruction{Mov64(R0, 0), LdImm64(R1, 1<<40), Exit()}
+	prog, err := SingleFunctionProgram(instructions)
+	if err != nil {
+		t.Fatalf("SingleFunctionProgram() error = %v", err)
+	}
+	if len(prog.Btf) == 0 {
+		t.Errorf("SingleFunctionProgram().Btf is empty")
+	}
+	if len(prog.Functions) != 1 || prog.Functions[0].FuncInfo.GetTypeId() != singleFunctionTypeId {
+		t.Fatalf("SingleFunctionProgram().Functions = %v, want one function of type %d", prog.Functions, singleFunctionTypeId)
+	}
+
+	// The wide load takes two slots, the exit starts at slot 3.
+	encoded, err := EncodeLineInfo(prog)
+	if err != nil {
+		t.Fatalf("EncodeLineInfo() error = %v", err)
+	}
+	records := make([][4]int32, len(encoded)/16)
+	if err := binary.Read(bytes.NewReader(encoded), binary.LittleEndian, records); err != nil {
+		t.Fatalf("binary.Read() error = %v", err)
+	}
+	want := [][4]int32{
+		{0, 1, 1, 1 << 10},
+		{1, 1, 1, 2 << 10},
+		{3, 1, 1, 3 << 10},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("EncodeLineInfo() = %v, want %v", records, want)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("EncodeLineInfo()[%d] = %v, want %v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestEncodeLineInfoWithoutLineInfo(t *testing.T) {
+	prog := &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{Mov64(R0, 0), Exit()}}}}
+	if got, err := EncodeLineInfo(prog); err != nil || got != nil {
+		t.Errorf("EncodeLineInfo() = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestSpinLockValueBtf(t *testing.T) {
+	encoded, err := SpinLockValueBtf()
+	if err != nil {
+		t.Fatalf("SpinLockValueBtf() error = %v", err)
+	}
+	var header struct {
+		Magic   uint16
+		Version uint8
+		Flags   uint8
+		HdrLen  int32
+		TypeOff int32
+		TypeLen int32
+		StrOff  int32
+		StrLen  int32
+	}
+	if err := binary.Read(bytes.NewReader(encoded), binary.LittleEndian, &header); err != nil {
+		t.Fatalf("binary.Read() error = %v", err)
+	}
+	// An int and two structs of one member.
+	if header.TypeLen != 16+24+24 {
+		t.Errorf("SpinLockValueBtf() type section length = %d, want %d", header.TypeLen, 16+24+24)
+	}
+	strs := encoded[header.HdrLen+header.StrOff:]
+	if int(header.StrLen) != len(strs) || strs[0] != 0 {
+		t.Fatalf("SpinLockValueBtf() string section = %q, want it to start with a null string", strs)
+	}
+
+	// Type 2 is the lock, the kernel recognizes it by its name.
+	var nameOff int32
+	lockType := encoded[header.HdrLen+header.TypeOff+16:]
+	if err := binary.Read(bytes.NewReader(lockType), binary.LittleEndian, &nameOff); err != nil {
+		t.Fatalf("binary.Read() error = %v", err)
+	}
+	name, _, _ := bytes.Cut(strs[nameOff:], []byte{0})
+	if string(name) != "bpf_spin_lock" {
+		t.Errorf("SpinLockValueBtf() type 2 name = %q, want %q", name, "bpf_spin_lock")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"io"
+)
+
+// isBranch returns true if `i` transfers control to the instruction at its
+// offset, that is a JA or a conditional jump.
+func isBranch(i *pb.Instruction) bool {
+	op := i.GetJmpOpcode()
+	if op == nil {
+		return false
+	}
+	return op.OperationCode != pb.JmpOperationCode_JmpCALL && op.OperationCode != pb.JmpOperationCode_JmpExit
+}
+
+// isUnconditionalBranch returns true if `i` is a JA.
+func isUnconditionalBranch(i *pb.Instruction) bool {
+	return isBranch(i) && i.GetJmpOpcode().OperationCode == pb.JmpOperationCode_JmpJA
+}
+
+// isExit returns true if `i` is an Exit instruction.
+func isExit(i *pb.Instruction) bool {
+	op := i.GetJmpOpcode()
+	return op != nil && op.OperationCode == pb.JmpOperationCode_JmpExit
+}
+
+// isCall returns true if `i` calls a helper, kfunc or bpf function.
+func isCall(i *pb.Instruction) bool {
+	op := i.GetJmpOpcode()
+	return op != nil && op.OperationCode == pb.JmpOperationCode_JmpCALL
+}
+
+// branchOffset returns the number of slots a branch jumps over. The 32 bit
+// flavor of JA (gotol) keeps its offset in the immediate.
+func branchOffset(i *pb.Instruction) int {
+	if isUnconditionalBranch(i) && i.GetJmpOpcode().InstructionClass == pb.InsClass_InsClassJmp32 {
+		return int(i.Immediate)
+	}
+	return int(i.Offset)
+}
+
+// slotIndices returns the slot at which each instruction starts once encoded
+// together with the total number of slots.
+func slotIndices(instructions []*pb.Instruction) ([]int, int) {
+	slots := make([]int, len(instructions))
+	slot := 0
+	for index, inst := range instructions {
+		slots[index] = slot
+		slot += instructionSlots(inst)
+	}
+	return slots, slot
+}
+
+// branchTargets returns, for every branch in `instructions`, the index of the
+// instruction it lands on. An error is returned if a branch lands outside of
+// the program or in the middle of a wide instruction.
+func branchTargets(instructions []*pb.Instruction) (map[int]int, error) {
+	slots, _ := slotIndices(instructions)
+	indexOfSlot := make(map[int]int, len(slots))
+	for index, slot := range slots {
+		indexOfSlot[slot] = index
+	}
+
+	targets := make(map[int]int)
+	for index, inst := range instructions {
+		if !isBranch(inst) {
+			continue
+		}
+		targetSlot := slots[index] + 1 + branchOffset(inst)
+		target, ok := indexOfSlot[targetSlot]
+		if !ok {
+			return nil, fmt.Errorf("jmp at instruction %d lands on slot %d which is not the start of an instruction", index, targetSlot)
+		}
+		targets[index] = target
+	}
+	return targets, nil
+}
+
+// BasicBlock is a maximal run of instructions that can only be entered
+// through its first instruction and left through its last one.
+type BasicBlock struct {
+	// Start and End are the indices of the first and last instructions of
+	// the block.
+	Start int
+	End   int
+
+	// Successors and Predecessors hold indices into the Blocks of the
+	// ControlFlowGraph the block belongs to.
+	Successors   []int
+	Predecessors []int
+}
+
+// ControlFlowGraph is the basic block view of a sequence of instructions.
+type ControlFlowGraph struct {
+	Blocks       []*BasicBlock
+	instructions []*pb.Instruction
+}
+
+// NewControlFlowGraph splits `instructions` into basic blocks and links them
+// through their fallthrough and jump edges. Blocks are sorted by Start.
+func NewControlFlowGraph(instructions []*pb.Instruction) (*ControlFlowGraph, error) {
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("cannot build a cfg of an empty program")
+	}
+	targets, err := branchTargets(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leaders are the first instruction, every branch target and every
+	// instruction following a branch or an exit.
+	isLeader := make([]bool, len(instructions))
+	isLeader[0] = true
+	for index, inst := range instructions {
+		if target, ok := targets[index]; ok {
+			isLeader[target] = true
+		}
+		if (isBranch(inst) || isExit(inst)) && index+1 < len(instructions) {
+			isLeader[index+1] = true
+		}
+	}
+
+	cfg := &ControlFlowGraph{instructions: instructions}
+	blockOf := make([]int, len(instructions))
+	for index := range instructions {
+		if isLeader[index] {
+			cfg.Blocks = append(cfg.Blocks, &BasicBlock{Start: index})
+		}
+		block := len(cfg.Blocks) - 1
+		cfg.Blocks[block].End = index
+		blockOf[index] = block
+	}
+
+	for blockIndex, block := range cfg.Blocks {
+		last := instructions[block.End]
+		successors := []int{}
+		if !isExit(last) && !isUnconditionalBranch(last) && block.End+1 < len(instructions) {
+			successors = append(successors, blockOf[block.End+1])
+		}
+		if target, ok := targets[block.End]; ok {
+			successors = append(successors, blockOf[target])
+		}
+		for _, successor := range successors {
+			if len(block.Successors) > 0 && block.Successors[0] == successor {
+				// A branch that lands on its fallthrough instruction.
+				continue
+			}
+			block.Successors = append(block.Successors, successor)
+			cfg.Blocks[successor].Predecessors = append(cfg.Blocks[successor].Predecessors, blockIndex)
+		}
+	}
+	return cfg, nil
+}
+
+// TerminatePaths returns `instructions` with an Exit appended if control can
+// run off their end, either by falling through the last instruction or by a
+// branch landing right after it. Branches landing anywhere else outside of
+// the program are reported as an error.
+func TerminatePaths(instructions []*pb.Instruction) ([]*pb.Instruction, error) {
+	if len(instructions) == 0 {
+		return []*pb.Instruction{Exit()}, nil
+	}
+
+	slots, total := slotIndices(instructions)
+	last := instructions[len(instructions)-1]
+	needsExit := !isExit(last) && !isUnconditionalBranch(last)
+	for index, inst := range instructions {
+		if isBranch(inst) && slots[index]+1+branchOffset(inst) == total {
+			needsExit = true
+		}
+	}
+
+	terminated := instructions
+	if needsExit {
+		terminated = append(instructions[:len(instructions):len(instructions)], Exit())
+	}
+	if _, err := branchTargets(terminated); err != nil {
+		return nil, err
+	}
+	return terminated, nil
+}
+
+// Instructions returns the instructions that make up `block`.
+func (cfg *ControlFlowGraph) Instructions(block *BasicBlock) []*pb.Instruction {
+	return cfg.instructions[block.Start : block.End+1]
+}
+
+// PrintCFG writes the basic blocks of `instructions`, one instruction per
+// line, followed by the blocks control can flow to.
+func PrintCFG(w io.Writer, instructions []*pb.Instruction) error {
+	cfg, err := NewControlFlowGraph(instructions)
+	if err != nil {
+		return err
+	}
+
+	for blockIndex, block := range cfg.Blocks {
+		if _, err := fmt.Fprintf(w, "block %d:\n", blockIndex); err != nil {
+			return err
+		}
+		for index := block.Start; index <= block.End; index++ {
+			if _, err := fmt.Fprintf(w, "\t%d: %s\n", index, InstructionString(instructions[index])); err != nil {
+				return err
+			}
+		}
+		successors := "none"
+		if len(block.Successors) > 0 {
+			successors = ""
+			for n, successor := range block.Successors {
+				if n > 0 {
+					successors += ", "
+				}
+				successors += fmt.Sprintf("block %d", successor)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "\tsuccessors: %s\n", successors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
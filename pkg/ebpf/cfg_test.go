@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestControlFlowGraphWithConditionalJump(t *testing.T) {
+	prog, err := InstructionSequence(
+		Mov64(R0, 0),
+		JmpEQ(R0, 0, 1),
+		Mov64(R0, 1),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	cfg, err := NewControlFlowGraph(prog)
+	if err != nil {
+		t.Fatalf("NewControlFlowGraph() error = %v", err)
+	}
+
+	want := []*BasicBlock{
+		{Start: 0, End: 1, Successors: []int{1, 2}},
+		{Start: 2, End: 2, Successors: []int{2}, Predecessors: []int{0}},
+		{Start: 3, End: 3, Predecessors: []int{0, 1}},
+	}
+	if !reflect.DeepEqual(cfg.Blocks, want) {
+		for _, block := range cfg.Blocks {
+			t.Logf("got block %+v", block)
+		}
+		t.Fatalf("NewControlFlowGraph() did not produce the expected blocks")
+	}
+
+	var out bytes.Buffer
+	if err := PrintCFG(&out, prog); err != nil {
+		t.Fatalf("PrintCFG() error = %v", err)
+	}
+	for _, wantLine := range []string{
+		"block 0:\n\t0: r0 = 0x0\n\t1: if r0 == 0x0 goto +1\n\tsuccessors: block 1, block 2\n",
+		"block 1:\n\t2: r0 = 0x1\n\tsuccessors: block 2\n",
+		"block 2:\n\t3: exit\n\tsuccessors: none\n",
+	} {
+		if !strings.Contains(out.String(), wantLine) {
+			t.Errorf("PrintCFG() = %q, want it to contain %q", out.String(), wantLine)
+		}
+	}
+}
+
+func TestControlFlowGraphRejectsOutOfBoundsJump(t *testing.T) {
+	prog, err := InstructionSequence(
+		JmpEQ(R0, 0, 5),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	if _, err := NewControlFlowGraph(prog); err == nil {
+		t.Errorf("NewControlFlowGraph() error = nil, want an out of bounds error")
+	}
+}
+
+func TestTerminatePaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		prog     []*pb.Instruction
+		wantExit bool
+		wantErr  bool
+	}{
+		{"empty", []*pb.Instruction{}, true, false},
+		{"already terminated", []*pb.Instruction{Mov64(R0, 0), Exit()}, false, false},
+		{"falls off the end", []*pb.Instruction{Mov64(R0, 0), Add64(R0, 1)}, true, false},
+		{"branch past the last exit", []*pb.Instruction{JmpEQ(R0, 0, 1), Exit()}, true, false},
+		{"backwards ja", []*pb.Instruction{Mov64(R0, 0), Exit(), Jmp(-3)}, false, false},
+		{"branch out of bounds", []*pb.Instruction{JmpEQ(R0, 0, 5), Exit()}, false, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := TerminatePaths(tc.prog)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("TerminatePaths() error = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			wantLen := len(tc.prog)
+			if tc.wantExit {
+				wantLen++
+			}
+			if len(got) != wantLen {
+				t.Fatalf("len(TerminatePaths()) = %d, want %d", len(got), wantLen)
+			}
+			if tc.wantExit && !isExit(got[len(got)-1]) {
+				t.Errorf("TerminatePaths() last instruction = %v, want an exit", got[len(got)-1])
+			}
+		})
+	}
+}
+
+func TestRandomProgramLeavesAreExits(t *testing.T) {
+	withTestGlobals(t, 1)
+	SharedConfig.BiasedJmpPercentage = 50
+
+	for n := 0; n < 500; n++ {
+		prog := RandomProgram(int(rand.SharedRNG.RandRange(1, 100)))
+		cfg, err := NewControlFlowGraph(prog)
+		if err != nil {
+			t.Fatalf("NewControlFlowGraph() error = %v", err)
+		}
+		for index, block := range cfg.Blocks {
+			if len(block.Successors) > 0 {
+				continue
+			}
+			if last := prog[block.End]; !isExit(last) {
+				t.Fatalf("block %d of RandomProgram() has no successors and ends in %v, want an exit", index, last)
+			}
+		}
+		if terminated, err := TerminatePaths(prog); err != nil || len(terminated) != len(prog) {
+			t.Fatalf("TerminatePaths(RandomProgram()) = %d instructions, %v, want %d and no error", len(terminated), err, len(prog))
+		}
+	}
+}
+
+// The analyses walk the control flow graph with worklists rather than
+// recursion, deeply nested and overlapping jumps must not exhaust the stack.
+func TestDeeplyNestedJumps(t *testing.T) {
+	const depth = 10000
+	prog := []*pb.Instruction{Mov64(R0, 0)}
+	// Every jmp lands on the exit, jumping over all the ones after it.
+	for i := 0; i < depth; i++ {
+		prog = append(prog, JmpEQ(R1, int32(i), int16(depth-i-1)))
+	}
+	prog = append(prog, Exit())
+
+	cfg, err := NewControlFlowGraph(prog)
+	if err != nil {
+		t.Fatalf("NewControlFlowGraph() error = %v", err)
+	}
+	if len(cfg.Blocks) != depth+1 {
+		t.Errorf("len(NewControlFlowGraph().Blocks) = %d, want %d", len(cfg.Blocks), depth+1)
+	}
+	if err := Validate(prog); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	if _, err := DefUse(prog); err != nil {
+		t.Errorf("DefUse() error = %v", err)
+	}
+}
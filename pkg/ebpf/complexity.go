@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+)
+
+// ComplexityLimit is BPF_COMPLEXITY_LIMIT_INSNS, the number of instructions
+// the verifier processes before giving up on a program.
+const ComplexityLimit = 1000000
+
+// branchingBits is the number of bits of `cond` BranchingProgram can test,
+// the value is expected to come from a 32 bit load.
+const branchingBits = 32
+
+// BranchingProgram returns `depth` levels of branches that each split every
+// path into `factor` paths, factor^depth paths in total, and join again on a
+// single Exit.
+//
+// Every conditional jump tests a different bit of `cond`, which should hold a
+// value unknown to the verifier (e.g. loaded from the context), so both of
+// its outcomes are explored. `acc` numbers the path taken and is compared at
+// the end, which makes the verifier track it precisely and keeps it from
+// pruning the paths together. The number of instructions the verifier
+// processes grows like BranchingComplexity.
+func BranchingProgram(cond, acc pb.Reg, depth, factor int) ([]*pb.Instruction, error) {
+	if factor < 2 || depth < 1 {
+		return nil, fmt.Errorf("branching needs a factor of at least 2 and a depth of at least 1, got %d and %d", factor, depth)
+	}
+	if depth*(factor-1) > branchingBits {
+		return nil, fmt.Errorf("depth %d with factor %d needs %d bits of cond, only %d are available", depth, factor, depth*(factor-1), branchingBits)
+	}
+
+	prog := []*pb.Instruction{Mov64(acc, 0)}
+	bit := 0
+	for level := 0; level < depth; level++ {
+		prog = append(prog, Mul64(acc, int32(factor)))
+
+		// The jumps select arms 0 to factor-2, falling through them
+		// selects arm factor-1. The arms follow the jumps starting with the
+		// fallthrough one, every arm but the last one jumps to the end of
+		// the level.
+		armsStart := factor - 1
+		levelEnd := armsStart + 2*(factor-1) + 1
+		for k := 0; k < factor-1; k++ {
+			target := armsStart + 2*(k+1)
+			prog = append(prog, JmpSET(cond, int32(uint32(1)<<bit), int16(target-(k+1))))
+			bit++
+		}
+		arms := []int{factor - 1}
+		for k := 0; k < factor-1; k++ {
+			arms = append(arms, k)
+		}
+		for n, k := range arms {
+			prog = append(prog, Add64(acc, int32(k)))
+			if n == len(arms)-1 {
+				break
+			}
+			jmp := armsStart + 2*n + 1
+			prog = append(prog, Jmp(int16(levelEnd-(jmp+1))))
+		}
+	}
+
+	// acc is never all ones, the verifier can tell and marks it precise
+	// while deciding the branch.
+	prog = append(prog,
+		JmpNE(acc, -1, 1),
+		Mov64(R0, 1),
+		Mov64(R0, 0),
+		Exit(),
+	)
+	return prog, nil
+}
+
+// BranchingComplexity estimates how many instructions the verifier
+// processes, without state pruning, for a BranchingProgram of `depth` and
+// `factor`. It is an upper bound: every path is assumed to go through every
+// jump of a level.
+func BranchingComplexity(depth, factor int) int {
+	total := 1
+	paths := 1
+	for level := 0; level < depth; level++ {
+		// The multiplication, the jumps and an arm.
+		total += paths * (1 + (factor - 1) + 2)
+		paths *= factor
+	}
+	return total + paths*4
+}
+
+// MaxBranchingDepth returns the deepest BranchingProgram of `factor` whose
+// BranchingComplexity stays within `limit`, or 0 if none does.
+func MaxBranchingDepth(factor, limit int) int {
+	depth := 0
+	for (depth+1)*(factor-1) <= branchingBits && BranchingComplexity(depth+1, factor) <= limit {
+		depth++
+	}
+	return depth
+}
+
+// IrreducibleLoop returns a loop with two entries, an irreducible region of
+// the control flow graph: depending on bit 0 of `cond` the loop is entered at
+// its first block, A, or jumps straight into its second one, B.
+//
+//	counter = 0
+//	if cond & 1 goto B
+//	A: counter += 2
+//	B: counter += 1
+//	   if counter < iterations goto A
+//	return 0
+//
+// When `bounded` is false the back edge tests `cond`, which the loop never
+// changes, instead of `counter`: on the paths where it is taken the loop
+// never ends and the verifier must reject the program.
+func IrreducibleLoop(cond, counter pb.Reg, iterations int32, bounded bool) ([]*pb.Instruction, error) {
+	if iterations < 1 {
+		return nil, fmt.Errorf("the loop needs at least 1 iteration, got %d", iterations)
+	}
+	if cond == counter {
+		return nil, fmt.Errorf("cond and counter must be different registers, got r%d", cond)
+	}
+	backEdge := JmpLT(counter, iterations, -3)
+	if !bounded {
+		backEdge = JmpLT(cond, iterations, -3)
+	}
+	return InstructionSequence(
+		Mov64(counter, 0),
+		JmpSET(cond, 1, 1),
+		Add64(counter, 2),
+		Add64(counter, 1),
+		backEdge,
+		Mov64(R0, 0),
+		Exit(),
+	)
+}
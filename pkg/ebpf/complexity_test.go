@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestBranchingProgram(t *testing.T) {
+	tests := []struct {
+		name   string
+		factor int
+	}{
+		{"binary", 2},
+		{"ternary", 3},
+		{"wide", 5},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			previous := 0
+			for depth := 1; depth <= 6; depth++ {
+				body, err := BranchingProgram(R6, R7, depth, tc.factor)
+				if err != nil {
+					t.Fatalf("BranchingProgram(%d, %d) error = %v", depth, tc.factor, err)
+				}
+				// R6 stands for an unknown value loaded from the context.
+				prog := append([]*pb.Instruction{LdW(R6, R1, 0)}, body...)
+				if err := Validate(prog); err != nil {
+					t.Fatalf("Validate(BranchingProgram(%d, %d)) error = %v\n%s", depth, tc.factor, err, ProgramString(prog))
+				}
+				if terminated, err := TerminatePaths(prog); err != nil || len(terminated) != len(prog) {
+					t.Fatalf("BranchingProgram(%d, %d) has paths that do not exit\n%s", depth, tc.factor, ProgramString(prog))
+				}
+
+				jsets := 0
+				for _, ins := range prog {
+					if ins.GetJmpOpcode().GetOperationCode() == pb.JmpOperationCode_JmpJSET {
+						jsets++
+					}
+				}
+				if want := depth * (tc.factor - 1); jsets != want {
+					t.Errorf("BranchingProgram(%d, %d) has %d branches, want %d", depth, tc.factor, jsets, want)
+				}
+
+				// Each level multiplies the paths, and so the work of
+				// the verifier, by roughly the factor.
+				complexity := BranchingComplexity(depth, tc.factor)
+				if previous != 0 && (complexity < previous*(tc.factor-1) || complexity > previous*(tc.factor+1)) {
+					t.Errorf("BranchingComplexity(%d, %d) = %d, want about %d times %d", depth, tc.factor, complexity, tc.factor, previous)
+				}
+				previous = complexity
+			}
+		})
+	}
+}
+
+func TestBranchingProgramPaths(t *testing.T) {
+	prog, err := BranchingProgram(R6, R7, 3, 3)
+	if err != nil {
+		t.Fatalf("BranchingProgram() error = %v", err)
+	}
+	cfg, err := NewControlFlowGraph(prog)
+	if err != nil {
+		t.Fatalf("NewControlFlowGraph() error = %v", err)
+	}
+
+	// Count the paths from the entry to the final exit.
+	paths := make([]int, len(cfg.Blocks))
+	paths[0] = 1
+	exits := 0
+	for index, block := range cfg.Blocks {
+		for _, successor := range block.Successors {
+			if successor <= index {
+				t.Fatalf("block %d has a back edge to block %d", index, successor)
+			}
+			paths[successor] += paths[index]
+		}
+		if len(block.Successors) == 0 {
+			exits += paths[index]
+		}
+	}
+	// The final branch on acc doubles the paths again.
+	if want := 27 * 2; exits != want {
+		t.Errorf("BranchingProgram(3, 3) has %d paths, want %d\n%s", exits, want, ProgramString(prog))
+	}
+}
+
+func TestMaxBranchingDepth(t *testing.T) {
+	for _, factor := range []int{2, 3, 4} {
+		depth := MaxBranchingDepth(factor, ComplexityLimit)
+		if depth == 0 {
+			t.Fatalf("MaxBranchingDepth(%d) = 0", factor)
+		}
+		if got := BranchingComplexity(depth, factor); got > ComplexityLimit {
+			t.Errorf("BranchingComplexity(MaxBranchingDepth(%d)) = %d, want at most %d", factor, got, ComplexityLimit)
+		}
+		if (depth+1)*(factor-1) <= branchingBits && BranchingComplexity(depth+1, factor) <= ComplexityLimit {
+			t.Errorf("MaxBranchingDepth(%d) = %d, a deeper program also fits", factor, depth)
+		}
+	}
+
+	if _, err := BranchingProgram(R6, R7, 17, 3); err == nil {
+		t.Errorf("BranchingProgram() needing more than %d bits error = nil, want error", branchingBits)
+	}
+}
+
+func TestIrreducibleLoop(t *testing.T) {
+	for _, bounded := range []bool{true, false} {
+		loop, err := IrreducibleLoop(R6, R7, 8, bounded)
+		if err != nil {
+			t.Fatalf("IrreducibleLoop(bounded = %v) unexpected error: %v", bounded, err)
+		}
+		if err := Validate(append([]*pb.Instruction{LdW(R6, R1, 0)}, loop...)); err != nil {
+			t.Errorf("Validate(IrreducibleLoop(bounded = %v)) = %v", bounded, err)
+		}
+		cfg, err := NewControlFlowGraph(loop)
+		if err != nil {
+			t.Fatalf("NewControlFlowGraph() unexpected error: %v", err)
+		}
+
+		// A back edge from `latch` to `header` closes the loop made of the
+		// blocks in between. The loop is irreducible if more than one of
+		// them is entered from outside of it.
+		irreducible := false
+		for header, block := range cfg.Blocks {
+			for _, latch := range block.Predecessors {
+				if latch < header {
+					continue
+				}
+				entries := 0
+				for member := header; member <= latch; member++ {
+					for _, predecessor := range cfg.Blocks[member].Predecessors {
+						if predecessor < header || predecessor > latch {
+							entries++
+							break
+						}
+					}
+				}
+				if entries >= 2 {
+					irreducible = true
+				}
+			}
+		}
+		if !irreducible {
+			t.Errorf("IrreducibleLoop(bounded = %v) has no loop with two entries: %v", bounded, cfg.Blocks)
+		}
+	}
+
+	if _, err := IrreducibleLoop(R6, R7, 0, true); err == nil {
+		t.Errorf("IrreducibleLoop() with 0 iterations error = nil, want error")
+	}
+	if _, err := IrreducibleLoop(R6, R6, 8, true); err == nil {
+		t.Errorf("IrreducibleLoop() counting in cond error = nil, want error")
+	}
+}
@@ -18,12 +18,73 @@ import pb "buzzer/proto/ebpf_go_proto"
 
 const (
 	// Constants related to the encoding of ebpf operations
-	// UnusedField Unused Field.
+	// UnusedField is the value constructors give to the fields (registers,
+	// offset or immediate) an instruction does not use. It encodes to 0,
+	// the kernel rejects most instructions with non zero reserved fields.
 	UnusedField = 0x00
 )
 
 const (
 	PseudoMapFD = pb.Reg_R1
+
+	// PseudoKfuncCall in the src register of a call marks the immediate
+	// as the BTF id of a kernel function instead of a helper number.
+	PseudoKfuncCall = pb.Reg_R2
+
+	// PseudoFunc in the src register of a 64 bit immediate load marks the
+	// immediate as the relative offset of a bpf function to take the
+	// address of.
+	PseudoFunc = pb.Reg_R4
+)
+
+const (
+	// Maximum number of instructions the kernel accepts for a program
+	// loaded without and with CAP_BPF/CAP_SYS_ADMIN respectively.
+	MaxUnprivilegedInstructions = 4096
+	MaxPrivilegedInstructions   = 1000000
+)
+
+const (
+	// Offsets of the packet pointers in the program context, __sk_buff for
+	// skb based programs and xdp_md for xdp.
+	SkbDataOffset    = 76
+	SkbDataEndOffset = 80
+	XdpDataOffset    = 0
+	XdpDataEndOffset = 4
+)
+
+const (
+	// bpf_prog_type values, see include/uapi/linux/bpf.h.
+	ProgTypeSocketFilter = 1
+	ProgTypeKprobe       = 2
+	ProgTypeSchedCls     = 3
+	ProgTypeXdp          = 6
+	ProgTypeCgroupSkb    = 8
+)
+
+const (
+	// ToLE and ToBE are the byte orders End instructions convert to. The
+	// kernel keeps them (BPF_TO_LE and BPF_TO_BE) in the source bit of the
+	// opcode, the source register is unused.
+	ToLE = pb.SrcOperand_Immediate
+	ToBE = pb.SrcOperand_RegSrc
+)
+
+const (
+	// xdp_action values, the return codes of xdp programs.
+	XdpAborted = 0
+	XdpDrop    = 1
+	XdpPass    = 2
+	XdpTx      = 3
+)
+
+const (
+	// BPF_F_* values accepted in the prog_flags of BPF_PROG_LOAD.
+	ProgFlagStrictAlignment = 1 << 0
+	ProgFlagAnyAlignment    = 1 << 1
+	ProgFlagTestRndHi32     = 1 << 2
+	ProgFlagTestStateFreq   = 1 << 3
+	ProgFlagSleepable       = 1 << 4
 )
 
 const (
@@ -44,5 +105,28 @@ const (
 	// ebpf helper function codes
 	// MapLookup Map Lookup helper function.
 	MapLookup            = 0x01
+	MapUpdate            = 0x02
+	MapDelete            = 0x03
+	TracePrintk          = 0x06
+	GetPrandomU32        = 0x07
+	TailCall             = 0x0c
 	SkbLoadBytesRelative = 0x44
+	MapPush              = 0x57
+	MapPop               = 0x58
+	SpinLock             = 0x5d
+	SpinUnlock           = 0x5e
+	RingbufReserve       = 0x83
+	RingbufSubmit        = 0x84
+	RingbufDiscard       = 0x85
+	Loop                 = 0xb5
+	// CopyFromUser can fault and is only available to sleepable programs.
+	CopyFromUser = 0x94
+)
+
+const (
+	// Flags of the map_update_elem helper, BPF_ANY, BPF_NOEXIST and BPF_EXIST
+	// in include/uapi/linux/bpf.h.
+	MapUpdateAny     = 0
+	MapUpdateNoExist = 1
+	MapUpdateExist   = 2
 )
@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	jsonpb "github.com/golang/protobuf/jsonpb"
+	proto "github.com/golang/protobuf/proto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A corpus is a directory of programs that must keep encoding to the same
+// bytecode. Each entry is made of two files:
+//   - <name>.json: the program, in the format written by GeneratePoc.
+//   - <name>.golden: the expected bytecode, one hex value per instruction
+//     slot.
+const (
+	corpusProgramExtension = ".json"
+	corpusGoldenExtension  = ".golden"
+)
+
+// WriteCorpusEntry adds `program` to the corpus in `dir` as `name`, using its
+// current bytecode as the golden value.
+func WriteCorpusEntry(dir string, name string, program *pb.Program) error {
+	bytecode, err := GenerateBytecode(program)
+	if err != nil {
+		return err
+	}
+
+	m := &jsonpb.Marshaler{
+		OrigName:     true,
+		EnumsAsInts:  false,
+		EmitDefaults: true,
+		Indent:       "   ",
+	}
+	programData, err := m.MarshalToString(program)
+	if err != nil {
+		return err
+	}
+
+	var golden strings.Builder
+	for _, slot := range bytecode {
+		fmt.Fprintf(&golden, "%#016x\n", slot)
+	}
+
+	base := filepath.Join(dir, name)
+	if err := os.WriteFile(base+corpusProgramExtension, []byte(programData), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(base+corpusGoldenExtension, []byte(golden.String()), 0644)
+}
+
+// ContentHash returns the SHA-256 of the deterministic wire encoding of
+// `program`. Unlike the kernel program tag, which only covers the bytecode and
+// ignores map fds, it covers every field of the program (BTF, func and line
+// info, license...), so programs that differ anywhere hash differently. The
+// instruction ids, see StampInstructionIds, are not part of the content.
+func ContentHash(program *pb.Program) ([32]byte, error) {
+	program = proto.Clone(program).(*pb.Program)
+	for _, function := range program.Functions {
+		for _, inst := range function.Instructions {
+			inst.Id = 0
+		}
+	}
+
+	buff := proto.NewBuffer(nil)
+	buff.SetDeterministic(true)
+	if err := buff.Marshal(program); err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(buff.Bytes()), nil
+}
+
+// registerOperands tells whether the dst and src fields of `i` name
+// registers, as opposed to being unused or holding pseudo values (e.g. the
+// src of LdMapByFd or of a call).
+func registerOperands(i *pb.Instruction) (dst bool, src bool) {
+	switch op := i.Opcode.(type) {
+	case *pb.Instruction_AluOpcode:
+		return true, op.AluOpcode.Source == pb.SrcOperand_RegSrc && op.AluOpcode.OperationCode != pb.AluOperationCode_AluEnd
+	case *pb.Instruction_JmpOpcode:
+		if !IsConditional(op.JmpOpcode.OperationCode) {
+			return false, false
+		}
+		return true, op.JmpOpcode.Source == pb.SrcOperand_RegSrc
+	case *pb.Instruction_MemOpcode:
+		class := op.MemOpcode.InstructionClass
+		if isLegacyPacketLoad(i) {
+			return false, op.MemOpcode.Mode == pb.StLdMode_StLdModeIND
+		}
+		return true, class == pb.InsClass_InsClassLdx || class == pb.InsClass_InsClassStx
+	}
+	return false, false
+}
+
+// NormalizeRegisters returns a copy of `program` where R6 to R9 are renamed
+// in order of first use: the first of them to appear becomes R6, the second
+// R7 and so on. Programs that only differ by a consistent renaming of those
+// registers normalize to the same program, and so to the same ContentHash.
+//
+// R0 to R5 and R10 are left alone, their meaning is fixed by the calling
+// convention and the frame pointer.
+func NormalizeRegisters(program *pb.Program) *pb.Program {
+	normalized := proto.Clone(program).(*pb.Program)
+	renames := map[pb.Reg]pb.Reg{}
+	rename := func(reg pb.Reg) pb.Reg {
+		if reg < R6 || reg > R9 {
+			return reg
+		}
+		if _, ok := renames[reg]; !ok {
+			renames[reg] = R6 + pb.Reg(len(renames))
+		}
+		return renames[reg]
+	}
+	for _, i := range ProgramInstructions(normalized) {
+		dst, src := registerOperands(i)
+		if dst {
+			i.DstReg = rename(i.DstReg)
+		}
+		if src {
+			i.SrcReg = rename(i.SrcReg)
+		}
+	}
+	return normalized
+}
+
+// AddToCorpus adds `program` to the corpus in `dir` named after its
+// ContentHash, so adding the same program twice keeps a single entry. The
+// name of the entry is returned.
+func AddToCorpus(dir string, program *pb.Program) (string, error) {
+	hash, err := ContentHash(program)
+	if err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(hash[:])
+	return name, WriteCorpusEntry(dir, name, program)
+}
+
+func readGolden(path string) ([]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	golden := []uint64{}
+	for lineNumber, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		slot, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber+1, err)
+		}
+		golden = append(golden, slot)
+	}
+	return golden, nil
+}
+
+// checkCorpusEntry regenerates the bytecode of the program stored in
+// `programPath` and compares it against its golden file.
+func checkCorpusEntry(programPath string) error {
+	data, err := os.ReadFile(programPath)
+	if err != nil {
+		return err
+	}
+	program := &pb.Program{}
+	if err := jsonpb.UnmarshalString(string(data), program); err != nil {
+		return fmt.Errorf("%s: %v", programPath, err)
+	}
+
+	bytecode, err := GenerateBytecode(program)
+	if err != nil {
+		return fmt.Errorf("%s: %v", programPath, err)
+	}
+
+	goldenPath := strings.TrimSuffix(programPath, corpusProgramExtension) + corpusGoldenExtension
+	golden, err := readGolden(goldenPath)
+	if err != nil {
+		return err
+	}
+
+	if len(bytecode) != len(golden) {
+		return fmt.Errorf("%s: bytecode has %d slots, golden has %d", programPath, len(bytecode), len(golden))
+	}
+	for slot := range golden {
+		if bytecode[slot] != golden[slot] {
+			return fmt.Errorf("%s: slot %d encodes to %#016x, golden is %#016x", programPath, slot, bytecode[slot], golden[slot])
+		}
+	}
+	return nil
+}
+
+// CorpusCheck verifies that every program of the corpus in `dir` still
+// encodes to its golden bytecode, the returned error lists every entry that
+// drifted.
+func CorpusCheck(dir string) error {
+	programs, err := filepath.Glob(filepath.Join(dir, "*"+corpusProgramExtension))
+	if err != nil {
+		return err
+	}
+	if len(programs) == 0 {
+		return fmt.Errorf("no programs found in corpus %q", dir)
+	}
+
+	var errs []error
+	for _, programPath := range programs {
+		errs = append(errs, checkCorpusEntry(programPath))
+	}
+	return errors.Join(errs...)
+}
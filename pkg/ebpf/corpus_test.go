@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestCorpusCheck(t *testing.T) {
+	dir := t.TempDir()
+	program := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{
+				LdMapByFd(R1, 3),
+				Mov64(R0, 1),
+				JmpGT(R0, 0, 1),
+				Add64(R0, R1),
+				Exit(),
+			}},
+		},
+	}
+	if err := WriteCorpusEntry(dir, "simple", program); err != nil {
+		t.Fatalf("WriteCorpusEntry() unexpected error: %v", err)
+	}
+
+	if err := CorpusCheck(dir); err != nil {
+		t.Fatalf("CorpusCheck() = %v, want nil", err)
+	}
+
+	// Tamper with the immediate of the Mov64.
+	goldenPath := filepath.Join(dir, "simple.golden")
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("could not read golden: %v", err)
+	}
+	tampered := strings.Replace(string(golden), "0x00000001000000b7", "0x00000002000000b7", 1)
+	if tampered == string(golden) {
+		t.Fatalf("golden %q does not contain the expected Mov64 encoding", golden)
+	}
+	if err := os.WriteFile(goldenPath, []byte(tampered), 0644); err != nil {
+		t.Fatalf("could not write golden: %v", err)
+	}
+
+	err = CorpusCheck(dir)
+	if err == nil {
+		t.Fatalf("CorpusCheck() with a tampered golden = nil, want error")
+	}
+	if !strings.Contains(err.Error(), "slot 2") {
+		t.Errorf("CorpusCheck() = %v, want it to report slot 2", err)
+	}
+}
+
+func TestCorpusCheckEmptyDir(t *testing.T) {
+	if err := CorpusCheck(t.TempDir()); err == nil {
+		t.Errorf("CorpusCheck() of an empty directory = nil, want error")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	program := func(imm int32) *pb.Program {
+		return &pb.Program{
+			Functions: []*pb.Functions{
+				{Instructions: []*pb.Instruction{Mov64(R0, imm), Exit()}},
+			},
+			License: "GPL",
+		}
+	}
+	hash := func(p *pb.Program) [32]byte {
+		t.Helper()
+		h, err := ContentHash(p)
+		if err != nil {
+			t.Fatalf("ContentHash() error = %v", err)
+		}
+		return h
+	}
+
+	if hash(program(1)) != hash(program(1)) {
+		t.Errorf("ContentHash() of identical programs differ")
+	}
+	if hash(program(1)) == hash(program(2)) {
+		t.Errorf("ContentHash() of programs differing in one immediate are equal")
+	}
+	stamped, forked := program(1), program(1)
+	StampInstructionIds(stamped.Functions[0].Instructions)
+	forked.Functions[0].Instructions[0].Id = 7
+	forked.Functions[0].Instructions[1].Id = 3
+	if hash(stamped) != hash(forked) {
+		t.Errorf("ContentHash() of programs differing only in their instruction ids differ")
+	}
+	if stamped.Functions[0].Instructions[0].Id == 0 {
+		t.Errorf("ContentHash() cleared the ids of its argument")
+	}
+	gpl, bsd := program(1), program(1)
+	bsd.License = "BSD"
+	if hash(gpl) == hash(bsd) {
+		t.Errorf("ContentHash() of programs differing in the license are equal")
+	}
+
+	dir := t.TempDir()
+	first, err := AddToCorpus(dir, program(1))
+	if err != nil {
+		t.Fatalf("AddToCorpus() error = %v", err)
+	}
+	second, err := AddToCorpus(dir, program(1))
+	if err != nil {
+		t.Fatalf("AddToCorpus() error = %v", err)
+	}
+	if first != second {
+		t.Errorf("AddToCorpus() of identical programs = %q and %q, want the same entry", first, second)
+	}
+	if err := CorpusCheck(dir); err != nil {
+		t.Errorf("CorpusCheck() = %v, want nil", err)
+	}
+}
+
+func TestNormalizeRegisters(t *testing.T) {
+	program := func(a, b pb.Reg) *pb.Program {
+		return &pb.Program{
+			Functions: []*pb.Functions{
+				{Instructions: []*pb.Instruction{
+					LdW(a, R1, 0),
+					Mov64(b, a),
+					LdMapByFd(b, 6),
+					Add64(a, 1),
+					JmpGT(a, b, 1),
+					StDW(R10, a, -8),
+					Mov64(R0, 0),
+					Exit(),
+				}},
+			},
+		}
+	}
+	hash := func(p *pb.Program) [32]byte {
+		t.Helper()
+		h, err := ContentHash(p)
+		if err != nil {
+			t.Fatalf("ContentHash() error = %v", err)
+		}
+		return h
+	}
+
+	canonical, swapped := program(R6, R7), program(R9, R6)
+	if hash(canonical) == hash(swapped) {
+		t.Fatalf("ContentHash() of programs using different registers are equal")
+	}
+	normalized := NormalizeRegisters(swapped)
+	if hash(normalized) != hash(NormalizeRegisters(canonical)) {
+		t.Errorf("NormalizeRegisters() = %v, want %v", normalized, canonical)
+	}
+	if hash(normalized) != hash(canonical) {
+		t.Errorf("NormalizeRegisters() = %v, want the registers renamed to R6 and R7 in order of first use", normalized)
+	}
+	if swapped.Functions[0].Instructions[0].DstReg != R9 {
+		t.Errorf("NormalizeRegisters() modified its input")
+	}
+
+	// The context, the frame pointer and the pseudo src of the map load
+	// (1, BPF_PSEUDO_MAP_FD) are not registers to rename.
+	instructions := normalized.Functions[0].Instructions
+	if instructions[0].SrcReg != R1 || instructions[5].DstReg != R10 || instructions[2].SrcReg != 1 {
+		t.Errorf("NormalizeRegisters() renamed fixed operands: %v", instructions)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"sort"
+)
+
+// reachingDefs holds, for every register, the indices of the instructions
+// whose write to it may still be its value.
+type reachingDefs [R10 + 1]map[int]bool
+
+func newReachingDefs() *reachingDefs {
+	defs := &reachingDefs{}
+	for reg := range defs {
+		defs[reg] = map[int]bool{}
+	}
+	return defs
+}
+
+func (d *reachingDefs) size() int {
+	size := 0
+	for _, defs := range d {
+		size += len(defs)
+	}
+	return size
+}
+
+// DefUse returns the def-use edges of `instructions`: every instruction that
+// reads a register is mapped to the sorted indices of the instructions whose
+// write to that register can reach it on some path. Registers initialized on
+// entry (R1 and R10) have no defining instruction.
+//
+// The analysis is conservative: helper calls are considered to read all of
+// R1 to R5 and, like Validate, to clobber them without defining them. LdAbs
+// and LdInd clobber them too.
+func DefUse(instructions []*pb.Instruction) (map[int][]int, error) {
+	cfg, err := NewControlFlowGraph(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	uses := map[int]map[int]bool{}
+	transfer := func(block *BasicBlock, in *reachingDefs, record bool) *reachingDefs {
+		current := newReachingDefs()
+		for reg := range in {
+			for def := range in[reg] {
+				current[reg][def] = true
+			}
+		}
+		for index := block.Start; index <= block.End; index++ {
+			reads, writes := instructionRegisters(instructions[index])
+			if isCall(instructions[index]) {
+				reads = append(reads, R1, R2, R3, R4, R5)
+			}
+			for _, reg := range reads {
+				if !record || len(current[reg]) == 0 {
+					continue
+				}
+				if uses[index] == nil {
+					uses[index] = map[int]bool{}
+				}
+				for def := range current[reg] {
+					uses[index][def] = true
+				}
+			}
+			if isCall(instructions[index]) || isLegacyPacketLoad(instructions[index]) {
+				for reg := R1; reg <= R5; reg++ {
+					current[reg] = map[int]bool{}
+				}
+			}
+			for _, reg := range writes {
+				current[reg] = map[int]bool{index: true}
+			}
+		}
+		return current
+	}
+
+	// Definitions only accumulate, so the sizes of the sets tell when
+	// nothing changes anymore.
+	in := make([]*reachingDefs, len(cfg.Blocks))
+	out := make([]*reachingDefs, len(cfg.Blocks))
+	for blockIndex := range cfg.Blocks {
+		in[blockIndex], out[blockIndex] = newReachingDefs(), newReachingDefs()
+	}
+	for changed := true; changed; {
+		changed = false
+		for blockIndex, block := range cfg.Blocks {
+			for _, predecessor := range block.Predecessors {
+				for reg := range out[predecessor] {
+					for def := range out[predecessor][reg] {
+						in[blockIndex][reg][def] = true
+					}
+				}
+			}
+			blockOut := transfer(block, in[blockIndex], false)
+			if blockOut.size() != out[blockIndex].size() {
+				changed = true
+			}
+			out[blockIndex] = blockOut
+		}
+	}
+
+	for blockIndex, block := range cfg.Blocks {
+		transfer(block, in[blockIndex], true)
+	}
+	edges := make(map[int][]int, len(uses))
+	for use, defs := range uses {
+		for def := range defs {
+			edges[use] = append(edges[use], def)
+		}
+		sort.Ints(edges[use])
+	}
+	return edges, nil
+}
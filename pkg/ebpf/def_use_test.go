@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"reflect"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestDefUse(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         map[int][]int
+	}{
+		{
+			name: "straight line",
+			instructions: []*pb.Instruction{
+				Mov64(R0, 1),  // 0
+				Mov64(R2, 2),  // 1
+				Add64(R0, R2), // 2
+				Mov64(R2, R1), // 3, R1 is initialized on entry
+				Mul64(R0, R2), // 4
+				Exit(),        // 5
+			},
+			want: map[int][]int{
+				2: {0, 1},
+				4: {2, 3},
+				5: {4},
+			},
+		},
+		{
+			name: "both arms of a branch reach the join",
+			instructions: []*pb.Instruction{
+				Mov64(R0, 0),    // 0
+				JmpEQ(R1, 0, 2), // 1
+				Mov64(R0, 1),    // 2
+				Jmp(1),          // 3
+				Mov64(R0, 2),    // 4
+				Exit(),          // 5
+			},
+			want: map[int][]int{
+				5: {2, 4},
+			},
+		},
+		{
+			name: "loop carried definition",
+			instructions: []*pb.Instruction{
+				Mov64(R0, 0),      // 0
+				Add64(R0, 1),      // 1
+				JmpLT(R0, 10, -2), // 2
+				Exit(),            // 3
+			},
+			want: map[int][]int{
+				1: {0, 1},
+				2: {1},
+				3: {1},
+			},
+		},
+		{
+			name: "calls read their arguments and clobber them",
+			instructions: []*pb.Instruction{
+				Mov64(R1, 1),  // 0
+				Mov64(R2, 2),  // 1
+				Call(MapPop),  // 2
+				Mov64(R3, R1), // 3
+				Exit(),        // 4
+			},
+			want: map[int][]int{
+				2: {0, 1},
+				4: {2},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DefUse(tc.instructions)
+			if err != nil {
+				t.Fatalf("DefUse() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("DefUse() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
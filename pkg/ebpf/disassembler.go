@@ -0,0 +1,289 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"strings"
+)
+
+var aluOperators = map[pb.AluOperationCode]string{
+	pb.AluOperationCode_AluAdd:  "+=",
+	pb.AluOperationCode_AluSub:  "-=",
+	pb.AluOperationCode_AluMul:  "*=",
+	pb.AluOperationCode_AluDiv:  "/=",
+	pb.AluOperationCode_AluOr:   "|=",
+	pb.AluOperationCode_AluAnd:  "&=",
+	pb.AluOperationCode_AluLsh:  "<<=",
+	pb.AluOperationCode_AluRsh:  ">>=",
+	pb.AluOperationCode_AluMod:  "%=",
+	pb.AluOperationCode_AluXor:  "^=",
+	pb.AluOperationCode_AluMov:  "=",
+	pb.AluOperationCode_AluArsh: "s>>=",
+}
+
+var jmpOperators = map[pb.JmpOperationCode]string{
+	pb.JmpOperationCode_JmpJEQ:  "==",
+	pb.JmpOperationCode_JmpJGT:  ">",
+	pb.JmpOperationCode_JmpJGE:  ">=",
+	pb.JmpOperationCode_JmpJSET: "&",
+	pb.JmpOperationCode_JmpJNE:  "!=",
+	pb.JmpOperationCode_JmpJSGT: "s>",
+	pb.JmpOperationCode_JmpJSGE: "s>=",
+	pb.JmpOperationCode_JmpJLT:  "<",
+	pb.JmpOperationCode_JmpJLE:  "<=",
+	pb.JmpOperationCode_JmpJSLT: "s<",
+	pb.JmpOperationCode_JmpJSLE: "s<=",
+}
+
+var sizeNames = map[pb.StLdSize]string{
+	pb.StLdSize_StLdSizeB:  "u8",
+	pb.StLdSize_StLdSizeH:  "u16",
+	pb.StLdSize_StLdSizeW:  "u32",
+	pb.StLdSize_StLdSizeDW: "u64",
+}
+
+var aluOpNames = map[pb.AluOperationCode]string{
+	pb.AluOperationCode_AluAdd:  "add",
+	pb.AluOperationCode_AluSub:  "sub",
+	pb.AluOperationCode_AluMul:  "mul",
+	pb.AluOperationCode_AluDiv:  "div",
+	pb.AluOperationCode_AluOr:   "or",
+	pb.AluOperationCode_AluAnd:  "and",
+	pb.AluOperationCode_AluLsh:  "lsh",
+	pb.AluOperationCode_AluRsh:  "rsh",
+	pb.AluOperationCode_AluNeg:  "neg",
+	pb.AluOperationCode_AluMod:  "mod",
+	pb.AluOperationCode_AluXor:  "xor",
+	pb.AluOperationCode_AluMov:  "mov",
+	pb.AluOperationCode_AluArsh: "arsh",
+	pb.AluOperationCode_AluEnd:  "end",
+}
+
+var jmpOpNames = map[pb.JmpOperationCode]string{
+	pb.JmpOperationCode_JmpJA:   "ja",
+	pb.JmpOperationCode_JmpJEQ:  "jeq",
+	pb.JmpOperationCode_JmpJGT:  "jgt",
+	pb.JmpOperationCode_JmpJGE:  "jge",
+	pb.JmpOperationCode_JmpJSET: "jset",
+	pb.JmpOperationCode_JmpJNE:  "jne",
+	pb.JmpOperationCode_JmpJSGT: "jsgt",
+	pb.JmpOperationCode_JmpJSGE: "jsge",
+	pb.JmpOperationCode_JmpCALL: "call",
+	pb.JmpOperationCode_JmpExit: "exit",
+	pb.JmpOperationCode_JmpJLT:  "jlt",
+	pb.JmpOperationCode_JmpJLE:  "jle",
+	pb.JmpOperationCode_JmpJSLT: "jslt",
+	pb.JmpOperationCode_JmpJSLE: "jsle",
+}
+
+var classNames = map[pb.InsClass]string{
+	pb.InsClass_InsClassLd:    "ld",
+	pb.InsClass_InsClassLdx:   "ldx",
+	pb.InsClass_InsClassSt:    "st",
+	pb.InsClass_InsClassStx:   "stx",
+	pb.InsClass_InsClassAlu:   "alu",
+	pb.InsClass_InsClassJmp:   "jmp",
+	pb.InsClass_InsClassJmp32: "jmp32",
+	pb.InsClass_InsClassAlu64: "alu64",
+}
+
+// OpName returns the name of the alu operation `op`, the upper 4 bits of an
+// alu opcode, e.g. "mov" for 0xb0.
+func OpName(op uint8) string {
+	if name, ok := aluOpNames[pb.AluOperationCode(op)]; ok {
+		return name
+	}
+	return unknownName(op)
+}
+
+// JmpOpName returns the name of the jmp operation `op`, the upper 4 bits of a
+// jmp opcode, e.g. "jgt" for 0x20.
+func JmpOpName(op uint8) string {
+	if name, ok := jmpOpNames[pb.JmpOperationCode(op)]; ok {
+		return name
+	}
+	return unknownName(op)
+}
+
+// ClassName returns the name of the instruction class `class`, the lower 3
+// bits of an opcode as returned by InstructionClass, e.g. "alu64" for 0x07.
+func ClassName(class uint8) string {
+	if name, ok := classNames[pb.InsClass(class)]; ok {
+		return name
+	}
+	return unknownName(class)
+}
+
+func unknownName(value uint8) string {
+	return fmt.Sprintf("unknown(0x%02x)", value)
+}
+
+// regName returns the name of register `r` as used by 64 bit (r) or 32 bit
+// (w) operations.
+func regName(r pb.Reg, is64 bool) string {
+	if is64 {
+		return fmt.Sprintf("r%d", r)
+	}
+	return fmt.Sprintf("w%d", r)
+}
+
+// InstructionString renders `i` using the same syntax as the kernel verifier
+// log, e.g. "r1 += 0x5" or "if w2 > w3 goto +4".
+func InstructionString(i *pb.Instruction) string {
+	switch c := i.Opcode.(type) {
+	case *pb.Instruction_AluOpcode:
+		return aluString(i, c.AluOpcode)
+	case *pb.Instruction_JmpOpcode:
+		return jmpString(i, c.JmpOpcode)
+	case *pb.Instruction_MemOpcode:
+		return memString(i, c.MemOpcode)
+	default:
+		return "unknown instruction"
+	}
+}
+
+// ProgramString renders `instructions` one per line, prefixed by the slot
+// each one starts at like the verifier log does. Wide instructions take a
+// single line even though they use two slots. Instruction ids, if any, are
+// added as a comment.
+func ProgramString(instructions []*pb.Instruction) string {
+	var out strings.Builder
+	Walk(instructions, func(slot int, i *pb.Instruction) error {
+		out.WriteString(programLine(slot, i, InstructionString(i)))
+		return nil
+	})
+	return out.String()
+}
+
+// ToAsmString renders every function of `program` like ProgramString, with
+// slots counted from the start of the program and the slot each branch lands
+// on added after it, e.g. "if r1 > 0x5 goto +3 <12>".
+func ToAsmString(program *pb.Program) string {
+	var out strings.Builder
+	start := 0
+	for _, function := range program.Functions {
+		Walk(function.Instructions, func(slot int, i *pb.Instruction) error {
+			text := InstructionString(i)
+			if isBranch(i) {
+				text += fmt.Sprintf(" <%d>", start+slot+1+branchOffset(i))
+			}
+			out.WriteString(programLine(start+slot, i, text))
+			return nil
+		})
+		start += ProgramSize(function.Instructions)
+	}
+	return out.String()
+}
+
+// programLine returns the line for instruction `i` at `slot` rendered as
+// `text`, followed by the id of the instruction if it has one.
+func programLine(slot int, i *pb.Instruction, text string) string {
+	if i.Id != 0 {
+		return fmt.Sprintf("%d: %s ; id %d\n", slot, text, i.Id)
+	}
+	return fmt.Sprintf("%d: %s\n", slot, text)
+}
+
+func aluString(i *pb.Instruction, op *pb.AluOpcode) string {
+	is64 := op.InstructionClass == pb.InsClass_InsClassAlu64
+	dst := regName(i.DstReg, is64)
+	src := fmt.Sprintf("%#x", uint32(i.Immediate))
+	if op.Source == pb.SrcOperand_RegSrc {
+		src = regName(i.SrcReg, is64)
+	}
+
+	switch op.OperationCode {
+	case pb.AluOperationCode_AluNeg:
+		return fmt.Sprintf("%s = -%s", dst, dst)
+	case pb.AluOperationCode_AluEnd:
+		endianness := "le"
+		if op.Source == pb.SrcOperand_RegSrc {
+			endianness = "be"
+		}
+		return fmt.Sprintf("%s = %s%d %s", dst, endianness, i.Immediate, dst)
+	}
+
+	operator, ok := aluOperators[op.OperationCode]
+	if !ok {
+		return fmt.Sprintf("unknown alu operation %#x", uint8(op.OperationCode))
+	}
+	return fmt.Sprintf("%s %s %s", dst, operator, src)
+}
+
+func jmpString(i *pb.Instruction, op *pb.JmpOpcode) string {
+	switch op.OperationCode {
+	case pb.JmpOperationCode_JmpJA:
+		return fmt.Sprintf("goto %+d", branchOffset(i))
+	case pb.JmpOperationCode_JmpCALL:
+		if i.SrcReg == PseudoKfuncCall {
+			return fmt.Sprintf("call kfunc:%d", i.Immediate)
+		}
+		return fmt.Sprintf("call %d", i.Immediate)
+	case pb.JmpOperationCode_JmpExit:
+		return "exit"
+	}
+
+	is64 := op.InstructionClass == pb.InsClass_InsClassJmp
+	dst := regName(i.DstReg, is64)
+	src := fmt.Sprintf("%#x", uint32(i.Immediate))
+	if op.Source == pb.SrcOperand_RegSrc {
+		src = regName(i.SrcReg, is64)
+	}
+
+	operator, ok := jmpOperators[op.OperationCode]
+	if !ok {
+		return fmt.Sprintf("unknown jmp operation %#x", uint8(op.OperationCode))
+	}
+	return fmt.Sprintf("if %s %s %s goto %+d", dst, operator, src, i.Offset)
+}
+
+func memString(i *pb.Instruction, op *pb.MemOpcode) string {
+	size := sizeNames[op.Size]
+	switch op.Mode {
+	case pb.StLdMode_StLdModeIMM:
+		if p, ok := i.PseudoInstruction.(*pb.Instruction_PseudoValue); ok {
+			if i.SrcReg == PseudoMapFD {
+				return fmt.Sprintf("r%d = map[fd:%d]", i.DstReg, i.Immediate)
+			}
+			imm := uint64(uint32(i.Immediate)) | uint64(p.PseudoValue.Immediate)<<32
+			return fmt.Sprintf("r%d = %#x ll", i.DstReg, imm)
+		}
+	case pb.StLdMode_StLdModeMEM:
+		switch op.InstructionClass {
+		case pb.InsClass_InsClassLdx:
+			return fmt.Sprintf("r%d = *(%s *)(r%d %+d)", i.DstReg, size, i.SrcReg, i.Offset)
+		case pb.InsClass_InsClassSt:
+			return fmt.Sprintf("*(%s *)(r%d %+d) = %#x", size, i.DstReg, i.Offset, uint32(i.Immediate))
+		case pb.InsClass_InsClassStx:
+			return fmt.Sprintf("*(%s *)(r%d %+d) = r%d", size, i.DstReg, i.Offset, i.SrcReg)
+		}
+	case pb.StLdMode_StLdModeABS:
+		if op.InstructionClass == pb.InsClass_InsClassLd {
+			return fmt.Sprintf("r0 = *(%s *)skb[%d]", size, i.Immediate)
+		}
+	case pb.StLdMode_StLdModeIND:
+		if op.InstructionClass == pb.InsClass_InsClassLd {
+			return fmt.Sprintf("r0 = *(%s *)skb[r%d + %d]", size, i.SrcReg, i.Immediate)
+		}
+	case pb.StLdMode_StLdModeATOMIC:
+		operator, ok := aluOperators[pb.AluOperationCode(i.Immediate)]
+		if ok && op.InstructionClass == pb.InsClass_InsClassStx {
+			return fmt.Sprintf("lock *(%s *)(r%d %+d) %s r%d", size, i.DstReg, i.Offset, operator, i.SrcReg)
+		}
+	}
+	return fmt.Sprintf("unknown memory operation %#x", InstructionOpcode(i))
+}
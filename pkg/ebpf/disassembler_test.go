@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"strings"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestInstructionString(t *testing.T) {
+	tests := []struct {
+		instruction *pb.Instruction
+		want        string
+	}{
+		{Add64(R1, 5), "r1 += 0x5"},
+		{Sub(R2, R3), "w2 -= w3"},
+		{Mov64(R0, R10), "r0 = r10"},
+		{Arsh64(R4, 3), "r4 s>>= 0x3"},
+		{Neg64(R5, 0), "r5 = -r5"},
+		{JmpGT(R1, R2, 3), "if r1 > r2 goto +3"},
+		{JmpSLE32(R1, -1, -2), "if w1 s<= 0xffffffff goto -2"},
+		{Jmp(4), "goto +4"},
+		{Call(MapLookup), "call 1"},
+		{KfuncCall(1234, 0), "call kfunc:1234"},
+		{Exit(), "exit"},
+		{LdDW(R1, R10, -8), "r1 = *(u64 *)(r10 -8)"},
+		{StW(R10, 7, -4), "*(u32 *)(r10 -4) = 0x7"},
+		{LdAbs(pb.StLdSize_StLdSizeW, 14), "r0 = *(u32 *)skb[14]"},
+		{LdAbs(pb.StLdSize_StLdSizeH, 12), "r0 = *(u16 *)skb[12]"},
+		{LdInd(pb.StLdSize_StLdSizeB, R7, 2), "r0 = *(u8 *)skb[r7 + 2]"},
+		{StB(R1, R2, 0), "*(u8 *)(r1 +0) = r2"},
+		{MemAdd64(R1, R2, 8), "lock *(u64 *)(r1 +8) += r2"},
+		{LdMapByFd(R1, 3), "r1 = map[fd:3]"},
+		{LdImm64(R1, 0x1122334455667788), "r1 = 0x1122334455667788 ll"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.want, func(t *testing.T) {
+			if got := InstructionString(tc.instruction); got != tc.want {
+				t.Errorf("InstructionString() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProgramStringWideInstruction(t *testing.T) {
+	prog, err := InstructionSequence(
+		LdImm64(R1, 0xdeadbeefcafe),
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	want := "0: r1 = 0xdeadbeefcafe ll\n2: r0 = 0x0\n3: exit\n"
+	if got := ProgramString(prog); got != want {
+		t.Errorf("ProgramString() = %q, want %q", got, want)
+	}
+}
+
+func TestToAsmString(t *testing.T) {
+	// Both arms of the first branch join at slot 7, the wide load moves every
+	// slot after it by one.
+	main, err := InstructionSequence(
+		LdImm64(R1, 0x100000000),
+		JmpGT(R1, 5, 3),
+		Mov64(R0, 1),
+		Add64(R0, 2),
+		Jmp(1),
+		Mov64(R0, 3),
+		JmpEQ(R0, 0, -4),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+	callback := []*pb.Instruction{Mov64(R0, 0), Exit()}
+	prog := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: main},
+			{Instructions: callback},
+		},
+	}
+
+	want := `0: r1 = 0x100000000 ll
+2: if r1 > 0x5 goto +3 <6>
+3: r0 = 0x1
+4: r0 += 0x2
+5: goto +1 <7>
+6: r0 = 0x3
+7: if r0 == 0x0 goto -4 <4>
+8: exit
+9: r0 = 0x0
+10: exit
+`
+	if got := ToAsmString(prog); got != want {
+		t.Errorf("ToAsmString() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOpNames(t *testing.T) {
+	// Every name is the lower case proto name without its prefix.
+	for value, protoName := range pb.AluOperationCode_name {
+		want := strings.ToLower(strings.TrimPrefix(protoName, "Alu"))
+		if got := OpName(uint8(value)); got != want {
+			t.Errorf("OpName(%#x) = %q, want %q", value, got, want)
+		}
+	}
+	for value, protoName := range pb.JmpOperationCode_name {
+		want := strings.ToLower(strings.TrimPrefix(protoName, "Jmp"))
+		if got := JmpOpName(uint8(value)); got != want {
+			t.Errorf("JmpOpName(%#x) = %q, want %q", value, got, want)
+		}
+	}
+	for value, protoName := range pb.InsClass_name {
+		want := strings.ToLower(strings.TrimPrefix(protoName, "InsClass"))
+		if got := ClassName(uint8(value)); got != want {
+			t.Errorf("ClassName(%#x) = %q, want %q", value, got, want)
+		}
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"OpName", OpName(0xe0), "unknown(0xe0)"},
+		{"JmpOpName", JmpOpName(0xf0), "unknown(0xf0)"},
+		{"ClassName", ClassName(0x08), "unknown(0x08)"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s() = %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
@@ -19,11 +19,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 var (
 	UnknownOperationCodeType = fmt.Errorf("Unknown operation error type")
 	UnknownOpcodeType        = fmt.Errorf("Unknown opcode type")
+	OffsetOutOfRange         = fmt.Errorf("Offset does not fit in 16 bits")
+	MalformedInstruction     = fmt.Errorf("Malformed instruction")
 )
 
 type Src interface {
@@ -63,17 +66,22 @@ func encodeMemOpcode(op *pb.MemOpcode) (uint8, error) {
 // EncodeInstructions transforms the given array of functions with instructions
 // and function info to ebpf bytecode and func_info bytecode, respectively.
 func EncodeInstructions(program *pb.Program) ([]byte, []byte, error) {
+	if err := checkFunctions(program); err != nil {
+		return nil, nil, err
+	}
 	prog_buff := new(bytes.Buffer)
 	func_buff := new(bytes.Buffer)
 
 	// The first function info must be with offset 0 and type_id to a function
+	index := 0
 	for _, functions := range program.Functions {
 		var err error
 		for _, instruction := range functions.Instructions {
 			encoding, err := encodeInstruction(instruction)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, fmt.Errorf("instruction %d: %w", index, err)
 			}
+			index++
 			err = binary.Write(prog_buff, binary.LittleEndian, encoding)
 			if err != nil {
 				fmt.Println("binary.Write failed:", err)
@@ -100,38 +108,155 @@ func EncodeInstructions(program *pb.Program) ([]byte, []byte, error) {
 	return prog_buff.Bytes(), func_buff.Bytes(), nil
 }
 
-// To understand what each part of the encoding mean, please refer to
-// http://shortn/_mFOBeQLg2s.
-func encodeInstruction(i *pb.Instruction) ([]uint64, error) {
-	encoding := uint64(0)
+// EncodeLineInfo returns the bpf_line_info records of every function of
+// `program`, in order, or nil if there are none.
+func EncodeLineInfo(program *pb.Program) ([]byte, error) {
+	if err := checkFunctions(program); err != nil {
+		return nil, err
+	}
+	var buff bytes.Buffer
+	for _, functions := range program.Functions {
+		for _, info := range functions.LineInfo {
+			record := []int32{info.InsnOff, info.FileNameOff, info.LineOff, info.LineCol}
+			if err := binary.Write(&buff, binary.LittleEndian, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if buff.Len() == 0 {
+		return nil, nil
+	}
+	return buff.Bytes(), nil
+}
 
-	opcode := uint8(0)
-	var err error
+// GenerateBytecode returns the bytecode of all the functions of `program`
+// as one 64 bit value per instruction slot, wide instructions take two.
+func GenerateBytecode(program *pb.Program) ([]uint64, error) {
+	return AppendBytecode([]uint64{}, program)
+}
+
+// AppendBytecode appends the bytecode of `program` to `dst` and returns the
+// extended slice, growing it only if it is too small. Loops that encode many
+// programs can reuse one buffer with AppendBytecode(buf[:0], program) instead
+// of allocating a new one per program like GenerateBytecode does.
+func AppendBytecode(dst []uint64, program *pb.Program) ([]uint64, error) {
+	if err := checkFunctions(program); err != nil {
+		return nil, err
+	}
+	index := 0
+	for _, functions := range program.Functions {
+		for _, instruction := range functions.Instructions {
+			var err error
+			dst, err = appendInstruction(dst, instruction)
+			if err != nil {
+				return nil, fmt.Errorf("instruction %d: %w", index, err)
+			}
+			index++
+		}
+	}
+	return dst, nil
+}
+
+// CanonicalBytecode returns the bytecode of `program` like GenerateBytecode
+// but with the fds of LdMapByFd replaced by the order in which the maps first
+// appear (0 for the first map, 1 for the second...). Fds change from run to
+// run, the canonical bytecode of the same program built in two runs does
+// not, so it can be compared across runs where ContentHash cannot.
+func CanonicalBytecode(program *pb.Program) ([]uint64, error) {
+	if err := checkFunctions(program); err != nil {
+		return nil, err
+	}
+	maps := map[int32]uint32{}
+	dst := []uint64{}
+	index := 0
+	for _, functions := range program.Functions {
+		for _, instruction := range functions.Instructions {
+			slot := len(dst)
+			var err error
+			dst, err = appendInstruction(dst, instruction)
+			if err != nil {
+				return nil, fmt.Errorf("instruction %d: %w", index, err)
+			}
+			if isMapFdLoad(instruction) {
+				fd := instruction.Immediate
+				if _, ok := maps[fd]; !ok {
+					maps[fd] = uint32(len(maps))
+				}
+				// The immediate is the upper half of the first slot.
+				dst[slot] = dst[slot]&0xffffffff | uint64(maps[fd])<<32
+			}
+			index++
+		}
+	}
+	return dst, nil
+}
+
+// checkFunctions returns an error if `program` or any of its functions is
+// nil, the instructions themselves are checked as they are encoded.
+func checkFunctions(program *pb.Program) error {
+	if program == nil {
+		return fmt.Errorf("%w: nil program", MalformedInstruction)
+	}
+	for index, functions := range program.Functions {
+		if functions == nil {
+			return fmt.Errorf("%w: nil function %d", MalformedInstruction, index)
+		}
+	}
+	return nil
+}
 
+// encodeOpcode returns the 8 bit opcode of the given instruction.
+func encodeOpcode(i *pb.Instruction) (uint8, error) {
+	if i == nil {
+		return 0, fmt.Errorf("%w: nil instruction", MalformedInstruction)
+	}
+	if i.GetAluOpcode() == nil && i.GetJmpOpcode() == nil && i.GetMemOpcode() == nil && i.Opcode != nil {
+		return 0, fmt.Errorf("%w: nil opcode", MalformedInstruction)
+	}
 	switch c := i.Opcode.(type) {
 	case *pb.Instruction_AluOpcode:
 		op := uint8(c.AluOpcode.OperationCode)
 		insClass := uint8(c.AluOpcode.InstructionClass)
 		src := uint8(c.AluOpcode.Source)
-		opcode, err = encodeAluJmpOpcode(op, insClass, src)
-		if err != nil {
-			return nil, err
-		}
+		return encodeAluJmpOpcode(op, insClass, src)
 	case *pb.Instruction_JmpOpcode:
 		op := uint8(c.JmpOpcode.OperationCode)
 		insClass := uint8(c.JmpOpcode.InstructionClass)
 		src := uint8(c.JmpOpcode.Source)
-		opcode, err = encodeAluJmpOpcode(op, insClass, src)
-		if err != nil {
-			return nil, err
-		}
+		return encodeAluJmpOpcode(op, insClass, src)
 	case *pb.Instruction_MemOpcode:
-		opcode, err = encodeMemOpcode(c.MemOpcode)
-		if err != nil {
-			return nil, err
-		}
+		return encodeMemOpcode(c.MemOpcode)
 	default:
-		return nil, UnknownOpcodeType
+		return 0, UnknownOpcodeType
+	}
+}
+
+func encodeInstruction(i *pb.Instruction) ([]uint64, error) {
+	encoding, err := appendInstruction(make([]uint64, 0, 2), i)
+	if err != nil {
+		return nil, err
+	}
+	return encoding, nil
+}
+
+// To understand what each part of the encoding mean, please refer to
+// http://shortn/_mFOBeQLg2s.
+//
+// Every field is encoded as is: constructors set the fields an instruction
+// does not use to UnusedField, which encodes to 0, and RawInstruction relies
+// on nothing being rewritten here.
+func appendInstruction(dst []uint64, i *pb.Instruction) ([]uint64, error) {
+	encoding := uint64(0)
+
+	opcode, err := encodeOpcode(i)
+	if err != nil {
+		return dst, err
+	}
+
+	// The proto keeps offsets as int32, anything wider than 16 bits would be
+	// silently truncated (e.g. a jmp over more than 32767 slots).
+	if i.Offset < math.MinInt16 || i.Offset > math.MaxInt16 {
+		return dst, fmt.Errorf("%w: %d", OffsetOutOfRange, i.Offset)
 	}
 
 	// The first 8 bits are the opcode.
@@ -150,18 +275,66 @@ func encodeInstruction(i *pb.Instruction) ([]uint64, error) {
 
 	encoding |= (uint64(i.Immediate) << 32)
 
-	result := []uint64{encoding}
+	dst = append(dst, encoding)
 	switch p := i.PseudoInstruction.(type) {
 	// For instructions requiring wide encoding, like 64-bit immediates, we
 	// use PseudoValue
 	case *pb.Instruction_PseudoValue:
-		resultPseudoValue, err := encodeInstruction(p.PseudoValue)
-		if err != nil {
-			return nil, err
+		if p.PseudoValue == nil {
+			return dst, fmt.Errorf("%w: nil pseudo value", MalformedInstruction)
+		}
+		// The second slot is a plain instruction, a pseudo value of its own
+		// would make the instruction take more slots or, if it points back
+		// to `i`, recurse forever.
+		if p.PseudoValue == i {
+			return dst, fmt.Errorf("%w: pseudo value refers back to its own instruction", MalformedInstruction)
 		}
-		result = append(result, resultPseudoValue[0])
+		if _, wide := p.PseudoValue.PseudoInstruction.(*pb.Instruction_PseudoValue); wide {
+			return dst, fmt.Errorf("%w: nested pseudo value", MalformedInstruction)
+		}
+		return appendInstruction(dst, p.PseudoValue)
 	}
-	return result, nil
+	return dst, nil
+}
+
+// The following accessors expose the fields of an instruction as they end up
+// in the bytecode, without having to encode it. Fields that do not apply to
+// an instruction are reported as 0.
+
+// InstructionOpcode returns the 8 bit opcode of `i`, or 0 if `i` has no
+// recognized opcode.
+func InstructionOpcode(i *pb.Instruction) uint8 {
+	opcode, err := encodeOpcode(i)
+	if err != nil {
+		return 0
+	}
+	return opcode
+}
+
+// InstructionClass returns the 3 bit instruction class of `i`.
+func InstructionClass(i *pb.Instruction) uint8 {
+	return InstructionOpcode(i) & 0x07
+}
+
+// InstructionDst returns the destination register number of `i`.
+func InstructionDst(i *pb.Instruction) uint8 {
+	return uint8(i.GetDstReg()) & 0x0F
+}
+
+// InstructionSrc returns the source register number of `i`.
+func InstructionSrc(i *pb.Instruction) uint8 {
+	return uint8(i.GetSrcReg()) & 0x0F
+}
+
+// InstructionImm returns the immediate of `i`. For wide instructions this is
+// only the lower 32 bits, the rest lives in the pseudo instruction.
+func InstructionImm(i *pb.Instruction) int32 {
+	return i.GetImmediate()
+}
+
+// InstructionOffset returns the offset of `i`.
+func InstructionOffset(i *pb.Instruction) int16 {
+	return int16(i.GetOffset())
 }
 
 // GetBpfFuncName returns the C macro name of the provided bpf helper function.
@@ -169,6 +342,32 @@ func GetBpfFuncName(funcNumber int32) string {
 	switch funcNumber {
 	case MapLookup:
 		return "BPF_FUNC_map_lookup_elem"
+	case MapUpdate:
+		return "BPF_FUNC_map_update_elem"
+	case MapDelete:
+		return "BPF_FUNC_map_delete_elem"
+	case MapPush:
+		return "BPF_FUNC_map_push_elem"
+	case MapPop:
+		return "BPF_FUNC_map_pop_elem"
+	case SpinLock:
+		return "BPF_FUNC_spin_lock"
+	case SpinUnlock:
+		return "BPF_FUNC_spin_unlock"
+	case RingbufReserve:
+		return "BPF_FUNC_ringbuf_reserve"
+	case RingbufSubmit:
+		return "BPF_FUNC_ringbuf_submit"
+	case RingbufDiscard:
+		return "BPF_FUNC_ringbuf_discard"
+	case TracePrintk:
+		return "BPF_FUNC_trace_printk"
+	case GetPrandomU32:
+		return "BPF_FUNC_get_prandom_u32"
+	case Loop:
+		return "BPF_FUNC_loop"
+	case CopyFromUser:
+		return "BPF_FUNC_copy_from_user"
 	default:
 		return "unknown"
 	}
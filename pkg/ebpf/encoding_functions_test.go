@@ -0,0 +1,331 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestInstructionAccessors(t *testing.T) {
+	tests := []struct {
+		testName    string
+		instruction *pb.Instruction
+
+		wantOpcode uint8
+		wantClass  uint8
+		wantDst    uint8
+		wantSrc    uint8
+		wantImm    int32
+		wantOffset int16
+	}{
+		{
+			testName:    "Add64 with immediate value as source",
+			instruction: Add64(R9, int32(-65535)),
+			wantOpcode:  0x07,
+			wantClass:   uint8(pb.InsClass_InsClassAlu64),
+			wantDst:     9,
+			wantSrc:     0,
+			wantImm:     -65535,
+			wantOffset:  0,
+		},
+		{
+			testName:    "StDW with register as source",
+			instruction: StDW(R10, R1, -8),
+			wantOpcode:  0x7b,
+			wantClass:   uint8(pb.InsClass_InsClassStx),
+			wantDst:     10,
+			wantSrc:     1,
+			wantImm:     0,
+			wantOffset:  -8,
+		},
+		{
+			testName:    "JmpSGT32 with register as source",
+			instruction: JmpSGT32(R3, R4, -3),
+			wantOpcode:  0x6e,
+			wantClass:   uint8(pb.InsClass_InsClassJmp32),
+			wantDst:     3,
+			wantSrc:     4,
+			wantImm:     0,
+			wantOffset:  -3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			if got := InstructionOpcode(tc.instruction); got != tc.wantOpcode {
+				t.Errorf("InstructionOpcode() = %#x, want %#x", got, tc.wantOpcode)
+			}
+			if got := InstructionClass(tc.instruction); got != tc.wantClass {
+				t.Errorf("InstructionClass() = %#x, want %#x", got, tc.wantClass)
+			}
+			if got := InstructionDst(tc.instruction); got != tc.wantDst {
+				t.Errorf("InstructionDst() = %d, want %d", got, tc.wantDst)
+			}
+			if got := InstructionSrc(tc.instruction); got != tc.wantSrc {
+				t.Errorf("InstructionSrc() = %d, want %d", got, tc.wantSrc)
+			}
+			if got := InstructionImm(tc.instruction); got != tc.wantImm {
+				t.Errorf("InstructionImm() = %d, want %d", got, tc.wantImm)
+			}
+			if got := InstructionOffset(tc.instruction); got != tc.wantOffset {
+				t.Errorf("InstructionOffset() = %d, want %d", got, tc.wantOffset)
+			}
+
+			// The accessors must agree with the generated bytecode.
+			encoding, err := encodeInstruction(tc.instruction)
+			if err != nil {
+				t.Fatalf("encodeInstruction() error = %v", err)
+			}
+			word := encoding[0]
+			if got := uint8(word); got != InstructionOpcode(tc.instruction) {
+				t.Errorf("encoded opcode = %#x, InstructionOpcode() = %#x", got, InstructionOpcode(tc.instruction))
+			}
+			if got := uint8(word>>8) & 0x0F; got != InstructionDst(tc.instruction) {
+				t.Errorf("encoded dst = %d, InstructionDst() = %d", got, InstructionDst(tc.instruction))
+			}
+			if got := uint8(word>>12) & 0x0F; got != InstructionSrc(tc.instruction) {
+				t.Errorf("encoded src = %d, InstructionSrc() = %d", got, InstructionSrc(tc.instruction))
+			}
+			if got := int16(word >> 16); got != InstructionOffset(tc.instruction) {
+				t.Errorf("encoded offset = %d, InstructionOffset() = %d", got, InstructionOffset(tc.instruction))
+			}
+			if got := int32(word >> 32); got != InstructionImm(tc.instruction) {
+				t.Errorf("encoded imm = %d, InstructionImm() = %d", got, InstructionImm(tc.instruction))
+			}
+		})
+	}
+}
+
+func TestEncodeRejectsMalformedPrograms(t *testing.T) {
+	nilPseudoValue := LdImm64(R1, 1)
+	nilPseudoValue.PseudoInstruction = &pb.Instruction_PseudoValue{}
+	selfPseudoValue := LdImm64(R1, 1)
+	selfPseudoValue.PseudoInstruction = &pb.Instruction_PseudoValue{PseudoValue: selfPseudoValue}
+	// Two instructions whose pseudo values point at each other.
+	cyclePseudoValue := LdImm64(R1, 1)
+	cyclePseudoValue.PseudoInstruction = &pb.Instruction_PseudoValue{PseudoValue: LdImm64(R2, 2)}
+	cyclePseudoValue.GetPseudoValue().PseudoInstruction = &pb.Instruction_PseudoValue{PseudoValue: cyclePseudoValue}
+
+	tests := []struct {
+		name    string
+		program *pb.Program
+	}{
+		{"nil program", nil},
+		{"nil function", &pb.Program{Functions: []*pb.Functions{nil}}},
+		{"nil instruction", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{Mov64(R0, 0), nil}}}}},
+		{"nil alu opcode", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{{Opcode: &pb.Instruction_AluOpcode{}}}}}}},
+		{"nil jmp opcode", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{{Opcode: &pb.Instruction_JmpOpcode{}}}}}}},
+		{"nil mem opcode", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{{Opcode: &pb.Instruction_MemOpcode{}}}}}}},
+		{"nil pseudo value", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{nilPseudoValue}}}}},
+		{"self referencing pseudo value", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{selfPseudoValue}}}}},
+		{"cyclic pseudo values", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{cyclePseudoValue}}}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := GenerateBytecode(tc.program); !errors.Is(err, MalformedInstruction) {
+				t.Errorf("GenerateBytecode() error = %v, want %v", err, MalformedInstruction)
+			}
+			if _, _, err := EncodeInstructions(tc.program); !errors.Is(err, MalformedInstruction) {
+				t.Errorf("EncodeInstructions() error = %v, want %v", err, MalformedInstruction)
+			}
+		})
+	}
+}
+
+func TestEncodeRejectsOutOfRangeOffsets(t *testing.T) {
+	// A jmp to an instruction 40000 slots away, as could be produced by
+	// editing the offset by hand.
+	far := JmpGT(R0, 0, 0)
+	far.Offset = 40000
+	program := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{Mov64(R0, 0), far, Exit()}},
+		},
+	}
+
+	_, _, err := EncodeInstructions(program)
+	if !errors.Is(err, OffsetOutOfRange) {
+		t.Fatalf("EncodeInstructions() error = %v, want %v", err, OffsetOutOfRange)
+	}
+	if !strings.Contains(err.Error(), "instruction 1") {
+		t.Errorf("EncodeInstructions() error = %v, want it to point at instruction 1", err)
+	}
+
+	if _, err := GenerateBytecode(program); !errors.Is(err, OffsetOutOfRange) {
+		t.Errorf("GenerateBytecode() error = %v, want %v", err, OffsetOutOfRange)
+	}
+}
+
+func TestCanonicalBytecode(t *testing.T) {
+	program := func(first, second int) *pb.Program {
+		return &pb.Program{
+			Functions: []*pb.Functions{
+				{Instructions: []*pb.Instruction{
+					LdMapByFd(R6, first),
+					LdMapByFd(R7, second),
+					LdMapByFd(R8, first),
+					LdImm64(R9, 5),
+					Mov64(R0, 0),
+					Exit(),
+				}},
+			},
+		}
+	}
+	canonical := func(p *pb.Program) []uint64 {
+		t.Helper()
+		bytecode, err := CanonicalBytecode(p)
+		if err != nil {
+			t.Fatalf("CanonicalBytecode() error = %v", err)
+		}
+		return bytecode
+	}
+
+	run1, run2 := program(3, 4), program(10, 7)
+	bytecode1, err := GenerateBytecode(run1)
+	if err != nil {
+		t.Fatalf("GenerateBytecode() error = %v", err)
+	}
+	bytecode2, err := GenerateBytecode(run2)
+	if err != nil {
+		t.Fatalf("GenerateBytecode() error = %v", err)
+	}
+	if reflect.DeepEqual(bytecode1, bytecode2) {
+		t.Fatalf("GenerateBytecode() of programs with different map fds are equal")
+	}
+	if got, want := canonical(run1), canonical(run2); !reflect.DeepEqual(got, want) {
+		t.Errorf("CanonicalBytecode() = %#x, want %#x", got, want)
+	}
+
+	// Maps are numbered by first use, the 64 bit immediate is not a map.
+	got := canonical(run1)
+	for slot, want := range map[int]uint64{0: 0, 2: 1, 4: 0, 6: 5} {
+		if imm := got[slot] >> 32; imm != want {
+			t.Errorf("CanonicalBytecode()[%d] immediate = %d, want %d", slot, imm, want)
+		}
+	}
+
+	// Using one map where the other program uses two is a different program.
+	if oneMap := canonical(program(3, 3)); reflect.DeepEqual(oneMap, got) {
+		t.Errorf("CanonicalBytecode() of programs using one and two maps are equal: %#x", got)
+	}
+}
+
+func TestAppendBytecode(t *testing.T) {
+	program := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{Mov64(R0, 0), LdImm64(R1, 1<<40), Add64(R0, R1), Exit()}},
+		},
+	}
+	want, err := GenerateBytecode(program)
+	if err != nil {
+		t.Fatalf("GenerateBytecode() error = %v", err)
+	}
+
+	// A buffer that is too small has to grow, one that is large enough has
+	// to be reused as is.
+	for _, capacity := range []int{0, 2, 64} {
+		buf := make([]uint64, 0, capacity)
+		got, err := AppendBytecode(buf[:0], program)
+		if err != nil {
+			t.Fatalf("AppendBytecode() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("AppendBytecode() = %x, want %x", got, want)
+		}
+		if capacity >= len(want) && &got[0] != &buf[:1][0] {
+			t.Errorf("AppendBytecode() with capacity %d allocated a new buffer", capacity)
+		}
+	}
+
+	buf := make([]uint64, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = AppendBytecode(buf[:0], program)
+	})
+	if allocs != 0 {
+		t.Errorf("AppendBytecode() into a large enough buffer allocated %v times, want 0", allocs)
+	}
+}
+
+func BenchmarkGenerateBytecode(b *testing.B) {
+	program := &pb.Program{Functions: []*pb.Functions{{Instructions: RandomProgram(500)}}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := GenerateBytecode(program); err != nil {
+			b.Fatalf("GenerateBytecode() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkAppendBytecode(b *testing.B) {
+	program := &pb.Program{Functions: []*pb.Functions{{Instructions: RandomProgram(500)}}}
+	var buf []uint64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendBytecode(buf[:0], program); err != nil {
+			b.Fatalf("AppendBytecode() error = %v", err)
+		}
+	}
+}
+
+func TestUnusedFieldsEncodeToZero(t *testing.T) {
+	const (
+		dstBits    = uint64(0xf) << 8
+		srcBits    = uint64(0xf) << 12
+		offsetBits = uint64(0xffff) << 16
+		immBits    = uint64(0xffffffff) << 32
+	)
+	tests := []struct {
+		name        string
+		instruction *pb.Instruction
+		unused      uint64
+	}{
+		{"exit", Exit(), dstBits | srcBits | offsetBits | immBits},
+		{"call", Call(MapLookup), dstBits | srcBits | offsetBits},
+		{"ja", Jmp(-3), dstBits | srcBits | immBits},
+		{"jmp reg", JmpGT(R1, R2, -3), immBits},
+		{"alu reg", Add64(R1, R2), offsetBits | immBits},
+		{"alu imm", Add64(R1, -1), srcBits | offsetBits},
+		{"load", LdDW(R1, R2, -8), immBits},
+		{"store reg", StDW(R1, R2, -8), immBits},
+		{"store imm", StDW(R1, -1, -8), srcBits},
+		{"xadd", XAdd(pb.StLdSize_StLdSizeDW, R1, R2, -8), immBits},
+		{"ld abs", LdAbs(pb.StLdSize_StLdSizeW, -1), dstBits | srcBits | offsetBits},
+		{"ld imm64", LdImm64(R1, 0xffffffffffffffff), srcBits | offsetBits},
+		{"mov64 wide", Mov64(R1, int64(-1)), srcBits | offsetBits},
+		{"map fd", LdMapByFd(R1, -1), offsetBits},
+	}
+	for _, tc := range tests {
+		encoding, err := encodeInstruction(tc.instruction)
+		if err != nil {
+			t.Fatalf("encodeInstruction(%s) unexpected error: %v", tc.name, err)
+		}
+		if got := encoding[0] & tc.unused; got != 0 {
+			t.Errorf("encodeInstruction(%s) unused fields = %#x, want 0", tc.name, got)
+		}
+		// Only the immediate of the second slot of wide instructions is used.
+		if len(encoding) == 2 {
+			if got := encoding[1] &^ immBits; got != 0 {
+				t.Errorf("encodeInstruction(%s) second slot = %#x, want only the immediate set", tc.name, encoding[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// forkMutation identifies the mutations Fork applies to a variant.
+type forkMutation int
+
+const (
+	// mutateImmediate draws a new immediate for an alu instruction, following
+	// the same per operation rules as the generators, see pickImmediate.
+	mutateImmediate forkMutation = iota
+	// mutateClass switches an alu instruction between its 32 and 64 bit
+	// forms, see FlipAluClass.
+	mutateClass
+	// mutateInsert adds a Mov64 of a random immediate to a random register of
+	// SharedConfig.RegisterWindow(), never the context in R1 or the frame
+	// pointer.
+	mutateInsert
+)
+
+// Fork returns `n` variants of `program`, each a deep copy with one random
+// mutation applied, that encode and can be loaded as is: immediates stay
+// valid for their operation and the context and frame pointer are never
+// overwritten. Every variant is
+// independent of `program` and of the other variants.
+//
+// Random choices are drawn from `rng` rather than rand.SharedRNG, so
+// concurrent calls with their own generators do not share any state. Fork
+// only reads `program`, which must not be modified while it runs.
+func Fork(program *pb.Program, n int, rng *rand.NumGen) ([]*pb.Program, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("cannot fork %d variants", n)
+	}
+	if len(ProgramInstructions(program)) == 0 {
+		return nil, fmt.Errorf("cannot fork a program without instructions")
+	}
+	variants := make([]*pb.Program, 0, n)
+	for i := 0; i < n; i++ {
+		variant := proto.Clone(program).(*pb.Program)
+		if err := mutateVariant(variant, rng); err != nil {
+			return nil, err
+		}
+		if _, err := GenerateBytecode(variant); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// mutateVariant applies one random mutation to `program` in place.
+func mutateVariant(program *pb.Program, rng *rand.NumGen) error {
+	immediates := []*pb.Instruction{}
+	alus := []*pb.Instruction{}
+	for _, i := range ProgramInstructions(program) {
+		op := i.GetAluOpcode()
+		if op == nil {
+			continue
+		}
+		alus = append(alus, i)
+		if _, restricted := aluValidity[op.OperationCode]; !restricted && op.Source == pb.SrcOperand_Immediate {
+			immediates = append(immediates, i)
+		}
+	}
+
+	mutations := []forkMutation{}
+	if len(immediates) > 0 {
+		mutations = append(mutations, mutateImmediate)
+	}
+	if len(alus) > 0 {
+		mutations = append(mutations, mutateClass)
+	}
+	// Inserting into one function would move the start of the following
+	// ones and break the pseudo calls into them.
+	if len(program.Functions) == 1 {
+		mutations = append(mutations, mutateInsert)
+	}
+	if len(mutations) == 0 {
+		return fmt.Errorf("no mutation applies to the program")
+	}
+
+	switch mutations[rng.RandRange(0, uint64(len(mutations)-1))] {
+	case mutateImmediate:
+		i := immediates[rng.RandRange(0, uint64(len(immediates)-1))]
+		op := i.GetAluOpcode()
+		i.Immediate = pickImmediate(op.OperationCode, op.InstructionClass, rng)
+	case mutateClass:
+		i := alus[rng.RandRange(0, uint64(len(alus)-1))]
+		flipped, err := FlipAluClass(i)
+		if err != nil {
+			return err
+		}
+		op := i.GetAluOpcode()
+		op.InstructionClass = flipped.GetAluOpcode().InstructionClass
+		switch op.OperationCode {
+		case pb.AluOperationCode_AluLsh, pb.AluOperationCode_AluRsh, pb.AluOperationCode_AluArsh:
+			// A 64 bit shift amount can be too large for 32 bits.
+			if op.Source == pb.SrcOperand_Immediate {
+				i.Immediate = pickImmediate(op.OperationCode, op.InstructionClass, rng)
+			}
+		}
+	case mutateInsert:
+		function := program.Functions[0]
+		// The last instruction stays last, it is usually the Exit.
+		index := int(rng.RandRange(0, uint64(len(function.Instructions)-1)))
+		dst := forkInsertRegister(rng)
+		instructions, err := InsertInstruction(function.Instructions, index, Mov64(dst, int32(rng.RandInt())))
+		if err != nil {
+			return err
+		}
+		StampInstructionIds(instructions)
+		function.Instructions = instructions
+	}
+	return nil
+}
+
+// forkInsertRegister returns the register mutateInsert writes to.
+func forkInsertRegister(rng *rand.NumGen) pb.Reg {
+	window := SharedConfig.RegisterWindow()
+	candidates := []pb.Reg{}
+	for r := window.Min; r <= window.Max; r++ {
+		if r != pb.Reg_R1 && r != pb.Reg_R10 {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		// A window of only R1 leaves R0, which the program sets before
+		// exiting anyway.
+		return pb.Reg_R0
+	}
+	return candidates[rng.RandRange(0, uint64(len(candidates)-1))]
+}
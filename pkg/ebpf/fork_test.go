@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	mrand "math/rand"
+	"sync"
+	"testing"
+
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+func TestFork(t *testing.T) {
+	base := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{
+				Mov64(R0, 1),
+				JmpGT(R0, 0, 1),
+				Add64(R0, 3),
+				Mul(R0, R0),
+				Exit(),
+			}},
+		},
+	}
+	StampInstructionIds(base.Functions[0].Instructions)
+	original := protobuf.Clone(base).(*pb.Program)
+
+	const forks, variantsPerFork = 8, 16
+	results := make([][]*pb.Program, forks)
+	errs := make([]error, forks)
+	var wg sync.WaitGroup
+	for f := 0; f < forks; f++ {
+		wg.Add(1)
+		go func(f int) {
+			defer wg.Done()
+			rng := rand.NewRand(mrand.NewSource(int64(f)))
+			results[f], errs[f] = Fork(base, variantsPerFork, rng)
+		}(f)
+	}
+	wg.Wait()
+
+	if !protobuf.Equal(base, original) {
+		t.Errorf("Fork() modified the base program")
+	}
+	seen := map[*pb.Instruction]bool{}
+	for _, i := range ProgramInstructions(base) {
+		seen[i] = true
+	}
+	variants := []*pb.Program{}
+	for f := 0; f < forks; f++ {
+		if errs[f] != nil {
+			t.Fatalf("Fork() unexpected error: %v", errs[f])
+		}
+		if len(results[f]) != variantsPerFork {
+			t.Fatalf("len(Fork()) = %d, want %d", len(results[f]), variantsPerFork)
+		}
+		variants = append(variants, results[f]...)
+	}
+	for _, variant := range variants {
+		for _, i := range ProgramInstructions(variant) {
+			if seen[i] {
+				t.Fatalf("variant shares instruction %s with the base or another variant", InstructionString(i))
+			}
+			seen[i] = true
+		}
+		if _, err := GenerateBytecode(variant); err != nil {
+			t.Errorf("GenerateBytecode(variant) unexpected error: %v", err)
+		}
+	}
+
+	// Changing one variant leaves the others and the base alone.
+	snapshot := protobuf.Clone(variants[1]).(*pb.Program)
+	variants[0].Functions[0].Instructions[0].Immediate++
+	if !protobuf.Equal(variants[1], snapshot) {
+		t.Errorf("modifying a variant changed another one")
+	}
+	if !protobuf.Equal(base, original) {
+		t.Errorf("modifying a variant changed the base program")
+	}
+}
+
+func TestForkErrors(t *testing.T) {
+	rng := rand.NewRand(mrand.NewSource(1))
+	program, err := NewProgram([]*pb.Instruction{Mov64(R0, 0), Exit()})
+	if err != nil {
+		t.Fatalf("NewProgram() unexpected error: %v", err)
+	}
+	if _, err := Fork(program, -1, rng); err == nil {
+		t.Errorf("Fork(-1) = nil error, want error")
+	}
+	if _, err := Fork(&pb.Program{}, 1, rng); err == nil {
+		t.Errorf("Fork(empty program) = nil error, want error")
+	}
+	variants, err := Fork(program, 0, rng)
+	if err != nil || len(variants) != 0 {
+		t.Errorf("Fork(0) = %v, %v, want no variants", variants, err)
+	}
+}
+
+func TestForkVariantsValidate(t *testing.T) {
+	program, err := NewProgram([]*pb.Instruction{
+		LdW(R2, R1, 0),
+		Lsh64(R2, 40),
+		Div(R2, 3),
+		Mod64(R2, 5),
+		Rsh(R2, 7),
+		Mov64(R0, R2),
+		Exit(),
+	})
+	if err != nil {
+		t.Fatalf("NewProgram() unexpected error: %v", err)
+	}
+
+	variants, err := Fork(program, 500, rand.NewRand(mrand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Fork() unexpected error: %v", err)
+	}
+	for _, variant := range variants {
+		instructions := ProgramInstructions(variant)
+		if err := Validate(instructions); err != nil {
+			t.Fatalf("Validate(%s) = %v, want nil", ProgramString(instructions), err)
+		}
+		for _, i := range instructions {
+			op := i.GetAluOpcode()
+			if op == nil {
+				continue
+			}
+			if i.DstReg == R1 || i.DstReg == R10 {
+				t.Fatalf("variant %s writes %v", ProgramString(instructions), i.DstReg)
+			}
+			if op.Source != pb.SrcOperand_Immediate {
+				continue
+			}
+			width := int32(64)
+			if op.InstructionClass == pb.InsClass_InsClassAlu {
+				width = 32
+			}
+			switch op.OperationCode {
+			case pb.AluOperationCode_AluLsh, pb.AluOperationCode_AluRsh, pb.AluOperationCode_AluArsh:
+				if i.Immediate < 0 || i.Immediate >= width {
+					t.Fatalf("variant has shift %s, want an amount below %d", InstructionString(i), width)
+				}
+			case pb.AluOperationCode_AluDiv, pb.AluOperationCode_AluMod:
+				if i.Immediate == 0 {
+					t.Fatalf("variant has division by zero %s", InstructionString(i))
+				}
+			}
+		}
+	}
+}
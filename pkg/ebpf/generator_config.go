@@ -0,0 +1,334 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	"math"
+)
+
+// ImmediateMode selects how the immediates of generated MOV instructions,
+// which initialize registers, are picked.
+type ImmediateMode int
+
+const (
+	// ImmediateFull draws a uniformly random 32 bit value.
+	ImmediateFull ImmediateMode = iota
+
+	// ImmediateSmall draws a value in [0, 255], small constants are tracked
+	// exactly by the verifier.
+	ImmediateSmall
+
+	// ImmediatePattern draws from a set of bit patterns (all ones, sign
+	// bits, alternating bits, single bits...) that stress the verifier
+	// tnum and bounds tracking.
+	ImmediatePattern
+
+	// ImmediateMixed picks one of the modes above for each instruction.
+	ImmediateMixed
+)
+
+// RegisterWindow is the inclusive range of registers the generators pick
+// operands from.
+type RegisterWindow struct {
+	Min pb.Reg
+	Max pb.Reg
+}
+
+// DefaultRegisterWindow returns the conventional registers to generate
+// instructions on for programs of type `progType`.
+//
+// Packet processing programs keep R0 for their verdict and R1 for the
+// context the packet pointers are loaded from, so only R2-R9 are used.
+// Everything else, socket filters included, uses R0-R9.
+func DefaultRegisterWindow(progType uint32) RegisterWindow {
+	switch progType {
+	case ProgTypeSchedCls, ProgTypeXdp:
+		return RegisterWindow{Min: pb.Reg_R2, Max: pb.Reg_R9}
+	default:
+		return RegisterWindow{Min: pb.Reg_R0, Max: pb.Reg_R9}
+	}
+}
+
+// GenerationTracer receives the decisions made by the generators, useful to
+// understand why a strategy produces a given program.
+type GenerationTracer interface {
+	// OnInstruction is called for every instruction appended to a program,
+	// `step` is the index of the instruction in the program.
+	OnInstruction(step int, instruction *pb.Instruction)
+
+	// OnRegisterInit is called when a generator initializes `reg` to a
+	// known value.
+	OnRegisterInit(reg pb.Reg)
+}
+
+// GeneratorConfig holds the knobs that the Random* generators of this
+// package consult when producing instructions.
+type GeneratorConfig struct {
+	// MaxInstructions caps the size, in instruction slots, of the programs
+	// produced by RandomProgram. A value of 0 means no limit.
+	MaxInstructions uint32
+
+	// MovImmediateMode controls the immediates of generated MOV
+	// instructions.
+	MovImmediateMode ImmediateMode
+
+	// JmpPercentage is the percentage, 0 to 100, of the instructions
+	// generated by RandomProgram that are conditional jumps.
+	JmpPercentage uint32
+
+	// BiasedJmpPercentage is the percentage, 0 to 100, of the conditional
+	// jumps generated by RandomProgram whose outcome is fixed by
+	// initializing their dst register right before the comparison.
+	BiasedJmpPercentage uint32
+
+	// TakenJmpPercentage is the percentage, 0 to 100, of biased jumps that
+	// are taken, the rest fall through.
+	TakenJmpPercentage uint32
+
+	// RegSrcPercentage is the percentage, 0 to 100, of random alu and jmp
+	// instructions that take a register as source operand instead of an
+	// immediate.
+	RegSrcPercentage uint32
+
+	// DistinctJmpRegisters makes the register form of random jmps compare
+	// two different registers. It is off by default: comparing a register
+	// to itself (e.g. if r3 > r3) is valid, its outcome is known statically
+	// and it exercises the dead branch pruning of the verifier.
+	DistinctJmpRegisters bool
+
+	// Tracer, if not nil, is notified of the generation decisions.
+	Tracer GenerationTracer
+
+	// ProgType is the bpf_prog_type the generated programs are meant for,
+	// 0 is treated as a socket filter.
+	ProgType uint32
+
+	// Registers, if not nil, overrides the DefaultRegisterWindow of
+	// ProgType.
+	Registers *RegisterWindow
+
+	// MapSize is the number of elements of the array maps the strategies
+	// create, RandomMapLookup keeps its keys within them. 0 is a single
+	// element, see MapElements.
+	MapSize uint32
+
+	// ImmediatePool, if not empty, is the set the immediates of random alu
+	// and jmp instructions are drawn from, e.g. InterestingImmediates(). It
+	// takes precedence over MovImmediateMode. Shift amounts are still
+	// reduced to the operand width.
+	ImmediatePool []int32
+
+	// AvoidDegenerateImmediates keeps random alu instructions from using
+	// immediates that make their result a constant, and with 0, mul by 0
+	// and or with all ones, which lets the verifier prune the code that
+	// depends on the range of the register. Meant for campaigns that chase
+	// coverage, it is off by default.
+	AvoidDegenerateImmediates bool
+
+	// AluOps, if not empty, restricts the operations RandomAluOp draws to
+	// this set, e.g. to keep divisions out of a campaign. See AluOpsExcept.
+	AluOps []pb.AluOperationCode
+
+	// Temperature is the value the knobs above were last scaled from by
+	// SetTemperature, 0 if it was never called.
+	Temperature float64
+}
+
+// SetTemperature scales several knobs at once from a single value between 0
+// (small, mostly straight line programs) and 1 (large, branchy programs with
+// a lot of data flow between registers), values out of range are clamped.
+// With t the temperature:
+//   - MaxInstructions goes from 16 to MaxUnprivilegedInstructions.
+//   - RandomProgramLength requests at least t/2 of the room MaxInstructions
+//     leaves.
+//   - JmpPercentage goes from 5 to 50.
+//   - RegSrcPercentage goes from 25 to 75.
+//
+// The knobs can still be tweaked individually afterwards.
+func (c *GeneratorConfig) SetTemperature(t float64) {
+	t = math.Max(0, math.Min(1, t))
+	scale := func(min, max float64) uint32 {
+		return uint32(math.Round(min + t*(max-min)))
+	}
+	c.Temperature = t
+	c.MaxInstructions = scale(16, MaxUnprivilegedInstructions)
+	c.JmpPercentage = scale(5, 50)
+	c.RegSrcPercentage = scale(25, 75)
+}
+
+// RandomProgramLength draws the number of instructions to ask RandomProgram
+// for. The upper bound is what MaxInstructions leaves for the final Exit, or
+// 100 without a limit, and the lower bound rises with Temperature from 1 up
+// to half of the upper bound, so hotter campaigns request longer programs
+// rather than only being allowed to.
+func (c *GeneratorConfig) RandomProgramLength(rng *rand.NumGen) int {
+	max := 100
+	if c.MaxInstructions > 1 {
+		max = int(c.MaxInstructions) - 1
+	}
+	min := 1 + int(c.Temperature*float64(max-1)/2)
+	return int(rng.RandRange(uint64(min), uint64(max)))
+}
+
+// InterestingImmediates returns constants the range tracking of the verifier
+// tends to get wrong: 0, +-1, the signed and unsigned 32 bit limits, every
+// power of two and the values around the page size.
+func InterestingImmediates() []int32 {
+	pool := []int32{
+		0, 1, -1,
+		math.MaxInt32, math.MinInt32, math.MaxInt32 - 1, math.MinInt32 + 1,
+		0xff, 0xffff, 0x7fff, -0x8000,
+		4095, 4096, 4097, -4096,
+	}
+	for bit := 1; bit < 31; bit++ {
+		pool = append(pool, int32(1)<<bit)
+	}
+	return pool
+}
+
+// allAluOps are the operations RandomAluOp draws from by default, AluEnd is
+// left out as it is not an arithmetic operation.
+var allAluOps = []pb.AluOperationCode{
+	pb.AluOperationCode_AluAdd,
+	pb.AluOperationCode_AluSub,
+	pb.AluOperationCode_AluMul,
+	pb.AluOperationCode_AluDiv,
+	pb.AluOperationCode_AluOr,
+	pb.AluOperationCode_AluAnd,
+	pb.AluOperationCode_AluLsh,
+	pb.AluOperationCode_AluRsh,
+	pb.AluOperationCode_AluNeg,
+	pb.AluOperationCode_AluMod,
+	pb.AluOperationCode_AluXor,
+	pb.AluOperationCode_AluMov,
+	pb.AluOperationCode_AluArsh,
+}
+
+// AluOpsExcept returns every operation RandomAluOp draws by default but
+// `disabled`, to be used as GeneratorConfig.AluOps.
+func AluOpsExcept(disabled ...pb.AluOperationCode) []pb.AluOperationCode {
+	ops := []pb.AluOperationCode{}
+	for _, op := range allAluOps {
+		keep := true
+		for _, d := range disabled {
+			if op == d {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// EnabledAluOps returns the operations the generators may use, AluOps if
+// set or every operation otherwise.
+func (c *GeneratorConfig) EnabledAluOps() []pb.AluOperationCode {
+	if len(c.AluOps) != 0 {
+		return c.AluOps
+	}
+	return allAluOps
+}
+
+// MapElements returns the number of elements of the array maps, MapSize if
+// set or 1 otherwise.
+func (c *GeneratorConfig) MapElements() uint32 {
+	if c.MapSize != 0 {
+		return c.MapSize
+	}
+	return 1
+}
+
+// RegisterWindow returns the registers the generators should use, the
+// explicit Registers override if set or the default window of ProgType.
+func (c *GeneratorConfig) RegisterWindow() RegisterWindow {
+	if c.Registers != nil {
+		return *c.Registers
+	}
+	return DefaultRegisterWindow(c.ProgType)
+}
+
+// DefaultGeneratorConfig returns the configuration buzzer uses unless told
+// otherwise.
+func DefaultGeneratorConfig() *GeneratorConfig {
+	return &GeneratorConfig{
+		MaxInstructions:  0,
+		MovImmediateMode: ImmediateFull,
+
+		JmpPercentage:       30,
+		BiasedJmpPercentage: 0,
+		TakenJmpPercentage:  50,
+		RegSrcPercentage:    50,
+
+		DistinctJmpRegisters: false,
+
+		Tracer: nil,
+
+		ProgType:  0,
+		Registers: nil,
+
+		MapSize: 0,
+
+		ImmediatePool:             nil,
+		AvoidDegenerateImmediates: false,
+		AluOps:                    nil,
+
+		Temperature: 0,
+	}
+}
+
+// GeneratorOption tweaks the configuration built by NewGeneratorConfig.
+type GeneratorOption func(*GeneratorConfig)
+
+// WithMaxInstructions sets GeneratorConfig.MaxInstructions.
+func WithMaxInstructions(max uint32) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.MaxInstructions = max
+	}
+}
+
+// WithMapSize sets GeneratorConfig.MapSize.
+func WithMapSize(size uint32) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.MapSize = size
+	}
+}
+
+// WithRegisters restricts the generators to the registers `min` to `max`,
+// see GeneratorConfig.Registers.
+func WithRegisters(min, max pb.Reg) GeneratorOption {
+	return func(c *GeneratorConfig) {
+		c.Registers = &RegisterWindow{Min: min, Max: max}
+	}
+}
+
+// NewGeneratorConfig returns the DefaultGeneratorConfig modified by `opts`,
+// e.g. NewGeneratorConfig(WithMapSize(4), WithRegisters(R6, R9)). The random
+// number generator is not part of the configuration, see rand.New.
+func NewGeneratorConfig(opts ...GeneratorOption) *GeneratorConfig {
+	config := DefaultGeneratorConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// SharedConfig is the configuration used by the package level generators,
+// strategies can tweak it before generating programs.
+var SharedConfig = DefaultGeneratorConfig()
@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	mrand "math/rand"
+	"reflect"
+	"testing"
+
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+// withTestGlobals gives the test a DefaultGeneratorConfig and a SharedRNG
+// seeded with `seed`, the previous ones are restored when it ends.
+func withTestGlobals(t testing.TB, seed int64) {
+	t.Helper()
+	oldConfig, oldRNG := SharedConfig, rand.SharedRNG
+	t.Cleanup(func() {
+		SharedConfig = oldConfig
+		rand.SharedRNG = oldRNG
+	})
+	SharedConfig = DefaultGeneratorConfig()
+	rand.SharedRNG = rand.NewRand(mrand.NewSource(seed))
+}
+
+func TestRegisterWindow(t *testing.T) {
+	tests := []struct {
+		testName  string
+		progType  uint32
+		override  *RegisterWindow
+		wantLower pb.Reg
+		wantUpper pb.Reg
+	}{
+		{
+			testName:  "Unspecified program type",
+			progType:  0,
+			wantLower: R0,
+			wantUpper: R9,
+		},
+		{
+			testName:  "Socket filter",
+			progType:  ProgTypeSocketFilter,
+			wantLower: R0,
+			wantUpper: R9,
+		},
+		{
+			testName:  "XDP",
+			progType:  ProgTypeXdp,
+			wantLower: R2,
+			wantUpper: R9,
+		},
+		{
+			testName:  "Override wins over the program type default",
+			progType:  ProgTypeXdp,
+			override:  &RegisterWindow{Min: R6, Max: R7},
+			wantLower: R6,
+			wantUpper: R7,
+		},
+	}
+
+	withTestGlobals(t, 1)
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			SharedConfig = DefaultGeneratorConfig()
+			SharedConfig.ProgType = tc.progType
+			SharedConfig.Registers = tc.override
+
+			window := SharedConfig.RegisterWindow()
+			if window.Min != tc.wantLower || window.Max != tc.wantUpper {
+				t.Fatalf("RegisterWindow() = [%v, %v], want [%v, %v]", window.Min, window.Max, tc.wantLower, tc.wantUpper)
+			}
+
+			for i := 0; i < 1000; i++ {
+				if reg := RandomRegister(); reg < tc.wantLower || reg > tc.wantUpper {
+					t.Fatalf("RandomRegister() = %v, want it in [%v, %v]", reg, tc.wantLower, tc.wantUpper)
+				}
+			}
+		})
+	}
+}
+
+func TestNewGeneratorConfig(t *testing.T) {
+	config := NewGeneratorConfig(WithMaxInstructions(64), WithMapSize(4), WithRegisters(R6, R9))
+	if config.MaxInstructions != 64 || config.MapSize != 4 {
+		t.Errorf("NewGeneratorConfig() MaxInstructions, MapSize = %d, %d, want 64, 4", config.MaxInstructions, config.MapSize)
+	}
+	if window := config.RegisterWindow(); window.Min != R6 || window.Max != R9 {
+		t.Errorf("NewGeneratorConfig().RegisterWindow() = [%v, %v], want [%v, %v]", window.Min, window.Max, R6, R9)
+	}
+
+	// The knobs without an option keep their defaults.
+	config.MaxInstructions, config.MapSize, config.Registers = 0, 0, nil
+	if !reflect.DeepEqual(config, DefaultGeneratorConfig()) {
+		t.Errorf("NewGeneratorConfig() = %+v, want the other knobs to be the defaults %+v", config, DefaultGeneratorConfig())
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	lastSize, lastJmps := -1.0, -1.0
+	for _, temperature := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		SharedConfig = DefaultGeneratorConfig()
+		SharedConfig.SetTemperature(temperature)
+		rand.SharedRNG = rand.NewRand(mrand.NewSource(1))
+
+		const programs = 50
+		size, jmps := 0, 0
+		for i := 0; i < programs; i++ {
+			prog := RandomProgram(SharedConfig.RandomProgramLength(rand.SharedRNG))
+			size += len(prog)
+			jmps += CountByClass(prog)[pb.InsClass_InsClassJmp] + CountByClass(prog)[pb.InsClass_InsClassJmp32]
+		}
+		avgSize, avgJmps := float64(size)/programs, float64(jmps)/programs
+		if avgSize <= lastSize {
+			t.Errorf("average RandomProgram() size at temperature %v = %v, want more than %v", temperature, avgSize, lastSize)
+		}
+		if avgJmps <= lastJmps {
+			t.Errorf("average RandomProgram() jmps at temperature %v = %v, want more than %v", temperature, avgJmps, lastJmps)
+		}
+		lastSize, lastJmps = avgSize, avgJmps
+	}
+
+	SharedConfig.SetTemperature(2)
+	if SharedConfig.Temperature != 1 || SharedConfig.MaxInstructions != MaxUnprivilegedInstructions {
+		t.Errorf("SetTemperature(2) = temperature %v, max instructions %d, want it clamped to 1", SharedConfig.Temperature, SharedConfig.MaxInstructions)
+	}
+}
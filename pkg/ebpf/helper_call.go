@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+)
+
+// HelperArgType is the kind of value the verifier expects in a helper
+// argument, a subset of the kernel's bpf_arg_type.
+type HelperArgType int
+
+const (
+	// ArgAnything is any initialized scalar.
+	ArgAnything HelperArgType = iota
+	// ArgConstMapPtr is a pointer to a map loaded with LdMapByFd.
+	ArgConstMapPtr
+	// ArgPtrToMapKey, ArgPtrToMapValue and ArgPtrToMem point to Size
+	// initialized bytes of stack.
+	ArgPtrToMapKey
+	ArgPtrToMapValue
+	ArgPtrToMem
+	// ArgConstSize is the size of the memory passed in the previous
+	// argument.
+	ArgConstSize
+	// ArgPtrToCtx is the context the program was called with.
+	ArgPtrToCtx
+)
+
+// HelperArg describes a single helper argument, Size is only used by the
+// memory argument types.
+type HelperArg struct {
+	Type HelperArgType
+	Size int32
+}
+
+// HelperSig describes the arguments that Helper takes, in order starting at
+// R1. MapFd is the map used by ArgConstMapPtr arguments.
+type HelperSig struct {
+	Helper int32
+	Args   []HelperArg
+	MapFd  int
+}
+
+func isMemArg(t HelperArgType) bool {
+	return t == ArgPtrToMapKey || t == ArgPtrToMapValue || t == ArgPtrToMem
+}
+
+// canBreak returns true if BuildHelperCall knows how to set up an argument of
+// type `t` so that the verifier rejects it.
+func canBreak(t HelperArgType) bool {
+	return t != ArgAnything
+}
+
+// BuildHelperCall returns the instructions that set up the arguments of
+// `sig` and call the helper. Memory arguments live on the stack and the
+// context is expected in R1 when the sequence starts, it is saved in R6.
+//
+// If `valid` is false one of the arguments, picked at random among those that
+// can be broken, is set up in a way the verifier rejects: a pointer to stack
+// memory that crosses the frame pointer, a size larger than its buffer, a
+// scalar instead of a map or the stack instead of the context.
+//
+// The sequence clobbers R1 to R5 like any call, and R6 if the context is
+// passed.
+func BuildHelperCall(sig HelperSig, valid bool) ([]*pb.Instruction, error) {
+	if len(sig.Args) > 5 {
+		return nil, fmt.Errorf("helpers take at most 5 arguments, got %d", len(sig.Args))
+	}
+
+	broken := -1
+	if !valid {
+		candidates := []int{}
+		for index, arg := range sig.Args {
+			if canBreak(arg.Type) {
+				candidates = append(candidates, index)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("helper %d has no argument that can be made invalid", sig.Helper)
+		}
+		broken = candidates[rand.SharedRNG.RandRange(0, uint64(len(candidates)-1))]
+	}
+
+	prologue := []*pb.Instruction{}
+	setup := []*pb.Instruction{}
+	stackOffset := int16(0)
+	for index, arg := range sig.Args {
+		reg := pb.Reg(int(R1) + index)
+		isBroken := index == broken
+		switch arg.Type {
+		case ArgAnything:
+			setup = append(setup, Mov64(reg, int32(rand.SharedRNG.RandInt())))
+		case ArgConstMapPtr:
+			if isBroken {
+				setup = append(setup, Mov64(reg, int32(sig.MapFd)))
+			} else {
+				setup = append(setup, LdMapByFd(reg, sig.MapFd))
+			}
+		case ArgPtrToMapKey, ArgPtrToMapValue, ArgPtrToMem:
+			if arg.Size <= 0 {
+				return nil, fmt.Errorf("argument %d needs a positive size, got %d", index, arg.Size)
+			}
+			if arg.Size > 256 {
+				return nil, fmt.Errorf("argument %d does not fit in the stack, size %d", index, arg.Size)
+			}
+			stackOffset -= int16((arg.Size + 7) / 8 * 8)
+			for offset := stackOffset; offset < stackOffset+int16(arg.Size); offset += 8 {
+				prologue = append(prologue, StDW(R10, 0, offset))
+			}
+			pointer := int32(stackOffset)
+			if isBroken {
+				// The last 8 bytes of the buffer land above the frame pointer.
+				pointer = 8 - arg.Size
+			}
+			setup = append(setup, Mov64(reg, R10), Add64(reg, pointer))
+		case ArgConstSize:
+			if index == 0 || !isMemArg(sig.Args[index-1].Type) {
+				return nil, fmt.Errorf("argument %d is a size but does not follow a memory argument", index)
+			}
+			size := sig.Args[index-1].Size
+			if isBroken {
+				// Larger than the whole stack, the read crosses the frame
+				// pointer wherever the buffer is.
+				size += 512
+			}
+			setup = append(setup, Mov64(reg, size))
+		case ArgPtrToCtx:
+			if isBroken {
+				setup = append(setup, Mov64(reg, R10))
+			} else {
+				prologue = append([]*pb.Instruction{Mov64(R6, R1)}, prologue...)
+				setup = append(setup, Mov64(reg, R6))
+			}
+		default:
+			return nil, fmt.Errorf("argument %d has unknown type %d", index, arg.Type)
+		}
+	}
+
+	sequence := append(prologue, setup...)
+	return append(sequence, Call(sig.Helper)), nil
+}
+
+// CopyFromUserSig returns the signature of bpf_copy_from_user copying `size`
+// bytes from the user address in R3 to the stack.
+func CopyFromUserSig(size int32) HelperSig {
+	return HelperSig{
+		Helper: CopyFromUser,
+		Args: []HelperArg{
+			{Type: ArgPtrToMem, Size: size},
+			{Type: ArgConstSize},
+			{Type: ArgAnything},
+		},
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+var mapUpdateSig = HelperSig{
+	Helper: MapUpdate,
+	Args: []HelperArg{
+		{Type: ArgConstMapPtr},
+		{Type: ArgPtrToMapKey, Size: 4},
+		{Type: ArgPtrToMapValue, Size: 8},
+		{Type: ArgAnything},
+	},
+	MapFd: 3,
+}
+
+func TestBuildHelperCallValid(t *testing.T) {
+	got, err := BuildHelperCall(mapUpdateSig, true)
+	if err != nil {
+		t.Fatalf("BuildHelperCall() error = %v", err)
+	}
+
+	want := []*pb.Instruction{
+		StDW(R10, 0, -8),
+		StDW(R10, 0, -16),
+		LdMapByFd(R1, 3),
+		Mov64(R2, R10),
+		Add64(R2, -8),
+		Mov64(R3, R10),
+		Add64(R3, -16),
+		nil, // R4 gets a random value.
+		Call(MapUpdate),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("len(BuildHelperCall()) = %d, want %d\n%s", len(got), len(want), ProgramString(got))
+	}
+	for i := range want {
+		if want[i] == nil {
+			if got[i].DstReg != R4 {
+				t.Errorf("BuildHelperCall()[%d] = %s, want a write to r4", i, InstructionString(got[i]))
+			}
+			continue
+		}
+		if !protobuf.Equal(got[i], want[i]) {
+			t.Errorf("BuildHelperCall()[%d] = %s, want %s", i, InstructionString(got[i]), InstructionString(want[i]))
+		}
+	}
+}
+
+func TestBuildHelperCallInvalid(t *testing.T) {
+	valid, err := BuildHelperCall(mapUpdateSig, true)
+	if err != nil {
+		t.Fatalf("BuildHelperCall(valid) error = %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		invalid, err := BuildHelperCall(mapUpdateSig, false)
+		if err != nil {
+			t.Fatalf("BuildHelperCall(invalid) error = %v", err)
+		}
+
+		// Exactly one argument is set up differently, R4 is random either way.
+		differences := 0
+		for _, reg := range []pb.Reg{R1, R2, R3} {
+			if ProgramString(setupOf(valid, reg)) != ProgramString(setupOf(invalid, reg)) {
+				differences++
+			}
+		}
+		if differences != 1 {
+			t.Fatalf("BuildHelperCall(invalid) changed %d arguments, want 1\n%s", differences, ProgramString(invalid))
+		}
+	}
+}
+
+// setupOf returns the instructions of `sequence` that write `reg`.
+func setupOf(sequence []*pb.Instruction, reg pb.Reg) []*pb.Instruction {
+	writes := []*pb.Instruction{}
+	for _, ins := range sequence {
+		if ins.GetJmpOpcode() == nil && ins.DstReg == reg {
+			writes = append(writes, ins)
+		}
+	}
+	return writes
+}
+
+func TestBuildHelperCallErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  HelperSig
+		ok   bool
+	}{
+		{"no breakable argument", HelperSig{Helper: 1, Args: []HelperArg{{Type: ArgAnything}}}, false},
+		{"size without memory", HelperSig{Helper: 1, Args: []HelperArg{{Type: ArgConstSize}}}, false},
+		{"memory without size", HelperSig{Helper: 1, Args: []HelperArg{{Type: ArgPtrToMem}}}, false},
+		{"too many arguments", HelperSig{Helper: 1, Args: make([]HelperArg, 6)}, false},
+		{"context", HelperSig{Helper: 1, Args: []HelperArg{{Type: ArgPtrToCtx}}}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := BuildHelperCall(tc.sig, false)
+			if (err == nil) != tc.ok {
+				t.Errorf("BuildHelperCall() error = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
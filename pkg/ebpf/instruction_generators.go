@@ -17,6 +17,8 @@ package ebpf
 import (
 	"buzzer/pkg/rand"
 	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"math"
 )
 
 // GenerateRandomAluInstruction provides a random ALU operation with either
@@ -31,16 +33,53 @@ func RandomAluInstruction() *pb.Instruction {
 		insClass = pb.InsClass_InsClassAlu64
 	}
 
-	// Toss another coin to decide if we are going to do an imm alu
-	// operation or one that uses a src register.
-	var instr *pb.Instruction
-	if rand.SharedRNG.RandRange(0, 1) == 0 {
-		instr = generateImmAluInstruction(op, insClass, dstReg)
-	} else {
-		instr = generateRegAluInstruction(op, insClass, dstReg)
+	return randomAluInstructionOn(op, insClass, dstReg)
+}
+
+// randomAluInstructionOn decides, following SharedConfig.RegSrcPercentage,
+// if the alu operation `op` on `dstReg` uses an imm or a src register.
+func randomAluInstructionOn(op pb.AluOperationCode, insClass pb.InsClass, dstReg pb.Reg) *pb.Instruction {
+	if !useRegSource() {
+		return generateImmAluInstruction(op, insClass, dstReg)
+	}
+	return generateRegAluInstruction(op, insClass, dstReg)
+}
+
+// useRegSource returns whether the next random instruction should take a
+// register as source operand, see GeneratorConfig.RegSrcPercentage.
+func useRegSource() bool {
+	return rand.SharedRNG.RandRange(1, 100) <= uint64(SharedConfig.RegSrcPercentage)
+}
+
+// RandomSubregisterSequence returns `count` random alu instructions that all
+// write `dst`, mixing 32 bit and 64 bit operations. 32 bit operations zero
+// the upper half of the register, which the verifier has to track across the
+// 64 bit ones.
+//
+// The sequence always contains a 64 bit operation and ends with a 32 bit one,
+// so the upper 32 bits of `dst` must be zero after it. `count` is raised to 2
+// if smaller.
+func RandomSubregisterSequence(dst pb.Reg, count int) []*pb.Instruction {
+	if count < 2 {
+		count = 2
 	}
 
-	return instr
+	sequence := []*pb.Instruction{}
+	has64 := false
+	for i := 0; i < count; i++ {
+		insClass := pb.InsClass_InsClassAlu
+		switch {
+		case i == count-1:
+			// Always finish on a 32 bit operation.
+		case i == count-2 && !has64:
+			insClass = pb.InsClass_InsClassAlu64
+		case rand.SharedRNG.OneOf(2):
+			insClass = pb.InsClass_InsClassAlu64
+		}
+		has64 = has64 || insClass == pb.InsClass_InsClassAlu64
+		sequence = append(sequence, randomAluInstructionOn(RandomAluOp(), insClass, dst))
+	}
+	return sequence
 }
 
 // RandomJmpInstruction generates a random jmp instruction that has an
@@ -66,16 +105,359 @@ func RandomJmpInstruction(maxOffset uint64) *pb.Instruction {
 	}
 
 	dstReg := RandomRegister()
-	offset := int16(rand.SharedRNG.RandRange(1, maxOffset))
-	if rand.SharedRNG.OneOf(2) {
-		src := int32(rand.SharedRNG.RandRange(0, 0xffffffff))
+	// With no room to jump forward fall back to an offset of 0, which simply
+	// continues on the next instruction.
+	offset := int16(0)
+	if maxOffset > 0 {
+		offset = int16(rand.SharedRNG.RandRange(1, maxOffset))
+	}
+	if !useRegSource() {
+		src := randomImmediate(rand.SharedRNG)
+		if op == pb.JmpOperationCode_JmpJSET && len(SharedConfig.ImmediatePool) == 0 {
+			src = randomJmpMask()
+		}
 		return newJmpInstruction(op, insClass, dstReg, src, offset)
 	} else {
 		src := RandomRegister()
+		window := SharedConfig.RegisterWindow()
+		for SharedConfig.DistinctJmpRegisters && src == dstReg && window.Min != window.Max {
+			src = RandomRegister()
+		}
 		return newJmpInstruction(op, insClass, dstReg, src, offset)
 	}
 }
 
+// randomJmpMask returns a non zero mask for JSET, flag style masks (a single
+// bit, a low bits mask or a bit pattern) exercise the branches far more than
+// a uniform random immediate, which almost always shares a bit with dst.
+func randomJmpMask() int32 {
+	switch rand.SharedRNG.RandRange(0, 2) {
+	case 0:
+		return int32(uint32(1) << rand.SharedRNG.RandRange(0, 31))
+	case 1:
+		return int32(uint32(1)<<rand.SharedRNG.RandRange(1, 31) - 1)
+	default:
+		for {
+			mask := immediatePatterns[rand.SharedRNG.RandRange(0, uint64(len(immediatePatterns)-1))]
+			if mask != 0 {
+				return int32(mask)
+			}
+		}
+	}
+}
+
+// jmpTaken evaluates the comparison of a conditional jmp of class
+// `insClass` between `dst` and `src`, JMP32 comparisons only look at the
+// lower 32 bits of the operands.
+func jmpTaken(op pb.JmpOperationCode, insClass pb.InsClass, dst, src uint64) bool {
+	sdst, ssrc := int64(dst), int64(src)
+	if insClass == pb.InsClass_InsClassJmp32 {
+		dst, src = uint64(uint32(dst)), uint64(uint32(src))
+		sdst, ssrc = int64(int32(dst)), int64(int32(src))
+	}
+
+	switch op {
+	case pb.JmpOperationCode_JmpJEQ:
+		return dst == src
+	case pb.JmpOperationCode_JmpJNE:
+		return dst != src
+	case pb.JmpOperationCode_JmpJGT:
+		return dst > src
+	case pb.JmpOperationCode_JmpJGE:
+		return dst >= src
+	case pb.JmpOperationCode_JmpJLT:
+		return dst < src
+	case pb.JmpOperationCode_JmpJLE:
+		return dst <= src
+	case pb.JmpOperationCode_JmpJSET:
+		return dst&src != 0
+	case pb.JmpOperationCode_JmpJSGT:
+		return sdst > ssrc
+	case pb.JmpOperationCode_JmpJSGE:
+		return sdst >= ssrc
+	case pb.JmpOperationCode_JmpJSLT:
+		return sdst < ssrc
+	case pb.JmpOperationCode_JmpJSLE:
+		return sdst <= ssrc
+	default:
+		return false
+	}
+}
+
+// BiasedJmpInstruction returns a random conditional jmp against an
+// immediate, with an offset of at most `maxOffset`, preceded by a Mov64 that
+// initializes its dst register so that the jmp is taken if `taken` is true
+// and falls through otherwise.
+func BiasedJmpInstruction(maxOffset uint64, taken bool) []*pb.Instruction {
+	insClass := pb.InsClass_InsClassJmp
+	if rand.SharedRNG.OneOf(2) {
+		insClass = pb.InsClass_InsClassJmp32
+	}
+
+	offset := int16(0)
+	if maxOffset > 0 {
+		offset = int16(rand.SharedRNG.RandRange(1, maxOffset))
+	}
+	dstReg := RandomRegister()
+
+	for {
+		op := RandomJumpOp()
+		if !IsConditional(op) {
+			continue
+		}
+
+		imm := int32(rand.SharedRNG.RandRange(0, 0xffffffff))
+		// Both the Mov64 and the jmp immediates are sign extended to 64
+		// bits. Some comparisons can only go one way for a given immediate
+		// (e.g. JGT against all ones), in that case pick a new one.
+		candidates := []int32{imm, imm + 1, imm - 1, imm ^ 1, ^imm, 0, -1, math.MinInt32, math.MaxInt32}
+		for _, value := range candidates {
+			if jmpTaken(op, insClass, uint64(int64(value)), uint64(int64(imm))) == taken {
+				return []*pb.Instruction{
+					Mov64(dstReg, value),
+					newJmpInstruction(op, insClass, dstReg, imm, offset),
+				}
+			}
+		}
+	}
+}
+
+// randomUnknownBranch returns a conditional jmp on `cond` that the verifier
+// cannot decide when `cond` holds an unknown 32 bit value, e.g. skb->len,
+// so it has to explore both the taken and the fall through paths: either a
+// test of a single bit or an unsigned 32 bit comparison with an immediate
+// that is not the largest u32.
+func randomUnknownBranch(cond pb.Reg, offset int16) *pb.Instruction {
+	if rand.SharedRNG.OneOf(2) {
+		bit := int32(1) << rand.SharedRNG.RandRange(0, 31)
+		return JmpSET(cond, bit, offset)
+	}
+	return JmpGT32(cond, int32(uint32(rand.SharedRNG.RandRange(0, 0xfffffffe))), offset)
+}
+
+// RandomJoinPoint returns a conditional jmp on `cond` followed by two arms
+// that both fall into the instruction after the sequence, the join point.
+// `cond` must hold an unknown 32 bit value so both arms are explored, see
+// randomUnknownBranch.
+//
+// Each arm runs `armLength` random 64 bit alu operations on `dst`, adds
+// `cond` so the random operations cannot leave a known constant behind and
+// then masks it, one arm with a mask one bit wider than the other. The
+// verifier reaches the join point with states that only differ in the
+// range of `dst`, which is what state pruning has to tell apart. The second
+// return value is the narrow mask, at most 0xff so it can size a stack
+// access: `dst` is only within it on one of the paths, a state pruned as if
+// that held on both is a verifier bug.
+func RandomJoinPoint(cond, dst pb.Reg, armLength int) ([]*pb.Instruction, int32) {
+	if armLength < 1 {
+		armLength = 1
+	}
+
+	narrowMask := int32(1)<<rand.SharedRNG.RandRange(1, 8) - 1
+	wideMask := narrowMask<<1 | 1
+	masks := []int32{narrowMask, wideMask}
+	if rand.SharedRNG.OneOf(2) {
+		masks[0], masks[1] = masks[1], masks[0]
+	}
+
+	arms := [][]*pb.Instruction{}
+	for _, mask := range masks {
+		arm := []*pb.Instruction{}
+		for i := 0; i < armLength; i++ {
+			arm = append(arm, randomAluInstructionOn(RandomAluOp(), pb.InsClass_InsClassAlu64, dst))
+		}
+		arms = append(arms, append(arm, Add64(dst, cond), And64(dst, mask)))
+	}
+
+	sequence := []*pb.Instruction{randomUnknownBranch(cond, int16(len(arms[0])+1))}
+	sequence = append(sequence, arms[0]...)
+	sequence = append(sequence, Jmp(int16(len(arms[1]))))
+	sequence = append(sequence, arms[1]...)
+	return sequence, narrowMask
+}
+
+// TypeConfusionJoin returns a conditional jmp on `cond` followed by two arms
+// that both fall into the instruction after the sequence: one runs
+// `pointerArm`, which is expected to leave a pointer in `dst`, the other sets
+// `dst` to a random scalar. `cond` must hold an unknown 32 bit value, e.g.
+// skb->len, the branch on it cannot be decided statically (see
+// randomUnknownBranch) so the verifier explores both arms.
+//
+// At the join point `dst` is a pointer on one path and a scalar on the other,
+// the verifier has to reject any dereference of it after the join.
+func TypeConfusionJoin(cond, dst pb.Reg, pointerArm []*pb.Instruction) ([]*pb.Instruction, error) {
+	if len(pointerArm) == 0 {
+		return nil, fmt.Errorf("the pointer arm cannot be empty")
+	}
+	arms := [][]*pb.Instruction{
+		pointerArm,
+		{Mov64(dst, int32(rand.SharedRNG.RandRange(0, 0xffffffff)))},
+	}
+	if rand.SharedRNG.OneOf(2) {
+		arms[0], arms[1] = arms[1], arms[0]
+	}
+
+	sequence := []*pb.Instruction{randomUnknownBranch(cond, int16(ProgramSize(arms[0])+1))}
+	sequence = append(sequence, arms[0]...)
+	sequence = append(sequence, Jmp(int16(ProgramSize(arms[1]))))
+	sequence = append(sequence, arms[1]...)
+	return sequence, nil
+}
+
+// RandomProgram generates a body of `count` random alu and jmp instructions
+// terminated by an Exit. Jmp offsets never point past the final Exit.
+//
+// If SharedConfig.MaxInstructions is set, the body is cut short so the whole
+// program, Exit included, never goes over the limit. Callers are expected to
+// initialize the registers (including R0) before the returned sequence.
+func RandomProgram(count int) []*pb.Instruction {
+	if limit := int(SharedConfig.MaxInstructions); limit != 0 && count >= limit {
+		count = limit - 1
+	}
+
+	tracer := SharedConfig.Tracer
+	prog := []*pb.Instruction{}
+	emit := func(instructions ...*pb.Instruction) {
+		for _, ins := range instructions {
+			if tracer != nil {
+				tracer.OnInstruction(len(prog), ins)
+			}
+			prog = append(prog, ins)
+		}
+	}
+
+	for remaining := count; remaining > 0; remaining-- {
+		// A jmp here can land at most on the final Exit, which is
+		// `remaining` instructions away.
+		if remaining > 1 && rand.SharedRNG.RandRange(1, 100) <= uint64(SharedConfig.JmpPercentage) {
+			if remaining > 2 && rand.SharedRNG.RandRange(1, 100) <= uint64(SharedConfig.BiasedJmpPercentage) {
+				// The biased jmp takes the place of two instructions.
+				taken := rand.SharedRNG.RandRange(1, 100) <= uint64(SharedConfig.TakenJmpPercentage)
+				remaining--
+				biased := BiasedJmpInstruction(uint64(remaining-1), taken)
+				if tracer != nil {
+					tracer.OnRegisterInit(biased[0].DstReg)
+				}
+				emit(biased...)
+				continue
+			}
+			emit(RandomJmpInstruction(uint64(remaining - 1)))
+		} else {
+			emit(RandomAluInstruction())
+		}
+	}
+	emit(Exit())
+	return prog
+}
+
+// Malformation is a kind of mistake MalformedProgram puts in a program, every
+// kind makes the verifier reject it.
+type Malformation int
+
+const (
+	// MalformationUninitRead reads a register that was never written.
+	MalformationUninitRead Malformation = iota
+	// MalformationJmpOutOfBounds jumps past the end of the program.
+	MalformationJmpOutOfBounds
+	// MalformationFramePointerWrite writes to R10.
+	MalformationFramePointerWrite
+	// MalformationUnreachable skips over an instruction nothing jumps to.
+	MalformationUnreachable
+)
+
+// Malformations holds every Malformation kind.
+var Malformations = []Malformation{
+	MalformationUninitRead,
+	MalformationJmpOutOfBounds,
+	MalformationFramePointerWrite,
+	MalformationUnreachable,
+}
+
+func (m Malformation) String() string {
+	switch m {
+	case MalformationUninitRead:
+		return "uninitialized read"
+	case MalformationJmpOutOfBounds:
+		return "jmp out of bounds"
+	case MalformationFramePointerWrite:
+		return "frame pointer write"
+	case MalformationUnreachable:
+		return "unreachable code"
+	default:
+		return fmt.Sprintf("malformation %d", int(m))
+	}
+}
+
+// MalformedProgram returns a complete program, register initialization
+// included, made of RandomProgram(count) preceded by a mistake of the given
+// kind.
+func MalformedProgram(kind Malformation, count int) ([]*pb.Instruction, error) {
+	// R1 holds the context on entry, it is always initialized.
+	uninit := R1
+	if kind == MalformationUninitRead {
+		for uninit == R1 {
+			uninit = pb.Reg(rand.SharedRNG.RandRange(uint64(R0), uint64(R9)))
+		}
+	}
+	prog := []*pb.Instruction{}
+	for reg := R0; reg <= R9; reg++ {
+		if reg != uninit {
+			prog = append(prog, Mov64(reg, int32(rand.SharedRNG.RandInt())))
+		}
+	}
+
+	body := RandomProgram(count)
+	switch kind {
+	case MalformationUninitRead:
+		prog = append(prog, Add64(RandomRegister(), uninit))
+	case MalformationJmpOutOfBounds:
+		offset := ProgramSize(body) + int(rand.SharedRNG.RandRange(0, 10))
+		prog = append(prog, JmpEQ(RandomRegister(), int32(rand.SharedRNG.RandInt()), int16(offset)))
+	case MalformationFramePointerWrite:
+		if rand.SharedRNG.OneOf(2) {
+			prog = append(prog, Mov64(R10, int32(rand.SharedRNG.RandInt())))
+		} else {
+			prog = append(prog, Add64(R10, int32(rand.SharedRNG.RandRange(1, 512))))
+		}
+	case MalformationUnreachable:
+		prog = append(prog, Jmp(1), RandomAluInstruction())
+	default:
+		return nil, fmt.Errorf("unknown malformation %d", int(kind))
+	}
+	return append(prog, body...), nil
+}
+
+// RandomMapLookup returns a lookup of a random key in the map held by
+// `mapPtr`, see LdMapElement. The key is kept within the
+// SharedConfig.MapElements() of the map so the lookup does not fail.
+func RandomMapLookup(mapPtr pb.Reg, keyPtr pb.Reg, offset int16) ([]*pb.Instruction, error) {
+	key := uint32(rand.SharedRNG.RandInt()) % SharedConfig.MapElements()
+	return LdMapElement(mapPtr, int32(key), keyPtr, offset)
+}
+
+// RandomLegacyPacketLoads returns a socket filter program that reads the
+// packet with `count` random LdAbs and LdInd instructions, the legacy packet
+// access inherited from classic BPF. The program sets R6 to the context as
+// the loads require and returns the result of the last one.
+func RandomLegacyPacketLoads(count int) []*pb.Instruction {
+	instructions := []*pb.Instruction{
+		Mov64(R6, R1),
+		Mov64(R7, int32(rand.SharedRNG.RandRange(0, 64))),
+		Mov64(R0, 0),
+	}
+	sizes := []pb.StLdSize{pb.StLdSize_StLdSizeW, pb.StLdSize_StLdSizeH, pb.StLdSize_StLdSizeB}
+	for i := 0; i < count; i++ {
+		size := sizes[rand.SharedRNG.RandRange(0, uint64(len(sizes)-1))]
+		imm := int32(rand.SharedRNG.RandRange(0, 64))
+		if rand.SharedRNG.OneOf(2) {
+			instructions = append(instructions, LdAbs(size, imm))
+		} else {
+			instructions = append(instructions, LdInd(size, R7, imm))
+		}
+	}
+	return append(instructions, Exit())
+}
+
 // RandomSize is a helper function to be used in the RandomMemInstruction
 // functions. The result of this function should be one of the recognized
 // operation sizes of ebpf (https://www.kernel.org/doc/html/v5.18/bpf/instruction-set.html#:~:text=The%20size%20modifier%20is%20one%20of%3A)
@@ -183,16 +565,62 @@ func RandomLoadInstruction() *pb.Instruction {
 	return newLoadOperation(size, dst, R10, offset)
 }
 
+// PointerSpillFill derives a stack pointer in `ptrReg`, spills it to the
+// stack slot at `spillOffset` with a DW store, fills it back into `fillReg`
+// and writes through the filled pointer.
+//
+// The verifier only tracks the type of a spilled register when the whole 8
+// byte, 8 byte aligned slot is written, so `spillOffset` must be a multiple
+// of 8. The derived pointer targets the slot right below the spill slot so
+// that writing through it does not clobber the spilled value.
+func PointerSpillFill(ptrReg, fillReg pb.Reg, spillOffset int16) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(ptrReg, R10),
+		Add64(ptrReg, int32(spillOffset-8)),
+		StDW(R10, ptrReg, spillOffset),
+		LdDW(fillReg, R10, spillOffset),
+		StDW(fillReg, int32(rand.SharedRNG.RandInt()), 0),
+	)
+}
+
+// RandomPointerSpillFill returns a PointerSpillFill sequence with random
+// registers and a random, properly aligned, spill slot.
+func RandomPointerSpillFill() []*pb.Instruction {
+	ptrReg := RandomRegister()
+	fillReg := RandomRegister()
+
+	// Leave room for the slot below the spill slot that the pointer targets.
+	spillOffset := RandomOffset(pb.StLdSize_StLdSizeDW)
+	for spillOffset <= -512 {
+		spillOffset = RandomOffset(pb.StLdSize_StLdSizeDW)
+	}
+
+	seq, _ := PointerSpillFill(ptrReg, fillReg, spillOffset)
+	return seq
+}
+
+// RandomPacketRead returns a bounds checked read of a random size and offset
+// from the packet delimited by `data` and `dataEnd`, see
+// PacketBoundsCheckedLoad.
+func RandomPacketRead(data, dataEnd, tmp, dst pb.Reg) []*pb.Instruction {
+	size := RandomSize()
+	offset := int16(rand.SharedRNG.RandRange(0, 64))
+	seq, _ := PacketBoundsCheckedLoad(data, dataEnd, tmp, dst, offset, size)
+	return seq
+}
+
 // RandomJumpOp generates a random jump operator.
 func RandomJumpOp() pb.JmpOperationCode {
 	// https://docs.kernel.org/bpf/instruction-set.html#jump-instructions
 	return pb.JmpOperationCode(rand.SharedRNG.RandRange(0x00, 0x0d) << 4)
 }
 
+// RandomAluOp generates a random alu operator out of the ones enabled in
+// SharedConfig.
 func RandomAluOp() pb.AluOperationCode {
-	// Shift by 4 bits because we need to respect the ebpf encoding:
 	// https://docs.kernel.org/bpf/instruction-set.html#id6
-	return pb.AluOperationCode(rand.SharedRNG.RandRange(0x00, 0x0c) << 4)
+	ops := SharedConfig.EnabledAluOps()
+	return ops[rand.SharedRNG.RandRange(0, uint64(len(ops)-1))]
 }
 
 // IsConditional determines if the operator is not an Exit, Call or JA
@@ -201,13 +629,71 @@ func IsConditional(op pb.JmpOperationCode) bool {
 	return !(op == pb.JmpOperationCode_JmpExit || op == pb.JmpOperationCode_JmpCALL || op == pb.JmpOperationCode_JmpJA)
 }
 
-// RandomRegister returns a random register from R0 to R9.
+// RandomRegister returns a random register from the window configured in
+// SharedConfig, R0 to R9 by default.
 func RandomRegister() pb.Reg {
-	return pb.Reg(rand.SharedRNG.RandRange(0, 9))
+	window := SharedConfig.RegisterWindow()
+	return pb.Reg(rand.SharedRNG.RandRange(uint64(window.Min), uint64(window.Max)))
+}
+
+var immediatePatterns = []uint32{
+	0x00000000, 0xffffffff, 0x80000000, 0x7fffffff,
+	0x55555555, 0xaaaaaaaa, 0x0000ffff, 0xffff0000,
+	0x00ff00ff, 0xff00ff00, 0x0f0f0f0f, 0xf0f0f0f0,
+}
+
+// randomImmediate returns a uniformly random immediate, or one out of
+// SharedConfig.ImmediatePool if set.
+func randomImmediate(rng *rand.NumGen) int32 {
+	if pool := SharedConfig.ImmediatePool; len(pool) != 0 {
+		return pool[rng.RandRange(0, uint64(len(pool)-1))]
+	}
+	return int32(rng.RandRange(0, 0xFFFFFFFF))
+}
+
+// randomMovImmediate returns an immediate suitable to initialize a register
+// according to SharedConfig.MovImmediateMode, or SharedConfig.ImmediatePool.
+func randomMovImmediate(rng *rand.NumGen) int32 {
+	if len(SharedConfig.ImmediatePool) != 0 {
+		return randomImmediate(rng)
+	}
+	mode := SharedConfig.MovImmediateMode
+	if mode == ImmediateMixed {
+		mode = ImmediateMode(rng.RandRange(uint64(ImmediateFull), uint64(ImmediatePattern)))
+	}
+
+	switch mode {
+	case ImmediateSmall:
+		return int32(rng.RandRange(0, 255))
+	case ImmediatePattern:
+		// Half of the time use a single set bit instead of a pattern.
+		if rng.OneOf(2) {
+			return int32(uint32(1) << rng.RandRange(0, 31))
+		}
+		return int32(immediatePatterns[rng.RandRange(0, uint64(len(immediatePatterns)-1))])
+	default:
+		return int32(rng.RandRange(0, 0xFFFFFFFF))
+	}
 }
 
 func generateImmAluInstruction(op pb.AluOperationCode, insClass pb.InsClass, dstReg pb.Reg) *pb.Instruction {
-	value := int32(rand.SharedRNG.RandRange(0, 0xFFFFFFFF))
+	if op == pb.AluOperationCode_AluEnd {
+		width := []int32{16, 32, 64}[rand.SharedRNG.RandRange(0, 2)]
+		order := ToLE
+		if insClass == pb.InsClass_InsClassAlu && rand.SharedRNG.OneOf(2) {
+			order = ToBE
+		}
+		return newEndInstruction(insClass, dstReg, order, width)
+	}
+	return newAluInstruction(op, insClass, dstReg, pickImmediate(op, insClass, rand.SharedRNG))
+}
+
+// pickImmediate returns a random immediate, drawn from `rng`, that is valid
+// for the alu operation `op` of class `insClass`: shift amounts are below the
+// operand width, divisors are not 0 and negations use 0. Byte swaps are built
+// by newEndInstruction instead.
+func pickImmediate(op pb.AluOperationCode, insClass pb.InsClass, rng *rand.NumGen) int32 {
+	value := randomImmediate(rng)
 	switch op {
 	case pb.AluOperationCode_AluRsh, pb.AluOperationCode_AluLsh, pb.AluOperationCode_AluArsh:
 		var maxShift = int32(64)
@@ -220,16 +706,100 @@ func generateImmAluInstruction(op pb.AluOperationCode, insClass pb.InsClass, dst
 		}
 	case pb.AluOperationCode_AluNeg:
 		value = 0
+	case pb.AluOperationCode_AluMov:
+		value = randomMovImmediate(rng)
+	case pb.AluOperationCode_AluDiv, pb.AluOperationCode_AluMod:
+		if value == 0 {
+			value = nonZeroImmediate(rng)
+		}
+	case pb.AluOperationCode_AluAnd, pb.AluOperationCode_AluMul, pb.AluOperationCode_AluOr:
+		if SharedConfig.AvoidDegenerateImmediates && isDegenerateImmediate(op, value) {
+			value = nonDegenerateImmediate(op, rng)
+		}
 	}
+	return value
+}
 
-	return newAluInstruction(op, insClass, dstReg, value)
+// isDegenerateImmediate returns true if the alu operation `op` with `imm` as
+// source sets its dst register to a constant, see
+// GeneratorConfig.AvoidDegenerateImmediates.
+func isDegenerateImmediate(op pb.AluOperationCode, imm int32) bool {
+	switch op {
+	case pb.AluOperationCode_AluAnd, pb.AluOperationCode_AluMul:
+		return imm == 0
+	case pb.AluOperationCode_AluOr:
+		// The immediate is sign extended, -1 sets every bit of 64 bit
+		// operations as well.
+		return imm == -1
+	}
+	return false
+}
+
+// nonDegenerateImmediate returns a random immediate for `op` that is not
+// degenerate. If SharedConfig.ImmediatePool only has degenerate values one of
+// them is returned anyway.
+func nonDegenerateImmediate(op pb.AluOperationCode, rng *rand.NumGen) int32 {
+	if len(SharedConfig.ImmediatePool) == 0 {
+		for {
+			if imm := randomImmediate(rng); !isDegenerateImmediate(op, imm) {
+				return imm
+			}
+		}
+	}
+	if imm, ok := poolImmediate(func(imm int32) bool { return !isDegenerateImmediate(op, imm) }, rng); ok {
+		return imm
+	}
+	return randomImmediate(rng)
+}
+
+// nonZeroImmediate returns a random immediate other than 0, the divisor of
+// div and mod. If SharedConfig.ImmediatePool only has 0, 1 is returned.
+func nonZeroImmediate(rng *rand.NumGen) int32 {
+	if len(SharedConfig.ImmediatePool) == 0 {
+		for {
+			if imm := randomImmediate(rng); imm != 0 {
+				return imm
+			}
+		}
+	}
+	if imm, ok := poolImmediate(func(imm int32) bool { return imm != 0 }, rng); ok {
+		return imm
+	}
+	return 1
+}
+
+// poolImmediate returns a random immediate of SharedConfig.ImmediatePool for
+// which `keep` is true, or false if there is none.
+func poolImmediate(keep func(int32) bool, rng *rand.NumGen) (int32, bool) {
+	candidates := []int32{}
+	for _, imm := range SharedConfig.ImmediatePool {
+		if keep(imm) {
+			candidates = append(candidates, imm)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return candidates[rng.RandRange(0, uint64(len(candidates)-1))], true
+}
+
+func anyTakesRegSource(ops []pb.AluOperationCode) bool {
+	for _, op := range ops {
+		if IsValidAluSource(op, pb.SrcOperand_RegSrc) {
+			return true
+		}
+	}
+	return false
 }
 
 func generateRegAluInstruction(op pb.AluOperationCode, insClass pb.InsClass, dstReg pb.Reg) *pb.Instruction {
+	if !IsValidAluSource(op, pb.SrcOperand_RegSrc) && !anyTakesRegSource(SharedConfig.EnabledAluOps()) {
+		// Re-sampling would never end, stick to the immediate form.
+		return generateImmAluInstruction(op, insClass, dstReg)
+	}
 	srcReg := RandomRegister()
-	// Negation is not supported with Register as src.
-	for op == pb.AluOperationCode_AluNeg {
-		op = pb.AluOperationCode(rand.SharedRNG.RandRange(0x00, 0x0c) << 4)
+	for !IsValidAluSource(op, pb.SrcOperand_RegSrc) {
+		op = RandomAluOp()
 	}
 
 	return newAluInstruction(op, insClass, dstReg, srcReg)
@@ -0,0 +1,681 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+func TestRandomProgramRespectsInstructionLimit(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	limit := uint32(8)
+	SharedConfig.MaxInstructions = limit
+
+	for i := 0; i < 1000; i++ {
+		prog := RandomProgram(100)
+		if ExceedsInstructionLimit(prog, limit) {
+			t.Fatalf("ProgramSize(RandomProgram(100)) = %d, want <= %d", ProgramSize(prog), limit)
+		}
+		last := prog[len(prog)-1]
+		if last.GetJmpOpcode().GetOperationCode() != pb.JmpOperationCode_JmpExit {
+			t.Fatalf("RandomProgram(100) last instruction = %v, want Exit", last)
+		}
+	}
+}
+
+func TestExceedsInstructionLimit(t *testing.T) {
+	prog, err := InstructionSequence(
+		LdMapByFd(R1, 3),
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	// LdMapByFd takes two slots.
+	if got := ProgramSize(prog); got != 4 {
+		t.Errorf("ProgramSize() = %d, want 4", got)
+	}
+	if ExceedsInstructionLimit(prog, 4) {
+		t.Errorf("ExceedsInstructionLimit(prog, 4) = true, want false")
+	}
+	if !ExceedsInstructionLimit(prog, 3) {
+		t.Errorf("ExceedsInstructionLimit(prog, 3) = false, want true")
+	}
+}
+
+func TestRandomPointerSpillFill(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		seq := RandomPointerSpillFill()
+
+		var stores, loads []int32
+		for _, ins := range seq {
+			mem := ins.GetMemOpcode()
+			if mem == nil || mem.Size != pb.StLdSize_StLdSizeDW || mem.Mode != pb.StLdMode_StLdModeMEM {
+				continue
+			}
+			switch {
+			case mem.InstructionClass == pb.InsClass_InsClassStx && ins.DstReg == R10:
+				stores = append(stores, ins.Offset)
+			case mem.InstructionClass == pb.InsClass_InsClassLdx && ins.SrcReg == R10:
+				loads = append(loads, ins.Offset)
+			}
+		}
+
+		if len(stores) != 1 || len(loads) != 1 {
+			t.Fatalf("RandomPointerSpillFill() = %v, want exactly one DW spill and one DW fill", seq)
+		}
+		if stores[0] != loads[0] {
+			t.Errorf("spill offset = %d, fill offset = %d, want them to match", stores[0], loads[0])
+		}
+		if stores[0]%8 != 0 {
+			t.Errorf("spill offset = %d, want it 8 byte aligned", stores[0])
+		}
+	}
+}
+
+func TestSmallMovImmediates(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	SharedConfig.MovImmediateMode = ImmediateSmall
+
+	for i := 0; i < 10000; i++ {
+		ins := generateImmAluInstruction(pb.AluOperationCode_AluMov, pb.InsClass_InsClassAlu64, R1)
+		if ins.Immediate < 0 || ins.Immediate > 255 {
+			t.Fatalf("generateImmAluInstruction(AluMov) immediate = %d, want it in [0, 255]", ins.Immediate)
+		}
+	}
+}
+
+func TestJmpTaken(t *testing.T) {
+	tests := []struct {
+		testName string
+		op       pb.JmpOperationCode
+		insClass pb.InsClass
+		dst, src uint64
+		want     bool
+	}{
+		{"JEQ equal", pb.JmpOperationCode_JmpJEQ, pb.InsClass_InsClassJmp, 5, 5, true},
+		{"JGT unsigned", pb.JmpOperationCode_JmpJGT, pb.InsClass_InsClassJmp, 0xffffffffffffffff, 1, true},
+		{"JSGT signed", pb.JmpOperationCode_JmpJSGT, pb.InsClass_InsClassJmp, 0xffffffffffffffff, 1, false},
+		{"JSET no common bits", pb.JmpOperationCode_JmpJSET, pb.InsClass_InsClassJmp, 0x0f, 0xf0, false},
+		{"JEQ32 ignores upper bits", pb.JmpOperationCode_JmpJEQ, pb.InsClass_InsClassJmp32, 0x100000005, 5, true},
+		{"JSLT32 sign of lower bits", pb.JmpOperationCode_JmpJSLT, pb.InsClass_InsClassJmp32, 0x80000000, 0, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			if got := jmpTaken(tc.op, tc.insClass, tc.dst, tc.src); got != tc.want {
+				t.Errorf("jmpTaken(%v, %#x, %#x) = %v, want %v", tc.op, tc.dst, tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBiasedJmpInstruction(t *testing.T) {
+	for _, taken := range []bool{true, false} {
+		for i := 0; i < 1000; i++ {
+			seq := BiasedJmpInstruction(5, taken)
+			if len(seq) != 2 {
+				t.Fatalf("len(BiasedJmpInstruction()) = %d, want 2", len(seq))
+			}
+			init, jmp := seq[0], seq[1]
+			if init.DstReg != jmp.DstReg {
+				t.Fatalf("BiasedJmpInstruction() initializes %v but compares %v", init.DstReg, jmp.DstReg)
+			}
+			if !IsConditional(jmp.GetJmpOpcode().GetOperationCode()) || jmp.GetJmpOpcode().GetSource() != pb.SrcOperand_Immediate {
+				t.Fatalf("BiasedJmpInstruction()[1] = %v, want a conditional jmp against an immediate", jmp)
+			}
+			if jmp.Offset < 1 || jmp.Offset > 5 {
+				t.Fatalf("BiasedJmpInstruction() offset = %d, want it in [1, 5]", jmp.Offset)
+			}
+
+			// Mov64 and the jmp both sign extend their immediates.
+			dst := uint64(int64(init.Immediate))
+			src := uint64(int64(jmp.Immediate))
+			op := jmp.GetJmpOpcode()
+			if got := jmpTaken(op.OperationCode, op.InstructionClass, dst, src); got != taken {
+				t.Fatalf("BiasedJmpInstruction(taken = %v) generated %v, %v which evaluates to %v", taken, init, jmp, got)
+			}
+		}
+	}
+}
+
+func TestRandomProgramBiasedJmps(t *testing.T) {
+	withTestGlobals(t, 1)
+	SharedConfig.BiasedJmpPercentage = 100
+	SharedConfig.TakenJmpPercentage = 100
+
+	for i := 0; i < 100; i++ {
+		prog := RandomProgram(50)
+		if len(prog) != 51 {
+			t.Fatalf("len(RandomProgram(50)) = %d, want 51", len(prog))
+		}
+		if _, err := NewControlFlowGraph(prog); err != nil {
+			t.Fatalf("RandomProgram() produced jumps out of the program: %v", err)
+		}
+		for j, ins := range prog {
+			if !isBranch(ins) {
+				continue
+			}
+			init := prog[j-1]
+			if init.GetAluOpcode().GetOperationCode() != pb.AluOperationCode_AluMov || init.DstReg != ins.DstReg {
+				// With only two instructions left there is no room for
+				// the dst init, a regular jmp is generated instead.
+				if j == len(prog)-3 {
+					continue
+				}
+				t.Fatalf("RandomProgram() jmp %d = %v is not preceded by a dst init", j, ins)
+			}
+			op := ins.GetJmpOpcode()
+			if !jmpTaken(op.OperationCode, op.InstructionClass, uint64(int64(init.Immediate)), uint64(int64(ins.Immediate))) {
+				t.Fatalf("RandomProgram() jmp %d = %v is not taken", j, ins)
+			}
+		}
+	}
+}
+
+type recordingTracer struct {
+	steps     []int
+	initRegs  []pb.Reg
+	lastInstr *pb.Instruction
+}
+
+func (r *recordingTracer) OnInstruction(step int, instruction *pb.Instruction) {
+	r.steps = append(r.steps, step)
+	r.lastInstr = instruction
+}
+
+func (r *recordingTracer) OnRegisterInit(reg pb.Reg) {
+	r.initRegs = append(r.initRegs, reg)
+}
+
+func TestGenerationTracer(t *testing.T) {
+	withTestGlobals(t, 1)
+	tracer := &recordingTracer{}
+	SharedConfig.BiasedJmpPercentage = 100
+	SharedConfig.Tracer = tracer
+
+	prog := RandomProgram(100)
+	if len(tracer.steps) != len(prog) {
+		t.Fatalf("OnInstruction() called %d times, want %d", len(tracer.steps), len(prog))
+	}
+	for i, step := range tracer.steps {
+		if step != i {
+			t.Fatalf("OnInstruction() call %d got step %d, want %d", i, step, i)
+		}
+	}
+	if tracer.lastInstr != prog[len(prog)-1] {
+		t.Errorf("last OnInstruction() instruction = %v, want %v", tracer.lastInstr, prog[len(prog)-1])
+	}
+}
+
+func TestRandomJmpInstructionJSETMasks(t *testing.T) {
+	found := 0
+	for i := 0; i < 5000; i++ {
+		ins := RandomJmpInstruction(10)
+		opcode := ins.GetJmpOpcode()
+		if opcode.OperationCode != pb.JmpOperationCode_JmpJSET || opcode.Source != pb.SrcOperand_Immediate {
+			continue
+		}
+		found++
+
+		if ins.Immediate == 0 {
+			t.Fatalf("RandomJmpInstruction() generated JSET with a zero mask")
+		}
+		encoding, err := encodeInstruction(ins)
+		if err != nil {
+			t.Fatalf("unexpected error when ecoding: %v", err)
+		}
+		if got := uint8(encoding[0]) & 0xf0; got != uint8(pb.JmpOperationCode_JmpJSET) {
+			t.Fatalf("JSET encoded operation = %#x, want %#x", got, uint8(pb.JmpOperationCode_JmpJSET))
+		}
+		if got := int32(encoding[0] >> 32); got != ins.Immediate {
+			t.Fatalf("JSET encoded mask = %#x, want %#x", got, ins.Immediate)
+		}
+	}
+	if found == 0 {
+		t.Fatalf("RandomJmpInstruction() never generated a JSET against an immediate")
+	}
+}
+
+func TestGenerationIsReproducible(t *testing.T) {
+	withTestGlobals(t, 1)
+	SharedConfig.BiasedJmpPercentage = 50
+	SharedConfig.MovImmediateMode = ImmediateMixed
+
+	generate := func() ([]pb.Reg, []*pb.Instruction) {
+		rand.SharedRNG = rand.NewRand(mrand.NewSource(42))
+		regs := []pb.Reg{}
+		for i := 0; i < 100; i++ {
+			regs = append(regs, RandomRegister())
+		}
+		return regs, RandomProgram(200)
+	}
+
+	firstRegs, firstProg := generate()
+	secondRegs, secondProg := generate()
+
+	for i := range firstRegs {
+		if firstRegs[i] != secondRegs[i] {
+			t.Fatalf("RandomRegister() call %d = %v, then %v with the same seed", i, firstRegs[i], secondRegs[i])
+		}
+	}
+	if len(firstProg) != len(secondProg) {
+		t.Fatalf("RandomProgram() lengths differ with the same seed: %d vs %d", len(firstProg), len(secondProg))
+	}
+	for i := range firstProg {
+		if !protobuf.Equal(firstProg[i], secondProg[i]) {
+			t.Fatalf("RandomProgram()[%d] = %v, then %v with the same seed", i, firstProg[i], secondProg[i])
+		}
+	}
+}
+
+func TestRandomSubregisterSequence(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		seq := RandomSubregisterSequence(R6, 10)
+		if len(seq) != 10 {
+			t.Fatalf("len(RandomSubregisterSequence()) = %d, want 10", len(seq))
+		}
+
+		classes := map[pb.InsClass]bool{}
+		for j, ins := range seq {
+			if ins.DstReg != R6 {
+				t.Fatalf("RandomSubregisterSequence()[%d].DstReg = %v, want %v", j, ins.DstReg, R6)
+			}
+			classes[ins.GetAluOpcode().GetInstructionClass()] = true
+		}
+		if !classes[pb.InsClass_InsClassAlu] || !classes[pb.InsClass_InsClassAlu64] {
+			t.Fatalf("RandomSubregisterSequence() classes = %v, want both 32 and 64 bit alu", classes)
+		}
+		if last := seq[len(seq)-1].GetAluOpcode().GetInstructionClass(); last != pb.InsClass_InsClassAlu {
+			t.Fatalf("RandomSubregisterSequence() last class = %v, want %v", last, pb.InsClass_InsClassAlu)
+		}
+	}
+}
+
+func TestRandomJoinPoint(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		seq, bound := RandomJoinPoint(R1, R6, 3)
+		prog := append(seq, Mov64(R0, 0), Exit())
+
+		cfg, err := NewControlFlowGraph(prog)
+		if err != nil {
+			t.Fatalf("NewControlFlowGraph() error = %v", err)
+		}
+
+		var join *BasicBlock
+		for _, block := range cfg.Blocks {
+			if block.Start == len(seq) {
+				join = block
+			}
+		}
+		if join == nil || len(join.Predecessors) != 2 {
+			t.Fatalf("RandomJoinPoint() join block = %+v, want one reachable from two branches", join)
+		}
+
+		histories := [][]*pb.Instruction{}
+		for _, predecessor := range join.Predecessors {
+			writes := []*pb.Instruction{}
+			for _, ins := range cfg.Instructions(cfg.Blocks[predecessor]) {
+				if ins.GetAluOpcode() != nil && ins.DstReg == R6 {
+					writes = append(writes, ins)
+				}
+			}
+			histories = append(histories, writes)
+		}
+		if len(histories[0]) == 0 || len(histories[1]) == 0 {
+			t.Fatalf("RandomJoinPoint() arms do not both write R6: %v", histories)
+		}
+		last0 := histories[0][len(histories[0])-1]
+		last1 := histories[1][len(histories[1])-1]
+		if protobuf.Equal(last0, last1) {
+			t.Fatalf("RandomJoinPoint() arms end on the same write %v", last0)
+		}
+
+		wantBound := last0.GetImmediate()
+		if last1.GetImmediate() < wantBound {
+			wantBound = last1.GetImmediate()
+		}
+		if bound != wantBound || bound > 0xff {
+			t.Fatalf("RandomJoinPoint() bound = %#x, want the narrow mask %#x", bound, wantBound)
+		}
+	}
+}
+
+func TestRandomMapLookupMapSize(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	for _, size := range []uint32{0, 4} {
+		SharedConfig = DefaultGeneratorConfig()
+		SharedConfig.MapSize = size
+		elements := SharedConfig.MapElements()
+
+		for i := 0; i < 1000; i++ {
+			lookup, err := RandomMapLookup(R9, R10, -4)
+			if err != nil {
+				t.Fatalf("RandomMapLookup() error = %v", err)
+			}
+
+			keys := 0
+			for _, ins := range lookup {
+				if ins.GetMemOpcode().GetInstructionClass() != pb.InsClass_InsClassSt {
+					continue
+				}
+				keys++
+				if key := uint32(ins.Immediate); key >= elements {
+					t.Fatalf("RandomMapLookup() with MapSize %d key = %d, want it below %d", size, key, elements)
+				}
+			}
+			if keys != 1 {
+				t.Fatalf("RandomMapLookup() stores %d keys, want 1", keys)
+			}
+		}
+	}
+}
+
+func TestDisabledAluOps(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	SharedConfig.AluOps = AluOpsExcept(pb.AluOperationCode_AluDiv, pb.AluOperationCode_AluMod)
+
+	for i := 0; i < 10000; i++ {
+		ins := RandomAluInstruction()
+		switch op := ins.GetAluOpcode().GetOperationCode(); op {
+		case pb.AluOperationCode_AluDiv, pb.AluOperationCode_AluMod:
+			t.Fatalf("RandomAluInstruction() op = %v, want div and mod to be disabled", op)
+		}
+	}
+}
+
+func TestAluOpsWithoutRegisterForm(t *testing.T) {
+	withTestGlobals(t, 1)
+	SharedConfig.AluOps = []pb.AluOperationCode{pb.AluOperationCode_AluNeg}
+
+	// Neg has no register form, generating one must not spin forever.
+	ins := generateRegAluInstruction(pb.AluOperationCode_AluNeg, pb.InsClass_InsClassAlu64, R1)
+	if got := ins.GetAluOpcode().GetSource(); got != pb.SrcOperand_Immediate {
+		t.Errorf("generateRegAluInstruction(AluNeg) source = %v, want %v", got, pb.SrcOperand_Immediate)
+	}
+}
+
+func TestRegSrcPercentage(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	tests := []struct {
+		name       string
+		percentage uint32
+		want       pb.SrcOperand
+	}{
+		{"all registers", 100, pb.SrcOperand_RegSrc},
+		{"all immediates", 0, pb.SrcOperand_Immediate},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SharedConfig = DefaultGeneratorConfig()
+			SharedConfig.RegSrcPercentage = tc.percentage
+			for i := 0; i < 10000; i++ {
+				if got := RandomAluInstruction().GetAluOpcode().GetSource(); got != tc.want {
+					t.Fatalf("RandomAluInstruction() source = %v, want %v", got, tc.want)
+				}
+				if got := RandomJmpInstruction(10).GetJmpOpcode().GetSource(); got != tc.want {
+					t.Fatalf("RandomJmpInstruction() source = %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestImmediatePool(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	SharedConfig.ImmediatePool = InterestingImmediates()
+	SharedConfig.RegSrcPercentage = 0
+
+	inPool := map[int32]bool{}
+	for _, imm := range SharedConfig.ImmediatePool {
+		inPool[imm] = true
+	}
+
+	for i := 0; i < 10000; i++ {
+		alu := RandomAluInstruction()
+		switch alu.GetAluOpcode().GetOperationCode() {
+		case pb.AluOperationCode_AluLsh, pb.AluOperationCode_AluRsh, pb.AluOperationCode_AluArsh, pb.AluOperationCode_AluNeg:
+			// Shift amounts and the negation immediate are fixed up.
+		case pb.AluOperationCode_AluDiv, pb.AluOperationCode_AluMod:
+			// The pool has 0, which must not be used as a divisor.
+			if alu.Immediate == 0 || !inPool[alu.Immediate] {
+				t.Fatalf("RandomAluInstruction() = %v, want a non zero divisor from the pool", alu)
+			}
+		default:
+			if !inPool[alu.Immediate] {
+				t.Fatalf("RandomAluInstruction() = %v, immediate %#x is not in the pool", alu, alu.Immediate)
+			}
+		}
+
+		jmp := RandomJmpInstruction(10)
+		if !inPool[jmp.Immediate] {
+			t.Fatalf("RandomJmpInstruction() = %v, immediate %#x is not in the pool", jmp, jmp.Immediate)
+		}
+	}
+}
+
+func TestAvoidDegenerateImmediates(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	// The interesting immediates have 0 and -1, every one of them would
+	// show up in 10000 instructions.
+	SharedConfig.ImmediatePool = InterestingImmediates()
+	SharedConfig.RegSrcPercentage = 0
+	SharedConfig.AluOps = []pb.AluOperationCode{pb.AluOperationCode_AluAnd, pb.AluOperationCode_AluMul, pb.AluOperationCode_AluOr}
+
+	for _, avoid := range []bool{false, true} {
+		SharedConfig.AvoidDegenerateImmediates = avoid
+		degenerate := 0
+		for i := 0; i < 10000; i++ {
+			alu := RandomAluInstruction()
+			if isDegenerateImmediate(alu.GetAluOpcode().GetOperationCode(), alu.Immediate) {
+				degenerate++
+			}
+		}
+		if avoid && degenerate != 0 {
+			t.Errorf("RandomAluInstruction() avoiding degenerate immediates generated %d of them", degenerate)
+		}
+		if !avoid && degenerate == 0 {
+			t.Errorf("RandomAluInstruction() generated no degenerate immediate, want them allowed by default")
+		}
+	}
+
+	for _, op := range SharedConfig.AluOps {
+		if isDegenerateImmediate(op, 1) {
+			t.Errorf("isDegenerateImmediate(%v, 1) = true, want false", op)
+		}
+	}
+	SharedConfig.ImmediatePool = []int32{0}
+	if got := nonDegenerateImmediate(pb.AluOperationCode_AluMul, rand.SharedRNG); got != 0 {
+		t.Errorf("nonDegenerateImmediate() with a pool of only 0 = %d, want 0", got)
+	}
+}
+
+func TestRandomEndInstructions(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	SharedConfig.AluOps = []pb.AluOperationCode{pb.AluOperationCode_AluEnd, pb.AluOperationCode_AluAdd}
+	SharedConfig.RegSrcPercentage = 50
+
+	ends := 0
+	for i := 0; i < 1000; i++ {
+		alu := RandomAluInstruction()
+		op := alu.GetAluOpcode()
+		if op.GetOperationCode() != pb.AluOperationCode_AluEnd {
+			continue
+		}
+		ends++
+		if alu.SrcReg != R0 {
+			t.Fatalf("RandomAluInstruction() = %s, want src register r0 for a byte swap", InstructionString(alu))
+		}
+		if _, err := NewEndInstruction(op.GetInstructionClass(), alu.DstReg, op.GetSource(), alu.Immediate); err != nil {
+			t.Fatalf("RandomAluInstruction() = %s, not a valid byte swap: %v", InstructionString(alu), err)
+		}
+	}
+	if ends == 0 {
+		t.Errorf("RandomAluInstruction() generated no byte swap")
+	}
+}
+
+func TestDistinctJmpRegisters(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	tests := []struct {
+		name     string
+		distinct bool
+	}{
+		{"self comparisons allowed", false},
+		{"distinct registers", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SharedConfig = DefaultGeneratorConfig()
+			SharedConfig.RegSrcPercentage = 100
+			SharedConfig.DistinctJmpRegisters = tc.distinct
+			selfComparison := false
+			for i := 0; i < 10000; i++ {
+				jmp := RandomJmpInstruction(10)
+				if jmp.DstReg == jmp.SrcReg {
+					selfComparison = true
+					break
+				}
+			}
+			if selfComparison == tc.distinct {
+				t.Errorf("RandomJmpInstruction() generated a self comparison = %v, want %v", selfComparison, !tc.distinct)
+			}
+		})
+	}
+}
+
+// undecidableOnU32 returns true if the conditional jmp `i` is taken for some
+// 32 bit values of its dst register and not taken for others.
+func undecidableOnU32(i *pb.Instruction) bool {
+	op := i.GetJmpOpcode()
+	if op == nil || !IsConditional(op.OperationCode) || op.Source != pb.SrcOperand_Immediate {
+		return false
+	}
+	is32 := op.InstructionClass == pb.InsClass_InsClassJmp32
+	imm := uint64(int64(i.Immediate))
+	if is32 {
+		imm = uint64(uint32(i.Immediate))
+	}
+	taken := func(v uint64) bool {
+		a, b := v, imm
+		sa, sb := int64(a), int64(b)
+		if is32 {
+			sa, sb = int64(int32(a)), int64(int32(b))
+		}
+		switch op.OperationCode {
+		case pb.JmpOperationCode_JmpJEQ:
+			return a == b
+		case pb.JmpOperationCode_JmpJNE:
+			return a != b
+		case pb.JmpOperationCode_JmpJGT:
+			return a > b
+		case pb.JmpOperationCode_JmpJGE:
+			return a >= b
+		case pb.JmpOperationCode_JmpJLT:
+			return a < b
+		case pb.JmpOperationCode_JmpJLE:
+			return a <= b
+		case pb.JmpOperationCode_JmpJSET:
+			return a&b != 0
+		case pb.JmpOperationCode_JmpJSGT:
+			return sa > sb
+		case pb.JmpOperationCode_JmpJSGE:
+			return sa >= sb
+		case pb.JmpOperationCode_JmpJSLT:
+			return sa < sb
+		case pb.JmpOperationCode_JmpJSLE:
+			return sa <= sb
+		}
+		return false
+	}
+	u := uint32(i.Immediate)
+	seen := map[bool]bool{}
+	for _, v := range []uint32{0, 1, u - 1, u, u + 1, 0x7fffffff, 0x80000000, 0xffffffff} {
+		seen[taken(uint64(v))] = true
+	}
+	return seen[true] && seen[false]
+}
+
+func TestRandomUnknownBranch(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	for i := 0; i < 1000; i++ {
+		branch := randomUnknownBranch(R6, 1)
+		if !undecidableOnU32(branch) {
+			t.Fatalf("randomUnknownBranch() = %s, can be decided for a u32", InstructionString(branch))
+		}
+	}
+}
+
+func TestTypeConfusionJoin(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	for i := 0; i < 100; i++ {
+		pointerArm := []*pb.Instruction{Mov64(R7, R10), Add64(R7, -8)}
+		join, err := TypeConfusionJoin(R6, R7, pointerArm)
+		if err != nil {
+			t.Fatalf("TypeConfusionJoin() unexpected error: %v", err)
+		}
+		if !undecidableOnU32(join[0]) {
+			t.Fatalf("TypeConfusionJoin() branch %s can be decided for a u32, one arm is dead", InstructionString(join[0]))
+		}
+		prog := []*pb.Instruction{LdW(R6, R1, 0)}
+		prog = append(prog, join...)
+		deref := len(prog)
+		prog = append(prog, LdDW(R0, R7, 0), Exit())
+		if err := Validate(prog); err != nil {
+			t.Fatalf("Validate() = %v\n%s", err, ProgramString(prog))
+		}
+
+		// The dereference must be reached by both the pointer and the
+		// scalar definitions of R7.
+		defUse, err := DefUse(prog)
+		if err != nil {
+			t.Fatalf("DefUse() unexpected error: %v", err)
+		}
+		pointer, scalar := false, false
+		for _, def := range defUse[deref] {
+			switch {
+			case protobuf.Equal(prog[def], pointerArm[len(pointerArm)-1]):
+				pointer = true
+			case prog[def].GetAluOpcode().GetOperationCode() == pb.AluOperationCode_AluMov && prog[def].GetAluOpcode().GetSource() == pb.SrcOperand_Immediate:
+				scalar = true
+			}
+		}
+		if !pointer || !scalar {
+			t.Fatalf("DefUse()[%d] = %v, want both a pointer and a scalar definition\n%s", deref, defUse[deref], ProgramString(prog))
+		}
+	}
+
+	if _, err := TypeConfusionJoin(R6, R7, nil); err == nil {
+		t.Errorf("TypeConfusionJoin() with an empty pointer arm error = nil, want an error")
+	}
+}
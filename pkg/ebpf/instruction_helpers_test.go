@@ -15,10 +15,13 @@
 package ebpf
 
 import (
+	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 
 	pb "buzzer/proto/ebpf_go_proto"
+	protobuf "github.com/golang/protobuf/proto"
 )
 
 func TestInstructionChainHelperTest(t *testing.T) {
@@ -67,3 +70,727 @@ func TestInstructionChainHelperTest(t *testing.T) {
 		})
 	}
 }
+
+// jmpOverNops returns a jmp over `count` instructions followed by an Exit.
+func jmpOverNops(count int) []*pb.Instruction {
+	program := []*pb.Instruction{Jmp(int16(count))}
+	for i := 0; i < count; i++ {
+		program = append(program, Mov64(R0, 0))
+	}
+	return append(program, Exit())
+}
+
+func TestInsertInstruction(t *testing.T) {
+	tests := []struct {
+		testName    string
+		program     []*pb.Instruction
+		index       int
+		instruction *pb.Instruction
+		want        []*pb.Instruction
+		wantErr     bool
+	}{
+		{
+			testName: "Insert before jump target",
+			program: []*pb.Instruction{
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			index:       2,
+			instruction: Mov64(R1, 2),
+			want: []*pb.Instruction{
+				JmpGT(R0, 0, 2),
+				Mov64(R0, 1),
+				Mov64(R1, 2),
+				Exit(),
+			},
+		},
+		{
+			testName: "Insert before backwards jump",
+			program: []*pb.Instruction{
+				Mov64(R0, 0),
+				Add64(R0, 1),
+				JmpLT(R0, 10, -2),
+				Exit(),
+			},
+			index:       2,
+			instruction: Mov64(R1, 2),
+			want: []*pb.Instruction{
+				Mov64(R0, 0),
+				Add64(R0, 1),
+				Mov64(R1, 2),
+				JmpLT(R0, 10, -3),
+				Exit(),
+			},
+		},
+		{
+			testName: "Insert outside of jump span",
+			program: []*pb.Instruction{
+				Mov64(R0, 0),
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			index:       0,
+			instruction: Mov64(R1, 2),
+			want: []*pb.Instruction{
+				Mov64(R1, 2),
+				Mov64(R0, 0),
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+		},
+		{
+			testName: "Insert wide instruction inside jump span",
+			program: []*pb.Instruction{
+				Jmp(1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			index:       1,
+			instruction: LdMapByFd(R1, 3),
+			want: []*pb.Instruction{
+				Jmp(3),
+				LdMapByFd(R1, 3),
+				Mov64(R0, 1),
+				Exit(),
+			},
+		},
+		{
+			testName:    "Jump offset overflows",
+			program:     jmpOverNops(32767),
+			index:       1,
+			instruction: Mov64(R1, 2),
+			wantErr:     true,
+		},
+		{
+			testName:    "Index out of range",
+			program:     []*pb.Instruction{Exit()},
+			index:       2,
+			instruction: Mov64(R1, 2),
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := InsertInstruction(tc.program, tc.index, tc.instruction)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("InsertInstruction() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("len(InsertInstruction()) = %d, want %d", len(got), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(got[i], tc.want[i]) {
+					t.Errorf("InsertInstruction()[%d] = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveInstruction(t *testing.T) {
+	tests := []struct {
+		testName string
+		program  []*pb.Instruction
+		index    int
+		want     []*pb.Instruction
+		wantErr  bool
+	}{
+		{
+			testName: "Remove inside jump span",
+			program: []*pb.Instruction{
+				JmpGT(R0, 0, 2),
+				Mov64(R0, 1),
+				Mov64(R1, 2),
+				Exit(),
+			},
+			index: 2,
+			want: []*pb.Instruction{
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+		},
+		{
+			testName: "Remove inside backwards jump span",
+			program: []*pb.Instruction{
+				Mov64(R0, 0),
+				Add64(R0, 1),
+				Mov64(R1, 2),
+				JmpLT(R0, 10, -3),
+				Exit(),
+			},
+			index: 2,
+			want: []*pb.Instruction{
+				Mov64(R0, 0),
+				Add64(R0, 1),
+				JmpLT(R0, 10, -2),
+				Exit(),
+			},
+		},
+		{
+			testName: "Remove the jump itself",
+			program: []*pb.Instruction{
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			index: 0,
+			want: []*pb.Instruction{
+				Mov64(R0, 1),
+				Exit(),
+			},
+		},
+		{
+			testName: "Remove jump target",
+			program: []*pb.Instruction{
+				JmpGT(R0, 0, 1),
+				Mov64(R0, 1),
+				Mov64(R1, 2),
+				Exit(),
+			},
+			index:   2,
+			wantErr: true,
+		},
+		{
+			testName: "Index out of range",
+			program:  []*pb.Instruction{Exit()},
+			index:    1,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := RemoveInstruction(tc.program, tc.index)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("RemoveInstruction() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("len(RemoveInstruction()) = %d, want %d", len(got), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(got[i], tc.want[i]) {
+					t.Errorf("RemoveInstruction()[%d] = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplaceInstruction(t *testing.T) {
+	tests := []struct {
+		testName    string
+		program     []*pb.Instruction
+		index       int
+		instruction *pb.Instruction
+		want        []*pb.Instruction
+		wantErr     bool
+	}{
+		{
+			testName: "Replace jump target with same width",
+			program: []*pb.Instruction{
+				Mov64(R0, 0),
+				JmpGT(R1, 0, 1),
+				Add64(R0, 1),
+				Sub64(R0, 1),
+				JmpLT(R0, 10, -3),
+				Exit(),
+			},
+			index:       3,
+			instruction: Xor64(R0, 2),
+			want: []*pb.Instruction{
+				Mov64(R0, 0),
+				JmpGT(R1, 0, 1),
+				Add64(R0, 1),
+				Xor64(R0, 2),
+				JmpLT(R0, 10, -3),
+				Exit(),
+			},
+		},
+		{
+			testName: "Replace with wider instruction",
+			program: []*pb.Instruction{
+				JmpGT(R1, 0, 2),
+				Mov64(R2, 1),
+				Add64(R0, R2),
+				JmpLT(R0, 10, -3),
+				Exit(),
+			},
+			index:       1,
+			instruction: LdImm64(R2, 1<<40),
+			want: []*pb.Instruction{
+				JmpGT(R1, 0, 3),
+				LdImm64(R2, 1<<40),
+				Add64(R0, R2),
+				JmpLT(R0, 10, -4),
+				Exit(),
+			},
+		},
+		{
+			testName: "Replace jump with a jump out of the program",
+			program: []*pb.Instruction{
+				JmpGT(R1, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			index:       0,
+			instruction: JmpGT(R1, 0, 5),
+			wantErr:     true,
+		},
+		{
+			testName:    "Index out of range",
+			program:     []*pb.Instruction{Exit()},
+			index:       1,
+			instruction: Mov64(R0, 0),
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := ReplaceInstruction(tc.program, tc.index, tc.instruction)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ReplaceInstruction() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("len(ReplaceInstruction()) = %d, want %d", len(got), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(got[i], tc.want[i]) {
+					t.Errorf("ReplaceInstruction()[%d] = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	program := []*pb.Instruction{
+		Mov64(R0, 0),
+		JmpGT(R1, 0, 3),
+		LdImm64(R2, 1<<40),
+		Add64(R0, R2),
+		JmpLT(R0, 10, -4),
+		Exit(),
+	}
+	tests := []struct {
+		testName string
+		n        int
+		want     []*pb.Instruction
+		wantErr  bool
+	}{
+		{
+			testName: "Jump out of the prefix lands on the exit",
+			n:        2,
+			want:     []*pb.Instruction{Mov64(R0, 0), JmpGT(R1, 0, 0), Exit()},
+		},
+		{
+			testName: "Jump over a wide instruction",
+			n:        3,
+			want:     []*pb.Instruction{Mov64(R0, 0), JmpGT(R1, 0, 2), LdImm64(R2, 1<<40), Exit()},
+		},
+		{
+			testName: "Backwards jump is kept",
+			n:        5,
+			want:     []*pb.Instruction{Mov64(R0, 0), JmpGT(R1, 0, 3), LdImm64(R2, 1<<40), Add64(R0, R2), JmpLT(R0, 10, -4), Exit()},
+		},
+		{
+			testName: "Whole program",
+			n:        6,
+			want:     program,
+		},
+		{
+			testName: "Empty prefix",
+			n:        0,
+			want:     []*pb.Instruction{Exit()},
+		},
+		{
+			testName: "Length out of range",
+			n:        7,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := Prefix(program, tc.n)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Prefix() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("len(Prefix()) = %d, want %d", len(got), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(got[i], tc.want[i]) {
+					t.Errorf("Prefix()[%d] = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+
+	if program[1].Offset != 3 {
+		t.Errorf("Prefix() modified the original program, jmp offset = %d, want 3", program[1].Offset)
+	}
+}
+
+func TestPrefixesAreLoadable(t *testing.T) {
+	header := []*pb.Instruction{}
+	for reg := R0; reg <= R9; reg++ {
+		header = append(header, Mov64(reg, 0))
+	}
+	program := append(header, RandomProgram(50)...)
+
+	for n := 0; n <= len(program); n++ {
+		prefix, err := Prefix(program, n)
+		if err != nil {
+			t.Fatalf("Prefix(%d) error = %v", n, err)
+		}
+		if len(prefix) != n+1 && (len(prefix) != n || !isExit(prefix[n-1])) {
+			t.Errorf("len(Prefix(%d)) = %d, want %d, or %d ending in an exit", n, len(prefix), n+1, n)
+		}
+		if n < len(header) {
+			continue
+		}
+		if err := Validate(prefix); err != nil {
+			t.Errorf("Validate(Prefix(%d)) error = %v\n%s", n, err, ProgramString(prefix))
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	head := []*pb.Instruction{
+		Mov64(R0, 0),
+		JmpEQ(R1, 0, 2),
+		LdImm64(R0, 1<<40),
+	}
+	tail := []*pb.Instruction{
+		Add64(R0, 1),
+		Exit(),
+	}
+	want := []*pb.Instruction{
+		Mov64(R0, 0),
+		JmpEQ(R1, 0, 2),
+		LdImm64(R0, 1<<40),
+		Add64(R0, 1),
+		Exit(),
+	}
+
+	got, err := Append(head, tail)
+	if err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	if len(got) != len(head)+len(tail) {
+		t.Fatalf("len(Append()) = %d, want %d", len(got), len(head)+len(tail))
+	}
+
+	encode := func(instructions []*pb.Instruction) []byte {
+		t.Helper()
+		bytecode, _, err := EncodeInstructions(&pb.Program{Functions: []*pb.Functions{{Instructions: instructions}}})
+		if err != nil {
+			t.Fatalf("EncodeInstructions() error = %v", err)
+		}
+		return bytecode
+	}
+	if gotBytes, wantBytes := encode(got), encode(want); !bytes.Equal(gotBytes, wantBytes) {
+		t.Errorf("EncodeInstructions(Append()) = %x, want %x", gotBytes, wantBytes)
+	}
+
+	if _, err := Append(want, tail); err == nil {
+		t.Errorf("Append() after an exit error = nil, want an error")
+	}
+	if _, err := Append(head, []*pb.Instruction{Jmp(1)}); err == nil {
+		t.Errorf("Append() with a tail jumping outside of it error = nil, want an error")
+	}
+}
+
+func TestWalkVisitsWideInstructionsOnce(t *testing.T) {
+	prog, err := InstructionSequence(
+		Mov64(R0, 0),
+		LdImm64(R1, 0x100000001),
+		Add64(R0, R1),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	gotSlots := []int{}
+	gotInstructions := []*pb.Instruction{}
+	err = Walk(prog, func(slot int, i *pb.Instruction) error {
+		gotSlots = append(gotSlots, slot)
+		gotInstructions = append(gotInstructions, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+
+	wantSlots := []int{0, 1, 3, 4}
+	if !reflect.DeepEqual(gotSlots, wantSlots) {
+		t.Errorf("Walk() slots = %v, want %v", gotSlots, wantSlots)
+	}
+	for i := range prog {
+		if gotInstructions[i] != prog[i] {
+			t.Errorf("Walk() visited %v at position %d, want %v", gotInstructions[i], i, prog[i])
+		}
+	}
+}
+
+func TestNewProgram(t *testing.T) {
+	instructions, err := InstructionSequence(
+		Mov64(R0, 0),
+		LdImm64(R1, 1<<40),
+		JmpGT(R1, 0, 1),
+		Mov64(R0, 1),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+
+	program, err := NewProgram(instructions)
+	if err != nil {
+		t.Fatalf("NewProgram() error = %v", err)
+	}
+	if program.ProgType != ProgTypeSocketFilter {
+		t.Errorf("NewProgram().ProgType = %d, want %d", program.ProgType, ProgTypeSocketFilter)
+	}
+	got := ProgramInstructions(program)
+	if size := ProgramSize(got); size != 6 {
+		t.Errorf("ProgramSize(NewProgram()) = %d, want 6", size)
+	}
+	for i, inst := range got {
+		if inst.Id != uint32(i+1) {
+			t.Errorf("NewProgram() instruction %d id = %d, want %d", i, inst.Id, i+1)
+		}
+	}
+
+	bytecode, err := GenerateBytecode(program)
+	if err != nil {
+		t.Fatalf("GenerateBytecode() error = %v", err)
+	}
+	want := []uint64{0xb7, 0x118, 0x10000000000, 0x10125, 0x1000000b7, 0x95}
+	if !reflect.DeepEqual(bytecode, want) {
+		t.Errorf("GenerateBytecode(NewProgram()) = %#x, want %#x", bytecode, want)
+	}
+
+	if _, err := NewProgram(nil); err == nil {
+		t.Errorf("NewProgram() of no instructions error = nil, want an error")
+	}
+	far := JmpGT(R0, 0, 0)
+	far.Offset = 40000
+	if _, err := NewProgram([]*pb.Instruction{Mov64(R0, 0), far, Exit()}); err == nil {
+		t.Errorf("NewProgram() of a malformed sequence error = nil, want an error")
+	}
+}
+
+func TestProgramInstructions(t *testing.T) {
+	program := &pb.Program{
+		Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{Mov64(R0, 0), LdImm64(R1, 0x100000001), Call(1), Exit()}},
+			{Instructions: []*pb.Instruction{LdImm64(R0, 1<<40), Add64(R0, 1), Exit()}},
+		},
+	}
+
+	instructions := ProgramInstructions(program)
+	if len(instructions) != 7 {
+		t.Fatalf("len(ProgramInstructions()) = %d, want 7", len(instructions))
+	}
+	// Each of the two double word loads takes an extra slot.
+	if size := ProgramSize(instructions); size != len(instructions)+2 {
+		t.Errorf("ProgramSize(ProgramInstructions()) = %d, want %d", size, len(instructions)+2)
+	}
+
+	bytecode, err := GenerateBytecode(program)
+	if err != nil {
+		t.Fatalf("GenerateBytecode() error = %v", err)
+	}
+	if len(bytecode) != ProgramSize(instructions) {
+		t.Fatalf("len(GenerateBytecode()) = %d, want %d", len(bytecode), ProgramSize(instructions))
+	}
+	err = Walk(instructions, func(slot int, i *pb.Instruction) error {
+		encoding, err := encodeInstruction(i)
+		if err != nil {
+			return err
+		}
+		for offset, want := range encoding {
+			if bytecode[slot+offset] != want {
+				t.Errorf("GenerateBytecode()[%d] = %#x, want %#x (%s)", slot+offset, bytecode[slot+offset], want, InstructionString(i))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+}
+
+func TestWalkStopsOnError(t *testing.T) {
+	prog := []*pb.Instruction{Mov64(R0, 0), Exit()}
+	wantErr := errors.New("stop")
+
+	visits := 0
+	err := Walk(prog, func(slot int, i *pb.Instruction) error {
+		visits++
+		return wantErr
+	})
+	if err != wantErr || visits != 1 {
+		t.Errorf("Walk() = %v after %d visits, want %v after 1", err, visits, wantErr)
+	}
+}
+
+func TestStackDepth(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         int
+	}{
+		{
+			name:         "stores off r10",
+			instructions: []*pb.Instruction{StDW(R10, 0, -256), StDW(R10, 1, -8), Exit()},
+			want:         256,
+		},
+		{
+			name:         "no stack access",
+			instructions: []*pb.Instruction{Mov64(R0, 0), Exit()},
+			want:         0,
+		},
+		{
+			name: "pointer arithmetic",
+			instructions: []*pb.Instruction{
+				Mov64(R2, R10),
+				Add64(R2, -64),
+				Sub64(R2, 16),
+				LdW(R3, R2, -4),
+				Exit(),
+			},
+			want: 84,
+		},
+		{
+			name: "overwritten pointer",
+			instructions: []*pb.Instruction{
+				Mov64(R2, R10),
+				Mov64(R2, 0),
+				StDW(R2, 0, -400),
+				StB(R10, 0, -1),
+				Exit(),
+			},
+			want: 1,
+		},
+		{
+			name: "clobbered by call",
+			instructions: []*pb.Instruction{
+				Mov64(R1, R10),
+				Mov64(R6, R10),
+				Call(MapLookup),
+				StDW(R1, 0, -300),
+				StDW(R6, 0, -200),
+				Exit(),
+			},
+			want: 200,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := StackDepth(tc.instructions); got != tc.want {
+				t.Errorf("StackDepth() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStampInstructionIds(t *testing.T) {
+	prog, err := InstructionSequence(
+		Mov64(R0, 0),
+		JmpEQ(R0, 0, 1),
+		Mov64(R0, 1),
+		Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() error = %v", err)
+	}
+	StampInstructionIds(prog)
+
+	seen := map[uint32]bool{}
+	for i, ins := range prog {
+		if ins.Id == 0 || seen[ins.Id] {
+			t.Fatalf("StampInstructionIds() gave instruction %d id %d, want a unique non zero id", i, ins.Id)
+		}
+		seen[ins.Id] = true
+	}
+
+	clone := make([]*pb.Instruction, len(prog))
+	for i, ins := range prog {
+		clone[i] = protobuf.Clone(ins).(*pb.Instruction)
+	}
+	for i := range prog {
+		if clone[i].Id != prog[i].Id {
+			t.Errorf("clone[%d].Id = %d, want %d", i, clone[i].Id, prog[i].Id)
+		}
+	}
+
+	// The jmp gets copied to update its offset, it has to keep its id.
+	inserted, err := InsertInstruction(clone, 2, Mov64(R1, 0))
+	if err != nil {
+		t.Fatalf("InsertInstruction() error = %v", err)
+	}
+	removed, err := RemoveInstruction(inserted, 0)
+	if err != nil {
+		t.Fatalf("RemoveInstruction() error = %v", err)
+	}
+	StampInstructionIds(removed)
+
+	wantIds := []uint32{prog[1].Id, 5, prog[2].Id, prog[3].Id}
+	for i, ins := range removed {
+		if ins.Id != wantIds[i] {
+			t.Errorf("edited program[%d].Id = %d, want %d", i, ins.Id, wantIds[i])
+		}
+	}
+	if got := ProgramString(removed[:1]); got != "0: if r0 == 0x0 goto +2 ; id 2\n" {
+		t.Errorf("ProgramString() = %q, want the id as a comment", got)
+	}
+}
+
+func TestCountByClass(t *testing.T) {
+	instructions := []*pb.Instruction{
+		Mov64(R0, 0),
+		Add(R0, 1),
+		LdMapByFd(R1, 3),
+		StDW(R10, 0, -8),
+		StDW(R10, R0, -16),
+		LdDW(R2, R10, -8),
+		JmpEQ(R2, 0, 1),
+		JmpEQ32(R2, 0, 0),
+		Exit(),
+	}
+	want := map[pb.InsClass]int{
+		pb.InsClass_InsClassAlu64: 1,
+		pb.InsClass_InsClassAlu:   1,
+		pb.InsClass_InsClassLd:    1,
+		pb.InsClass_InsClassSt:    1,
+		pb.InsClass_InsClassStx:   1,
+		pb.InsClass_InsClassLdx:   1,
+		pb.InsClass_InsClassJmp:   2,
+		pb.InsClass_InsClassJmp32: 1,
+	}
+	if got := CountByClass(instructions); !reflect.DeepEqual(got, want) {
+		t.Errorf("CountByClass() = %v, want %v", got, want)
+	}
+}
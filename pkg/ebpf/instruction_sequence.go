@@ -17,6 +17,9 @@ package ebpf
 import (
 	pb "buzzer/proto/ebpf_go_proto"
 	"fmt"
+	"math"
+
+	proto "github.com/golang/protobuf/proto"
 )
 
 // InstructionSequence abstracts away the process of creating a sequence of
@@ -30,3 +33,384 @@ func InstructionSequence(instructions ...*pb.Instruction) ([]*pb.Instruction, er
 	}
 	return instructions, nil
 }
+
+// NewProgram wraps `instructions`, e.g. built with InstructionSequence, in a
+// single function socket filter program that can be encoded, validated or
+// loaded as is. The instructions get ids (see StampInstructionIds) and have
+// to encode, so a malformed sequence is reported here rather than on load.
+// Maps are created through the FFI, the instructions refer to them by fd.
+func NewProgram(instructions []*pb.Instruction) (*pb.Program, error) {
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("a program needs at least one instruction")
+	}
+	program := &pb.Program{
+		Functions: []*pb.Functions{{Instructions: instructions}},
+		ProgType:  ProgTypeSocketFilter,
+	}
+	if _, err := GenerateBytecode(program); err != nil {
+		return nil, err
+	}
+	StampInstructionIds(instructions)
+	return program, nil
+}
+
+// instructionSlots returns how many 8 byte slots `i` takes once encoded,
+// wide instructions (e.g. 64 bit immediate loads) take two.
+func instructionSlots(i *pb.Instruction) int {
+	if _, ok := i.PseudoInstruction.(*pb.Instruction_PseudoValue); ok {
+		return 2
+	}
+	return 1
+}
+
+// ProgramSize returns the number of instructions the kernel will count for
+// the given sequence, this is what the kernel instruction limit applies to.
+func ProgramSize(instructions []*pb.Instruction) int {
+	size := 0
+	for _, inst := range instructions {
+		size += instructionSlots(inst)
+	}
+	return size
+}
+
+// ProgramInstructions returns the instructions of every function of
+// `program` as a single sequence, in the order GenerateBytecode encodes them.
+// Wide instructions appear once, ProgramSize tells how many slots they take.
+func ProgramInstructions(program *pb.Program) []*pb.Instruction {
+	instructions := []*pb.Instruction{}
+	for _, function := range program.GetFunctions() {
+		instructions = append(instructions, function.GetInstructions()...)
+	}
+	return instructions
+}
+
+// Walk calls `visit` once for every instruction in `instructions` together
+// with the slot it starts at. Wide instructions are visited once, their
+// second slot is never handed to `visit` on its own. Walk stops at the first
+// error returned by `visit`.
+func Walk(instructions []*pb.Instruction, visit func(slot int, i *pb.Instruction) error) error {
+	slots, _ := slotIndices(instructions)
+	for index, inst := range instructions {
+		if err := visit(slots[index], inst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountByClass returns how many instructions of `instructions` fall in each
+// instruction class, e.g. to check that a strategy emits the memory
+// operations it is meant to. Wide instructions count once.
+func CountByClass(instructions []*pb.Instruction) map[pb.InsClass]int {
+	counts := make(map[pb.InsClass]int)
+	Walk(instructions, func(_ int, i *pb.Instruction) error {
+		counts[pb.InsClass(InstructionClass(i))]++
+		return nil
+	})
+	return counts
+}
+
+// StampInstructionIds gives an id to every instruction of `instructions` that
+// does not have one yet. Ids start after the largest one already in use and
+// grow in program order, so they stay unique within the program and keep
+// pointing to the same instructions across clones, insertions and removals.
+func StampInstructionIds(instructions []*pb.Instruction) {
+	next := uint32(1)
+	for _, inst := range instructions {
+		if inst.Id >= next {
+			next = inst.Id + 1
+		}
+	}
+	for _, inst := range instructions {
+		if inst.Id == 0 {
+			inst.Id = next
+			next++
+		}
+	}
+}
+
+// ExceedsInstructionLimit returns true if the encoded size of
+// `instructions` is larger than `limit`.
+func ExceedsInstructionLimit(instructions []*pb.Instruction, limit uint32) bool {
+	return uint64(ProgramSize(instructions)) > uint64(limit)
+}
+
+// StackDepth estimates how many bytes of stack `instructions` use, that is the
+// deepest offset below R10 they access. It follows the registers that get a
+// copy of R10 and are moved by constant offsets, any other write to them
+// makes them untracked, like helper calls do for R1 to R5.
+//
+// Control flow is ignored: the instructions are considered in order as if all
+// of them ran.
+func StackDepth(instructions []*pb.Instruction) int {
+	// Offset from R10 of the registers known to point to the stack.
+	frameOffsets := map[pb.Reg]int{R10: 0}
+	depth := 0
+	access := func(base pb.Reg, offset int32) {
+		if frameOffset, ok := frameOffsets[base]; ok && -(frameOffset+int(offset)) > depth {
+			depth = -(frameOffset + int(offset))
+		}
+	}
+
+	for _, inst := range instructions {
+		switch op := inst.Opcode.(type) {
+		case *pb.Instruction_AluOpcode:
+			if inst.DstReg == R10 {
+				continue
+			}
+			frameOffset, tracked := frameOffsets[inst.DstReg]
+			delete(frameOffsets, inst.DstReg)
+			if op.AluOpcode.InstructionClass != pb.InsClass_InsClassAlu64 {
+				continue
+			}
+			isImm := op.AluOpcode.Source == pb.SrcOperand_Immediate
+			switch op.AluOpcode.OperationCode {
+			case pb.AluOperationCode_AluMov:
+				if source, ok := frameOffsets[inst.SrcReg]; ok && !isImm {
+					frameOffsets[inst.DstReg] = source
+				}
+			case pb.AluOperationCode_AluAdd:
+				if tracked && isImm {
+					frameOffsets[inst.DstReg] = frameOffset + int(inst.Immediate)
+				}
+			case pb.AluOperationCode_AluSub:
+				if tracked && isImm {
+					frameOffsets[inst.DstReg] = frameOffset - int(inst.Immediate)
+				}
+			}
+		case *pb.Instruction_JmpOpcode:
+			if op.JmpOpcode.OperationCode == pb.JmpOperationCode_JmpCALL {
+				for reg := R0; reg <= R5; reg++ {
+					delete(frameOffsets, reg)
+				}
+			}
+		case *pb.Instruction_MemOpcode:
+			switch op.MemOpcode.InstructionClass {
+			case pb.InsClass_InsClassLdx:
+				access(inst.SrcReg, inst.Offset)
+				delete(frameOffsets, inst.DstReg)
+			case pb.InsClass_InsClassSt, pb.InsClass_InsClassStx:
+				access(inst.DstReg, inst.Offset)
+				if op.MemOpcode.Mode == pb.StLdMode_StLdModeATOMIC {
+					// Fetching atomics write the old value back.
+					delete(frameOffsets, inst.SrcReg)
+					delete(frameOffsets, R0)
+				}
+			case pb.InsClass_InsClassLd:
+				delete(frameOffsets, inst.DstReg)
+			}
+		}
+	}
+	return depth
+}
+
+// setBranchOffset sets the number of slots branch `i` jumps over, the
+// counterpart of branchOffset.
+func setBranchOffset(i *pb.Instruction, offset int) error {
+	if isUnconditionalBranch(i) && i.GetJmpOpcode().InstructionClass == pb.InsClass_InsClassJmp32 {
+		if offset < math.MinInt32 || offset > math.MaxInt32 {
+			return fmt.Errorf("jmp offset %d does not fit in 32 bits", offset)
+		}
+		i.Immediate = int32(offset)
+		return nil
+	}
+	if offset < math.MinInt16 || offset > math.MaxInt16 {
+		return fmt.Errorf("jmp offset %d does not fit in 16 bits", offset)
+	}
+	i.Offset = int32(offset)
+	return nil
+}
+
+// retargetBranches makes every branch in `instructions` land on the index
+// given by `targets` (branch index -> target index). Branches whose offset
+// changes are copied so the instructions of the original sequence are not
+// modified.
+func retargetBranches(instructions []*pb.Instruction, targets map[int]int) error {
+	slots, _ := slotIndices(instructions)
+	for index, target := range targets {
+		offset := slots[target] - slots[index] - 1
+		if offset == branchOffset(instructions[index]) {
+			continue
+		}
+		branch := proto.Clone(instructions[index]).(*pb.Instruction)
+		if err := setBranchOffset(branch, offset); err != nil {
+			return fmt.Errorf("jmp at instruction %d: %v", index, err)
+		}
+		instructions[index] = branch
+	}
+	return nil
+}
+
+// InsertInstruction returns a new sequence with `instruction` inserted at
+// `index`. The offsets of jumps that span the insertion point are adjusted so
+// every jump keeps landing on the same instruction; jumps that targeted the
+// instruction previously at `index` now land on it in its new position,
+// after the inserted instruction.
+func InsertInstruction(instructions []*pb.Instruction, index int, instruction *pb.Instruction) ([]*pb.Instruction, error) {
+	if instruction == nil {
+		return nil, fmt.Errorf("cannot insert a nil instruction")
+	}
+	if index < 0 || index > len(instructions) {
+		return nil, fmt.Errorf("insertion index %d out of range [0, %d]", index, len(instructions))
+	}
+
+	targets, err := branchTargets(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	shift := func(i int) int {
+		if i >= index {
+			return i + 1
+		}
+		return i
+	}
+
+	result := make([]*pb.Instruction, 0, len(instructions)+1)
+	result = append(result, instructions[:index]...)
+	result = append(result, instruction)
+	result = append(result, instructions[index:]...)
+
+	newTargets := make(map[int]int, len(targets))
+	for branch, target := range targets {
+		newTargets[shift(branch)] = shift(target)
+	}
+	if err := retargetBranches(result, newTargets); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Prefix returns a new sequence with the first `n` instructions followed by
+// an Exit, useful to bisect which part of a program triggers a behavior.
+// Jumps that would leave the prefix land on the Exit instead, so every
+// prefix of a loadable program is loadable on its own. The Exit is left out
+// when nothing could reach it, the verifier rejects unreachable code.
+func Prefix(instructions []*pb.Instruction, n int) ([]*pb.Instruction, error) {
+	if n < 0 || n > len(instructions) {
+		return nil, fmt.Errorf("prefix length %d out of range [0, %d]", n, len(instructions))
+	}
+
+	targets, err := branchTargets(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	newTargets := make(map[int]int, len(targets))
+	needsExit := n == 0 || (!isExit(instructions[n-1]) && !isUnconditionalBranch(instructions[n-1]))
+	for branch, target := range targets {
+		if branch >= n {
+			continue
+		}
+		if target >= n {
+			target = n
+			needsExit = true
+		}
+		newTargets[branch] = target
+	}
+
+	result := make([]*pb.Instruction, 0, n+1)
+	result = append(result, instructions[:n]...)
+	if needsExit {
+		result = append(result, Exit())
+	}
+	if err := retargetBranches(result, newTargets); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Append returns a new sequence with `tail` placed after `instructions`, so
+// the last instruction of `instructions` falls through into the first one of
+// `tail`. This is meant to stitch prologues, epilogues or corpus fragments
+// together. Jump offsets are relative so both halves keep their control flow,
+// but `instructions` must not end in an Exit since `tail` would be dead code.
+func Append(instructions []*pb.Instruction, tail []*pb.Instruction) ([]*pb.Instruction, error) {
+	if len(instructions) > 0 && isExit(instructions[len(instructions)-1]) {
+		return nil, fmt.Errorf("cannot append after the exit at instruction %d", len(instructions)-1)
+	}
+
+	result := make([]*pb.Instruction, 0, len(instructions)+len(tail))
+	result = append(result, instructions...)
+	result = append(result, tail...)
+
+	// Jumps of `instructions` may target its end, that is the first
+	// instruction of `tail`, so only the joined sequence can be checked.
+	if _, err := branchTargets(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RemoveInstruction returns a new sequence without the instruction at
+// `index`, shrinking the offsets of jumps that span it. Removing an
+// instruction that is the target of a jump is an error since that jump
+// would be left without a landing site.
+func RemoveInstruction(instructions []*pb.Instruction, index int) ([]*pb.Instruction, error) {
+	if index < 0 || index >= len(instructions) {
+		return nil, fmt.Errorf("removal index %d out of range [0, %d)", index, len(instructions))
+	}
+
+	targets, err := branchTargets(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	shift := func(i int) int {
+		if i > index {
+			return i - 1
+		}
+		return i
+	}
+
+	newTargets := make(map[int]int, len(targets))
+	for branch, target := range targets {
+		if branch == index {
+			continue
+		}
+		if target == index {
+			return nil, fmt.Errorf("cannot remove instruction %d, it is the target of the jmp at instruction %d", index, branch)
+		}
+		newTargets[shift(branch)] = shift(target)
+	}
+
+	result := make([]*pb.Instruction, 0, len(instructions)-1)
+	result = append(result, instructions[:index]...)
+	result = append(result, instructions[index+1:]...)
+	if err := retargetBranches(result, newTargets); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReplaceInstruction returns a new sequence with the instruction at `index`
+// swapped for `instruction`. Jumps that targeted the old instruction land on
+// the new one and, when the new instruction takes a different number of
+// slots (e.g. replacing a Mov64 with a LdImm64), the offsets of the jumps
+// that span it are adjusted. If `instruction` is a jump its offset is kept
+// as given and has to land on an instruction of the new sequence.
+func ReplaceInstruction(instructions []*pb.Instruction, index int, instruction *pb.Instruction) ([]*pb.Instruction, error) {
+	if instruction == nil {
+		return nil, fmt.Errorf("cannot replace with a nil instruction")
+	}
+	if index < 0 || index >= len(instructions) {
+		return nil, fmt.Errorf("replacement index %d out of range [0, %d)", index, len(instructions))
+	}
+
+	targets, err := branchTargets(instructions)
+	if err != nil {
+		return nil, err
+	}
+	delete(targets, index)
+
+	result := make([]*pb.Instruction, len(instructions))
+	copy(result, instructions)
+	result[index] = instruction
+	if err := retargetBranches(result, targets); err != nil {
+		return nil, err
+	}
+	if _, err := branchTargets(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
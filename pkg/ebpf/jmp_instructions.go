@@ -16,6 +16,8 @@ package ebpf
 
 import (
 	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"math"
 )
 
 func newJmpInstruction[T Src](oc pb.JmpOperationCode, insclass pb.InsClass, dst pb.Reg, src T, offset int16) *pb.Instruction {
@@ -26,7 +28,7 @@ func newJmpInstruction[T Src](oc pb.JmpOperationCode, insclass pb.InsClass, dst
 	case pb.Reg:
 		srcType = pb.SrcOperand_RegSrc
 		srcReg = any(src).(pb.Reg)
-		imm = 0
+		imm = UnusedField
 	case int:
 		srcType = pb.SrcOperand_Immediate
 		srcReg = pb.Reg_R0
@@ -123,6 +125,18 @@ func Call(functionValue int32) *pb.Instruction {
 	return newJmpInstruction(pb.JmpOperationCode_JmpCALL, pb.InsClass_InsClassJmp, pb.Reg_R0, functionValue, int16(UnusedField))
 }
 
+// KfuncCall calls the kernel function (kfunc) with BTF id `btfID`.
+// `btfFdIndex` selects the BTF the id belongs to: 0 is vmlinux, otherwise it
+// is an index into the fd_array passed at load time for module BTFs.
+//
+// The id is not resolved here, callers must look it up in the BTF of the
+// running kernel beforehand.
+func KfuncCall(btfID int32, btfFdIndex int16) *pb.Instruction {
+	ins := newJmpInstruction(pb.JmpOperationCode_JmpCALL, pb.InsClass_InsClassJmp, pb.Reg_R0, btfID, btfFdIndex)
+	ins.SrcReg = PseudoKfuncCall
+	return ins
+}
+
 func LdFunctionPtr(Imm int32) *pb.Instruction {
 	return &pb.Instruction{
 		Opcode: &pb.Instruction_MemOpcode{
@@ -133,7 +147,7 @@ func LdFunctionPtr(Imm int32) *pb.Instruction {
 			},
 		},
 		DstReg:    R2,
-		SrcReg:    pb.Reg_R4,
+		SrcReg:    PseudoFunc,
 		Offset:    0,
 		Immediate: Imm,
 		PseudoInstruction: &pb.Instruction_PseudoValue{
@@ -174,6 +188,26 @@ func LdMapElement(mapPtr pb.Reg, element int32, keyPtr pb.Reg, offset int16) ([]
 	)
 }
 
+// NullCheck guards `onNull` so it only runs when `ptr` is NULL, e.g. after a
+// map lookup:
+//
+//	if ptr != 0 goto +len(onNull)
+//	onNull...
+//
+// The check is written as a JNE over the block so the null handling can be
+// placed inline; `onNull` should end the program (or jump away) as the
+// instructions after it assume `ptr` is not NULL.
+func NullCheck(ptr pb.Reg, onNull []*pb.Instruction) ([]*pb.Instruction, error) {
+	if len(onNull) == 0 {
+		return nil, fmt.Errorf("the null handling block cannot be empty")
+	}
+	size := ProgramSize(onNull)
+	if size > math.MaxInt16 {
+		return nil, fmt.Errorf("the null handling block is too big to jump over: %d instructions", size)
+	}
+	return InstructionSequence(append([]*pb.Instruction{JmpNE(ptr, 0, int16(size))}, onNull...)...)
+}
+
 // CallSkbLoadBytesRelative sets up the state of the registers to invoke the
 // skb_load_bytes_relative helper function.
 //
@@ -191,6 +225,206 @@ func CallSkbLoadBytesRelative[T Src](skb pb.Reg, skb_offset T, dstAddress pb.Reg
 	)
 }
 
+// CallTailCall sets up the state of the registers to invoke the tail_call
+// helper function.
+//
+// The invocation of this function would look more or less like this:
+// tail_call(ctx, progArray, index).
+//
+// `progArray` must hold a pointer to a BPF_MAP_TYPE_PROG_ARRAY map, e.g. loaded
+// with LdMapByFd. If the tail call succeeds execution never returns to the
+// caller.
+//
+// The arguments are moved into R1-R3 in order, so an argument cannot live in a
+// register that an earlier argument is moved into.
+func CallTailCall(ctx pb.Reg, progArray pb.Reg, index pb.Reg) ([]*pb.Instruction, error) {
+	args := []pb.Reg{ctx, progArray, index}
+	sequence := []*pb.Instruction{}
+	for i, arg := range args {
+		if arg < pb.Reg_R0 || arg > pb.Reg_R10 {
+			return nil, fmt.Errorf("argument %d is not a valid register: %v", i, arg)
+		}
+		dst := pb.Reg_R1 + pb.Reg(i)
+		for j := i + 1; j < len(args); j++ {
+			if args[j] == dst {
+				return nil, fmt.Errorf("argument %d in %v would be overwritten by argument %d", j, dst, i)
+			}
+		}
+		sequence = append(sequence, Mov64(dst, arg))
+	}
+	sequence = append(sequence, Call(TailCall))
+	return InstructionSequence(sequence...)
+}
+
+// CallMapUpdate sets up the state of the registers to invoke the
+// map_update_elem helper function, storing the value at r10 +
+// valueStackOffset under the key at r10 + keyStackOffset. `flags` is one of
+// MapUpdateAny, MapUpdateNoExist or MapUpdateExist, R0 is 0 on success.
+//
+// The invocation of this function would look more or less like this:
+// map_update_elem(mapPtr, r10 + keyStackOffset, r10 + valueStackOffset, flags).
+func CallMapUpdate(mapPtr pb.Reg, keyStackOffset int16, valueStackOffset int16, flags int32) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, mapPtr),
+		Mov64(pb.Reg_R2, pb.Reg_R10),
+		Add64(pb.Reg_R2, int32(keyStackOffset)),
+		Mov64(pb.Reg_R3, pb.Reg_R10),
+		Add64(pb.Reg_R3, int32(valueStackOffset)),
+		Mov64(pb.Reg_R4, flags),
+		Call(MapUpdate),
+	)
+}
+
+// CallMapDelete sets up the state of the registers to invoke the
+// map_delete_elem helper function, removing the key at r10 + keyStackOffset
+// from a hash map. R0 is 0 if the key was found.
+//
+// The invocation of this function would look more or less like this:
+// map_delete_elem(mapPtr, r10 + keyStackOffset).
+func CallMapDelete(mapPtr pb.Reg, keyStackOffset int16) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, mapPtr),
+		Mov64(pb.Reg_R2, pb.Reg_R10),
+		Add64(pb.Reg_R2, int32(keyStackOffset)),
+		Call(MapDelete),
+	)
+}
+
+// CallMapPush sets up the state of the registers to invoke the map_push_elem
+// helper function, pushing the value stored at r10 + valueStackOffset into a
+// BPF_MAP_TYPE_QUEUE or BPF_MAP_TYPE_STACK map.
+//
+// The invocation of this function would look more or less like this:
+// map_push_elem(mapPtr, r10 + valueStackOffset, flags).
+func CallMapPush(mapPtr pb.Reg, valueStackOffset int16, flags int32) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, mapPtr),
+		Mov64(pb.Reg_R2, pb.Reg_R10),
+		Add64(pb.Reg_R2, int32(valueStackOffset)),
+		Mov64(pb.Reg_R3, flags),
+		Call(MapPush),
+	)
+}
+
+// CallMapPop sets up the state of the registers to invoke the map_pop_elem
+// helper function, which removes the next element of a queue or stack map and
+// stores it at r10 + dstStackOffset. R0 is 0 if an element was popped.
+//
+// The invocation of this function would look more or less like this:
+// map_pop_elem(mapPtr, r10 + dstStackOffset).
+func CallMapPop(mapPtr pb.Reg, dstStackOffset int16) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, mapPtr),
+		Mov64(pb.Reg_R2, pb.Reg_R10),
+		Add64(pb.Reg_R2, int32(dstStackOffset)),
+		Call(MapPop),
+	)
+}
+
+// CallSpinLock sets up the state of the registers to invoke the spin_lock
+// helper function, `lock` must point to the bpf_spin_lock of a map value (see
+// SpinLockValueBtf). Until the matching CallSpinUnlock the verifier forbids
+// calls and exiting the program.
+//
+// The invocation of this function would look more or less like this:
+// spin_lock(lock).
+func CallSpinLock(lock pb.Reg) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, lock),
+		Call(SpinLock),
+	)
+}
+
+// CallSpinUnlock sets up the state of the registers to invoke the
+// spin_unlock helper function, releasing the lock taken by CallSpinLock.
+//
+// The invocation of this function would look more or less like this:
+// spin_unlock(lock).
+func CallSpinUnlock(lock pb.Reg) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, lock),
+		Call(SpinUnlock),
+	)
+}
+
+// CallRingbufReserve sets up the state of the registers to invoke the
+// ringbuf_reserve helper function, which reserves `size` bytes of a
+// BPF_MAP_TYPE_RINGBUF map. R0 holds a pointer to the record or NULL, the
+// verifier tracks the record as a reference that has to be released with
+// CallRingbufSubmit or CallRingbufDiscard before the program exits.
+//
+// The invocation of this function would look more or less like this:
+// ringbuf_reserve(ringbuf, size, flags).
+func CallRingbufReserve(ringbuf pb.Reg, size int32, flags int32) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, ringbuf),
+		Mov64(pb.Reg_R2, size),
+		Mov64(pb.Reg_R3, flags),
+		Call(RingbufReserve),
+	)
+}
+
+// CallRingbufSubmit sets up the state of the registers to invoke the
+// ringbuf_submit helper function, which publishes the record in `record`
+// returned by CallRingbufReserve.
+//
+// The invocation of this function would look more or less like this:
+// ringbuf_submit(record, flags).
+func CallRingbufSubmit(record pb.Reg, flags int32) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, record),
+		Mov64(pb.Reg_R2, flags),
+		Call(RingbufSubmit),
+	)
+}
+
+// CallRingbufDiscard sets up the state of the registers to invoke the
+// ringbuf_discard helper function, which drops the record in `record`
+// returned by CallRingbufReserve.
+//
+// The invocation of this function would look more or less like this:
+// ringbuf_discard(record, flags).
+func CallRingbufDiscard(record pb.Reg, flags int32) ([]*pb.Instruction, error) {
+	return InstructionSequence(
+		Mov64(pb.Reg_R1, record),
+		Mov64(pb.Reg_R2, flags),
+		Call(RingbufDiscard),
+	)
+}
+
+// CallTracePrintk sets up the state of the registers to invoke the
+// trace_printk helper function, useful to dump registers of a misbehaving
+// program to /sys/kernel/tracing/trace_pipe.
+//
+// The invocation of this function would look more or less like this:
+// trace_printk(r10 + fmtStackOffset, fmtLen, args...).
+//
+// The format string has to be on the stack already, see StackString. At most
+// 3 args are supported and an argument cannot live in a register that an
+// earlier argument is moved into.
+func CallTracePrintk(fmtStackOffset int16, fmtLen int32, args ...pb.Reg) ([]*pb.Instruction, error) {
+	if len(args) > 3 {
+		return nil, fmt.Errorf("trace_printk takes at most 3 arguments, got %d", len(args))
+	}
+	sequence := []*pb.Instruction{}
+	for i, arg := range args {
+		dst := pb.Reg_R3 + pb.Reg(i)
+		for j := i + 1; j < len(args); j++ {
+			if args[j] == dst {
+				return nil, fmt.Errorf("argument %d in %v would be overwritten by argument %d", j, dst, i)
+			}
+		}
+		sequence = append(sequence, Mov64(dst, arg))
+	}
+	sequence = append(sequence,
+		Mov64(pb.Reg_R1, pb.Reg_R10),
+		Add64(pb.Reg_R1, int32(fmtStackOffset)),
+		Mov64(pb.Reg_R2, fmtLen),
+		Call(TracePrintk),
+	)
+	return InstructionSequence(sequence...)
+}
+
 func Exit() *pb.Instruction {
 	return newJmpInstruction(pb.JmpOperationCode_JmpExit, pb.InsClass_InsClassJmp, pb.Reg_R0, int32(UnusedField), int16(UnusedField))
 }
@@ -52,6 +52,17 @@ func TestJmpOperationCorrectEncoding(t *testing.T) {
 			wantOffset:           42,
 			wantEncoding:         []uint64{0x2a0005},
 		},
+		{
+			testName:             "Encoding JmpSET with a mask",
+			instruction:          JmpSET(pb.Reg_R1, 0x8, 3),
+			wantDstReg:           pb.Reg_R1,
+			wantImm:              0x8,
+			wantOperationCode:    pb.JmpOperationCode_JmpJSET,
+			wantSrc:              pb.SrcOperand_Immediate,
+			wantInstructionClass: pb.InsClass_InsClassJmp,
+			wantOffset:           3,
+			wantEncoding:         []uint64{0x800030145},
+		},
 		{
 			testName:             "Encoding Exit",
 			instruction:          Exit(),
@@ -358,3 +369,350 @@ func TestJmpOperationCorrectEncoding(t *testing.T) {
 		})
 	}
 }
+
+func TestCallTailCall(t *testing.T) {
+	instructions, err := CallTailCall(R6, R7, R8)
+	if err != nil {
+		t.Fatalf("CallTailCall() unexpected error: %v", err)
+	}
+
+	want := []*pb.Instruction{
+		Mov64(R1, R6),
+		Mov64(R2, R7),
+		Mov64(R3, R8),
+		Call(TailCall),
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("len(CallTailCall()) = %d, want %d", len(instructions), len(want))
+	}
+	for i := range want {
+		if !protobuf.Equal(instructions[i], want[i]) {
+			t.Errorf("CallTailCall()[%d] = %v, want %v", i, instructions[i], want[i])
+		}
+	}
+
+	last := instructions[len(instructions)-1]
+	if InstructionOpcode(last) != 0x85 || last.Immediate != TailCall {
+		t.Errorf("CallTailCall() last instruction = %v, want call %d", last, TailCall)
+	}
+}
+
+func TestCallTailCallInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name                  string
+		ctx, progArray, index pb.Reg
+	}{
+		{"progArray clobbered by ctx", R6, R1, R8},
+		{"index clobbered by ctx", R6, R7, R1},
+		{"index clobbered by progArray", R1, R7, R2},
+		{"index out of range", R1, R7, pb.Reg(11)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := CallTailCall(tc.ctx, tc.progArray, tc.index); err == nil {
+				t.Errorf("CallTailCall(%v, %v, %v) error = nil, want error", tc.ctx, tc.progArray, tc.index)
+			}
+		})
+	}
+}
+
+func TestCallMapUpdateDelete(t *testing.T) {
+	update, err := CallMapUpdate(R6, -8, -16, MapUpdateNoExist)
+	if err != nil {
+		t.Fatalf("CallMapUpdate() unexpected error: %v", err)
+	}
+	del, err := CallMapDelete(R6, -8)
+	if err != nil {
+		t.Fatalf("CallMapDelete() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         []*pb.Instruction
+		wantHelper   int32
+	}{
+		{
+			name:         "update",
+			instructions: update,
+			want:         []*pb.Instruction{Mov64(R1, R6), Mov64(R2, R10), Add64(R2, -8), Mov64(R3, R10), Add64(R3, -16), Mov64(R4, 1), Call(MapUpdate)},
+			wantHelper:   2,
+		},
+		{
+			name:         "delete",
+			instructions: del,
+			want:         []*pb.Instruction{Mov64(R1, R6), Mov64(R2, R10), Add64(R2, -8), Call(MapDelete)},
+			wantHelper:   3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.instructions) != len(tc.want) {
+				t.Fatalf("len(%s) = %d, want %d", tc.name, len(tc.instructions), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(tc.instructions[i], tc.want[i]) {
+					t.Errorf("%s[%d] = %v, want %v", tc.name, i, tc.instructions[i], tc.want[i])
+				}
+			}
+			// The helper ids are part of the kernel ABI.
+			if got := tc.instructions[len(tc.instructions)-1].Immediate; got != tc.wantHelper {
+				t.Errorf("%s helper = %d, want %d", tc.name, got, tc.wantHelper)
+			}
+		})
+	}
+
+	// So are the flags, BPF_ANY, BPF_NOEXIST and BPF_EXIST, passed in R4.
+	for _, tc := range []struct {
+		flags int32
+		want  int32
+	}{{MapUpdateAny, 0}, {MapUpdateNoExist, 1}, {MapUpdateExist, 2}} {
+		update, err := CallMapUpdate(R6, -8, -16, tc.flags)
+		if err != nil {
+			t.Fatalf("CallMapUpdate() unexpected error: %v", err)
+		}
+		if got := update[len(update)-2]; got.DstReg != R4 || got.Immediate != tc.want {
+			t.Errorf("CallMapUpdate(flags = %d) sets %v, want R4 = %d", tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestCallMapPushPop(t *testing.T) {
+	push, err := CallMapPush(R6, -8, 0)
+	if err != nil {
+		t.Fatalf("CallMapPush() unexpected error: %v", err)
+	}
+	pop, err := CallMapPop(R6, -16)
+	if err != nil {
+		t.Fatalf("CallMapPop() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         []*pb.Instruction
+	}{
+		{
+			name:         "push",
+			instructions: push,
+			want:         []*pb.Instruction{Mov64(R1, R6), Mov64(R2, R10), Add64(R2, -8), Mov64(R3, 0), Call(MapPush)},
+		},
+		{
+			name:         "pop",
+			instructions: pop,
+			want:         []*pb.Instruction{Mov64(R1, R6), Mov64(R2, R10), Add64(R2, -16), Call(MapPop)},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.instructions) != len(tc.want) {
+				t.Fatalf("len(%s) = %d, want %d", tc.name, len(tc.instructions), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(tc.instructions[i], tc.want[i]) {
+					t.Errorf("%s[%d] = %v, want %v", tc.name, i, tc.instructions[i], tc.want[i])
+				}
+			}
+		})
+	}
+
+	// The helper ids are part of the kernel ABI.
+	if got := push[len(push)-1].Immediate; got != 87 {
+		t.Errorf("CallMapPush() helper = %d, want 87 (BPF_FUNC_map_push_elem)", got)
+	}
+	if got := pop[len(pop)-1].Immediate; got != 88 {
+		t.Errorf("CallMapPop() helper = %d, want 88 (BPF_FUNC_map_pop_elem)", got)
+	}
+}
+
+func TestCallRingbuf(t *testing.T) {
+	reserve, err := CallRingbufReserve(R6, 16, 0)
+	if err != nil {
+		t.Fatalf("CallRingbufReserve() unexpected error: %v", err)
+	}
+	submit, err := CallRingbufSubmit(R7, 0)
+	if err != nil {
+		t.Fatalf("CallRingbufSubmit() unexpected error: %v", err)
+	}
+	discard, err := CallRingbufDiscard(R7, 0)
+	if err != nil {
+		t.Fatalf("CallRingbufDiscard() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         []*pb.Instruction
+		wantHelper   int32
+	}{
+		{
+			name:         "reserve",
+			instructions: reserve,
+			want:         []*pb.Instruction{Mov64(R1, R6), Mov64(R2, 16), Mov64(R3, 0), Call(RingbufReserve)},
+			wantHelper:   131,
+		},
+		{
+			name:         "submit",
+			instructions: submit,
+			want:         []*pb.Instruction{Mov64(R1, R7), Mov64(R2, 0), Call(RingbufSubmit)},
+			wantHelper:   132,
+		},
+		{
+			name:         "discard",
+			instructions: discard,
+			want:         []*pb.Instruction{Mov64(R1, R7), Mov64(R2, 0), Call(RingbufDiscard)},
+			wantHelper:   133,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.instructions) != len(tc.want) {
+				t.Fatalf("len(%s) = %d, want %d", tc.name, len(tc.instructions), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(tc.instructions[i], tc.want[i]) {
+					t.Errorf("%s[%d] = %v, want %v", tc.name, i, tc.instructions[i], tc.want[i])
+				}
+			}
+			// The helper ids are part of the kernel ABI.
+			if got := tc.instructions[len(tc.instructions)-1].Immediate; got != tc.wantHelper {
+				t.Errorf("%s helper = %d, want %d", tc.name, got, tc.wantHelper)
+			}
+		})
+	}
+}
+
+func TestCallSpinLock(t *testing.T) {
+	lock, err := CallSpinLock(R6)
+	if err != nil {
+		t.Fatalf("CallSpinLock() unexpected error: %v", err)
+	}
+	unlock, err := CallSpinUnlock(R6)
+	if err != nil {
+		t.Fatalf("CallSpinUnlock() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		want         []*pb.Instruction
+		wantHelper   int32
+	}{
+		{
+			name:         "lock",
+			instructions: lock,
+			want:         []*pb.Instruction{Mov64(R1, R6), Call(SpinLock)},
+			wantHelper:   93,
+		},
+		{
+			name:         "unlock",
+			instructions: unlock,
+			want:         []*pb.Instruction{Mov64(R1, R6), Call(SpinUnlock)},
+			wantHelper:   94,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.instructions) != len(tc.want) {
+				t.Fatalf("len(%s) = %d, want %d", tc.name, len(tc.instructions), len(tc.want))
+			}
+			for i := range tc.want {
+				if !protobuf.Equal(tc.instructions[i], tc.want[i]) {
+					t.Errorf("%s[%d] = %v, want %v", tc.name, i, tc.instructions[i], tc.want[i])
+				}
+			}
+			if got := tc.instructions[len(tc.instructions)-1].Immediate; got != tc.wantHelper {
+				t.Errorf("%s helper = %d, want %d", tc.name, got, tc.wantHelper)
+			}
+		})
+	}
+}
+
+func TestCallTracePrintk(t *testing.T) {
+	instructions, err := CallTracePrintk(-16, 12, R6, R7)
+	if err != nil {
+		t.Fatalf("CallTracePrintk() unexpected error: %v", err)
+	}
+
+	want := []*pb.Instruction{
+		Mov64(R3, R6),
+		Mov64(R4, R7),
+		Mov64(R1, R10),
+		Add64(R1, -16),
+		Mov64(R2, 12),
+		Call(TracePrintk),
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("len(CallTracePrintk()) = %d, want %d", len(instructions), len(want))
+	}
+	for i := range want {
+		if !protobuf.Equal(instructions[i], want[i]) {
+			t.Errorf("CallTracePrintk()[%d] = %v, want %v", i, instructions[i], want[i])
+		}
+	}
+
+	tests := []struct {
+		name string
+		args []pb.Reg
+	}{
+		{"too many args", []pb.Reg{R6, R7, R8, R9}},
+		{"clobbered arg", []pb.Reg{R6, R3}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := CallTracePrintk(-16, 12, tc.args...); err == nil {
+				t.Errorf("CallTracePrintk(%v) error = nil, want error", tc.args)
+			}
+		})
+	}
+}
+
+func TestNullCheck(t *testing.T) {
+	onNull := []*pb.Instruction{
+		Mov64(R0, 0),
+		LdMapByFd(R1, 3),
+		Exit(),
+	}
+	instructions, err := NullCheck(R0, onNull)
+	if err != nil {
+		t.Fatalf("NullCheck() unexpected error: %v", err)
+	}
+
+	if len(instructions) != len(onNull)+1 {
+		t.Fatalf("len(NullCheck()) = %d, want %d", len(instructions), len(onNull)+1)
+	}
+	check := instructions[0]
+	if !protobuf.Equal(check, JmpNE(R0, 0, 4)) {
+		t.Errorf("NullCheck()[0] = %v, want a jump over the 4 slots of the null block", check)
+	}
+	for i, ins := range onNull {
+		if instructions[i+1] != ins {
+			t.Errorf("NullCheck()[%d] = %v, want %v", i+1, instructions[i+1], ins)
+		}
+	}
+
+	if _, err := NullCheck(R0, nil); err == nil {
+		t.Errorf("NullCheck() with an empty block error = nil, want error")
+	}
+}
+
+func TestKfuncCall(t *testing.T) {
+	btfID := int32(0x1234)
+	encoding, err := encodeInstruction(KfuncCall(btfID, 0))
+	if err != nil {
+		t.Fatalf("unexpected error when ecoding: %v", err)
+	}
+	if len(encoding) != 1 {
+		t.Fatalf("len(encoding) = %d, want 1", len(encoding))
+	}
+
+	if opcode := uint8(encoding[0]); opcode != 0x85 {
+		t.Errorf("KfuncCall() opcode = %#x, want %#x", opcode, 0x85)
+	}
+	if src := uint8(encoding[0]>>8) >> 4; src != uint8(PseudoKfuncCall) {
+		t.Errorf("KfuncCall() src = %d, want %d (BPF_PSEUDO_KFUNC_CALL)", src, PseudoKfuncCall)
+	}
+	if imm := int32(encoding[0] >> 32); imm != btfID {
+		t.Errorf("KfuncCall() imm = %#x, want %#x", imm, btfID)
+	}
+}
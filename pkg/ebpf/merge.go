@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"math"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// mergeHeader returns the instructions MergeWith puts before the bodies of
+// the parents: a random number is drawn and one of its bits decides whether
+// to jump over the first body, which is `firstSize` slots long. The context
+// pointer survives the helper call in R1, R6 is used to keep it.
+func mergeHeader(firstSize int, rng *rand.NumGen) []*pb.Instruction {
+	bit := int32(1) << rng.RandRange(0, 30)
+	return []*pb.Instruction{
+		Mov64(R6, R1),
+		Call(GetPrandomU32),
+		Mov64(R1, R6),
+		JmpSET(R0, bit, int16(firstSize)),
+	}
+}
+
+// MergeWith returns a child of `program` and `other` for crossover style
+// mutations: depending on a random bit drawn at runtime the child executes
+// the instructions of one parent or of the other. The parents are copied
+// unchanged one after the other, so their jumps keep their offsets, and the
+// ids of the child are renumbered to stay unique.
+//
+// Both parents must be made of a single function whose last instruction is
+// an Exit, so neither body can fall into the other. The child clobbers R0
+// and R6 before the bodies run and keeps the load attributes (program type,
+// btf, license...) of `program`.
+func MergeWith(program, other *pb.Program, rng *rand.NumGen) (*pb.Program, error) {
+	bodies := [][]*pb.Instruction{}
+	for _, parent := range []*pb.Program{program, other} {
+		if len(parent.GetFunctions()) != 1 {
+			return nil, fmt.Errorf("only single function programs can be merged, got %d functions", len(parent.GetFunctions()))
+		}
+		body := parent.Functions[0].Instructions
+		if len(body) == 0 || !isExit(body[len(body)-1]) {
+			return nil, fmt.Errorf("merged programs must end with an exit")
+		}
+		bodies = append(bodies, body)
+	}
+	if ProgramSize(bodies[0]) > math.MaxInt16 {
+		return nil, fmt.Errorf("program of %d slots is too large to jump over", ProgramSize(bodies[0]))
+	}
+
+	instructions := mergeHeader(ProgramSize(bodies[0]), rng)
+	for _, body := range bodies {
+		for _, i := range body {
+			clone := proto.Clone(i).(*pb.Instruction)
+			clone.Id = 0
+			instructions = append(instructions, clone)
+		}
+	}
+	StampInstructionIds(instructions)
+
+	child := proto.Clone(program).(*pb.Program)
+	child.Functions = []*pb.Functions{{Instructions: instructions}}
+	if _, err := GenerateBytecode(child); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
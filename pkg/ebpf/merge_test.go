@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+func TestMergeWith(t *testing.T) {
+	first := []*pb.Instruction{
+		Mov64(R0, 0),
+		JmpGT(R1, 0, 1),
+		Mov64(R0, 1),
+		Exit(),
+	}
+	second := []*pb.Instruction{
+		LdImm64(R2, 0x1122334455),
+		Mov64(R0, R2),
+		Exit(),
+	}
+	program, err := NewProgram(first)
+	if err != nil {
+		t.Fatalf("NewProgram() unexpected error: %v", err)
+	}
+	other, err := NewProgram(second)
+	if err != nil {
+		t.Fatalf("NewProgram() unexpected error: %v", err)
+	}
+	program.ProgType = ProgTypeSchedCls
+	programBefore := protobuf.Clone(program).(*pb.Program)
+	otherBefore := protobuf.Clone(other).(*pb.Program)
+
+	child, err := MergeWith(program, other, rand.NewRand(mrand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("MergeWith() unexpected error: %v", err)
+	}
+	if child.ProgType != ProgTypeSchedCls {
+		t.Errorf("MergeWith().ProgType = %d, want %d", child.ProgType, ProgTypeSchedCls)
+	}
+
+	instructions := child.Functions[0].Instructions
+	header := len(instructions) - len(first) - len(second)
+	choice := instructions[header-1]
+	if !isBranch(choice) || isUnconditionalBranch(choice) {
+		t.Fatalf("instruction before the bodies is %s, want a conditional jump", InstructionString(choice))
+	}
+	// The fall through path runs the first parent, the taken one the second.
+	if got, want := int(choice.Offset), ProgramSize(first); got != want {
+		t.Errorf("choice offset = %d, want %d", got, want)
+	}
+	bodies := []struct {
+		name   string
+		got    []*pb.Instruction
+		parent []*pb.Instruction
+	}{
+		{"first", instructions[header : header+len(first)], first},
+		{"second", instructions[header+len(first):], second},
+	}
+	for _, body := range bodies {
+		if len(body.got) != len(body.parent) {
+			t.Fatalf("%s body has %d instructions, want %d", body.name, len(body.got), len(body.parent))
+		}
+		for i := range body.got {
+			got := protobuf.Clone(body.got[i]).(*pb.Instruction)
+			want := protobuf.Clone(body.parent[i]).(*pb.Instruction)
+			got.Id, want.Id = 0, 0
+			if !protobuf.Equal(got, want) {
+				t.Errorf("%s body instruction %d = %s, want %s", body.name, i, InstructionString(got), InstructionString(want))
+			}
+		}
+	}
+
+	ids := map[uint32]bool{}
+	for _, i := range instructions {
+		if i.Id == 0 || ids[i.Id] {
+			t.Errorf("instruction %s has id %d, want a unique non zero id", InstructionString(i), i.Id)
+		}
+		ids[i.Id] = true
+	}
+	if !protobuf.Equal(program, programBefore) || !protobuf.Equal(other, otherBefore) {
+		t.Errorf("MergeWith() modified its parents")
+	}
+}
+
+func TestMergeWithErrors(t *testing.T) {
+	rng := rand.NewRand(mrand.NewSource(1))
+	exits := &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{Mov64(R0, 0), Exit()}}}}
+	tests := []struct {
+		name   string
+		parent *pb.Program
+	}{
+		{"no exit", &pb.Program{Functions: []*pb.Functions{{Instructions: []*pb.Instruction{Mov64(R0, 0)}}}}},
+		{"empty", &pb.Program{Functions: []*pb.Functions{{}}}},
+		{"two functions", &pb.Program{Functions: []*pb.Functions{
+			{Instructions: []*pb.Instruction{Mov64(R0, 0), Exit()}},
+			{Instructions: []*pb.Instruction{Mov64(R0, 0), Exit()}},
+		}}},
+	}
+	for _, tc := range tests {
+		if _, err := MergeWith(tc.parent, exits, rng); err == nil {
+			t.Errorf("MergeWith(%s, ...) = nil error, want error", tc.name)
+		}
+		if _, err := MergeWith(exits, tc.parent, rng); err == nil {
+			t.Errorf("MergeWith(..., %s) = nil error, want error", tc.name)
+		}
+	}
+}
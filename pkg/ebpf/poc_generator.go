@@ -20,10 +20,12 @@ import (
 	"fmt"
 	jsonpb "github.com/golang/protobuf/jsonpb"
 	"os"
+	"strings"
 )
 
 // GeneratePoc generates a c program that can be used to reproduce fuzzer
-// test cases.
+// test cases. The disassembly of the program, see ProgramString, is written
+// next to it with a .txt extension.
 func GeneratePoc(program *pb.Program) error {
 	m := &jsonpb.Marshaler{
 		OrigName:     true,
@@ -42,6 +44,14 @@ func GeneratePoc(program *pb.Program) error {
 
 	fmt.Printf("Writing eBPF PoC %q.\n", f.Name())
 	_, err = f.Write([]byte(textpbData))
-	return errors.Join(err, f.Close())
+	if err = errors.Join(err, f.Close()); err != nil {
+		return err
+	}
+
+	var disassembly strings.Builder
+	for _, function := range program.Functions {
+		disassembly.WriteString(ProgramString(function.Instructions))
+	}
+	return os.WriteFile(strings.TrimSuffix(f.Name(), ".json")+".txt", []byte(disassembly.String()), 0644)
 
 }
@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+// Instruction classes, as encoded in the 3 LSB of the opcode, that do not use
+// a MemOpcode.
+const (
+	classAlu   = uint8(pb.InsClass_InsClassAlu)
+	classJmp   = uint8(pb.InsClass_InsClassJmp)
+	classJmp32 = uint8(pb.InsClass_InsClassJmp32)
+	classAlu64 = uint8(pb.InsClass_InsClassAlu64)
+)
+
+// rawOpcode decomposes an 8 bit opcode into the opcode fields of an
+// Instruction so that it encodes back to exactly `opcode`.
+func rawOpcode(i *pb.Instruction, opcode uint8) {
+	insClass := pb.InsClass(opcode & 0x07)
+	switch opcode & 0x07 {
+	case classAlu, classAlu64:
+		i.Opcode = &pb.Instruction_AluOpcode{
+			AluOpcode: &pb.AluOpcode{
+				OperationCode:    pb.AluOperationCode(opcode & 0xF0),
+				Source:           pb.SrcOperand(opcode & 0x08),
+				InstructionClass: insClass,
+			},
+		}
+	case classJmp, classJmp32:
+		i.Opcode = &pb.Instruction_JmpOpcode{
+			JmpOpcode: &pb.JmpOpcode{
+				OperationCode:    pb.JmpOperationCode(opcode & 0xF0),
+				Source:           pb.SrcOperand(opcode & 0x08),
+				InstructionClass: insClass,
+			},
+		}
+	default:
+		// Ld, Ldx, St and Stx classes.
+		i.Opcode = &pb.Instruction_MemOpcode{
+			MemOpcode: &pb.MemOpcode{
+				Mode:             pb.StLdMode(opcode & 0xE0),
+				Size:             pb.StLdSize(opcode & 0x18),
+				InstructionClass: insClass,
+			},
+		}
+	}
+}
+
+// RawInstruction returns an instruction that encodes to exactly the given
+// fields, this allows experimenting with encodings buzzer does not model
+// yet. Only the 4 LSB of `dst` and `src` are used.
+func RawInstruction(opcode uint8, dst uint8, src uint8, offset int16, imm int32) *pb.Instruction {
+	i := &pb.Instruction{
+		DstReg:    pb.Reg(dst & 0x0F),
+		SrcReg:    pb.Reg(src & 0x0F),
+		Offset:    int32(offset),
+		Immediate: imm,
+		PseudoInstruction: &pb.Instruction_Empty{
+			Empty: &pb.Empty{},
+		},
+	}
+	rawOpcode(i, opcode)
+	return i
+}
+
+// RawWideInstruction is the double word form of RawInstruction: it takes two
+// slots, the second one being all zeros except for `nextImm` as done by the
+// 64 bit immediate loads.
+func RawWideInstruction(opcode uint8, dst uint8, src uint8, offset int16, imm int32, nextImm int32) *pb.Instruction {
+	i := RawInstruction(opcode, dst, src, offset, imm)
+	i.PseudoInstruction = &pb.Instruction_PseudoValue{
+		PseudoValue: RawInstruction(0, 0, 0, 0, nextImm),
+	}
+	return i
+}
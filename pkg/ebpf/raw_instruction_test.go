@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"reflect"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestRawInstruction(t *testing.T) {
+	tests := []struct {
+		testName     string
+		instruction  *pb.Instruction
+		wantSlots    int
+		wantEncoding []uint64
+	}{
+		{
+			testName:     "Raw alu",
+			instruction:  RawInstruction(0x07, 1, 0, 0, 5),
+			wantSlots:    1,
+			wantEncoding: []uint64{0x0000000500000107},
+		},
+		{
+			testName:     "Raw jmp with negative offset",
+			instruction:  RawInstruction(0x2d, 3, 4, -2, 0),
+			wantSlots:    1,
+			wantEncoding: []uint64{0x00000000fffe432d},
+		},
+		{
+			testName:     "Raw memory load",
+			instruction:  RawInstruction(0x79, 1, 10, -8, 0),
+			wantSlots:    1,
+			wantEncoding: []uint64{0x00000000fff8a179},
+		},
+		{
+			testName: "Opcode buzzer does not model",
+			// Undefined alu operation 0xe0.
+			instruction:  RawInstruction(0xe7, 2, 0, 0, -1),
+			wantSlots:    1,
+			wantEncoding: []uint64{0xffffffff000002e7},
+		},
+		{
+			testName:     "Raw 64 bit immediate load",
+			instruction:  RawWideInstruction(0x18, 1, 0, 0, 0x11223344, 0x55667788),
+			wantSlots:    2,
+			wantEncoding: []uint64{0x1122334400000118, 0x5566778800000000},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			if slots := instructionSlots(tc.instruction); slots != tc.wantSlots {
+				t.Errorf("instructionSlots() = %d, want %d", slots, tc.wantSlots)
+			}
+
+			encoding, err := encodeInstruction(tc.instruction)
+			if err != nil {
+				t.Fatalf("unexpected error when ecoding: %v", err)
+			}
+			if !reflect.DeepEqual(encoding, tc.wantEncoding) {
+				t.Errorf("encodeInstruction() = %x, want %x", encoding, tc.wantEncoding)
+			}
+		})
+	}
+}
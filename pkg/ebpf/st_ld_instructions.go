@@ -16,6 +16,8 @@ package ebpf
 
 import (
 	pb "buzzer/proto/ebpf_go_proto"
+	"encoding/binary"
+	"fmt"
 )
 
 func newStoreOperation[T Src](size pb.StLdSize, dst pb.Reg, src T, offset int16) *pb.Instruction {
@@ -26,7 +28,7 @@ func newStoreOperation[T Src](size pb.StLdSize, dst pb.Reg, src T, offset int16)
 	switch any(src).(type) {
 	case pb.Reg:
 		srcReg = any(src).(pb.Reg)
-		imm = 0
+		imm = UnusedField
 		class = pb.InsClass_InsClassStx
 	case int:
 		srcReg = pb.Reg_R0
@@ -150,24 +152,133 @@ func LdB(dst pb.Reg, src pb.Reg, offset int16) *pb.Instruction {
 	return newLoadOperation(pb.StLdSize_StLdSizeB, dst, src, offset)
 }
 
+// LdSkbData loads the packet start pointer from the __sk_buff held in `ctx`.
+func LdSkbData(dst pb.Reg, ctx pb.Reg) *pb.Instruction {
+	return LdW(dst, ctx, SkbDataOffset)
+}
+
+// LdSkbDataEnd loads the packet end pointer from the __sk_buff held in `ctx`.
+func LdSkbDataEnd(dst pb.Reg, ctx pb.Reg) *pb.Instruction {
+	return LdW(dst, ctx, SkbDataEndOffset)
+}
+
+// LdXdpData loads the packet start pointer from the xdp_md held in `ctx`.
+func LdXdpData(dst pb.Reg, ctx pb.Reg) *pb.Instruction {
+	return LdW(dst, ctx, XdpDataOffset)
+}
+
+// LdXdpDataEnd loads the packet end pointer from the xdp_md held in `ctx`.
+func LdXdpDataEnd(dst pb.Reg, ctx pb.Reg) *pb.Instruction {
+	return LdW(dst, ctx, XdpDataEndOffset)
+}
+
+// PacketBoundsCheckedLoad reads `size` bytes at `data` + `offset` into `dst`,
+// guarded by the bounds check the verifier requires for direct packet access:
+//
+//	tmp = data
+//	tmp += offset + size
+//	if tmp > dataEnd goto +1
+//	dst = *(size *)(data + offset)
+//
+// `data` and `dataEnd` must hold the packet pointers, e.g. loaded with
+// LdSkbData and LdSkbDataEnd.
+func PacketBoundsCheckedLoad(data, dataEnd, tmp, dst pb.Reg, offset int16, size pb.StLdSize) ([]*pb.Instruction, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("packet offset %d must not be negative", offset)
+	}
+	width := AlignmentForSize(size)
+	if width == 0 {
+		return nil, fmt.Errorf("invalid load size %v", size)
+	}
+	return InstructionSequence(
+		Mov64(tmp, data),
+		Add64(tmp, int32(offset)+int32(width)),
+		JmpGT(tmp, dataEnd, 1),
+		newLoadOperation(size, dst, data, offset),
+	)
+}
+
+// newPseudoValue returns the second slot of a wide instruction, every field
+// but the immediate is unused and encodes to 0.
+func newPseudoValue(imm int32) *pb.Instruction {
+	return &pb.Instruction{
+		Opcode: &pb.Instruction_MemOpcode{
+			MemOpcode: &pb.MemOpcode{
+				Mode:             UnusedField,
+				Size:             UnusedField,
+				InstructionClass: UnusedField,
+			},
+		},
+		DstReg:    UnusedField,
+		SrcReg:    UnusedField,
+		Offset:    UnusedField,
+		Immediate: imm,
+		PseudoInstruction: &pb.Instruction_Empty{
+			Empty: &pb.Empty{},
+		},
+	}
+}
+
 func LdMapByFd(dst pb.Reg, fd int) *pb.Instruction {
-	pseudoIns := &pb.Instruction{
+	return newLoadImmOperation(pb.StLdSize_StLdSizeDW, dst, PseudoMapFD, UnusedField, int32(fd), newPseudoValue(UnusedField))
+}
+
+// LdImm64 loads the 64 bit immediate `imm` into `dst`. The upper half of the
+// immediate lives in the second slot of the instruction.
+func LdImm64(dst pb.Reg, imm uint64) *pb.Instruction {
+	return newLoadImmOperation(pb.StLdSize_StLdSizeDW, dst, pb.Reg_R0, UnusedField, int32(imm), newPseudoValue(int32(imm>>32)))
+}
+
+// isMapFdLoad returns true if `i` was built with LdMapByFd, its immediate
+// is the fd of a map.
+func isMapFdLoad(i *pb.Instruction) bool {
+	op := i.GetMemOpcode()
+	return op != nil && op.InstructionClass == pb.InsClass_InsClassLd && op.Mode == pb.StLdMode_StLdModeIMM &&
+		op.Size == pb.StLdSize_StLdSizeDW && i.SrcReg == PseudoMapFD
+}
+
+func newPacketLoadOperation(mode pb.StLdMode, size pb.StLdSize, src pb.Reg, imm int32) *pb.Instruction {
+	return &pb.Instruction{
 		Opcode: &pb.Instruction_MemOpcode{
 			MemOpcode: &pb.MemOpcode{
-				Mode:             0,
-				Size:             0,
-				InstructionClass: 0,
+				Mode:             mode,
+				Size:             size,
+				InstructionClass: pb.InsClass_InsClassLd,
 			},
 		},
-		DstReg:    0,
-		SrcReg:    0,
-		Offset:    0,
-		Immediate: 0,
+		DstReg:    pb.Reg_R0,
+		SrcReg:    src,
+		Offset:    UnusedField,
+		Immediate: imm,
 		PseudoInstruction: &pb.Instruction_Empty{
 			Empty: &pb.Empty{},
 		},
 	}
-	return newLoadImmOperation(pb.StLdSize_StLdSizeDW, dst, PseudoMapFD, UnusedField, int32(fd), pseudoIns)
+}
+
+// LdAbs creates a legacy BPF_LD | BPF_ABS packet load, inherited from
+// classic BPF: R0 = ntohl(*(size *)(skb->data + imm)).
+//
+// Its operands are implicit: R6 must hold the context (the __sk_buff the
+// program got in R1) and the result always goes to R0, while R1 to R5 are
+// clobbered as if a helper had been called. A load out of the packet bounds
+// makes the program exit returning 0. Only W, H and B sizes are valid.
+func LdAbs(size pb.StLdSize, imm int32) *pb.Instruction {
+	return newPacketLoadOperation(pb.StLdMode_StLdModeABS, size, pb.Reg_R0, imm)
+}
+
+// LdInd creates a legacy BPF_LD | BPF_IND packet load, the same as LdAbs
+// but the packet offset is src + imm: R0 = ntohl(*(size *)(skb->data + src +
+// imm)).
+func LdInd(size pb.StLdSize, src pb.Reg, imm int32) *pb.Instruction {
+	return newPacketLoadOperation(pb.StLdMode_StLdModeIND, size, src, imm)
+}
+
+// isLegacyPacketLoad returns true if `i` was built with LdAbs or LdInd.
+func isLegacyPacketLoad(i *pb.Instruction) bool {
+	op := i.GetMemOpcode()
+	return op != nil && op.InstructionClass == pb.InsClass_InsClassLd &&
+		(op.Mode == pb.StLdMode_StLdModeABS || op.Mode == pb.StLdMode_StLdModeIND)
 }
 
 func newAtomicInstruction(dst, src pb.Reg, size pb.StLdSize, offset int16, operation int32) *pb.Instruction {
@@ -195,6 +306,18 @@ func newAtomicInstruction(dst, src pb.Reg, size pb.StLdSize, offset int16, opera
 	}
 }
 
+// XAdd creates a legacy BPF_XADD instruction (`lock *(size *)(dst + offset)
+// += src`), the only atomic operation understood by kernels older than 5.12.
+//
+// BPF_XADD shares its mode bits (0xc0) with the generalized BPF_ATOMIC
+// instructions that replaced it, so the opcode byte is the same. What makes
+// it "legacy" is that the operation is implied by the opcode: the immediate
+// must be 0 (BPF_ADD without BPF_FETCH), older kernels reject anything else.
+// Only W and DW sizes are valid.
+func XAdd(size pb.StLdSize, dst, src pb.Reg, offset int16) *pb.Instruction {
+	return newAtomicInstruction(dst, src, size, offset, UnusedField)
+}
+
 func MemAdd64(dst, src pb.Reg, offset int16) *pb.Instruction {
 	return newAtomicInstruction(dst, src, pb.StLdSize_StLdSizeDW, offset, int32(pb.AluOperationCode_AluAdd))
 }
@@ -226,3 +349,64 @@ func MemXor64(dst, src pb.Reg, offset int16) *pb.Instruction {
 func MemXor(dst, src pb.Reg, offset int16) *pb.Instruction {
 	return newAtomicInstruction(dst, src, pb.StLdSize_StLdSizeW, offset, int32(pb.AluOperationCode_AluXor))
 }
+
+// StackString stores `s`, NUL terminated, on the stack at r10 + `offset`
+// 4 bytes at a time, e.g. to build the format string of CallTracePrintk.
+// The stored string takes len(s) + 1 bytes.
+func StackString(s string, offset int16) ([]*pb.Instruction, error) {
+	if offset%4 != 0 {
+		return nil, fmt.Errorf("stack offset %d is not 4 byte aligned", offset)
+	}
+	data := append([]byte(s), 0)
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	if int(offset)+len(data) > 0 || int(offset) < -512 {
+		return nil, fmt.Errorf("%d bytes at stack offset %d do not fit the stack", len(data), offset)
+	}
+	sequence := []*pb.Instruction{}
+	for i := 0; i < len(data); i += 4 {
+		word := int32(binary.LittleEndian.Uint32(data[i : i+4]))
+		sequence = append(sequence, StW(pb.Reg_R10, word, offset+int16(i)))
+	}
+	return InstructionSequence(sequence...)
+}
+
+// VariableStackPointer sets `ptr` to r10 + `base` + (`offset` & `mask`), a
+// stack pointer with a variable offset the verifier has to bound. `offset`
+// is masked in place. The verifier always enforces strict alignment on the
+// stack, so the low bits of `mask` are cleared to keep the offset a
+// multiple of `size` and `base` has to be aligned too. The sequence is
+// rejected unless an access of `size` bytes through `ptr` stays within the
+// stack for every value of `offset`, so a correct verifier accepts the
+// access:
+//
+//	offset &= mask &^ (size - 1)
+//	ptr = r10
+//	ptr += base
+//	ptr += offset
+func VariableStackPointer(ptr, offset pb.Reg, base int16, mask int32, size pb.StLdSize) ([]*pb.Instruction, error) {
+	if ptr == offset || ptr == pb.Reg_R10 || offset == pb.Reg_R10 {
+		return nil, fmt.Errorf("ptr (%v) and offset (%v) must be distinct registers other than r10", ptr, offset)
+	}
+	if mask < 0 {
+		return nil, fmt.Errorf("mask %#x is negative", mask)
+	}
+	width := AlignmentForSize(size)
+	if width == 0 {
+		return nil, fmt.Errorf("invalid access size %v", size)
+	}
+	if base%width != 0 {
+		return nil, fmt.Errorf("base %d is not aligned to %d byte accesses", base, width)
+	}
+	mask &^= int32(width - 1)
+	if int(base) < -512 || int(base)+int(mask)+int(AlignmentForSize(size)) > 0 {
+		return nil, fmt.Errorf("%d byte accesses at stack offsets [%d, %d] do not fit the stack", AlignmentForSize(size), base, int(base)+int(mask))
+	}
+	return InstructionSequence(
+		And64(offset, mask),
+		Mov64(ptr, pb.Reg_R10),
+		Add64(ptr, int32(base)),
+		Add64(ptr, offset),
+	)
+}
@@ -15,6 +15,7 @@
 package ebpf
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
@@ -198,6 +199,30 @@ func TestMemoryInstructionCorrectEncoding(t *testing.T) {
 			wantImm:              42,
 			wantEncoding:         []uint64{0x2a00001918, 0},
 		},
+		{
+			testName:             "Encoding XAdd DW Instruction",
+			instruction:          XAdd(pb.StLdSize_StLdSizeDW, testDstReg, testSrcReg, testOffset),
+			wantMode:             pb.StLdMode_StLdModeATOMIC,
+			wantSize:             pb.StLdSize_StLdSizeDW,
+			wantInstructionClass: pb.InsClass_InsClassStx,
+			wantOffset:           testOffset,
+			wantDstReg:           testDstReg,
+			wantSrcReg:           testSrcReg,
+			wantImm:              0,
+			wantEncoding:         []uint64{0xfff809db},
+		},
+		{
+			testName:             "Encoding XAdd W Instruction",
+			instruction:          XAdd(pb.StLdSize_StLdSizeW, testDstReg, testSrcReg, testOffset),
+			wantMode:             pb.StLdMode_StLdModeATOMIC,
+			wantSize:             pb.StLdSize_StLdSizeW,
+			wantInstructionClass: pb.InsClass_InsClassStx,
+			wantOffset:           testOffset,
+			wantDstReg:           testDstReg,
+			wantSrcReg:           testSrcReg,
+			wantImm:              0,
+			wantEncoding:         []uint64{0xfff809c3},
+		},
 	}
 
 	for _, tc := range tests {
@@ -254,3 +279,212 @@ func TestMemoryInstructionCorrectEncoding(t *testing.T) {
 		})
 	}
 }
+
+func TestXAddMatchesAtomicAdd(t *testing.T) {
+	// BPF_XADD and BPF_ATOMIC share the same opcode byte, the legacy form
+	// is the generalized atomic add without BPF_FETCH.
+	xadd, err := encodeInstruction(XAdd(pb.StLdSize_StLdSizeDW, R1, R2, -8))
+	if err != nil {
+		t.Fatalf("unexpected error when ecoding: %v", err)
+	}
+	memAdd, err := encodeInstruction(MemAdd64(R1, R2, -8))
+	if err != nil {
+		t.Fatalf("unexpected error when ecoding: %v", err)
+	}
+	if !reflect.DeepEqual(xadd, memAdd) {
+		t.Errorf("XAdd() encoding = %x, MemAdd64() encoding = %x, want them equal", xadd, memAdd)
+	}
+}
+
+func TestLegacyPacketLoads(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction *pb.Instruction
+		want        uint64
+	}{
+		// BPF_LD | BPF_ABS | BPF_W, the packet offset in the immediate.
+		{"LdAbs W", LdAbs(pb.StLdSize_StLdSizeW, 14), 0x0000000e_00000020},
+		// BPF_LD | BPF_ABS | BPF_H
+		{"LdAbs H", LdAbs(pb.StLdSize_StLdSizeH, 12), 0x0000000c_00000028},
+		// BPF_LD | BPF_IND | BPF_B, the src register adds to the offset.
+		{"LdInd B", LdInd(pb.StLdSize_StLdSizeB, R7, 2), 0x00000002_00007050},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := encodeInstruction(tc.instruction)
+			if err != nil {
+				t.Fatalf("unexpected error when ecoding: %v", err)
+			}
+			if len(got) != 1 || got[0] != tc.want {
+				t.Errorf("%s encoding = %#x, want [%#x]", tc.name, got, tc.want)
+			}
+		})
+	}
+
+	// The loads read R6 and write R0, that is the whole program is
+	// initialized before use.
+	withTestGlobals(t, 1)
+	program := RandomLegacyPacketLoads(10)
+	if err := Validate(program); err != nil {
+		t.Errorf("Validate(RandomLegacyPacketLoads()) = %v", err)
+	}
+	loads := 0
+	for _, i := range program {
+		if isLegacyPacketLoad(i) {
+			loads++
+		}
+	}
+	if loads != 10 {
+		t.Errorf("RandomLegacyPacketLoads(10) has %d packet loads, want 10", loads)
+	}
+	if _, err := GenerateBytecode(&pb.Program{
+		Functions: []*pb.Functions{{Instructions: program}},
+		ProgType:  ProgTypeSocketFilter,
+	}); err != nil {
+		t.Errorf("GenerateBytecode(RandomLegacyPacketLoads()) error = %v", err)
+	}
+
+	// R1 to R5 do not survive the loads.
+	clobbered := []*pb.Instruction{Mov64(R6, R1), Mov64(R2, 1), LdAbs(pb.StLdSize_StLdSizeB, 0), Mov64(R0, R2), Exit()}
+	if err := Validate(clobbered); !errors.Is(err, UninitializedRead) {
+		t.Errorf("Validate() of a read of R2 after LdAbs = %v, want %v", err, UninitializedRead)
+	}
+}
+
+func TestPacketBoundsCheckedLoad(t *testing.T) {
+	got, err := PacketBoundsCheckedLoad(R2, R3, R4, R5, 14, pb.StLdSize_StLdSizeH)
+	if err != nil {
+		t.Fatalf("PacketBoundsCheckedLoad() unexpected error: %v", err)
+	}
+
+	want := []*pb.Instruction{
+		Mov64(R4, R2),
+		Add64(R4, 16),
+		JmpGT(R4, R3, 1),
+		LdH(R5, R2, 14),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("len(PacketBoundsCheckedLoad()) = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !protobuf.Equal(got[i], want[i]) {
+			t.Errorf("PacketBoundsCheckedLoad()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := PacketBoundsCheckedLoad(R2, R3, R4, R5, -1, pb.StLdSize_StLdSizeB); err == nil {
+		t.Errorf("PacketBoundsCheckedLoad() with negative offset error = nil, want error")
+	}
+}
+
+func TestRandomPacketReadIsGuarded(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		seq := RandomPacketRead(R2, R3, R4, R5)
+		if len(seq) != 4 {
+			t.Fatalf("len(RandomPacketRead()) = %d, want 4", len(seq))
+		}
+
+		check, load := seq[2], seq[3]
+		if check.GetJmpOpcode().GetOperationCode() != pb.JmpOperationCode_JmpJGT || check.DstReg != R4 || check.SrcReg != R3 || check.Offset != 1 {
+			t.Fatalf("RandomPacketRead()[2] = %v, want a jump over the load when the read ends past data_end", check)
+		}
+		if load.GetMemOpcode().GetInstructionClass() != pb.InsClass_InsClassLdx || load.SrcReg != R2 || load.DstReg != R5 {
+			t.Fatalf("RandomPacketRead()[3] = %v, want a load from the packet", load)
+		}
+
+		// The checked end must cover the whole read.
+		readEnd := load.Offset + int32(AlignmentForSize(load.GetMemOpcode().GetSize()))
+		if seq[1].Immediate != readEnd {
+			t.Errorf("RandomPacketRead() checks up to %d, want %d", seq[1].Immediate, readEnd)
+		}
+	}
+}
+
+func TestStackString(t *testing.T) {
+	got, err := StackString("r6=%d", -8)
+	if err != nil {
+		t.Fatalf("StackString() unexpected error: %v", err)
+	}
+
+	// "r6=%d\0" padded to 8 bytes, little endian words.
+	want := []*pb.Instruction{
+		StW(R10, int32(0x253d3672), -8),
+		StW(R10, int32(0x00000064), -4),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("len(StackString()) = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !protobuf.Equal(got[i], want[i]) {
+			t.Errorf("StackString()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := StackString("r6=%d", -6); err == nil {
+		t.Errorf("StackString() with unaligned offset error = nil, want error")
+	}
+	if _, err := StackString("r6=%d", -4); err == nil {
+		t.Errorf("StackString() past the frame pointer error = nil, want error")
+	}
+}
+
+func TestVariableStackPointer(t *testing.T) {
+	got, err := VariableStackPointer(R7, R6, -64, 0x1f, pb.StLdSize_StLdSizeDW)
+	if err != nil {
+		t.Fatalf("VariableStackPointer() unexpected error: %v", err)
+	}
+
+	// The offset has to be masked before it is added to the stack pointer
+	// and the low bits of the mask are cleared to keep it 8 byte aligned.
+	want := []*pb.Instruction{
+		And64(R6, 0x18),
+		Mov64(R7, R10),
+		Add64(R7, -64),
+		Add64(R7, R6),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("len(VariableStackPointer()) = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !protobuf.Equal(got[i], want[i]) {
+			t.Errorf("VariableStackPointer()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	tests := []struct {
+		name   string
+		ptr    pb.Reg
+		offset pb.Reg
+		base   int16
+		mask   int32
+		size   pb.StLdSize
+	}{
+		{"past the frame pointer", R7, R6, -32, 0x3f, pb.StLdSize_StLdSizeDW},
+		{"below the stack", R7, R6, -520, 0x7, pb.StLdSize_StLdSizeB},
+		{"negative mask", R7, R6, -64, -1, pb.StLdSize_StLdSizeB},
+		{"same registers", R6, R6, -64, 0x7, pb.StLdSize_StLdSizeB},
+		{"frame pointer", R10, R6, -64, 0x7, pb.StLdSize_StLdSizeB},
+		{"misaligned base", R7, R6, -62, 0x7, pb.StLdSize_StLdSizeW},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := VariableStackPointer(tc.ptr, tc.offset, tc.base, tc.mask, tc.size); err == nil {
+				t.Errorf("VariableStackPointer() error = nil, want an error")
+			}
+		})
+	}
+
+	// Whatever the mask, the masked offset is a multiple of the access size.
+	for _, size := range []pb.StLdSize{pb.StLdSize_StLdSizeB, pb.StLdSize_StLdSizeH, pb.StLdSize_StLdSizeW, pb.StLdSize_StLdSizeDW} {
+		width := int32(AlignmentForSize(size))
+		for mask := int32(0); mask < 0x100; mask++ {
+			got, err := VariableStackPointer(R7, R6, -264, mask, size)
+			if err != nil {
+				t.Fatalf("VariableStackPointer(mask %#x) unexpected error: %v", mask, err)
+			}
+			if masked := got[0].Immediate; masked&(width-1) != 0 || masked&^mask != 0 {
+				t.Fatalf("VariableStackPointer(mask %#x, %d bytes) masks with %#x, want a subset of the mask aligned to the size", mask, width, masked)
+			}
+		}
+	}
+}
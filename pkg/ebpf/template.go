@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"buzzer/pkg/rand"
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+// ProgramTemplate is the skeleton of the programs of a given type, e.g. an
+// xdp program reads the packet pointers, checks the bounds of the headers
+// it parses and returns an xdp action. Generate keeps the skeleton and
+// randomizes the details (which fields are read, what they are compared
+// with, the returned values...), so its programs are far more likely to be
+// accepted than random instructions and still take different paths.
+type ProgramTemplate struct {
+	// Name identifies the template, e.g. "xdp".
+	Name string
+	// ProgType is the program type the generated programs are loaded as.
+	ProgType uint32
+	// Generate returns the instructions of a new program.
+	Generate func() ([]*pb.Instruction, error)
+}
+
+// XdpTemplate generates xdp programs that parse the ethernet, ip and udp
+// headers of the packet, see xdpProgram.
+var XdpTemplate = ProgramTemplate{
+	Name:     "xdp",
+	ProgType: ProgTypeXdp,
+	Generate: xdpProgram,
+}
+
+var (
+	// xdpHeaderLengths are the lengths of the ethernet header alone and
+	// followed by an ipv4 header and then an udp header.
+	xdpHeaderLengths = []int16{14, 34, 42}
+
+	xdpActions = []int32{XdpAborted, XdpDrop, XdpPass, XdpTx}
+)
+
+func randomXdpAction() int32 {
+	return xdpActions[rand.SharedRNG.RandRange(0, uint64(len(xdpActions)-1))]
+}
+
+// xdpProgram returns a program with the following skeleton:
+//
+//	data = ctx->data
+//	dataEnd = ctx->data_end
+//	if data + headerLength > dataEnd goto outOfBounds
+//	field1 = *(size *)(data + offset1)
+//	...
+//	if fieldN <op> imm goto taken
+//	r0 = action; exit
+//	taken: r0 = action; exit
+//	outOfBounds: r0 = action; exit
+//
+// The header length, the fields, the comparison and the actions are random.
+func xdpProgram() ([]*pb.Instruction, error) {
+	headerLength := xdpHeaderLengths[rand.SharedRNG.RandRange(0, uint64(len(xdpHeaderLengths)-1))]
+
+	fields := []pb.Reg{R5, R6, R7, R8}
+	body := []*pb.Instruction{}
+	last := R5
+	for _, field := range fields[:rand.SharedRNG.RandRange(1, uint64(len(fields)))] {
+		size := RandomSize()
+		width := AlignmentForSize(size)
+		offset := int16(rand.SharedRNG.RandRange(0, uint64((headerLength-width)/width))) * width
+		body = append(body, newLoadOperation(size, field, R2, offset))
+		last = field
+	}
+	ops := []pb.JmpOperationCode{
+		pb.JmpOperationCode_JmpJEQ,
+		pb.JmpOperationCode_JmpJNE,
+		pb.JmpOperationCode_JmpJGT,
+		pb.JmpOperationCode_JmpJSET,
+	}
+	op := ops[rand.SharedRNG.RandRange(0, uint64(len(ops)-1))]
+	body = append(body,
+		newJmpInstruction(op, pb.InsClass_InsClassJmp, last, int32(rand.SharedRNG.RandInt()), 2),
+		Mov64(R0, randomXdpAction()),
+		Exit(),
+		Mov64(R0, randomXdpAction()),
+		Exit(),
+	)
+
+	instructions := []*pb.Instruction{
+		LdXdpData(R2, R1),
+		LdXdpDataEnd(R3, R1),
+		Mov64(R4, R2),
+		Add64(R4, int32(headerLength)),
+		JmpGT(R4, R3, int16(ProgramSize(body))),
+	}
+	instructions = append(instructions, body...)
+	instructions = append(instructions, Mov64(R0, randomXdpAction()), Exit())
+	return InstructionSequence(instructions...)
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestXdpTemplate(t *testing.T) {
+	withTestGlobals(t, 1)
+
+	validActions := map[int32]bool{XdpAborted: true, XdpDrop: true, XdpPass: true, XdpTx: true}
+	isCtxLoad := func(i *pb.Instruction, offset int32) bool {
+		op := i.GetMemOpcode()
+		return op != nil && op.InstructionClass == pb.InsClass_InsClassLdx && i.SrcReg == R1 && i.Offset == offset
+	}
+	for n := 0; n < 200; n++ {
+		instructions, err := XdpTemplate.Generate()
+		if err != nil {
+			t.Fatalf("XdpTemplate.Generate() unexpected error: %v", err)
+		}
+		if err := Validate(instructions); err != nil {
+			t.Fatalf("Validate(XdpTemplate.Generate()) = %v, want nil\n%s", err, ProgramString(instructions))
+		}
+		if !isExit(instructions[len(instructions)-1]) {
+			t.Fatalf("XdpTemplate.Generate() does not end with an exit\n%s", ProgramString(instructions))
+		}
+
+		// Every exit returns an xdp action.
+		for index, i := range instructions {
+			if !isExit(i) {
+				continue
+			}
+			ret := instructions[index-1]
+			op := ret.GetAluOpcode()
+			if op == nil || op.OperationCode != pb.AluOperationCode_AluMov || op.Source != pb.SrcOperand_Immediate || ret.DstReg != R0 || !validActions[ret.Immediate] {
+				t.Fatalf("exit at %d is not preceded by a valid xdp action\n%s", index, ProgramString(instructions))
+			}
+		}
+
+		// The packet is only read once data_end has been checked.
+		var data, dataEnd pb.Reg = -1, -1
+		checked := false
+		for _, i := range instructions {
+			switch {
+			case isCtxLoad(i, XdpDataOffset):
+				data = i.DstReg
+			case isCtxLoad(i, XdpDataEndOffset):
+				dataEnd = i.DstReg
+			case isBranch(i) && i.GetJmpOpcode().Source == pb.SrcOperand_RegSrc && i.SrcReg == dataEnd:
+				checked = true
+			case i.GetMemOpcode() != nil && i.SrcReg == data && !checked:
+				t.Fatalf("packet read before the bounds check\n%s", ProgramString(instructions))
+			}
+		}
+		if data < 0 || dataEnd < 0 || !checked {
+			t.Fatalf("XdpTemplate.Generate() has no data/data_end bounds check\n%s", ProgramString(instructions))
+		}
+	}
+}
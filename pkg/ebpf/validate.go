@@ -0,0 +1,238 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	pb "buzzer/proto/ebpf_go_proto"
+	"fmt"
+	"strings"
+)
+
+var (
+	UninitializedRead      = fmt.Errorf("Read of an uninitialized register")
+	JmpOutOfBounds         = fmt.Errorf("Control flow leaves the program")
+	FramePointerWrite      = fmt.Errorf("Write to the read only frame pointer")
+	UnreachableInstruction = fmt.Errorf("Unreachable instruction")
+	// UninitializedReturn is reported, along with UninitializedRead, when
+	// the read of an uninitialized register is the read of R0 by an exit.
+	UninitializedReturn = fmt.Errorf("Exit with an uninitialized R0")
+)
+
+// regSet is a bit set of registers, bit n stands for Rn.
+type regSet uint16
+
+func (s regSet) has(r pb.Reg) bool {
+	return s&(1<<r) != 0
+}
+
+// instructionRegisters returns the registers `i` reads and writes. Helper
+// calls are assumed to read no arguments, they clobber R1 to R5 which is
+// accounted for by Validate.
+func instructionRegisters(i *pb.Instruction) (reads []pb.Reg, writes []pb.Reg) {
+	switch op := i.Opcode.(type) {
+	case *pb.Instruction_AluOpcode:
+		if op.AluOpcode.OperationCode != pb.AluOperationCode_AluMov {
+			reads = append(reads, i.DstReg)
+		}
+		if op.AluOpcode.Source == pb.SrcOperand_RegSrc && op.AluOpcode.OperationCode != pb.AluOperationCode_AluEnd {
+			reads = append(reads, i.SrcReg)
+		}
+		writes = append(writes, i.DstReg)
+	case *pb.Instruction_JmpOpcode:
+		switch {
+		case op.JmpOpcode.OperationCode == pb.JmpOperationCode_JmpExit:
+			reads = append(reads, R0)
+		case op.JmpOpcode.OperationCode == pb.JmpOperationCode_JmpCALL:
+			writes = append(writes, R0)
+		case IsConditional(op.JmpOpcode.OperationCode):
+			reads = append(reads, i.DstReg)
+			if op.JmpOpcode.Source == pb.SrcOperand_RegSrc {
+				reads = append(reads, i.SrcReg)
+			}
+		}
+	case *pb.Instruction_MemOpcode:
+		switch op.MemOpcode.InstructionClass {
+		case pb.InsClass_InsClassLd:
+			switch op.MemOpcode.Mode {
+			case pb.StLdMode_StLdModeABS:
+				reads = append(reads, R6)
+				writes = append(writes, R0)
+			case pb.StLdMode_StLdModeIND:
+				reads = append(reads, R6, i.SrcReg)
+				writes = append(writes, R0)
+			default:
+				writes = append(writes, i.DstReg)
+			}
+		case pb.InsClass_InsClassLdx:
+			reads = append(reads, i.SrcReg)
+			writes = append(writes, i.DstReg)
+		case pb.InsClass_InsClassSt:
+			reads = append(reads, i.DstReg)
+		case pb.InsClass_InsClassStx:
+			reads = append(reads, i.DstReg, i.SrcReg)
+			if op.MemOpcode.Mode == pb.StLdMode_StLdModeATOMIC {
+				writes = append(writes, i.SrcReg)
+			}
+		}
+	}
+	return reads, writes
+}
+
+// writesR0 returns true if any of the instructions of `block` writes R0.
+func writesR0(instructions []*pb.Instruction, block *BasicBlock) bool {
+	for index := block.Start; index <= block.End; index++ {
+		_, writes := instructionRegisters(instructions[index])
+		for _, reg := range writes {
+			if reg == R0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uninitializedReturnPath returns the blocks, as instruction ranges, of a
+// path from the entry to the exit at `exit` along which R0 is never written.
+func uninitializedReturnPath(cfg *ControlFlowGraph, exit int) string {
+	parent := map[int]int{0: -1}
+	pending := []int{0}
+	for len(pending) > 0 {
+		blockIndex := pending[0]
+		pending = pending[1:]
+		block := cfg.Blocks[blockIndex]
+		if block.Start <= exit && exit <= block.End {
+			path := []string{}
+			for ; blockIndex >= 0; blockIndex = parent[blockIndex] {
+				b := cfg.Blocks[blockIndex]
+				path = append([]string{fmt.Sprintf("[%d-%d]", b.Start, b.End)}, path...)
+			}
+			return strings.Join(path, " -> ")
+		}
+		if writesR0(cfg.instructions, block) {
+			continue
+		}
+		for _, successor := range block.Successors {
+			if _, seen := parent[successor]; !seen {
+				parent[successor] = blockIndex
+				pending = append(pending, successor)
+			}
+		}
+	}
+	return "unknown"
+}
+
+// Validate statically checks `instructions` for mistakes the verifier always
+// rejects: reads of registers that are not initialized on every path, jumps
+// out of the program or falling off its end, writes to R10 and unreachable
+// instructions. R1 and R10 are the only registers initialized on entry.
+//
+// The returned error wraps one of UninitializedRead, JmpOutOfBounds,
+// FramePointerWrite or UnreachableInstruction. A nil error does not mean the
+// verifier accepts the program, Validate knows nothing about types or bounds.
+func Validate(instructions []*pb.Instruction) error {
+	if len(instructions) == 0 {
+		return fmt.Errorf("%w: the program is empty", JmpOutOfBounds)
+	}
+
+	for index, inst := range instructions {
+		if _, writes := instructionRegisters(inst); len(writes) > 0 {
+			for _, reg := range writes {
+				if reg == R10 {
+					return fmt.Errorf("%w: instruction %d: %s", FramePointerWrite, index, InstructionString(inst))
+				}
+			}
+		}
+	}
+
+	cfg, err := NewControlFlowGraph(instructions)
+	if err != nil {
+		return fmt.Errorf("%w: %v", JmpOutOfBounds, err)
+	}
+
+	reachable := make([]bool, len(cfg.Blocks))
+	pending := []int{0}
+	reachable[0] = true
+	for len(pending) > 0 {
+		block := cfg.Blocks[pending[0]]
+		pending = pending[1:]
+		for _, successor := range block.Successors {
+			if !reachable[successor] {
+				reachable[successor] = true
+				pending = append(pending, successor)
+			}
+		}
+	}
+	for blockIndex, block := range cfg.Blocks {
+		if !reachable[blockIndex] {
+			return fmt.Errorf("%w: instruction %d", UnreachableInstruction, block.Start)
+		}
+		last := instructions[block.End]
+		if block.End == len(instructions)-1 && !isExit(last) && !isUnconditionalBranch(last) {
+			return fmt.Errorf("%w: instruction %d falls off the end", JmpOutOfBounds, block.End)
+		}
+	}
+
+	// Registers initialized on every path to the start and end of each
+	// block, iterated until nothing changes.
+	entry := regSet(1<<R1 | 1<<R10)
+	in := make([]regSet, len(cfg.Blocks))
+	out := make([]regSet, len(cfg.Blocks))
+	for blockIndex := range cfg.Blocks {
+		in[blockIndex], out[blockIndex] = ^regSet(0), ^regSet(0)
+	}
+	transfer := func(block *BasicBlock, initialized regSet, check bool) (regSet, error) {
+		for index := block.Start; index <= block.End; index++ {
+			reads, writes := instructionRegisters(instructions[index])
+			for _, reg := range reads {
+				if check && !initialized.has(reg) {
+					if isExit(instructions[index]) {
+						return initialized, fmt.Errorf("%w: %w: instruction %d, through blocks %s", UninitializedRead, UninitializedReturn, index, uninitializedReturnPath(cfg, index))
+					}
+					return initialized, fmt.Errorf("%w: instruction %d reads r%d: %s", UninitializedRead, index, reg, InstructionString(instructions[index]))
+				}
+			}
+			if isCall(instructions[index]) || isLegacyPacketLoad(instructions[index]) {
+				initialized &^= regSet(1<<R1 | 1<<R2 | 1<<R3 | 1<<R4 | 1<<R5)
+			}
+			for _, reg := range writes {
+				initialized |= 1 << reg
+			}
+		}
+		return initialized, nil
+	}
+	for changed := true; changed; {
+		changed = false
+		for blockIndex, block := range cfg.Blocks {
+			initialized := ^regSet(0)
+			if blockIndex == 0 {
+				initialized = entry
+			}
+			for _, predecessor := range block.Predecessors {
+				initialized &= out[predecessor]
+			}
+			blockOut, _ := transfer(block, initialized, false)
+			if initialized != in[blockIndex] || blockOut != out[blockIndex] {
+				in[blockIndex], out[blockIndex] = initialized, blockOut
+				changed = true
+			}
+		}
+	}
+	for blockIndex, block := range cfg.Blocks {
+		if _, err := transfer(block, in[blockIndex], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
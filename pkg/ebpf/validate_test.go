@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []*pb.Instruction
+		wantErr      error
+	}{
+		{
+			name:         "well formed",
+			instructions: []*pb.Instruction{Mov64(R0, 0), Exit()},
+		},
+		{
+			name:         "context and frame pointer are initialized",
+			instructions: []*pb.Instruction{Mov64(R0, R1), Add64(R0, R10), Exit()},
+		},
+		{
+			name: "initialized on every path",
+			instructions: []*pb.Instruction{
+				JmpEQ(R1, 0, 2),
+				Mov64(R0, 1),
+				Jmp(1),
+				Mov64(R0, 2),
+				Exit(),
+			},
+		},
+		{
+			name:         "empty",
+			instructions: []*pb.Instruction{},
+			wantErr:      JmpOutOfBounds,
+		},
+		{
+			name:         "uninitialized read",
+			instructions: []*pb.Instruction{Mov64(R0, R2), Exit()},
+			wantErr:      UninitializedRead,
+		},
+		{
+			name:         "exit without r0",
+			instructions: []*pb.Instruction{Exit()},
+			wantErr:      UninitializedRead,
+		},
+		{
+			name: "initialized on one path only",
+			instructions: []*pb.Instruction{
+				JmpEQ(R1, 0, 1),
+				Mov64(R0, 1),
+				Exit(),
+			},
+			wantErr: UninitializedRead,
+		},
+		{
+			name: "clobbered by a call",
+			instructions: []*pb.Instruction{
+				Mov64(R2, 0),
+				Call(MapLookup),
+				Mov64(R0, R2),
+				Exit(),
+			},
+			wantErr: UninitializedRead,
+		},
+		{
+			name:         "jmp past the end",
+			instructions: []*pb.Instruction{Mov64(R0, 0), JmpEQ(R0, 0, 5), Exit()},
+			wantErr:      JmpOutOfBounds,
+		},
+		{
+			name:         "falls off the end",
+			instructions: []*pb.Instruction{Mov64(R0, 0)},
+			wantErr:      JmpOutOfBounds,
+		},
+		{
+			name:         "frame pointer write",
+			instructions: []*pb.Instruction{Mov64(R0, 0), Add64(R10, 8), Exit()},
+			wantErr:      FramePointerWrite,
+		},
+		{
+			name:         "unreachable",
+			instructions: []*pb.Instruction{Mov64(R0, 0), Exit(), Mov64(R0, 1), Exit()},
+			wantErr:      UnreachableInstruction,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.instructions)
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Validate() = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsUninitializedReturnPath(t *testing.T) {
+	instructions := []*pb.Instruction{
+		Mov64(R2, 0),    // 0
+		JmpEQ(R1, 0, 2), // 1
+		Mov64(R0, 1),    // 2
+		Exit(),          // 3
+		Mov64(R3, 1),    // 4
+		Exit(),          // 5
+	}
+	err := Validate(instructions)
+	if !errors.Is(err, UninitializedRead) || !errors.Is(err, UninitializedReturn) {
+		t.Fatalf("Validate() = %v, want %v and %v", err, UninitializedRead, UninitializedReturn)
+	}
+	if want := "instruction 5, through blocks [0-1] -> [4-5]"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Validate() = %v, want it to contain %q", err, want)
+	}
+
+	// Other uninitialized reads are not about the return value.
+	if err := Validate([]*pb.Instruction{Mov64(R0, R2), Exit()}); errors.Is(err, UninitializedReturn) {
+		t.Errorf("Validate() = %v, want it not to be %v", err, UninitializedReturn)
+	}
+}
+
+func TestValidateMalformedProgram(t *testing.T) {
+	wantErrs := map[Malformation]error{
+		MalformationUninitRead:        UninitializedRead,
+		MalformationJmpOutOfBounds:    JmpOutOfBounds,
+		MalformationFramePointerWrite: FramePointerWrite,
+		MalformationUnreachable:       UnreachableInstruction,
+	}
+
+	for _, kind := range Malformations {
+		t.Run(kind.String(), func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				prog, err := MalformedProgram(kind, 30)
+				if err != nil {
+					t.Fatalf("MalformedProgram() error = %v", err)
+				}
+				if err := Validate(prog); !errors.Is(err, wantErrs[kind]) {
+					t.Fatalf("Validate(MalformedProgram()) = %v, want %v\n%s", err, wantErrs[kind], ProgramString(prog))
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRandomProgram(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		prog := []*pb.Instruction{}
+		for reg := R0; reg <= R9; reg++ {
+			prog = append(prog, Mov64(reg, 0))
+		}
+		prog = append(prog, RandomProgram(30)...)
+		if err := Validate(prog); err != nil {
+			t.Fatalf("Validate(RandomProgram()) = %v, want nil\n%s", err, ProgramString(prog))
+		}
+	}
+}
@@ -20,6 +20,7 @@
 package rand
 
 import (
+	"math"
 	"math/rand"
 	"time"
 )
@@ -46,18 +47,87 @@ type NumGen struct {
 	r *rand.Rand
 }
 
-// NewRand generates a new random number generator
-func NewRand(randSource rand.Source) *NumGen {
+// Option configures the generator returned by New.
+type Option func(*options)
+
+type options struct {
+	source rand.Source
+	seed   int64
+	seeded bool
+}
+
+// WithRNG makes the generator draw from `source`, e.g. a XorshiftSource,
+// instead of the math/rand source.
+func WithRNG(source rand.Source) Option {
+	return func(o *options) {
+		o.source = source
+	}
+}
+
+// WithSeed seeds the source of the generator with `seed`, whether it is the
+// default one or the one given to WithRNG.
+func WithSeed(seed int64) Option {
+	return func(o *options) {
+		o.seed = seed
+		o.seeded = true
+	}
+}
+
+// New returns a generator configured by `opts`. Without options it draws
+// from the math/rand source seeded with the current time.
+func New(opts ...Option) *NumGen {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	switch {
+	case o.source == nil && o.seeded:
+		o.source = rand.NewSource(o.seed)
+	case o.source == nil:
+		o.source = rand.NewSource(time.Now().Unix())
+	case o.seeded:
+		o.source.Seed(o.seed)
+	}
 	return &NumGen{
-		r: rand.New(randSource),
+		r: rand.New(o.source),
 	}
 }
 
+// NewRand generates a new random number generator
+func NewRand(randSource rand.Source) *NumGen {
+	return New(WithRNG(randSource))
+}
+
+// SharedRNG is the source of randomness of every generator in buzzer.
+//
+// Generation is reproducible: replacing SharedRNG with a NumGen built from a
+// fixed seed makes the same sequence of generator calls (with the same
+// generator configuration) return the same values, and thus pick the same
+// registers, operations and immediates. Generators must only draw from
+// SharedRNG and never depend on map iteration order to keep this property.
 var SharedRNG = NewRand(rand.NewSource(time.Now().Unix()))
 
 // RandRange returns a random 64-bit integer in the range of begin..end
+//
+// If end <= begin the range is degenerate and begin is returned without
+// consuming any randomness.
 func (g *NumGen) RandRange(begin, end uint64) uint64 {
-	return begin + uint64(g.r.Intn(int(end-begin+1)))
+	if end <= begin {
+		return begin
+	}
+
+	span := end - begin
+	switch {
+	case span < math.MaxInt32:
+		return begin + uint64(g.r.Intn(int(span+1)))
+	case span < math.MaxInt64:
+		return begin + uint64(g.r.Int63n(int64(span+1)))
+	case span == math.MaxUint64:
+		// span + 1 would overflow, any 64 bit value is in range.
+		return g.r.Uint64()
+	default:
+		return begin + g.r.Uint64()%(span+1)
+	}
 }
 
 // OneOf returns true 1 out of n times
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rand
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRandRangeDegenerate(t *testing.T) {
+	g := NewRand(rand.NewSource(1))
+	tests := []struct {
+		begin, end uint64
+		want       uint64
+	}{
+		{begin: 5, end: 5, want: 5},
+		{begin: 0, end: 0, want: 0},
+		{begin: math.MaxUint64, end: math.MaxUint64, want: math.MaxUint64},
+		{begin: 10, end: 3, want: 10},
+	}
+
+	for _, tc := range tests {
+		for i := 0; i < 1000; i++ {
+			if got := g.RandRange(tc.begin, tc.end); got != tc.want {
+				t.Fatalf("RandRange(%d, %d) = %d, want %d", tc.begin, tc.end, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestRandRangeBounds(t *testing.T) {
+	g := NewRand(rand.NewSource(1))
+	tests := []struct {
+		begin, end uint64
+	}{
+		{begin: 1, end: 2},
+		{begin: 0, end: 0xffffffff},
+		{begin: 1 << 40, end: 1<<40 + 3},
+		{begin: 1, end: math.MaxUint64},
+		{begin: 0, end: math.MaxUint64},
+	}
+
+	for _, tc := range tests {
+		for i := 0; i < 1000; i++ {
+			if got := g.RandRange(tc.begin, tc.end); got < tc.begin || got > tc.end {
+				t.Fatalf("RandRange(%d, %d) = %d, want a value in range", tc.begin, tc.end, got)
+			}
+		}
+	}
+}
+
+// countingSource is a XorshiftSource that counts the values drawn from it.
+type countingSource struct {
+	XorshiftSource
+	draws int
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.XorshiftSource.Int63()
+}
+
+func TestNewWithOptions(t *testing.T) {
+	draw := func(g *NumGen) []uint64 {
+		values := []uint64{}
+		for i := 0; i < 100; i++ {
+			values = append(values, g.RandRange(0, 1<<40))
+		}
+		return values
+	}
+
+	custom := &countingSource{}
+	got := draw(New(WithSeed(7), WithRNG(custom)))
+	if custom.draws == 0 {
+		t.Errorf("New(WithSeed(7), WithRNG(custom)) does not draw from custom")
+	}
+	// The seed applies to the custom source whatever the order of the
+	// options.
+	again := draw(New(WithRNG(&countingSource{}), WithSeed(7)))
+	for i := range got {
+		if got[i] != again[i] {
+			t.Fatalf("draw %d: %d != %d for the same seed and source", i, got[i], again[i])
+		}
+	}
+	if xorshift := draw(NewRand(NewXorshiftSource(7))); xorshift[0] != got[0] {
+		t.Errorf("New(WithSeed(7), WithRNG(custom)) = %d..., want the sequence of NewXorshiftSource(7) %d...", got[0], xorshift[0])
+	}
+
+	// Without a source the seed goes to the math/rand one.
+	seeded, old := draw(New(WithSeed(7))), draw(NewRand(rand.NewSource(7)))
+	for i := range seeded {
+		if seeded[i] != old[i] {
+			t.Fatalf("draw %d: New(WithSeed(7)) = %d, NewRand(rand.NewSource(7)) = %d", i, seeded[i], old[i])
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rand
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// XorshiftSource is a xorshift64* generator. It is cheaper and much smaller
+// than the math/rand source at the cost of a shorter period (2^64 - 1) and
+// weaker statistical quality, neither of which matters for generating
+// programs. Like the math/rand sources it is not safe for concurrent use.
+type XorshiftSource struct {
+	state uint64
+}
+
+// NewXorshiftSource returns a XorshiftSource seeded with `seed`.
+func NewXorshiftSource(seed int64) *XorshiftSource {
+	s := &XorshiftSource{}
+	s.Seed(seed)
+	return s
+}
+
+// Seed resets the generator to the state derived from `seed`. The seed goes
+// through a splitmix64 step first so that close seeds do not produce
+// correlated sequences and the all zero state is never reached.
+func (s *XorshiftSource) Seed(seed int64) {
+	z := uint64(seed) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	if z == 0 {
+		z = 0x9e3779b97f4a7c15
+	}
+	s.state = z
+}
+
+// Uint64 returns a random 64 bit value.
+func (s *XorshiftSource) Uint64() uint64 {
+	x := s.state
+	x ^= x >> 12
+	x ^= x << 25
+	x ^= x >> 27
+	s.state = x
+	return x * 0x2545f4914f6cdd1d
+}
+
+// Int63 returns a random non negative 63 bit value.
+func (s *XorshiftSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// NewSourceByName returns the source of the algorithm called `name` seeded
+// with `seed`: "default" for the math/rand source and "xorshift" for a
+// XorshiftSource.
+func NewSourceByName(name string, seed int64) (rand.Source, error) {
+	switch name {
+	case "default":
+		return rand.NewSource(seed), nil
+	case "xorshift":
+		return NewXorshiftSource(seed), nil
+	default:
+		return nil, fmt.Errorf("unknown random number generator %q, want default or xorshift", name)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rand
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestXorshiftRandRange(t *testing.T) {
+	g := NewRand(NewXorshiftSource(1))
+
+	for _, v := range []uint64{0, 7, 1 << 40} {
+		if got := g.RandRange(v, v); got != v {
+			t.Errorf("RandRange(%d, %d) = %d, want %d", v, v, got, v)
+		}
+	}
+
+	tests := []struct {
+		begin, end uint64
+	}{
+		{begin: 0, end: 1},
+		{begin: 3, end: 10},
+		{begin: 1 << 40, end: 1<<40 + 3},
+	}
+	for _, tc := range tests {
+		seen := map[uint64]bool{}
+		for i := 0; i < 1000; i++ {
+			got := g.RandRange(tc.begin, tc.end)
+			if got < tc.begin || got > tc.end {
+				t.Fatalf("RandRange(%d, %d) = %d, want a value in range", tc.begin, tc.end, got)
+			}
+			seen[got] = true
+		}
+		if !seen[tc.begin] || !seen[tc.end] {
+			t.Errorf("RandRange(%d, %d) never returned one of the endpoints in 1000 draws", tc.begin, tc.end)
+		}
+	}
+}
+
+func TestXorshiftSeed(t *testing.T) {
+	a, b := NewXorshiftSource(42), NewXorshiftSource(42)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Uint64(), b.Uint64(); x != y {
+			t.Fatalf("draw %d: %#x != %#x for the same seed", i, x, y)
+		}
+	}
+
+	// 0 would be a fixed point of xorshift without the splitmix step.
+	zero := NewXorshiftSource(0)
+	if zero.Uint64() == 0 && zero.Uint64() == 0 {
+		t.Errorf("NewXorshiftSource(0) only returns zeros")
+	}
+}
+
+func TestNewSourceByName(t *testing.T) {
+	for _, name := range []string{"default", "xorshift"} {
+		if _, err := NewSourceByName(name, 1); err != nil {
+			t.Errorf("NewSourceByName(%q) error = %v", name, err)
+		}
+	}
+	if _, err := NewSourceByName("pcg", 1); err == nil {
+		t.Errorf("NewSourceByName(\"pcg\") error = nil, want an error")
+	}
+}
+
+func benchmarkRandInt(b *testing.B, source rand.Source) {
+	g := NewRand(source)
+	for i := 0; i < b.N; i++ {
+		g.RandInt()
+	}
+}
+
+func BenchmarkRandIntDefault(b *testing.B) {
+	benchmarkRandInt(b, rand.NewSource(1))
+}
+
+func BenchmarkRandIntXorshift(b *testing.B) {
+	benchmarkRandInt(b, NewXorshiftSource(1))
+}
@@ -0,0 +1,103 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewComplexityStrategy returns a strategy that probes the complexity limit
+// of the verifier with binary branching programs that stay within it.
+func NewComplexityStrategy() *Complexity {
+	return &Complexity{isFinished: false, BranchFactor: 2, StayUnderLimit: true}
+}
+
+// Complexity generates programs whose paths multiply on every level of
+// branches, see BranchingProgram, so the verifier processes a number of
+// instructions exponential in the depth of the program.
+//
+// Programs are only verified: what matters is whether the verifier copes
+// with them, e.g. rejects one that BranchingComplexity expects to fit.
+type Complexity struct {
+	// BranchFactor is the number of paths every path splits into per level.
+	BranchFactor int
+
+	// Depth is the number of levels, 0 picks a random depth for every
+	// program.
+	Depth int
+
+	// StayUnderLimit keeps random depths within MaxBranchingDepth, the
+	// programs are then expected to be accepted. Otherwise depths go a few
+	// levels past it.
+	StayUnderLimit bool
+
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+// depth returns the depth of the next program.
+func (c *Complexity) depth() int {
+	if c.Depth != 0 {
+		return c.Depth
+	}
+	maxDepth := MaxBranchingDepth(c.BranchFactor, ComplexityLimit)
+	if !c.StayUnderLimit {
+		// BranchingProgram rejects depths it has no bits of cond for.
+		maxDepth += 2
+	}
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+	return int(rand.SharedRNG.RandRange(1, uint64(maxDepth)))
+}
+
+func (c *Complexity) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	c.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", c.programCount, c.validProgramCount)
+
+	body, err := BranchingProgram(R6, R7, c.depth(), c.BranchFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	// skb->len is unknown to the verifier, its bits pick the paths.
+	instructions := append([]*epb.Instruction{LdW(R6, R1, 0)}, body...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (c *Complexity) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		c.validProgramCount += 1
+	}
+	return false
+}
+
+func (c *Complexity) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (c *Complexity) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (c *Complexity) IsFuzzingDone() bool {
+	return c.isFinished
+}
+
+func (c *Complexity) Name() string {
+	return "complexity"
+}
@@ -16,14 +16,16 @@ var (
 	unknownOperation = errors.New("Unknown mutation operation")
 )
 
-// These constants are used to decide which type of operations to generate.
+// These constants are used to decide which type of operations to generate,
+// see CoverageBased.Operations.
 const (
-	OPERATION_ADD    = 0
-	OPERATION_MODIFY = 1
-	MAX_PROG_REUSE   = 25
-	ALU_OPERATION    = 0
-	JMP_OPERATION    = 1
-	MEM_OPERATION    = 2
+	OPERATION_ADD        = 0
+	OPERATION_MODIFY     = 1
+	OPERATION_FLIP_CLASS = 2
+	MAX_PROG_REUSE       = 25
+	ALU_OPERATION        = 0
+	JMP_OPERATION        = 1
+	MEM_OPERATION        = 2
 )
 
 // Factory method to create a new coverage based strategy.
@@ -63,6 +65,7 @@ func NewCoverageBasedStrategy() *CoverageBased {
 		validProgramCount:    0,
 		mapFd:                -1,
 		defaultProg:          defaultProg,
+		Operations:           []int{OPERATION_ADD, OPERATION_MODIFY},
 	}
 }
 
@@ -80,6 +83,11 @@ type CoverageBased struct {
 	lastProgram          []*epb.Instruction
 	mapFd                int
 	defaultProg          []*epb.Instruction
+
+	// Operations are the mutations, e.g. OPERATION_ADD, applied to the
+	// programs, each picked with the same probability. OPERATION_FLIP_CLASS
+	// is not enabled by default.
+	Operations []int
 }
 
 func mapPtrArithmeticFooter(randomReg epb.Reg, mapFd int) ([]*epb.Instruction, error) {
@@ -172,16 +180,42 @@ func handleModifyInstruction(prog []*epb.Instruction) ([]*epb.Instruction, error
 	return prog, nil
 }
 
-func mutateProgram(prog []*epb.Instruction, headSize int) ([]*epb.Instruction, error) {
+// handleFlipClassInstruction switches a random alu instruction of `prog`
+// between its 32 and 64 bit forms, see FlipAluClass.
+func handleFlipClassInstruction(prog []*epb.Instruction) ([]*epb.Instruction, error) {
+	aluPositions := []int{}
+	for pos, ins := range prog {
+		if ins.GetAluOpcode() != nil {
+			aluPositions = append(aluPositions, pos)
+		}
+	}
+	if len(aluPositions) == 0 {
+		return handleModifyInstruction(prog)
+	}
+	pos := aluPositions[rand.SharedRNG.RandRange(0, uint64(len(aluPositions)-1))]
+	flipped, err := FlipAluClass(prog[pos])
+	if err != nil {
+		return nil, err
+	}
+	prog[pos] = flipped
+	return prog, nil
+}
+
+func mutateProgram(prog []*epb.Instruction, headSize int, operations []int) ([]*epb.Instruction, error) {
+	if len(operations) == 0 {
+		return nil, unknownOperation
+	}
 	progHead := prog[:headSize]
 	progBody := prog[headSize:]
-	operation := rand.SharedRNG.RandInt() % 2
+	operation := operations[rand.SharedRNG.RandInt()%uint64(len(operations))]
 	var err error = nil
 	switch operation {
 	case OPERATION_ADD:
 		progBody, err = handleAddInstruction(progBody)
 	case OPERATION_MODIFY:
 		progBody, err = handleModifyInstruction(progBody)
+	case OPERATION_FLIP_CLASS:
+		progBody, err = handleFlipClassInstruction(progBody)
 	default:
 		return nil, unknownOperation
 	}
@@ -209,7 +243,7 @@ func (cv *CoverageBased) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
 		}
 	}
 
-	mutatedProgram, err := mutateProgram(progHead, len(cv.defaultProg))
+	mutatedProgram, err := mutateProgram(progHead, len(cv.defaultProg), cv.Operations)
 	cv.lastProgram = mutatedProgram
 	if err != nil {
 		return nil, err
@@ -219,10 +253,11 @@ func (cv *CoverageBased) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
 	// not do ptr arithmetic, test will attempt to do some and see if the
 	// verifier thinks its safe. We will validate this assumption in onExecuteDone.
 	ffi.CloseFD(cv.mapFd)
-	cv.mapFd = ffi.CreateMapArray(1)
-	if cv.mapFd < 0 {
-		return nil, mapCreationFailed
+	mapFd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		return nil, err
 	}
+	cv.mapFd = mapFd
 
 	mutatedProgram[0].Immediate = int32(cv.mapFd)
 
@@ -0,0 +1,41 @@
+package strategies
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	epb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestMutateProgramOperations(t *testing.T) {
+	oldRNG := rand.SharedRNG
+	defer func() {
+		rand.SharedRNG = oldRNG
+	}()
+	rand.SharedRNG = rand.NewRand(mrand.NewSource(1))
+
+	for _, op := range NewCoverageBasedStrategy().Operations {
+		if op == OPERATION_FLIP_CLASS {
+			t.Errorf("NewCoverageBasedStrategy().Operations has OPERATION_FLIP_CLASS, want it disabled by default")
+		}
+	}
+
+	head := []*epb.Instruction{Mov64(R0, 0)}
+	prog := append(head, Add64(R1, 2))
+	got, err := mutateProgram(prog, len(head), []int{OPERATION_FLIP_CLASS})
+	if err != nil {
+		t.Fatalf("mutateProgram() unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[1].GetAluOpcode().GetInstructionClass() != epb.InsClass_InsClassAlu {
+		t.Errorf("mutateProgram(OPERATION_FLIP_CLASS) = %s, want the body switched to 32 bits", ProgramString(got))
+	}
+	if got[0].GetAluOpcode().GetInstructionClass() != epb.InsClass_InsClassAlu64 {
+		t.Errorf("mutateProgram() changed the head: %s", ProgramString(got))
+	}
+
+	if _, err := mutateProgram(prog, len(head), nil); err == nil {
+		t.Errorf("mutateProgram() without operations = nil error, want error")
+	}
+}
@@ -0,0 +1,87 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewIrreducibleLoopStrategy returns a strategy that makes 1 out of 4 loops
+// unbounded.
+func NewIrreducibleLoopStrategy() *IrreducibleLoops {
+	return &IrreducibleLoops{isFinished: false, UnboundedPercentage: 25}
+}
+
+// IrreducibleLoops generates loops that can be entered at two different
+// blocks, see IrreducibleLoop, to probe the loop detection of the verifier.
+// Bounded loops are expected to be accepted, unbounded ones never end on
+// some paths and must be rejected.
+//
+// Programs are only verified.
+type IrreducibleLoops struct {
+	// UnboundedPercentage is the percentage, 0 to 100, of programs whose
+	// loop does not terminate.
+	UnboundedPercentage uint64
+
+	isFinished        bool
+	bounded           bool
+	programCount      int
+	validProgramCount int
+}
+
+func (il *IrreducibleLoops) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	il.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", il.programCount, il.validProgramCount)
+
+	il.bounded = rand.SharedRNG.RandRange(1, 100) > il.UnboundedPercentage
+	iterations := int32(rand.SharedRNG.RandRange(1, 256))
+	loop, err := IrreducibleLoop(R6, R7, iterations, il.bounded)
+	if err != nil {
+		return nil, err
+	}
+
+	// skb->len is unknown to the verifier, both entries have to be explored.
+	instructions := append([]*epb.Instruction{LdW(R6, R1, 0)}, loop...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (il *IrreducibleLoops) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		il.validProgramCount += 1
+		if !il.bounded {
+			fmt.Printf("\nverifier accepted an irreducible loop that may never end\n")
+		}
+	} else if il.bounded {
+		fmt.Printf("\nverifier rejected a bounded irreducible loop: %s\n", verificationResult.BpfError)
+	}
+	return false
+}
+
+func (il *IrreducibleLoops) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (il *IrreducibleLoops) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (il *IrreducibleLoops) IsFuzzingDone() bool {
+	return il.isFinished
+}
+
+func (il *IrreducibleLoops) Name() string {
+	return "irreducible_loop"
+}
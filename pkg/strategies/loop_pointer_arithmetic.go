@@ -4,7 +4,6 @@ import (
 	. "buzzer/pkg/ebpf/ebpf"
 	"buzzer/pkg/rand"
 	"buzzer/pkg/units/units"
-	btfpb "buzzer/proto/btf_go_proto"
 	epb "buzzer/proto/ebpf_go_proto"
 	fpb "buzzer/proto/ffi_go_proto"
 	pb "buzzer/proto/program_go_proto"
@@ -25,129 +24,14 @@ type LoopPointerArithmetic struct {
 	log               string
 }
 
-func types() []*btfpb.BtfType {
-	types := []*btfpb.BtfType{}
-
-	// 1: Func_Proto
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x0,
-		Info: &btfpb.TypeInfo{
-			Vlen:     0,
-			Kind:     btfpb.BtfKind_FUNCPROTO,
-			KindFlag: false,
-		},
-		SizeOrType: 0x0,
-		Extra: &btfpb.BtfType_Empty{
-			Empty: &btfpb.Empty{},
-		},
-	})
-
-	// 2: Func
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x1,
-		Info: &btfpb.TypeInfo{
-			Vlen:     0,
-			Kind:     btfpb.BtfKind_FUNC,
-			KindFlag: false,
-		},
-		SizeOrType: 0x01,
-		Extra: &btfpb.BtfType_Empty{
-			Empty: &btfpb.Empty{},
-		},
-	})
-
-	// 3: Int
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x1,
-		Info: &btfpb.TypeInfo{
-			Vlen:     0,
-			Kind:     btfpb.BtfKind_INT,
-			KindFlag: false,
-		},
-		SizeOrType: 0x4,
-		Extra: &btfpb.BtfType_IntTypeData{
-			IntTypeData: &btfpb.IntTypeData{IntInfo: 0x01000020},
-		},
-	})
-
-	// 4: Struct
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x1,
-		Info: &btfpb.TypeInfo{
-			Vlen:     1,
-			Kind:     btfpb.BtfKind_STRUCT,
-			KindFlag: false,
-		},
-		SizeOrType: 0x4,
-		Extra: &btfpb.BtfType_StructTypeData{
-			StructTypeData: &btfpb.StructTypeData{
-				NameOff:    0x1,
-				StructType: 0x3,
-				Offset:     0x0,
-			},
-		},
-	})
-
-	// 5: Ptr
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x0,
-		Info: &btfpb.TypeInfo{
-			Vlen:     0,
-			Kind:     btfpb.BtfKind_PTR,
-			KindFlag: false,
-		},
-		SizeOrType: 0x4,
-		Extra: &btfpb.BtfType_Empty{
-			Empty: &btfpb.Empty{},
-		},
-	})
-
-	// 6: Func_Proto
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x0,
-		Info: &btfpb.TypeInfo{
-			Vlen:     2,
-			Kind:     btfpb.BtfKind_FUNCPROTO,
-			KindFlag: false,
-		},
-		SizeOrType: 0x3,
-		Extra: &btfpb.BtfType_FuncProtoTypeData{
-			FuncProtoTypeData: &btfpb.FuncProtoTypeData{
-				Param: []*btfpb.BtfParam{
-					{NameOff: 0x1, ParamType: 0x3},
-					{NameOff: 0x1, ParamType: 0x5},
-				},
-			},
-		},
-	})
-
-	// 7: Func
-	types = append(types, &btfpb.BtfType{
-		NameOff: 0x1,
-		Info: &btfpb.TypeInfo{
-			Vlen:     0,
-			Kind:     btfpb.BtfKind_FUNC,
-			KindFlag: false,
-		},
-		SizeOrType: 0x6,
-		Extra: &btfpb.BtfType_Empty{
-			Empty: &btfpb.Empty{},
-		},
-	})
-	return types
-}
-
 func (lp *LoopPointerArithmetic) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
 	lp.programCount += 1
 	fmt.Printf("Generated %d programs, %d were valid               \r", lp.programCount, lp.validProgramCount)
 
-	// Setup BTF Section
-	btf := &btfpb.Btf{}
-	SetHeaderSection(btf, 0xeb9f, 0x01, 0x0)
-	btf.TypeSection = &btfpb.TypeSection{BtfType: types()}
-	btf.StringSection = &btfpb.StringSection{Str: "buzzer"}
-
-	mapFd := ffi.CreateMapArray(2)
+	mapFd, err := ffi.CreateMapArray(2)
+	if err != nil {
+		return nil, err
+	}
 	ffi.CloseFD(lp.mapFd)
 	lp.mapFd = mapFd
 
@@ -181,18 +65,14 @@ func (lp *LoopPointerArithmetic) GenerateProgram(ffi *units.FFI) (*pb.Program, e
 		Exit(), // return 0
 	)
 
+	// Set up the loop context, the call to bpf_loop is added by
+	// BpfLoopProgram.
 	mainHeader, _ := InstructionSequence(
-		// Set up and call loop function
-		StW(R10, 0, -4),                       // Stack[-4] = 0
-		StW(R10, 0, -12),                      // Stack[-12] = 0
-		Mov64(R3, R10),                        // R3 = stack
-		Add64(R3, -8),                         // R3 = stack[-8] (param 3, *ctx)
-		Mov(R1, 10),                           // R1 = 10 (param 1, # iterations)
-		Mov(R4, 0),                            // R4 = 0 (param 4, flags)
-		LdFunctionPtr(int32(len(mainBody)+3)), // R2 = func (param 2)
-		Call(181),                             // Call loop
+		StW(R10, 0, -4),  // Stack[-4] = 0
+		StW(R10, 0, -12), // Stack[-12] = 0
+		Mov64(R3, R10),   // R3 = stack
+		Add64(R3, -8),    // R3 = stack[-8] (param 3, *ctx)
 	)
-	main := append(mainHeader, mainBody...)
 
 	loopFuncHead, _ := InstructionSequence(
 		StDW(R10, R2, -8),
@@ -253,23 +133,14 @@ func (lp *LoopPointerArithmetic) GenerateProgram(ffi *units.FFI) (*pb.Program, e
 	loopFunc := append(loopFuncHead, loopFuncBody...)
 	loopFunc = append(loopFunc, loopFuncFoo...)
 
-	func_info_na := &btfpb.FuncInfo{InsnOff: 0, TypeId: 2}
-	func_info_loop := &btfpb.FuncInfo{InsnOff: int32(len(main) + 2), TypeId: 7}
-
-	btfBuffer, err := GetBuffer(btf)
+	ebpfProg, err := BpfLoopProgram(mainHeader, mainBody, loopFunc, 10, R3)
 	if err != nil {
 		return nil, err
 	}
 
 	prog := &pb.Program{
 		Program: &pb.Program_Ebpf{
-			Ebpf: &epb.Program{
-				Functions: []*epb.Functions{
-					{Instructions: main, FuncInfo: func_info_na},
-					{Instructions: loopFunc, FuncInfo: func_info_loop},
-				},
-				Btf: btfBuffer,
-			},
+			Ebpf: ebpfProg,
 		},
 	}
 	return prog, nil
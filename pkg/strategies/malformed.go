@@ -0,0 +1,81 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewMalformedStrategy returns a strategy that generates programs the
+// verifier must reject.
+func NewMalformedStrategy() *Malformed {
+	return &Malformed{isFinished: false}
+}
+
+// Malformed generates random programs with a deliberate mistake in them, see
+// MalformedProgram for the kinds of mistakes. Every program is first checked
+// with Validate, any program the verifier accepts is reported along with a
+// PoC.
+type Malformed struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+	kind              Malformation
+	prog              *epb.Program
+}
+
+func (ml *Malformed) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	ml.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", ml.programCount, ml.validProgramCount)
+
+	ml.kind = Malformations[rand.SharedRNG.RandRange(0, uint64(len(Malformations)-1))]
+	instructions, err := MalformedProgram(ml.kind, SharedConfig.RandomProgramLength(rand.SharedRNG))
+	if err != nil {
+		return nil, err
+	}
+	if Validate(instructions) == nil {
+		return nil, fmt.Errorf("Validate() did not catch the %v in the generated program", ml.kind)
+	}
+
+	ml.prog = &epb.Program{
+		Functions: []*epb.Functions{
+			{Instructions: instructions},
+		},
+	}
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: ml.prog,
+		}}
+	return prog, nil
+}
+
+func (ml *Malformed) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		ml.validProgramCount += 1
+		fmt.Printf("The verifier accepted a program with a %v\n", ml.kind)
+		GeneratePoc(ml.prog)
+	}
+	// None of the programs is supposed to run.
+	return false
+}
+
+func (ml *Malformed) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (ml *Malformed) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (ml *Malformed) IsFuzzingDone() bool {
+	return ml.isFinished
+}
+
+func (ml *Malformed) Name() string {
+	return "malformed"
+}
@@ -0,0 +1,106 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewPacketBoundsStrategy returns a strategy that generates direct packet
+// accesses guarded by data/data_end bounds checks.
+func NewPacketBoundsStrategy() *PacketBounds {
+	return &PacketBounds{isFinished: false}
+}
+
+// PacketBounds loads tc programs, which have direct packet access, made of
+// packet reads through data pointers that get moved around by constant and
+// variable offsets before the bounds check.
+//
+// Programs are only verified: they cannot be attached to the socket used to
+// execute programs.
+type PacketBounds struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+func (pk *PacketBounds) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	pk.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", pk.programCount, pk.validProgramCount)
+
+	// R6 keeps the context, R7 holds a random scalar used as a variable
+	// packet offset. Reads only write R5 when they are in bounds, it needs
+	// a value for the paths where they are not.
+	header, err := InstructionSequence(
+		Mov64(R6, R1),
+		Mov64(R7, int32(rand.SharedRNG.RandInt())),
+		And64(R7, int32(rand.SharedRNG.RandRange(0, 0xff))),
+		Mov64(R5, 0),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []*epb.Instruction{}
+	for readCount := rand.SharedRNG.RandRange(1, 10); readCount != 0; readCount-- {
+		body = append(body, LdSkbData(R2, R6), LdSkbDataEnd(R3, R6))
+		switch rand.SharedRNG.RandRange(0, 2) {
+		case 0:
+			body = append(body, Add64(R2, int32(rand.SharedRNG.RandRange(0, 64))))
+		case 1:
+			body = append(body, Add64(R2, R7))
+		}
+		body = append(body, RandomPacketRead(R2, R3, R4, R5)...)
+		body = append(body, Add64(R7, R5), And64(R7, int32(rand.SharedRNG.RandRange(0, 0xff))))
+	}
+
+	footer, err := InstructionSequence(
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, body...)
+	header = append(header, footer...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: header},
+				},
+				ProgType: ProgTypeSchedCls,
+			},
+		}}
+	return prog, nil
+}
+
+func (pk *PacketBounds) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		pk.validProgramCount += 1
+	}
+	// tc programs cannot be attached to the execution socket.
+	return false
+}
+
+func (pk *PacketBounds) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (pk *PacketBounds) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (pk *PacketBounds) IsFuzzingDone() bool {
+	return pk.isFinished
+}
+
+func (pk *PacketBounds) Name() string {
+	return "packet_bounds"
+}
@@ -0,0 +1,29 @@
+package strategies
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+)
+
+func TestPacketBoundsProgramsValidate(t *testing.T) {
+	oldRNG := rand.SharedRNG
+	defer func() {
+		rand.SharedRNG = oldRNG
+	}()
+	rand.SharedRNG = rand.NewRand(mrand.NewSource(1))
+
+	pk := NewPacketBoundsStrategy()
+	for i := 0; i < 100; i++ {
+		prog, err := pk.GenerateProgram(nil)
+		if err != nil {
+			t.Fatalf("GenerateProgram() unexpected error: %v", err)
+		}
+		instructions := prog.GetEbpf().GetFunctions()[0].GetInstructions()
+		if err := Validate(instructions); err != nil {
+			t.Fatalf("Validate(GenerateProgram()) = %v, want nil\n%s", err, ProgramString(instructions))
+		}
+	}
+}
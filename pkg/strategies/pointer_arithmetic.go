@@ -7,14 +7,9 @@ import (
 	epb "buzzer/proto/ebpf_go_proto"
 	fpb "buzzer/proto/ffi_go_proto"
 	pb "buzzer/proto/program_go_proto"
-	"errors"
 	"fmt"
 )
 
-var (
-	mapCreationFailed = errors.New("Unable to create map array")
-)
-
 func NewPointerArithmeticStrategy() *PointerArithmetic {
 	return &PointerArithmetic{isFinished: false}
 }
@@ -72,9 +67,9 @@ func (pa *PointerArithmetic) GenerateProgram(ffi *units.FFI) (*pb.Program, error
 	// not do ptr arithmetic, test will attempt to do some and see if the
 	// verifier thinks its safe. We will validate this assumption in onExecuteDone.
 	ffi.CloseFD(pa.mapFd)
-	pa.mapFd = ffi.CreateMapArray(2)
-	if pa.mapFd < 0 {
-		return nil, mapCreationFailed
+	pa.mapFd, err = ffi.CreateMapArray(2)
+	if err != nil {
+		return nil, err
 	}
 
 	footer, err := InstructionSequence(
@@ -0,0 +1,115 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewPointerReturnStrategy returns a strategy that returns a pointer in 1
+// out of 2 programs.
+func NewPointerReturnStrategy() *PointerReturn {
+	return &PointerReturn{isFinished: false, PointerPercentage: 50}
+}
+
+// PointerReturn exercises the checks the verifier does on the return value:
+// cgroup skb programs must return a scalar in [0, 1], so every program sets
+// R0 either to such a scalar or to a pointer (to the context, the stack or
+// the packet, possibly moved by a constant) right before its Exit.
+//
+// Programs are only verified, a program that returns a pointer and is
+// accepted anyway is a verifier bug.
+type PointerReturn struct {
+	// PointerPercentage is the percentage, 0 to 100, of programs that
+	// return a pointer.
+	PointerPercentage uint64
+
+	isFinished        bool
+	returnsPointer    bool
+	programCount      int
+	validProgramCount int
+}
+
+// pointerReturn returns instructions that leave a pointer in R0.
+func pointerReturn() []*epb.Instruction {
+	var instructions []*epb.Instruction
+	switch rand.SharedRNG.RandRange(0, 2) {
+	case 0:
+		instructions = []*epb.Instruction{Mov64(R0, R1)}
+	case 1:
+		instructions = []*epb.Instruction{StDW(R10, 0, -8), Mov64(R0, R10), Add64(R0, -8)}
+	default:
+		instructions = []*epb.Instruction{LdW(R0, R1, SkbDataOffset)}
+	}
+	if rand.SharedRNG.OneOf(2) {
+		instructions = append(instructions, Add64(R0, int32(rand.SharedRNG.RandRange(0, 16))))
+	}
+	return instructions
+}
+
+// scalarReturn returns instructions that leave 0 or 1 in R0.
+func scalarReturn() []*epb.Instruction {
+	if rand.SharedRNG.OneOf(2) {
+		return []*epb.Instruction{Mov64(R0, int32(rand.SharedRNG.RandRange(0, 1)))}
+	}
+	// skb->len is unknown to the verifier, only its low bit is returned.
+	return []*epb.Instruction{LdW(R0, R1, 0), And64(R0, 1)}
+}
+
+func (pr *PointerReturn) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	pr.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", pr.programCount, pr.validProgramCount)
+
+	pr.returnsPointer = rand.SharedRNG.RandRange(1, 100) <= pr.PointerPercentage
+	var instructions []*epb.Instruction
+	if pr.returnsPointer {
+		instructions = pointerReturn()
+	} else {
+		instructions = scalarReturn()
+	}
+	instructions = append(instructions, Exit())
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+				ProgType: ProgTypeCgroupSkb,
+			},
+		}}
+	return prog, nil
+}
+
+func (pr *PointerReturn) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		pr.validProgramCount += 1
+		if pr.returnsPointer {
+			fmt.Printf("\nverifier accepted a program that returns a pointer\n")
+		}
+	} else if !pr.returnsPointer {
+		fmt.Printf("\nverifier rejected a program that returns a scalar: %s\n", verificationResult.BpfError)
+	}
+	return false
+}
+
+func (pr *PointerReturn) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (pr *PointerReturn) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (pr *PointerReturn) IsFuzzingDone() bool {
+	return pr.isFinished
+}
+
+func (pr *PointerReturn) Name() string {
+	return "pointer_return"
+}
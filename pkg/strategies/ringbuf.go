@@ -0,0 +1,150 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// ringbufRelease is how a generated program gets rid of its ringbuf record.
+type ringbufRelease int
+
+const (
+	releaseSubmit ringbufRelease = iota
+	releaseDiscard
+	// releaseForget never releases the record.
+	releaseForget
+	// releaseOnOneBranch only releases the record when a branch on the
+	// packet length falls through, the taken path leaks it.
+	releaseOnOneBranch
+)
+
+// NewRingbufStrategy returns a strategy that leaks a ringbuf record in 1 out
+// of 4 programs.
+func NewRingbufStrategy() *Ringbuf {
+	return &Ringbuf{isFinished: false, LeakPercentage: 25, ringbufFd: -1}
+}
+
+// Ringbuf exercises the reference tracking of the verifier: every program
+// reserves a ringbuf record, writes to it and then submits it, discards it
+// or "forgets" to do so on some or all of its paths.
+//
+// Programs are only verified, a program that leaks its record and is
+// accepted anyway is a verifier bug.
+type Ringbuf struct {
+	// LeakPercentage is the percentage, 0 to 100, of programs that do not
+	// release their record on every path.
+	LeakPercentage uint64
+
+	isFinished        bool
+	ringbufFd         int
+	leaks             bool
+	programCount      int
+	validProgramCount int
+}
+
+// release returns how the next program releases its record.
+func (r *Ringbuf) release() ringbufRelease {
+	if rand.SharedRNG.RandRange(1, 100) <= r.LeakPercentage {
+		return []ringbufRelease{releaseForget, releaseOnOneBranch}[rand.SharedRNG.RandRange(0, 1)]
+	}
+	return []ringbufRelease{releaseSubmit, releaseDiscard}[rand.SharedRNG.RandRange(0, 1)]
+}
+
+func (r *Ringbuf) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	r.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", r.programCount, r.validProgramCount)
+
+	if r.ringbufFd < 0 {
+		fd, err := ffi.CreateMapRingbuf(4096)
+		if err != nil {
+			return nil, err
+		}
+		r.ringbufFd = fd
+	}
+
+	// Records are reserved in multiples of 8 bytes so they can be filled
+	// with double word stores.
+	words := int32(rand.SharedRNG.RandRange(1, 8))
+	reserve, err := CallRingbufReserve(R6, words*8, 0)
+	if err != nil {
+		return nil, err
+	}
+	nullCheck, err := NullCheck(R0, []*epb.Instruction{Mov64(R0, 0), Exit()})
+	if err != nil {
+		return nil, err
+	}
+
+	// skb->len is unknown to the verifier, R8 can decide the branches.
+	instructions := []*epb.Instruction{LdW(R8, R1, 0), LdMapByFd(R6, r.ringbufFd)}
+	instructions = append(instructions, reserve...)
+	instructions = append(instructions, nullCheck...)
+	instructions = append(instructions, Mov64(R7, R0))
+	for i := rand.SharedRNG.RandRange(1, 4); i > 0; i-- {
+		offset := int16(rand.SharedRNG.RandRange(0, uint64(words-1)) * 8)
+		instructions = append(instructions, StDW(R7, int32(rand.SharedRNG.RandInt()), offset))
+	}
+
+	release := r.release()
+	r.leaks = release == releaseForget || release == releaseOnOneBranch
+	switch release {
+	case releaseSubmit, releaseOnOneBranch:
+		submit, err := CallRingbufSubmit(R7, 0)
+		if err != nil {
+			return nil, err
+		}
+		if release == releaseOnOneBranch {
+			skip := JmpGT(R8, int32(rand.SharedRNG.RandRange(0, 1500)), int16(ProgramSize(submit)))
+			instructions = append(instructions, skip)
+		}
+		instructions = append(instructions, submit...)
+	case releaseDiscard:
+		discard, err := CallRingbufDiscard(R7, 0)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, discard...)
+	}
+	instructions = append(instructions, Mov64(R0, 0), Exit())
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (r *Ringbuf) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		r.validProgramCount += 1
+		if r.leaks {
+			fmt.Printf("\nverifier accepted a program that leaks its ringbuf record\n")
+		}
+	}
+	return false
+}
+
+func (r *Ringbuf) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (r *Ringbuf) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (r *Ringbuf) IsFuzzingDone() bool {
+	return r.isFinished
+}
+
+func (r *Ringbuf) Name() string {
+	return "ringbuf"
+}
@@ -0,0 +1,114 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewSleepableStrategy returns a strategy that generates sleepable programs.
+func NewSleepableStrategy() *Sleepable {
+	return &Sleepable{isFinished: false}
+}
+
+// Sleepable loads kprobe programs with BPF_F_SLEEPABLE, the flag uprobes
+// use, that mix random alu instructions with calls to helpers only available
+// in sleepable context.
+//
+// Programs are only verified: kprobes cannot be run through the execution
+// socket.
+type Sleepable struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+func (sl *Sleepable) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	sl.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", sl.programCount, sl.validProgramCount)
+
+	header, err := InstructionSequence(
+		Mov64(R0, int32(rand.SharedRNG.RandInt())),
+		Mov64(R1, int32(rand.SharedRNG.RandInt())),
+		Mov64(R2, int32(rand.SharedRNG.RandInt())),
+		Mov64(R3, int32(rand.SharedRNG.RandInt())),
+		Mov64(R4, int32(rand.SharedRNG.RandInt())),
+		Mov64(R5, int32(rand.SharedRNG.RandInt())),
+		Mov64(R6, int32(rand.SharedRNG.RandInt())),
+		Mov64(R7, int32(rand.SharedRNG.RandInt())),
+		Mov64(R8, int32(rand.SharedRNG.RandInt())),
+		Mov64(R9, int32(rand.SharedRNG.RandInt())),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []*epb.Instruction{}
+	for callCount := rand.SharedRNG.RandRange(1, 5); callCount != 0; callCount-- {
+		for aluCount := rand.SharedRNG.RandRange(0, 20); aluCount != 0; aluCount-- {
+			body = append(body, RandomAluInstruction())
+		}
+		call, err := BuildHelperCall(CopyFromUserSig(int32(rand.SharedRNG.RandRange(1, 64))), true)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, call...)
+
+		// The call clobbers R0 to R5, give them a value again so the alu
+		// instructions that follow can read them.
+		for reg := R0; reg <= R5; reg++ {
+			body = append(body, Mov64(reg, int32(rand.SharedRNG.RandInt())))
+		}
+	}
+
+	footer, err := InstructionSequence(
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, body...)
+	header = append(header, footer...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: header},
+				},
+				ProgType:  ProgTypeKprobe,
+				ProgFlags: ProgFlagSleepable,
+			},
+		}}
+	return prog, nil
+}
+
+func (sl *Sleepable) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		sl.validProgramCount += 1
+	}
+	// kprobe programs cannot be attached to the execution socket.
+	return false
+}
+
+func (sl *Sleepable) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (sl *Sleepable) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (sl *Sleepable) IsFuzzingDone() bool {
+	return sl.isFinished
+}
+
+func (sl *Sleepable) Name() string {
+	return "sleepable"
+}
@@ -0,0 +1,102 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewSpillFillStrategy returns a strategy that stresses how the
+// verifier tracks the type of pointers spilled to and filled from the stack.
+func NewSpillFillStrategy() *SpillFill {
+	return &SpillFill{isFinished: false}
+}
+
+// SpillFill generates random alu instructions interleaved with stack
+// pointers that are spilled to the stack, filled back into a random register
+// and written through, see RandomPointerSpillFill. The verifier has to carry
+// the pointer type through the stack slot for the program to be accepted.
+type SpillFill struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+func (ps *SpillFill) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	ps.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", ps.programCount, ps.validProgramCount)
+
+	header, err := InstructionSequence(
+		Mov64(R0, int32(rand.SharedRNG.RandInt())),
+		Mov64(R1, int32(rand.SharedRNG.RandInt())),
+		Mov64(R2, int32(rand.SharedRNG.RandInt())),
+		Mov64(R3, int32(rand.SharedRNG.RandInt())),
+		Mov64(R4, int32(rand.SharedRNG.RandInt())),
+		Mov64(R5, int32(rand.SharedRNG.RandInt())),
+		Mov64(R6, int32(rand.SharedRNG.RandInt())),
+		Mov64(R7, int32(rand.SharedRNG.RandInt())),
+		Mov64(R8, int32(rand.SharedRNG.RandInt())),
+		Mov64(R9, int32(rand.SharedRNG.RandInt())),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Interleave random alu operations with pointer spills and fills so
+	// that the spilled registers get modified around the stack accesses.
+	body := []*epb.Instruction{}
+	for sequenceCount := rand.SharedRNG.RandRange(1, 20); sequenceCount != 0; sequenceCount-- {
+		for aluCount := rand.SharedRNG.RandRange(0, 10); aluCount != 0; aluCount-- {
+			body = append(body, RandomAluInstruction())
+		}
+		body = append(body, RandomPointerSpillFill()...)
+	}
+
+	footer, err := InstructionSequence(
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, body...)
+	header = append(header, footer...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: header},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (ps *SpillFill) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		ps.validProgramCount += 1
+	}
+	return true
+}
+
+func (ps *SpillFill) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (ps *SpillFill) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (ps *SpillFill) IsFuzzingDone() bool {
+	return ps.isFinished
+}
+
+func (ps *SpillFill) Name() string {
+	return "spill_fill"
+}
@@ -0,0 +1,151 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// spinUnlock is how a generated program releases the lock it took.
+type spinUnlock int
+
+const (
+	unlockAlways spinUnlock = iota
+	// unlockNever exits while still holding the lock.
+	unlockNever
+	// unlockOnOneBranch only releases the lock when a branch on the packet
+	// length falls through, the taken path exits holding it.
+	unlockOnOneBranch
+)
+
+// NewLockBalanceStrategy returns a strategy that leaves the lock unbalanced in
+// 1 out of 4 programs.
+func NewLockBalanceStrategy() *LockBalance {
+	return &LockBalance{isFinished: false, UnbalancedPercentage: 25, mapFd: -1}
+}
+
+// LockBalance generates programs that take the bpf_spin_lock of a map value
+// (see CallSpinLock), access the value while holding it and then release it
+// or "forget" to do so on some or all of their paths.
+//
+// Programs are only verified, a program that exits holding the lock and is
+// accepted anyway is a verifier bug.
+type LockBalance struct {
+	// UnbalancedPercentage is the percentage, 0 to 100, of programs that do
+	// not release the lock on every path.
+	UnbalancedPercentage uint64
+
+	isFinished        bool
+	mapFd             int
+	unbalanced        bool
+	programCount      int
+	validProgramCount int
+}
+
+// unlock returns how the next program releases its lock.
+func (lb *LockBalance) unlock() spinUnlock {
+	if rand.SharedRNG.RandRange(1, 100) <= lb.UnbalancedPercentage {
+		return []spinUnlock{unlockNever, unlockOnOneBranch}[rand.SharedRNG.RandRange(0, 1)]
+	}
+	return unlockAlways
+}
+
+func (lb *LockBalance) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	lb.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", lb.programCount, lb.validProgramCount)
+
+	if lb.mapFd < 0 {
+		fd, err := ffi.CreateMapSpinLock(uint64(SharedConfig.MapElements()))
+		if err != nil {
+			return nil, err
+		}
+		lb.mapFd = fd
+	}
+
+	lookup, err := RandomMapLookup(R8, R10, -8)
+	if err != nil {
+		return nil, err
+	}
+	nullCheck, err := NullCheck(R0, []*epb.Instruction{Mov64(R0, 0), Exit()})
+	if err != nil {
+		return nil, err
+	}
+	lock, err := CallSpinLock(R6)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := CallSpinUnlock(R6)
+	if err != nil {
+		return nil, err
+	}
+
+	// skb->len is unknown to the verifier, R9 can decide the branches.
+	instructions := []*epb.Instruction{LdW(R9, R1, 0), LdMapByFd(R8, lb.mapFd)}
+	instructions = append(instructions, lookup...)
+	instructions = append(instructions, nullCheck...)
+	instructions = append(instructions, Mov64(R6, R0))
+	instructions = append(instructions, lock...)
+	// The data follows the lock, which the program cannot touch.
+	for i := rand.SharedRNG.RandRange(1, 4); i > 0; i-- {
+		if rand.SharedRNG.OneOf(2) {
+			instructions = append(instructions, StDW(R6, int32(rand.SharedRNG.RandInt()), 8))
+		} else {
+			instructions = append(instructions, LdDW(R7, R6, 8))
+		}
+	}
+
+	how := lb.unlock()
+	lb.unbalanced = how != unlockAlways
+	switch how {
+	case unlockAlways:
+		instructions = append(instructions, unlock...)
+	case unlockOnOneBranch:
+		skip := JmpGT(R9, int32(rand.SharedRNG.RandRange(0, 1500)), int16(ProgramSize(unlock)))
+		instructions = append(instructions, skip)
+		instructions = append(instructions, unlock...)
+	}
+	instructions = append(instructions, Mov64(R0, 0), Exit())
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+				// Socket filters cannot use bpf_spin_lock.
+				ProgType: ProgTypeSchedCls,
+			},
+		}}
+	return prog, nil
+}
+
+func (lb *LockBalance) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		lb.validProgramCount += 1
+		if lb.unbalanced {
+			fmt.Printf("\nverifier accepted a program that exits holding a spin lock\n")
+		}
+	}
+	return false
+}
+
+func (lb *LockBalance) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (lb *LockBalance) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (lb *LockBalance) IsFuzzingDone() bool {
+	return lb.isFinished
+}
+
+func (lb *LockBalance) Name() string {
+	return "spin_lock"
+}
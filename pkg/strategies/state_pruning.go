@@ -0,0 +1,108 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewStatePruningStrategy returns a strategy that stresses the state pruning
+// done by the verifier at join points.
+func NewStatePruningStrategy() *StatePruning {
+	return &StatePruning{isFinished: false}
+}
+
+// StatePruning generates two paths, chosen by the unknown skb->len, that
+// converge on a join point with a slightly different range for R6 (see
+// RandomJoinPoint). After the join R6 is used as the offset of a stack
+// write that is only in bounds within the narrower of both ranges.
+//
+// Programs are only verified: a correct verifier explores the path with the
+// wider range and rejects the write, an accepted program means the states
+// were wrongly pruned as equivalent.
+type StatePruning struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+func (sp *StatePruning) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	sp.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", sp.programCount, sp.validProgramCount)
+
+	// skb->len is unknown to the verifier: R7 decides the branch and R6
+	// starts without a known range. The other registers may be the source
+	// of the random alu operations.
+	header, err := InstructionSequence(
+		LdW(R7, R1, 0),
+		LdW(R6, R1, 0),
+		Mov64(R0, int32(rand.SharedRNG.RandInt())),
+		Mov64(R1, int32(rand.SharedRNG.RandInt())),
+		Mov64(R2, int32(rand.SharedRNG.RandInt())),
+		Mov64(R3, int32(rand.SharedRNG.RandInt())),
+		Mov64(R4, int32(rand.SharedRNG.RandInt())),
+		Mov64(R5, int32(rand.SharedRNG.RandInt())),
+		Mov64(R8, int32(rand.SharedRNG.RandInt())),
+		Mov64(R9, int32(rand.SharedRNG.RandInt())),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	body, bound := RandomJoinPoint(R7, R6, int(rand.SharedRNG.RandRange(1, 10)))
+
+	// The write lands in [r10 - bound - 1, r10) while R6 is within the
+	// narrow mask and past the frame pointer otherwise.
+	footer, err := InstructionSequence(
+		Mov64(R8, R10),
+		Add64(R8, -(bound+1)),
+		Add64(R8, R6),
+		StB(R8, 1, 0),
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, body...)
+	header = append(header, footer...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: header},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (sp *StatePruning) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		sp.validProgramCount += 1
+		fmt.Printf("\nverifier accepted a stack write that is out of bounds on one of the paths\n")
+	}
+	return false
+}
+
+func (sp *StatePruning) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (sp *StatePruning) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (sp *StatePruning) IsFuzzingDone() bool {
+	return sp.isFinished
+}
+
+func (sp *StatePruning) Name() string {
+	return "state_pruning"
+}
@@ -0,0 +1,119 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewSubregisterStrategy returns a strategy that checks the zero extension
+// of 32 bit alu operations.
+func NewSubregisterStrategy() *Subregister {
+	return &Subregister{isFinished: false, mapFd: -1}
+}
+
+// Subregister mixes 32 bit and 64 bit alu operations on a single register,
+// always finishing with a 32 bit one, and writes the upper half of the
+// register to a map. The upper half must be 0 at runtime regardless of what
+// the verifier believed while checking the program.
+type Subregister struct {
+	isFinished        bool
+	mapFd             int
+	programCount      int
+	validProgramCount int
+}
+
+func (sr *Subregister) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	sr.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", sr.programCount, sr.validProgramCount)
+
+	ffi.CloseFD(sr.mapFd)
+	mapFd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		return nil, err
+	}
+	sr.mapFd = mapFd
+
+	header, err := InstructionSequence(
+		Mov64(R0, int32(rand.SharedRNG.RandInt())),
+		Mov64(R1, int32(rand.SharedRNG.RandInt())),
+		Mov64(R2, int32(rand.SharedRNG.RandInt())),
+		Mov64(R3, int32(rand.SharedRNG.RandInt())),
+		Mov64(R4, int32(rand.SharedRNG.RandInt())),
+		Mov64(R5, int32(rand.SharedRNG.RandInt())),
+		Mov64(R6, int64(rand.SharedRNG.RandInt())),
+		Mov64(R7, int32(rand.SharedRNG.RandInt())),
+		Mov64(R8, int32(rand.SharedRNG.RandInt())),
+		Mov64(R9, int32(rand.SharedRNG.RandInt())),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	body := RandomSubregisterSequence(R6, int(rand.SharedRNG.RandRange(2, 50)))
+
+	footer, err := InstructionSequence(
+		// Keep the upper half of the register, it must be 0.
+		Rsh64(R6, 32),
+		LdMapByFd(R9, sr.mapFd),
+		StW(R10, 0, -4),
+		Mov64(R2, R10),
+		Add64(R2, -4),
+		Mov64(R1, R9),
+		Call(MapLookup),
+		JmpNE(R0, 0, 1),
+		Exit(),
+		StDW(R0, R6, 0),
+		Mov64(R0, 0),
+		Exit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, body...)
+	header = append(header, footer...)
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: header},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (sr *Subregister) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		sr.validProgramCount += 1
+	}
+	return true
+}
+
+func (sr *Subregister) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	mapElements, err := ffi.GetMapElements(sr.mapFd, 1)
+	if err != nil {
+		fmt.Println(err)
+		return true
+	}
+
+	return mapElements.Elements[0] == 0
+}
+
+func (sr *Subregister) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (sr *Subregister) IsFuzzingDone() bool {
+	return sr.isFinished
+}
+
+func (sr *Subregister) Name() string {
+	return "subregister"
+}
@@ -0,0 +1,76 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewTemplateStrategy returns a strategy that generates programs following
+// `template`, e.g. XdpTemplate.
+func NewTemplateStrategy(template ProgramTemplate) *TemplateStrategy {
+	return &TemplateStrategy{isFinished: false, template: template}
+}
+
+// TemplateStrategy generates programs with the typical structure of a real
+// program type instead of purely random instructions: the skeleton comes
+// from a ProgramTemplate and only its details are random. Most of these
+// programs pass the verifier and their checks of the context reach deeper
+// into it.
+//
+// Programs are only verified, the program types templates exist for cannot
+// be attached to the execution socket.
+type TemplateStrategy struct {
+	isFinished        bool
+	template          ProgramTemplate
+	programCount      int
+	validProgramCount int
+}
+
+func (ts *TemplateStrategy) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	ts.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", ts.programCount, ts.validProgramCount)
+
+	instructions, err := ts.template.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+				ProgType: ts.template.ProgType,
+			},
+		}}
+	return prog, nil
+}
+
+func (ts *TemplateStrategy) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		ts.validProgramCount += 1
+	}
+	return false
+}
+
+func (ts *TemplateStrategy) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (ts *TemplateStrategy) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (ts *TemplateStrategy) IsFuzzingDone() bool {
+	return ts.isFinished
+}
+
+func (ts *TemplateStrategy) Name() string {
+	return ts.template.Name + "_template"
+}
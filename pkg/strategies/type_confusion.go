@@ -0,0 +1,121 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewTypeConfusionStrategy returns a strategy that merges a pointer and a
+// scalar in one register before dereferencing it.
+func NewTypeConfusionStrategy() *TypeConfusion {
+	return &TypeConfusion{isFinished: false, mapFd: -1}
+}
+
+// TypeConfusion generates programs where, see TypeConfusionJoin, a register
+// holds a pointer (to the stack or to a map value) on one path and a scalar
+// on the other, and is dereferenced after both paths join.
+//
+// Programs are only verified: every one of them must be rejected, an
+// accepted program means the verifier let a scalar be used as a pointer.
+type TypeConfusion struct {
+	isFinished        bool
+	mapFd             int
+	programCount      int
+	validProgramCount int
+}
+
+// pointerArm returns instructions that leave a pointer in R7, either to the
+// stack or to the value of a map element.
+func (tc *TypeConfusion) pointerArm() ([]*epb.Instruction, error) {
+	if rand.SharedRNG.OneOf(2) {
+		return InstructionSequence(
+			StDW(R10, 0, -8),
+			Mov64(R7, R10),
+			Add64(R7, -8),
+		)
+	}
+
+	lookup, err := RandomMapLookup(R8, R10, -16)
+	if err != nil {
+		return nil, err
+	}
+	nullCheck, err := NullCheck(R0, []*epb.Instruction{Mov64(R0, 0), Exit()})
+	if err != nil {
+		return nil, err
+	}
+	arm := append([]*epb.Instruction{LdMapByFd(R8, tc.mapFd)}, lookup...)
+	arm = append(arm, nullCheck...)
+	return append(arm, Mov64(R7, R0)), nil
+}
+
+func (tc *TypeConfusion) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	tc.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", tc.programCount, tc.validProgramCount)
+
+	if tc.mapFd < 0 {
+		fd, err := ffi.CreateMapArray(uint64(SharedConfig.MapElements()))
+		if err != nil {
+			return nil, err
+		}
+		tc.mapFd = fd
+	}
+
+	pointerArm, err := tc.pointerArm()
+	if err != nil {
+		return nil, err
+	}
+	join, err := TypeConfusionJoin(R6, R7, pointerArm)
+	if err != nil {
+		return nil, err
+	}
+
+	// skb->len is unknown to the verifier, both arms have to be explored.
+	instructions := []*epb.Instruction{LdW(R6, R1, 0)}
+	instructions = append(instructions, join...)
+	if rand.SharedRNG.OneOf(2) {
+		instructions = append(instructions, LdDW(R0, R7, 0))
+	} else {
+		instructions = append(instructions, StDW(R7, int32(rand.SharedRNG.RandInt()), 0), Mov64(R0, 0))
+	}
+	instructions = append(instructions, Exit())
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (tc *TypeConfusion) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		tc.validProgramCount += 1
+		fmt.Printf("\nverifier accepted a dereference of a register that may be a scalar\n")
+	}
+	return false
+}
+
+func (tc *TypeConfusion) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (tc *TypeConfusion) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (tc *TypeConfusion) IsFuzzingDone() bool {
+	return tc.isFinished
+}
+
+func (tc *TypeConfusion) Name() string {
+	return "type_confusion"
+}
@@ -0,0 +1,138 @@
+package strategies
+
+import (
+	. "buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/rand"
+	"buzzer/pkg/units/units"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+	"fmt"
+)
+
+// NewVariableStackStrategy returns a strategy that accesses the stack
+// through pointers with bounded variable offsets.
+func NewVariableStackStrategy() *VariableStack {
+	return &VariableStack{isFinished: false}
+}
+
+// VariableStack generates programs that mask an unknown value to a small
+// range, add it to a stack pointer (see VariableStackPointer) and load or
+// store through the result. The offset always stays within the initialized
+// part of the stack.
+//
+// Programs are only verified: every one of them is safe, a rejected program
+// means the verifier lost track of the bounds of the offset.
+type VariableStack struct {
+	isFinished        bool
+	programCount      int
+	validProgramCount int
+}
+
+// stackAccess returns a load from or a store to `ptr` of `size` bytes.
+func stackAccess(ptr epb.Reg, size epb.StLdSize, store bool) *epb.Instruction {
+	value := int32(rand.SharedRNG.RandInt())
+	switch size {
+	case epb.StLdSize_StLdSizeB:
+		if store {
+			return StB(ptr, value, 0)
+		}
+		return LdB(R8, ptr, 0)
+	case epb.StLdSize_StLdSizeH:
+		if store {
+			return StH(ptr, value, 0)
+		}
+		return LdH(R8, ptr, 0)
+	case epb.StLdSize_StLdSizeW:
+		if store {
+			return StW(ptr, value, 0)
+		}
+		return LdW(R8, ptr, 0)
+	default:
+		if store {
+			return StDW(ptr, value, 0)
+		}
+		return LdDW(R8, ptr, 0)
+	}
+}
+
+func (vs *VariableStack) GenerateProgram(ffi *units.FFI) (*pb.Program, error) {
+	vs.programCount += 1
+	fmt.Printf("Generated %d programs, %d were valid               \r", vs.programCount, vs.validProgramCount)
+
+	size := RandomSize()
+	sizeBytes := int(AlignmentForSize(size))
+	base := -8 * int16(rand.SharedRNG.RandRange(2, 64))
+	// The widest mask that keeps the access within [base, 0).
+	// VariableStackPointer clears its low bits, the verifier rejects stack
+	// accesses that are not aligned to their size.
+	mask := int32(1)
+	for int(base)+int(mask<<1|1)+sizeBytes <= 0 {
+		mask = mask<<1 | 1
+	}
+	mask >>= rand.SharedRNG.RandRange(0, 3)
+
+	// skb->len is unknown to the verifier, it is the variable offset.
+	instructions := []*epb.Instruction{LdW(R6, R1, 0)}
+	scramblers := []epb.AluOperationCode{
+		epb.AluOperationCode_AluAdd,
+		epb.AluOperationCode_AluSub,
+		epb.AluOperationCode_AluMul,
+		epb.AluOperationCode_AluXor,
+		epb.AluOperationCode_AluOr,
+	}
+	for i := rand.SharedRNG.RandRange(0, 3); i > 0; i-- {
+		op := scramblers[rand.SharedRNG.RandRange(0, uint64(len(scramblers)-1))]
+		scramble, err := NewAluImmInstruction(op, epb.InsClass_InsClassAlu64, R6, int32(rand.SharedRNG.RandInt()))
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, scramble)
+	}
+	// Reads of the stack need it to be initialized.
+	for offset := base; offset < 0; offset += 8 {
+		instructions = append(instructions, StDW(R10, 0, offset))
+	}
+	pointer, err := VariableStackPointer(R7, R6, base, mask, size)
+	if err != nil {
+		return nil, err
+	}
+	instructions = append(instructions, pointer...)
+	instructions = append(instructions, stackAccess(R7, size, rand.SharedRNG.OneOf(2)), Mov64(R0, 0), Exit())
+
+	prog := &pb.Program{
+		Program: &pb.Program_Ebpf{
+			Ebpf: &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: instructions},
+				},
+			},
+		}}
+	return prog, nil
+}
+
+func (vs *VariableStack) OnVerifyDone(ffi *units.FFI, verificationResult *fpb.ValidationResult) bool {
+	if verificationResult.IsValid {
+		vs.validProgramCount += 1
+	} else {
+		fmt.Printf("\nverifier rejected an in bounds variable offset stack access: %s\n", verificationResult.BpfError)
+	}
+	return false
+}
+
+func (vs *VariableStack) OnExecuteDone(ffi *units.FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (vs *VariableStack) OnError(e error) bool {
+	fmt.Printf("error %v\n", e)
+	return false
+}
+
+func (vs *VariableStack) IsFuzzingDone() bool {
+	return vs.isFinished
+}
+
+func (vs *VariableStack) Name() string {
+	return "variable_stack"
+}
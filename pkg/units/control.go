@@ -64,6 +64,12 @@ type Control struct {
 	ffi   *FFI
 	cm    *CoverageManager
 	rdy   bool
+
+	report *ReportWriter
+
+	// validateEbpf loads ebpf programs, ffi.ValidateEbpfProgram unless a
+	// test stands in for the verifier.
+	validateEbpf func(*fpb.EncodedProgram) (*fpb.ValidationResult, error)
 }
 
 // Init prepares the control unit to be used.
@@ -73,12 +79,19 @@ func (cu *Control) Init(ffi *FFI, coverageManager *CoverageManager, strat Strate
 		return NilStrategyError
 	}
 	cu.ffi = ffi
+	cu.validateEbpf = ffi.ValidateEbpfProgram
 	cu.cm = coverageManager
 	cu.strat = strat
 	cu.rdy = true
 	return nil
 }
 
+// SetReportWriter makes the control unit report the outcome of every ebpf
+// program it loads to `report`, nil disables the reports.
+func (cu *Control) SetReportWriter(report *ReportWriter) {
+	cu.report = report
+}
+
 // IsReady indicates to the caller if the Control is initialized successully.
 func (cu *Control) IsReady() bool {
 	return cu.rdy
@@ -120,8 +133,32 @@ func (cu *Control) RunFuzzer() error {
 	return nil
 }
 
-func (cu *Control) runEbpf(prog *epb.Program) error {
+// encodeEbpfProgram transforms `prog` into the EncodedProgram that the ffi
+// loads, carrying over the attributes that describe how to load it.
+func encodeEbpfProgram(prog *epb.Program) (*fpb.EncodedProgram, error) {
 	encodedProg, encodedFuncInfo, err := ebpf.EncodeInstructions(prog)
+	encodedLineInfo, lineInfoErr := ebpf.EncodeLineInfo(prog)
+	if err == nil {
+		err = lineInfoErr
+	}
+	return &fpb.EncodedProgram{
+		Program:            encodedProg,
+		Btf:                prog.Btf,
+		Function:           encodedFuncInfo,
+		LineInfo:           encodedLineInfo,
+		ProgType:           prog.ProgType,
+		ExpectedAttachType: prog.ExpectedAttachType,
+		AttachBtfId:        prog.AttachBtfId,
+		ProgFlags:          prog.ProgFlags,
+		License:            prog.License,
+	}, err
+}
+
+func (cu *Control) runEbpf(prog *epb.Program) error {
+	// Ids let the PoC be matched against later edits of the program.
+	ebpf.StampInstructionIds(ebpf.ProgramInstructions(prog))
+
+	encodedProgram, err := encodeEbpfProgram(prog)
 
 	if err != nil {
 		fmt.Printf("Encoding error: %v\n", err)
@@ -130,12 +167,7 @@ func (cu *Control) runEbpf(prog *epb.Program) error {
 		}
 	}
 
-	encodedProgram := &fpb.EncodedProgram{
-		Program:  encodedProg,
-		Btf:      prog.Btf,
-		Function: encodedFuncInfo,
-	}
-	validationResult, err := cu.ffi.ValidateEbpfProgram(encodedProgram)
+	validationResult, err := cu.validateEbpf(encodedProgram)
 	if err != nil {
 		fmt.Printf("Validation error: %v\n", err)
 		if !cu.strat.OnError(err) {
@@ -144,6 +176,12 @@ func (cu *Control) runEbpf(prog *epb.Program) error {
 		return nil
 	}
 
+	if cu.report != nil {
+		if err := cu.report.Report(prog, validationResult); err != nil {
+			fmt.Printf("Report error: %v\n", err)
+		}
+	}
+
 	if !cu.strat.OnVerifyDone(cu.ffi, validationResult) || !validationResult.IsValid {
 		cu.ffi.CloseFD(int(validationResult.ProgramFd))
 		return nil
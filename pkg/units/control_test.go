@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package units
+
+import (
+	"testing"
+
+	"buzzer/pkg/ebpf/ebpf"
+	epb "buzzer/proto/ebpf_go_proto"
+)
+
+func TestEncodeEbpfProgramLoadAttributes(t *testing.T) {
+	prog := &epb.Program{
+		Functions: []*epb.Functions{
+			{Instructions: []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()}},
+		},
+		ProgType:           18,
+		ExpectedAttachType: 10,
+		AttachBtfId:        42,
+		ProgFlags:          ebpf.ProgFlagStrictAlignment | ebpf.ProgFlagTestStateFreq,
+		License:            "Dual BSD/GPL",
+	}
+
+	encoded, err := encodeEbpfProgram(prog)
+	if err != nil {
+		t.Fatalf("encodeEbpfProgram() unexpected error: %v", err)
+	}
+
+	if len(encoded.GetProgram()) != 16 {
+		t.Errorf("len(encodeEbpfProgram().Program) = %d, want %d", len(encoded.GetProgram()), 16)
+	}
+	if encoded.GetProgType() != prog.GetProgType() {
+		t.Errorf("encodeEbpfProgram().ProgType = %d, want %d", encoded.GetProgType(), prog.GetProgType())
+	}
+	if encoded.GetExpectedAttachType() != prog.GetExpectedAttachType() {
+		t.Errorf("encodeEbpfProgram().ExpectedAttachType = %d, want %d", encoded.GetExpectedAttachType(), prog.GetExpectedAttachType())
+	}
+	if encoded.GetAttachBtfId() != prog.GetAttachBtfId() {
+		t.Errorf("encodeEbpfProgram().AttachBtfId = %d, want %d", encoded.GetAttachBtfId(), prog.GetAttachBtfId())
+	}
+	if encoded.GetLicense() != prog.GetLicense() {
+		t.Errorf("encodeEbpfProgram().License = %q, want %q", encoded.GetLicense(), prog.GetLicense())
+	}
+	if encoded.GetProgFlags() != prog.GetProgFlags() {
+		t.Errorf("encodeEbpfProgram().ProgFlags = %#x, want %#x", encoded.GetProgFlags(), prog.GetProgFlags())
+	}
+}
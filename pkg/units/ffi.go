@@ -26,17 +26,31 @@ package units
 //struct bpf_result ffi_load_ebpf_program(void* serialized_proto, size_t size, int coverage_enabled, unsigned long coverage_size);
 //struct bpf_result ffi_execute_ebpf_program(void* serialized_proto, size_t length);
 //struct bpf_result ffi_get_map_elements(int map_fd, uint64_t map_size);
+//struct bpf_result ffi_get_map_elements_batch(int map_fd, uint64_t map_size);
 //int ffi_create_bpf_map(size_t size);
+//int ffi_create_percpu_array_map(size_t size);
+//int ffi_create_queue_map(size_t size);
+//int ffi_create_stack_map(size_t size);
+//int ffi_create_lru_hash_map(size_t size);
+//int ffi_create_ringbuf_map(size_t size);
+//int ffi_create_spin_lock_map(size_t size, void* btf_buff, size_t btf_size, uint32_t key_type_id, uint32_t value_type_id, uint32_t value_size);
+//int ffi_create_prog_array_map(size_t size);
+//int ffi_update_prog_array_element(int map_fd, int key, int prog_fd);
 //void ffi_close_fd(int fd);
+//int ffi_pin_object(int fd, const char* path);
 //int ffi_update_map_element(int map_fd, int key, uint64_t value);
+//struct bpf_result ffi_get_percpu_map_element(int map_fd, uint32_t key);
 import "C"
 
 import (
 	"buzzer/pkg/cbpf/cbpf"
+	"buzzer/pkg/ebpf/ebpf"
 	fpb "buzzer/proto/ffi_go_proto"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"syscall"
 	"unsafe"
 )
 
@@ -109,10 +123,161 @@ type FFI struct {
 	MetricsUnit *Metrics
 }
 
-// CreateMapArray creates an ebpf map of type array and returns its fd.
-// -1 means error.
-func (e *FFI) CreateMapArray(size uint64) int {
-	return int(C.ffi_create_bpf_map(C.ulong(size)))
+// errnoNames holds the names of the errors commonly returned by bpf(2).
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:  "EPERM",
+	syscall.EACCES: "EACCES",
+	syscall.EINVAL: "EINVAL",
+	syscall.ENOMEM: "ENOMEM",
+	syscall.EMFILE: "EMFILE",
+	syscall.E2BIG:  "E2BIG",
+	syscall.EFAULT: "EFAULT",
+}
+
+// mapCreationError describes the failure of a map creation syscall that set
+// `err`, e.g. "map creation failed: operation not permitted (EPERM)".
+func mapCreationError(err error) error {
+	return syscallError("map creation", err)
+}
+
+// syscallError describes the failure of the bpf(2) command `what` that set
+// `err`, see mapCreationError.
+func syscallError(what string, err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) || errno == 0 {
+		return fmt.Errorf("%s failed", what)
+	}
+	if name, ok := errnoNames[errno]; ok {
+		return fmt.Errorf("%s failed: %w (%s)", what, errno, name)
+	}
+	return fmt.Errorf("%s failed: %w", what, errno)
+}
+
+// CreateMapArray creates an ebpf map of type array and returns its fd, on
+// failure the error carries the errno reported by the kernel.
+func (e *FFI) CreateMapArray(size uint64) (int, error) {
+	fd, err := C.ffi_create_bpf_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapPerCpuArray creates an ebpf map of type percpu array, every cpu
+// gets its own copy of each u64 value. Programs look up elements with the same
+// idiom used for regular arrays and get the slot of the cpu they run on.
+func (e *FFI) CreateMapPerCpuArray(size uint64) (int, error) {
+	fd, err := C.ffi_create_percpu_array_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapQueue creates an ebpf map of type queue holding u64 values, see
+// ebpf.CallMapPush and ebpf.CallMapPop.
+func (e *FFI) CreateMapQueue(size uint64) (int, error) {
+	fd, err := C.ffi_create_queue_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapStack creates an ebpf map of type stack holding u64 values, see
+// ebpf.CallMapPush and ebpf.CallMapPop.
+func (e *FFI) CreateMapStack(size uint64) (int, error) {
+	fd, err := C.ffi_create_stack_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapLruHash creates an ebpf map of type lru hash with u32 keys and u64
+// values holding at most `size` keys. See ebpf.CallMapUpdate and
+// ebpf.CallMapDelete.
+func (e *FFI) CreateMapLruHash(size uint64) (int, error) {
+	fd, err := C.ffi_create_lru_hash_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapRingbuf creates an ebpf map of type ringbuf of `size` bytes, a
+// power of 2 multiple of the page size. See ebpf.CallRingbufReserve.
+func (e *FFI) CreateMapRingbuf(size uint64) (int, error) {
+	fd, err := C.ffi_create_ringbuf_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// CreateMapSpinLock creates an array map of `size` elements whose values
+// hold a bpf_spin_lock, laid out as described by ebpf.SpinLockValueBtf.
+// Programs using it cannot be socket filters.
+func (e *FFI) CreateMapSpinLock(size uint64) (int, error) {
+	btf, err := ebpf.SpinLockValueBtf()
+	if err != nil {
+		return -1, err
+	}
+	fd, err := C.ffi_create_spin_lock_map(C.ulong(size), unsafe.Pointer(&btf[0]), C.ulong(len(btf)),
+		ebpf.SpinLockKeyTypeId, ebpf.SpinLockValueTypeId, ebpf.SpinLockValueSize)
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// ReadPerCpu returns the value every possible cpu holds at `index` of the
+// percpu array described by `fd`.
+func (e *FFI) ReadPerCpu(fd int, index int) ([]uint64, error) {
+	res := C.ffi_get_percpu_map_element(C.int(fd), C.uint32_t(index))
+	elements, err := mapElementsProtoFromStruct(&res)
+	if err != nil {
+		return nil, err
+	}
+	if elements.GetErrorMessage() != "" {
+		return nil, fmt.Errorf("reading percpu element %d: %s", index, elements.GetErrorMessage())
+	}
+	return elements.GetElements(), nil
+}
+
+// CreateMapProgArray creates an ebpf map of type prog array, used as the target
+// of tail calls, and returns its fd. See ebpf.CallTailCall.
+func (e *FFI) CreateMapProgArray(size uint64) (int, error) {
+	fd, err := C.ffi_create_prog_array_map(C.ulong(size))
+	if fd < 0 {
+		return -1, mapCreationError(err)
+	}
+	return int(fd), nil
+}
+
+// SetProgArrayElement stores the program `progFd` at index `key` of the prog
+// array described by `fd`, on failure the error carries the errno reported by
+// the kernel.
+func (e *FFI) SetProgArrayElement(fd int, key uint32, progFd int) error {
+	if res, err := C.ffi_update_prog_array_element(C.int(fd), C.int(key), C.int(progFd)); res < 0 {
+		return syscallError("prog array update", err)
+	}
+	return nil
+}
+
+// PinMap pins the map `fd` to `path` (e.g. /sys/fs/bpf/buzzer_log) so it
+// outlives buzzer and can be inspected with bpftool. The pin has to be
+// removed with os.Remove once it is no longer needed.
+func (e *FFI) PinMap(fd int, path string) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	if res, err := C.ffi_pin_object(C.int(fd), cPath); res < 0 {
+		if errno, ok := err.(syscall.Errno); ok && errno != 0 {
+			return fmt.Errorf("pinning map to %s failed: %w", path, errno)
+		}
+		return fmt.Errorf("pinning map to %s failed", path)
+	}
+	return nil
 }
 
 // CloseFD closes the provided file descriptor.
@@ -126,6 +291,15 @@ func (e *FFI) GetMapElements(fd int, mapSize uint64) (*fpb.MapElements, error) {
 	return mapElementsProtoFromStruct(&res)
 }
 
+// GetMapElementsBatch fetches the map elements of the given fd with a single
+// BPF_MAP_LOOKUP_BATCH call, this is considerably faster than GetMapElements
+// for big maps. Kernels without batch support fall back to per element
+// lookups.
+func (e *FFI) GetMapElementsBatch(fd int, mapSize uint64) (*fpb.MapElements, error) {
+	res := C.ffi_get_map_elements_batch(C.int(fd), C.ulong(mapSize))
+	return mapElementsProtoFromStruct(&res)
+}
+
 // SetMapElement sets the elemnt specified by `key` to `value` in the map
 // described by `fd`
 func (e *FFI) SetMapElement(fd int, key uint32, value uint64) int {
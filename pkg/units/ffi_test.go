@@ -0,0 +1,682 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package units
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"buzzer/pkg/ebpf/ebpf"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+)
+
+// newTestFFI returns an FFI that can create maps and load programs, skipping
+// the test unless it runs as root.
+func newTestFFI(t *testing.T) *FFI {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating maps and loading programs requires root")
+	}
+	return &FFI{
+		MetricsUnit: &Metrics{
+			metricsCollection: &MetricsCollection{},
+		},
+	}
+}
+
+// validateOrSkip passes `prog` through the verifier, skipping the test if bpf
+// is not available. The program fd, if any, is closed when the test ends.
+func validateOrSkip(t *testing.T, prog *epb.Program) *fpb.ValidationResult {
+	t.Helper()
+	ffi := newTestFFI(t)
+	encoded, err := encodeEbpfProgram(prog)
+	if err != nil {
+		t.Fatalf("encodeEbpfProgram() unexpected error: %v", err)
+	}
+	res, err := ffi.ValidateEbpfProgram(encoded)
+	if err != nil {
+		t.Skipf("ValidateEbpfProgram() error = %v, bpf is probably not available", err)
+	}
+	if res.GetProgramFd() >= 0 {
+		t.Cleanup(func() { ffi.CloseFD(int(res.GetProgramFd())) })
+	}
+	return res
+}
+
+// loadOrFail is validateOrSkip for programs the verifier must accept.
+func loadOrFail(t *testing.T, prog *epb.Program) *fpb.ValidationResult {
+	t.Helper()
+	res := validateOrSkip(t, prog)
+	if !res.GetIsValid() {
+		t.Fatalf("ValidateEbpfProgram() rejected the program: %s", res.GetBpfError())
+	}
+	return res
+}
+
+// socketFilter returns a socket filter made of `instructions`.
+func socketFilter(instructions []*epb.Instruction) *epb.Program {
+	return &epb.Program{
+		Functions: []*epb.Functions{{Instructions: instructions}},
+		ProgType:  ebpf.ProgTypeSocketFilter,
+	}
+}
+
+func TestGetMapElementsBatchMatchesPerElement(t *testing.T) {
+	const mapSize = 64
+	ffi := newTestFFI(t)
+	fd, err := ffi.CreateMapArray(mapSize)
+	if err != nil {
+		t.Skipf("could not create an array map, bpf is probably not available: %v", err)
+	}
+	defer ffi.CloseFD(fd)
+
+	for i := uint32(0); i < mapSize; i++ {
+		if ffi.SetMapElement(fd, i, uint64(i)*0x1000+7) < 0 {
+			t.Fatalf("SetMapElement(%d) failed", i)
+		}
+	}
+
+	want, err := ffi.GetMapElements(fd, mapSize)
+	if err != nil {
+		t.Fatalf("GetMapElements() error = %v", err)
+	}
+	got, err := ffi.GetMapElementsBatch(fd, mapSize)
+	if err != nil {
+		t.Fatalf("GetMapElementsBatch() error = %v", err)
+	}
+	if got.GetErrorMessage() != "" {
+		t.Fatalf("GetMapElementsBatch() error message = %q", got.GetErrorMessage())
+	}
+
+	if len(got.GetElements()) != len(want.GetElements()) {
+		t.Fatalf("len(GetMapElementsBatch()) = %d, want %d", len(got.GetElements()), len(want.GetElements()))
+	}
+	for i, w := range want.GetElements() {
+		if got.GetElements()[i] != w {
+			t.Errorf("GetMapElementsBatch()[%d] = %d, want %d", i, got.GetElements()[i], w)
+		}
+	}
+}
+
+func TestExpectedAttachTypeIsHonored(t *testing.T) {
+	const (
+		progTypeCgroupSockAddr = 18 // BPF_PROG_TYPE_CGROUP_SOCK_ADDR
+		attachInet4Connect     = 10 // BPF_CGROUP_INET4_CONNECT
+	)
+
+	tests := []struct {
+		name               string
+		expectedAttachType uint32
+		wantValid          bool
+	}{
+		{name: "without expected_attach_type", expectedAttachType: 0, wantValid: false},
+		{name: "with expected_attach_type", expectedAttachType: attachInet4Connect, wantValid: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := validateOrSkip(t, &epb.Program{
+				Functions: []*epb.Functions{
+					{Instructions: []*epb.Instruction{ebpf.Mov64(ebpf.R0, 1), ebpf.Exit()}},
+				},
+				ProgType:           progTypeCgroupSockAddr,
+				ExpectedAttachType: tc.expectedAttachType,
+			})
+			if res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram().IsValid = %v, want %v (error %q)", res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
+
+func TestValidateEbpfProgramProgFlags(t *testing.T) {
+	ffi := newTestFFI(t)
+	mapFd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		t.Skipf("could not create an array map, bpf is probably not available: %v", err)
+	}
+	defer ffi.CloseFD(mapFd)
+
+	// Reads 4 bytes at offset 1 of a map value, only strict alignment makes
+	// the verifier care about it.
+	misalignedRead, err := ebpf.InstructionSequence(
+		ebpf.StW(ebpf.R10, 0, -4),
+		ebpf.Mov64(ebpf.R2, ebpf.R10),
+		ebpf.Add64(ebpf.R2, -4),
+		ebpf.LdMapByFd(ebpf.R1, mapFd),
+		ebpf.Call(ebpf.MapLookup),
+		ebpf.JmpNE(ebpf.R0, 0, 2),
+		ebpf.Mov64(ebpf.R0, 0),
+		ebpf.Exit(),
+		ebpf.LdW(ebpf.R0, ebpf.R0, 1),
+		ebpf.Exit(),
+	)
+	if err != nil {
+		t.Fatalf("InstructionSequence() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		progFlags uint32
+		wantValid bool
+	}{
+		{name: "no flags", progFlags: 0, wantValid: true},
+		{name: "BPF_F_ANY_ALIGNMENT", progFlags: ebpf.ProgFlagAnyAlignment, wantValid: true},
+		{name: "BPF_F_STRICT_ALIGNMENT", progFlags: ebpf.ProgFlagStrictAlignment, wantValid: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := validateOrSkip(t, &epb.Program{
+				Functions: []*epb.Functions{{Instructions: misalignedRead}},
+				ProgFlags: tc.progFlags,
+			})
+			if res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram().IsValid = %v, want %v (error %q)", res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
+
+func TestBuildHelperCallVerdict(t *testing.T) {
+	ffi := newTestFFI(t)
+	mapFd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		t.Skipf("could not create an array map, bpf is probably not available: %v", err)
+	}
+	defer ffi.CloseFD(mapFd)
+
+	sig := ebpf.HelperSig{
+		Helper: ebpf.MapUpdate,
+		Args: []ebpf.HelperArg{
+			{Type: ebpf.ArgConstMapPtr},
+			{Type: ebpf.ArgPtrToMapKey, Size: 4},
+			{Type: ebpf.ArgPtrToMapValue, Size: 8},
+			{Type: ebpf.ArgAnything},
+		},
+		MapFd: mapFd,
+	}
+
+	for _, valid := range []bool{true, true, false, false, false, false} {
+		call, err := ebpf.BuildHelperCall(sig, valid)
+		if err != nil {
+			t.Fatalf("BuildHelperCall(%v) unexpected error: %v", valid, err)
+		}
+		prog := append(call, ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+		res := validateOrSkip(t, &epb.Program{
+			Functions: []*epb.Functions{{Instructions: prog}},
+		})
+		if res.GetIsValid() != valid {
+			t.Errorf("ValidateEbpfProgram(BuildHelperCall(%v)).IsValid = %v, want %v\n%s\n%s", valid, res.GetIsValid(), valid, ebpf.ProgramString(prog), res.GetBpfError())
+		}
+	}
+}
+
+func TestValidateEbpfProgramSleepable(t *testing.T) {
+	call, err := ebpf.BuildHelperCall(ebpf.CopyFromUserSig(8), true)
+	if err != nil {
+		t.Fatalf("BuildHelperCall() unexpected error: %v", err)
+	}
+	prog := append(call, ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+	validate := func(progFlags uint32) *fpb.ValidationResult {
+		return validateOrSkip(t, &epb.Program{
+			Functions: []*epb.Functions{{Instructions: prog}},
+			ProgType:  ebpf.ProgTypeKprobe,
+			ProgFlags: progFlags,
+		})
+	}
+
+	if res := validate(ebpf.ProgFlagSleepable); !res.GetIsValid() {
+		t.Skipf("sleepable kprobes are probably not supported by this kernel: %s", res.GetBpfError())
+	}
+	if res := validate(0); res.GetIsValid() {
+		t.Errorf("ValidateEbpfProgram() without BPF_F_SLEEPABLE accepted a call to bpf_copy_from_user")
+	}
+}
+
+func TestMapCreationError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"eperm", syscall.EPERM, "map creation failed: operation not permitted (EPERM)"},
+		{"enomem", syscall.ENOMEM, "map creation failed: cannot allocate memory (ENOMEM)"},
+		{"no errno", nil, "map creation failed"},
+		{"zero errno", syscall.Errno(0), "map creation failed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mapCreationError(tc.err)
+			if got.Error() != tc.want {
+				t.Errorf("mapCreationError(%v) = %q, want %q", tc.err, got, tc.want)
+			}
+		})
+	}
+
+	if err := mapCreationError(syscall.EPERM); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("mapCreationError(EPERM) = %v, want it to wrap EPERM", err)
+	}
+	if got, want := syscallError("prog array update", syscall.EINVAL).Error(), "prog array update failed: invalid argument (EINVAL)"; got != want {
+		t.Errorf("syscallError(EINVAL) = %q, want %q", got, want)
+	}
+}
+
+func TestCreateMapArrayUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("map creation is expected to succeed as root")
+	}
+
+	ffi := &FFI{}
+	fd, err := ffi.CreateMapArray(1)
+	if err == nil {
+		ffi.CloseFD(fd)
+		t.Skip("unprivileged bpf is enabled on this machine")
+	}
+	if !strings.HasPrefix(err.Error(), "map creation failed") {
+		t.Errorf("CreateMapArray() error = %q, want a map creation failure", err)
+	}
+}
+
+func TestReadPerCpu(t *testing.T) {
+	ffi := newTestFFI(t)
+	mapFd, err := ffi.CreateMapPerCpuArray(1)
+	if err != nil {
+		t.Skipf("CreateMapPerCpuArray() error = %v, bpf is probably not available", err)
+	}
+	defer ffi.CloseFD(mapFd)
+
+	// Only the cpu the program runs on should see the stored value.
+	const want = 0x1234
+	lookup, err := ebpf.LdMapElement(ebpf.R6, 0, ebpf.R10, -4)
+	if err != nil {
+		t.Fatalf("LdMapElement() unexpected error: %v", err)
+	}
+	nullCheck, err := ebpf.NullCheck(ebpf.R0, []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+	if err != nil {
+		t.Fatalf("NullCheck() unexpected error: %v", err)
+	}
+	prog := []*epb.Instruction{ebpf.LdMapByFd(ebpf.R6, mapFd)}
+	prog = append(prog, lookup...)
+	prog = append(prog, nullCheck...)
+	prog = append(prog, ebpf.StDW(ebpf.R0, want, 0), ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+	res := loadOrFail(t, socketFilter(prog))
+	if _, err := ffi.RunEbpfProgram(&fpb.ExecutionRequest{ProgFd: res.GetProgramFd()}); err != nil {
+		t.Fatalf("RunEbpfProgram() unexpected error: %v", err)
+	}
+
+	values, err := ffi.ReadPerCpu(mapFd, 0)
+	if err != nil {
+		t.Fatalf("ReadPerCpu() unexpected error: %v", err)
+	}
+	if len(values) == 0 {
+		t.Fatalf("ReadPerCpu() returned no values")
+	}
+	stored := 0
+	for _, v := range values {
+		switch v {
+		case want:
+			stored++
+		case 0:
+		default:
+			t.Errorf("ReadPerCpu() = %v, want only 0 or %#x", values, want)
+		}
+	}
+	if stored != 1 {
+		t.Errorf("ReadPerCpu() = %v, want exactly one cpu to hold %#x", values, want)
+	}
+}
+
+func TestMapPushPop(t *testing.T) {
+	ffi := newTestFFI(t)
+	tests := []struct {
+		name   string
+		create func(uint64) (int, error)
+	}{
+		{"queue", ffi.CreateMapQueue},
+		{"stack", ffi.CreateMapStack},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mapFd, err := tc.create(4)
+			if err != nil {
+				t.Skipf("creating the %s map error = %v, bpf is probably not available", tc.name, err)
+			}
+			defer ffi.CloseFD(mapFd)
+			resultFd, err := ffi.CreateMapArray(1)
+			if err != nil {
+				t.Fatalf("CreateMapArray() unexpected error: %v", err)
+			}
+			defer ffi.CloseFD(resultFd)
+
+			// Push a value, pop it back and store what came out in the
+			// array so it can be read from here.
+			const want = 0x4242
+			push, err := ebpf.CallMapPush(ebpf.R6, -8, 0)
+			if err != nil {
+				t.Fatalf("CallMapPush() unexpected error: %v", err)
+			}
+			pop, err := ebpf.CallMapPop(ebpf.R6, -16)
+			if err != nil {
+				t.Fatalf("CallMapPop() unexpected error: %v", err)
+			}
+			lookup, err := ebpf.LdMapElement(ebpf.R7, 0, ebpf.R10, -20)
+			if err != nil {
+				t.Fatalf("LdMapElement() unexpected error: %v", err)
+			}
+			nullCheck, err := ebpf.NullCheck(ebpf.R0, []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+			if err != nil {
+				t.Fatalf("NullCheck() unexpected error: %v", err)
+			}
+			prog := []*epb.Instruction{
+				ebpf.LdMapByFd(ebpf.R6, mapFd),
+				ebpf.LdMapByFd(ebpf.R7, resultFd),
+				ebpf.StDW(ebpf.R10, want, -8),
+			}
+			prog = append(prog, push...)
+			prog = append(prog, pop...)
+			prog = append(prog, ebpf.LdDW(ebpf.R8, ebpf.R10, -16))
+			prog = append(prog, lookup...)
+			prog = append(prog, nullCheck...)
+			prog = append(prog, ebpf.StDW(ebpf.R0, ebpf.R8, 0), ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+			res := loadOrFail(t, socketFilter(prog))
+			if _, err := ffi.RunEbpfProgram(&fpb.ExecutionRequest{ProgFd: res.GetProgramFd()}); err != nil {
+				t.Fatalf("RunEbpfProgram() unexpected error: %v", err)
+			}
+
+			elements, err := ffi.GetMapElements(resultFd, 1)
+			if err != nil {
+				t.Fatalf("GetMapElements() unexpected error: %v", err)
+			}
+			if got := elements.GetElements(); len(got) != 1 || got[0] != want {
+				t.Errorf("popped value = %v, want [%#x]", got, want)
+			}
+		})
+	}
+}
+
+func TestLruHashUpdateLookup(t *testing.T) {
+	ffi := newTestFFI(t)
+	mapFd, err := ffi.CreateMapLruHash(4)
+	if err != nil {
+		t.Skipf("CreateMapLruHash() error = %v, bpf is probably not available", err)
+	}
+	defer ffi.CloseFD(mapFd)
+	resultFd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		t.Fatalf("CreateMapArray() unexpected error: %v", err)
+	}
+	defer ffi.CloseFD(resultFd)
+
+	// Store a value under key 7, look the key up and copy what was found
+	// to the array so it can be read from here.
+	const want = 0x4242
+	update, err := ebpf.CallMapUpdate(ebpf.R6, -4, -16, ebpf.MapUpdateNoExist)
+	if err != nil {
+		t.Fatalf("CallMapUpdate() unexpected error: %v", err)
+	}
+	lookupKey, err := ebpf.LdMapElement(ebpf.R6, 7, ebpf.R10, -4)
+	if err != nil {
+		t.Fatalf("LdMapElement() unexpected error: %v", err)
+	}
+	lookupResult, err := ebpf.LdMapElement(ebpf.R7, 0, ebpf.R10, -20)
+	if err != nil {
+		t.Fatalf("LdMapElement() unexpected error: %v", err)
+	}
+	nullCheck, err := ebpf.NullCheck(ebpf.R0, []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+	if err != nil {
+		t.Fatalf("NullCheck() unexpected error: %v", err)
+	}
+	prog := []*epb.Instruction{
+		ebpf.LdMapByFd(ebpf.R6, mapFd),
+		ebpf.LdMapByFd(ebpf.R7, resultFd),
+		ebpf.StW(ebpf.R10, 7, -4),
+		ebpf.StDW(ebpf.R10, want, -16),
+	}
+	prog = append(prog, update...)
+	prog = append(prog, lookupKey...)
+	prog = append(prog, nullCheck...)
+	prog = append(prog, ebpf.LdDW(ebpf.R8, ebpf.R0, 0))
+	prog = append(prog, lookupResult...)
+	prog = append(prog, nullCheck...)
+	prog = append(prog, ebpf.StDW(ebpf.R0, ebpf.R8, 0), ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+	res := loadOrFail(t, socketFilter(prog))
+	if _, err := ffi.RunEbpfProgram(&fpb.ExecutionRequest{ProgFd: res.GetProgramFd()}); err != nil {
+		t.Fatalf("RunEbpfProgram() unexpected error: %v", err)
+	}
+
+	elements, err := ffi.GetMapElements(resultFd, 1)
+	if err != nil {
+		t.Fatalf("GetMapElements() unexpected error: %v", err)
+	}
+	if got := elements.GetElements(); len(got) != 1 || got[0] != want {
+		t.Errorf("looked up value = %v, want [%#x]", got, want)
+	}
+}
+
+func TestPinMap(t *testing.T) {
+	ffi := newTestFFI(t)
+	if _, err := os.Stat("/sys/fs/bpf"); err != nil {
+		t.Skipf("bpffs is not mounted: %v", err)
+	}
+
+	fd, err := ffi.CreateMapArray(1)
+	if err != nil {
+		t.Skipf("CreateMapArray() error = %v, bpf is probably not available", err)
+	}
+	defer ffi.CloseFD(fd)
+
+	path := fmt.Sprintf("/sys/fs/bpf/buzzer_test_%d", os.Getpid())
+	if err := ffi.PinMap(fd, path); err != nil {
+		t.Fatalf("PinMap(%q) unexpected error: %v", path, err)
+	}
+	defer os.Remove(path)
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("PinMap(%q) did not create the pin: %v", path, err)
+	}
+	if err := ffi.PinMap(fd, path); err == nil {
+		t.Errorf("PinMap(%q) twice error = nil, want an error", path)
+	}
+}
+
+func TestValidateEbpfProgramWithLineInfo(t *testing.T) {
+	prog, err := ebpf.SingleFunctionProgram([]*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+	if err != nil {
+		t.Fatalf("SingleFunctionProgram() unexpected error: %v", err)
+	}
+	encoded, err := encodeEbpfProgram(prog)
+	if err != nil {
+		t.Fatalf("encodeEbpfProgram() unexpected error: %v", err)
+	}
+	if len(encoded.GetLineInfo()) == 0 {
+		t.Fatalf("encodeEbpfProgram().LineInfo is empty")
+	}
+
+	if res := validateOrSkip(t, prog); !res.GetIsValid() {
+		t.Errorf("ValidateEbpfProgram() rejected a program with func_info and line_info: %s\n%s", res.GetBpfError(), res.GetVerifierLog())
+	}
+}
+
+func TestValidateEbpfProgramLicense(t *testing.T) {
+	// bpf_trace_printk is only available to GPL compatible programs.
+	format, err := ebpf.StackString("buzzer", -8)
+	if err != nil {
+		t.Fatalf("StackString() unexpected error: %v", err)
+	}
+	printk, err := ebpf.CallTracePrintk(-8, 7)
+	if err != nil {
+		t.Fatalf("CallTracePrintk() unexpected error: %v", err)
+	}
+	prog := append(format, printk...)
+	prog = append(prog, ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+	tests := []struct {
+		license   string
+		wantValid bool
+	}{
+		{"", true},
+		{"GPL", true},
+		{"Dual BSD/GPL", true},
+		{"Proprietary", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.license, func(t *testing.T) {
+			res := validateOrSkip(t, &epb.Program{
+				Functions: []*epb.Functions{{Instructions: prog}},
+				License:   tc.license,
+			})
+			if res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram() under %q IsValid = %v, want %v (error %q)", tc.license, res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
+
+func TestRingbufReferenceTracking(t *testing.T) {
+	ffi := newTestFFI(t)
+	ringbufFd, err := ffi.CreateMapRingbuf(uint64(os.Getpagesize()))
+	if err != nil {
+		t.Skipf("CreateMapRingbuf() error = %v, bpf is probably not available", err)
+	}
+	defer ffi.CloseFD(ringbufFd)
+
+	submit, err := ebpf.CallRingbufSubmit(ebpf.R7, 0)
+	if err != nil {
+		t.Fatalf("CallRingbufSubmit() unexpected error: %v", err)
+	}
+	discard, err := ebpf.CallRingbufDiscard(ebpf.R7, 0)
+	if err != nil {
+		t.Fatalf("CallRingbufDiscard() unexpected error: %v", err)
+	}
+	tests := []struct {
+		name      string
+		release   []*epb.Instruction
+		wantValid bool
+	}{
+		{"reserve then submit", submit, true},
+		{"reserve then discard", discard, true},
+		{"reserve without submit", nil, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reserve, err := ebpf.CallRingbufReserve(ebpf.R6, 8, 0)
+			if err != nil {
+				t.Fatalf("CallRingbufReserve() unexpected error: %v", err)
+			}
+			nullCheck, err := ebpf.NullCheck(ebpf.R0, []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+			if err != nil {
+				t.Fatalf("NullCheck() unexpected error: %v", err)
+			}
+			prog := []*epb.Instruction{ebpf.LdMapByFd(ebpf.R6, ringbufFd)}
+			prog = append(prog, reserve...)
+			prog = append(prog, nullCheck...)
+			prog = append(prog, ebpf.Mov64(ebpf.R7, ebpf.R0), ebpf.StDW(ebpf.R7, 0x42, 0))
+			prog = append(prog, tc.release...)
+			prog = append(prog, ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+			if res := validateOrSkip(t, socketFilter(prog)); res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram() valid = %v, want %v: %s", res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
+
+func TestSpinLockBalance(t *testing.T) {
+	ffi := newTestFFI(t)
+	mapFd, err := ffi.CreateMapSpinLock(1)
+	if err != nil {
+		t.Skipf("CreateMapSpinLock() error = %v, bpf is probably not available", err)
+	}
+	defer ffi.CloseFD(mapFd)
+
+	unlock, err := ebpf.CallSpinUnlock(ebpf.R6)
+	if err != nil {
+		t.Fatalf("CallSpinUnlock() unexpected error: %v", err)
+	}
+	tests := []struct {
+		name      string
+		unlock    []*epb.Instruction
+		wantValid bool
+	}{
+		{"lock then unlock", unlock, true},
+		{"lock without unlock", nil, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lookup, err := ebpf.LdMapElement(ebpf.R8, 0, ebpf.R10, -8)
+			if err != nil {
+				t.Fatalf("LdMapElement() unexpected error: %v", err)
+			}
+			nullCheck, err := ebpf.NullCheck(ebpf.R0, []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()})
+			if err != nil {
+				t.Fatalf("NullCheck() unexpected error: %v", err)
+			}
+			lock, err := ebpf.CallSpinLock(ebpf.R6)
+			if err != nil {
+				t.Fatalf("CallSpinLock() unexpected error: %v", err)
+			}
+			prog := []*epb.Instruction{ebpf.LdMapByFd(ebpf.R8, mapFd)}
+			prog = append(prog, lookup...)
+			prog = append(prog, nullCheck...)
+			prog = append(prog, ebpf.Mov64(ebpf.R6, ebpf.R0))
+			prog = append(prog, lock...)
+			prog = append(prog, ebpf.StDW(ebpf.R6, 0x42, 8))
+			prog = append(prog, tc.unlock...)
+			prog = append(prog, ebpf.Mov64(ebpf.R0, 0), ebpf.Exit())
+
+			res := validateOrSkip(t, &epb.Program{
+				Functions: []*epb.Functions{{Instructions: prog}},
+				ProgType:  ebpf.ProgTypeSchedCls,
+			})
+			if res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram() valid = %v, want %v: %s", res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
+
+func TestPointerReturn(t *testing.T) {
+	tests := []struct {
+		name      string
+		ret       []*epb.Instruction
+		wantValid bool
+	}{
+		{"scalar", []*epb.Instruction{ebpf.Mov64(ebpf.R0, 1)}, true},
+		{"context pointer", []*epb.Instruction{ebpf.Mov64(ebpf.R0, ebpf.R1)}, false},
+		{"stack pointer", []*epb.Instruction{ebpf.Mov64(ebpf.R0, ebpf.R10), ebpf.Add64(ebpf.R0, -8)}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := validateOrSkip(t, &epb.Program{
+				Functions: []*epb.Functions{{Instructions: append(tc.ret, ebpf.Exit())}},
+				ProgType:  ebpf.ProgTypeCgroupSkb,
+			})
+			if res.GetIsValid() != tc.wantValid {
+				t.Errorf("ValidateEbpfProgram() valid = %v, want %v: %s", res.GetIsValid(), tc.wantValid, res.GetBpfError())
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package units
+
+import (
+	"buzzer/pkg/ebpf/ebpf"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// ProgramReport is the outcome of loading one program, ReportWriter writes
+// one of them per line.
+type ProgramReport struct {
+	// Hash is the hex encoded ebpf.ContentHash of the program.
+	Hash string `json:"hash"`
+	// Size is the number of instruction slots of the program.
+	Size     int  `json:"size"`
+	Accepted bool `json:"accepted"`
+	// RejectionCategory is the error the kernel returned when loading the
+	// program (e.g. "Permission denied"), empty for accepted programs.
+	RejectionCategory string `json:"rejection_category,omitempty"`
+	VerifierLogLength int    `json:"verifier_log_length"`
+	// Seed is the seed the random number generator of the campaign was
+	// created with, including one picked from the current time.
+	Seed int64 `json:"seed"`
+}
+
+// ReportWriter streams a JSON line for every program the Control unit
+// loads, meant to be fed to log processing pipelines to analyze a fuzzing
+// run offline. See Control.SetReportWriter.
+type ReportWriter struct {
+	encoder *json.Encoder
+	seed    int64
+}
+
+// NewReportWriter returns a ReportWriter that writes to `w` the reports of a
+// campaign that uses `seed`.
+func NewReportWriter(w io.Writer, seed int64) *ReportWriter {
+	return &ReportWriter{encoder: json.NewEncoder(w), seed: seed}
+}
+
+// Report writes the line describing how loading `prog` went.
+func (r *ReportWriter) Report(prog *epb.Program, result *fpb.ValidationResult) error {
+	hash, err := ebpf.ContentHash(prog)
+	if err != nil {
+		return err
+	}
+	report := &ProgramReport{
+		Hash:              hex.EncodeToString(hash[:]),
+		Size:              ebpf.ProgramSize(ebpf.ProgramInstructions(prog)),
+		Accepted:          result.GetIsValid(),
+		VerifierLogLength: len(result.GetVerifierLog()),
+		Seed:              r.seed,
+	}
+	if !report.Accepted {
+		report.RejectionCategory = result.GetBpfError()
+	}
+	// Encode terminates every value with a newline.
+	return r.encoder.Encode(report)
+}
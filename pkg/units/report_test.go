@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package units
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"buzzer/pkg/ebpf/ebpf"
+	epb "buzzer/proto/ebpf_go_proto"
+	fpb "buzzer/proto/ffi_go_proto"
+	pb "buzzer/proto/program_go_proto"
+)
+
+func TestReportWriter(t *testing.T) {
+	programs := []*epb.Program{
+		{Functions: []*epb.Functions{{Instructions: []*epb.Instruction{ebpf.Mov64(ebpf.R0, 0), ebpf.Exit()}}}},
+		{Functions: []*epb.Functions{{Instructions: []*epb.Instruction{ebpf.Exit()}}}},
+		{Functions: []*epb.Functions{{Instructions: []*epb.Instruction{ebpf.LdImm64(ebpf.R0, 1<<40), ebpf.Exit()}}}},
+	}
+	// Stands in for the verifier.
+	results := []*fpb.ValidationResult{
+		{IsValid: true, VerifierLog: "processed 2 insns"},
+		{IsValid: false, VerifierLog: "R0 !read_ok", BpfError: "Permission denied"},
+		{IsValid: true},
+	}
+
+	var out bytes.Buffer
+	report := NewReportWriter(&out, 42)
+	for i, prog := range programs {
+		if err := report.Report(prog, results[i]); err != nil {
+			t.Fatalf("Report() unexpected error: %v", err)
+		}
+	}
+
+	want := []struct {
+		size              int
+		accepted          bool
+		rejectionCategory string
+		verifierLogLength int
+	}{
+		{2, true, "", 17},
+		{1, false, "Permission denied", 11},
+		{3, true, "", 0},
+	}
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+	for scanner.Scan() {
+		if lines >= len(want) {
+			t.Fatalf("Report() wrote more than %d lines", len(want))
+		}
+		// Check the documented field names, not only the struct.
+		var fields map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			t.Fatalf("line %d: json.Unmarshal() error = %v", lines, err)
+		}
+		for _, field := range []string{"hash", "size", "accepted", "verifier_log_length", "seed"} {
+			if _, ok := fields[field]; !ok {
+				t.Errorf("line %d = %s, missing field %q", lines, scanner.Text(), field)
+			}
+		}
+
+		var got ProgramReport
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("line %d: json.Unmarshal() error = %v", lines, err)
+		}
+		hash, err := ebpf.ContentHash(programs[lines])
+		if err != nil {
+			t.Fatalf("ContentHash() unexpected error: %v", err)
+		}
+		w := want[lines]
+		if got.Hash != hex.EncodeToString(hash[:]) || got.Size != w.size || got.Accepted != w.accepted ||
+			got.RejectionCategory != w.rejectionCategory || got.VerifierLogLength != w.verifierLogLength || got.Seed != 42 {
+			t.Errorf("line %d = %+v, want size %d, accepted %v, rejection category %q, verifier log length %d and seed 42",
+				lines, got, w.size, w.accepted, w.rejectionCategory, w.verifierLogLength)
+		}
+		lines++
+	}
+	if lines != len(want) {
+		t.Errorf("Report() wrote %d lines, want %d", lines, len(want))
+	}
+}
+
+// scriptedStrategy generates `programs` in order and only verifies them.
+type scriptedStrategy struct {
+	programs []*epb.Program
+	next     int
+	errors   int
+}
+
+func (s *scriptedStrategy) GenerateProgram(ffi *FFI) (*pb.Program, error) {
+	s.next++
+	return &pb.Program{Program: &pb.Program_Ebpf{Ebpf: s.programs[s.next-1]}}, nil
+}
+
+func (s *scriptedStrategy) OnVerifyDone(ffi *FFI, verificationResult *fpb.ValidationResult) bool {
+	return false
+}
+
+func (s *scriptedStrategy) OnExecuteDone(ffi *FFI, executionResult *fpb.ExecutionResult) bool {
+	return true
+}
+
+func (s *scriptedStrategy) OnError(e error) bool {
+	s.errors++
+	return true
+}
+
+func (s *scriptedStrategy) IsFuzzingDone() bool {
+	return s.next == len(s.programs)
+}
+
+func (s *scriptedStrategy) Name() string {
+	return "scripted"
+}
+
+func TestControlReportsCampaign(t *testing.T) {
+	programs := []*epb.Program{}
+	for imm := 0; imm < 4; imm++ {
+		programs = append(programs, &epb.Program{
+			Functions: []*epb.Functions{{Instructions: []*epb.Instruction{ebpf.Mov64(ebpf.R0, imm), ebpf.Exit()}}},
+		})
+	}
+	// Stands in for the verifier, the third program fails to load and is
+	// not reported.
+	results := []*fpb.ValidationResult{
+		{IsValid: true, ProgramFd: -1},
+		{IsValid: false, ProgramFd: -1, BpfError: "Permission denied"},
+		nil,
+		{IsValid: false, ProgramFd: -1, BpfError: "Invalid argument"},
+	}
+	loads := 0
+	validate := func(*fpb.EncodedProgram) (*fpb.ValidationResult, error) {
+		loads++
+		if results[loads-1] == nil {
+			return nil, errors.New("bpf is not available")
+		}
+		return results[loads-1], nil
+	}
+
+	strategy := &scriptedStrategy{programs: programs}
+	control := Control{}
+	if err := control.Init(&FFI{}, nil, strategy); err != nil {
+		t.Fatalf("Init() unexpected error: %v", err)
+	}
+	control.validateEbpf = validate
+	var out bytes.Buffer
+	control.SetReportWriter(NewReportWriter(&out, 7))
+	if err := control.RunFuzzer(); err != nil {
+		t.Fatalf("RunFuzzer() unexpected error: %v", err)
+	}
+	if strategy.errors != 1 {
+		t.Errorf("OnError() called %d times, want 1 for the failed load", strategy.errors)
+	}
+
+	want := []struct {
+		program           int
+		rejectionCategory string
+	}{
+		{0, ""},
+		{1, "Permission denied"},
+		{3, "Invalid argument"},
+	}
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		if lines >= len(want) {
+			t.Fatalf("RunFuzzer() reported more than %d programs", len(want))
+		}
+		var got ProgramReport
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("line %d: json.Unmarshal() error = %v", lines, err)
+		}
+		w := want[lines]
+		hash, err := ebpf.ContentHash(programs[w.program])
+		if err != nil {
+			t.Fatalf("ContentHash() unexpected error: %v", err)
+		}
+		if got.Hash != hex.EncodeToString(hash[:]) || got.Accepted != (w.rejectionCategory == "") ||
+			got.RejectionCategory != w.rejectionCategory || got.Seed != 7 {
+			t.Errorf("line %d = %+v, want program %d with rejection category %q and seed 7", lines, got, w.program, w.rejectionCategory)
+		}
+	}
+	if lines != len(want) {
+		t.Errorf("RunFuzzer() reported %d programs, want %d", lines, len(want))
+	}
+}